@@ -12,6 +12,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -34,7 +35,9 @@ var captureStd = helper.CaptureStd
 var stateMachineLongDesc = `Options for controlling the internal state machine.
 Other than -w, these options are mutually exclusive. When -u or -t is given,
 the state machine can be resumed later with -r, but -w must be given in that
-case since the state is saved in a ubuntu-image.json file in the working directory.`
+case since the state is saved in a ubuntu-image.json file in the working directory.
+The saved state can also be rewound with --from to run again the steps from a
+given step.`
 
 func initStateMachine(imageType string, commonOpts *commands.CommonOpts, stateMachineOpts *commands.StateMachineOpts, ubuntuImageCommand *commands.UbuntuImageCommand) (statemachine.SmInterface, error) {
 	var stateMachine statemachine.SmInterface
@@ -46,12 +49,31 @@ func initStateMachine(imageType string, commonOpts *commands.CommonOpts, stateMa
 		}
 	case "classic":
 		stateMachine = &statemachine.ClassicStateMachine{
+			Opts: ubuntuImageCommand.Classic.ClassicOptsPassed,
 			Args: ubuntuImageCommand.Classic.ClassicArgsPassed,
 		}
 	case "pack":
 		stateMachine = &statemachine.PackStateMachine{
 			Opts: ubuntuImageCommand.Pack.PackOptsPassed,
 		}
+	case "clean":
+		stateMachine = &statemachine.CleanStateMachine{
+			Opts: ubuntuImageCommand.Clean.CleanOptsPassed,
+		}
+	case "schema":
+		stateMachine = &statemachine.SchemaStateMachine{
+			Args: ubuntuImageCommand.Schema.SchemaArgsPassed,
+		}
+	case "lint":
+		stateMachine = &statemachine.LintStateMachine{
+			Opts: ubuntuImageCommand.Lint.LintOptsPassed,
+			Args: ubuntuImageCommand.Lint.LintArgsPassed,
+		}
+	case "validate":
+		stateMachine = &statemachine.ValidateStateMachine{
+			Opts: ubuntuImageCommand.Validate.ValidateOptsPassed,
+			Args: ubuntuImageCommand.Validate.ValidateArgsPassed,
+		}
 	default:
 		return nil, fmt.Errorf("unsupported command\n")
 	}
@@ -112,7 +134,7 @@ func parseFlags(parser *flags.Parser, restoreStdout, restoreStderr func(), stdou
 				fmt.Println(string(readStdout))
 				return e, 0
 			case flags.ErrCommandRequired:
-				// if --resume was given, this is not an error
+				// if --resume or --from was given, this is not an error
 				if !resume && !version {
 					restoreStdout()
 					restoreStderr()
@@ -176,7 +198,7 @@ func main() { //nolint: gocyclo
 	unhidePackOpts(parser)
 
 	// Parse the options provided and handle specific errors
-	err, code := parseFlags(parser, restoreStdout, restoreStderr, stdout, stderr, stateMachineOpts.Resume, commonOpts.Version)
+	err, code := parseFlags(parser, restoreStdout, restoreStderr, stdout, stderr, stateMachineOpts.Resume || stateMachineOpts.From != "", commonOpts.Version)
 	if err != nil {
 		osExit(code)
 		return
@@ -202,6 +224,12 @@ func main() { //nolint: gocyclo
 		imageType = parser.Command.Active.Name
 	}
 
+	// keep stdout for the json progress events
+	if commonOpts.Progress == "json" && commonOpts.ProgressFile == "" {
+		restoreOutput := statemachine.SeparateProgressOutput()
+		defer restoreOutput()
+	}
+
 	// init the state machine
 	sm, err := initStateMachine(imageType, commonOpts, stateMachineOpts, ubuntuImageCommand)
 	if err != nil {
@@ -213,8 +241,28 @@ func main() { //nolint: gocyclo
 	// let the state machine handle the image build
 	err = executeStateMachine(sm)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		osExit(1)
+		if !alreadyReported(err) {
+			fmt.Printf("Error: %s\n", err.Error())
+		}
+		osExit(exitCode(err))
 		return
 	}
 }
+
+// alreadyReported returns whether the error sums up the errors or the lint
+// warnings already reported by the validate and lint commands
+func alreadyReported(err error) bool {
+	var invalidFilesErr *statemachine.InvalidFilesError
+	var strictLintErr *statemachine.StrictLintError
+	return errors.As(err, &invalidFilesErr) || (errors.As(err, &strictLintErr) && strictLintErr.Reported)
+}
+
+// exitCode returns the exit code for a failed build. Builds interrupted by
+// a signal exit with the code of a process killed by it.
+func exitCode(err error) int {
+	var interruptedErr *statemachine.InterruptedError
+	if errors.As(err, &interruptedErr) {
+		return interruptedErr.ExitCode()
+	}
+	return 1
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"os"
+	"syscall"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -128,7 +130,7 @@ func TestInvalidCommands(t *testing.T) {
 		flags         []string
 		expectedError string
 	}{
-		{"invalid_command", []string{"test"}, nil, "Unknown command `test'. Please specify one command of: classic or snap"},
+		{"invalid_command", []string{"test"}, nil, "Unknown command `test'. Please specify one command of: classic, clean, lint, schema, snap or validate"},
 		{"no_model_assertion", []string{"snap"}, nil, "the required argument `model_assertion` was not provided"},
 		{"no_gadget_tree", []string{"classic"}, nil, "the required argument `image_definition` was not provided"},
 		{"invalid_flag", []string{"classic"}, []string{"--nonexistent"}, "unknown flag `nonexistent'"},
@@ -354,6 +356,16 @@ func TestExecuteStateMachine(t *testing.T) {
 	}
 }
 
+func Test_exitCode(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	asserter.AssertEqual(1, exitCode(ErrAtRun))
+
+	interruptedErr := &statemachine.InterruptedError{Signal: syscall.SIGTERM, Step: "install_packages"}
+	asserter.AssertEqual(143, exitCode(interruptedErr))
+	asserter.AssertEqual(130, exitCode(fmt.Errorf("error during cleanup: %w",
+		&statemachine.InterruptedError{Signal: os.Interrupt})))
+}
+
 func Test_initStateMachine(t *testing.T) {
 	asserter := helper.Asserter{T: t}
 	type args struct {
@@ -367,6 +379,9 @@ func Test_initStateMachine(t *testing.T) {
 		cmpopts.IgnoreUnexported(
 			statemachine.SnapStateMachine{},
 			statemachine.StateMachine{},
+			statemachine.ValidateStateMachine{},
+			statemachine.SchemaStateMachine{},
+			statemachine.LintStateMachine{},
 			gadget.Info{},
 		),
 	}
@@ -412,6 +427,74 @@ func Test_initStateMachine(t *testing.T) {
 				Args: commands.ClassicArgs{},
 			},
 		},
+		{
+			name: "init a clean state machine",
+			args: args{
+				imageType:        "clean",
+				commonOpts:       &commands.CommonOpts{},
+				stateMachineOpts: &commands.StateMachineOpts{},
+				ubuntuImageCommand: &commands.UbuntuImageCommand{
+					Clean: commands.CleanCommand{
+						CleanOptsPassed: commands.CleanOpts{Delete: true},
+					},
+				},
+			},
+			want: &statemachine.CleanStateMachine{
+				Opts: commands.CleanOpts{Delete: true},
+			},
+		},
+		{
+			name: "init a validate state machine",
+			args: args{
+				imageType:        "validate",
+				commonOpts:       &commands.CommonOpts{},
+				stateMachineOpts: &commands.StateMachineOpts{},
+				ubuntuImageCommand: &commands.UbuntuImageCommand{
+					Validate: commands.ValidateCommand{
+						ValidateArgsPassed: commands.ValidateArgs{ImageDefinition: "image.yaml"},
+						ValidateOptsPassed: commands.ValidateOpts{Format: "json"},
+					},
+				},
+			},
+			want: &statemachine.ValidateStateMachine{
+				Opts: commands.ValidateOpts{Format: "json"},
+				Args: commands.ValidateArgs{ImageDefinition: "image.yaml"},
+			},
+		},
+		{
+			name: "init a schema state machine",
+			args: args{
+				imageType:        "schema",
+				commonOpts:       &commands.CommonOpts{},
+				stateMachineOpts: &commands.StateMachineOpts{},
+				ubuntuImageCommand: &commands.UbuntuImageCommand{
+					Schema: commands.SchemaCommand{
+						SchemaArgsPassed: commands.SchemaArgs{ImageType: "classic"},
+					},
+				},
+			},
+			want: &statemachine.SchemaStateMachine{
+				Args: commands.SchemaArgs{ImageType: "classic"},
+			},
+		},
+		{
+			name: "init a lint state machine",
+			args: args{
+				imageType:        "lint",
+				commonOpts:       &commands.CommonOpts{},
+				stateMachineOpts: &commands.StateMachineOpts{},
+				ubuntuImageCommand: &commands.UbuntuImageCommand{
+					Lint: commands.LintCommand{
+						LintArgsPassed: commands.LintArgs{ImageDefinition: "image.yaml"},
+						LintOptsPassed: commands.LintOpts{Strict: true},
+					},
+				},
+			},
+			want: &statemachine.LintStateMachine{
+				Opts: commands.LintOpts{Strict: true},
+				Args: commands.LintArgs{ImageDefinition: "image.yaml"},
+			},
+		},
 		{
 			name: "fail to init an unknown statemachine",
 			args: args{
@@ -5,6 +5,18 @@ type ClassicArgs struct {
 	ImageDefinition string `positional-arg-name:"image_definition" description:"Classic image definition file. This is used to define what should be in the image and the outputs that are created."`
 }
 
+// ClassicOpts holds all flags that are specific to the classic command
+type ClassicOpts struct {
+	TarballKeyring string            `long:"tarball-keyring" description:"Path to the keyring used to verify the gpg signature of the rootfs tarball. Overrides the keyring given in the image definition." value-name:"KEYRING"`
+	StoreAuth      map[string]string `long:"store-auth" description:"File holding the credentials used to download snaps from a store, given as <store-id>:<file>, with canonical as ID for the default store. Can be given several times. The UBUNTU_STORE_AUTH and UBUNTU_STORE_AUTH_DATA_FILENAME environment variables are used for stores without a credentials file." value-name:"STORE-AUTH"`
+	CacheDir       string            `long:"cache-dir" description:"Directory in which files downloaded from http(s) URLs are cached. Defaults to ubuntu-image/ in the user cache directory." value-name:"DIRECTORY"`
+	Variables      []string          `long:"set" description:"Set a variable substituted in the image definition, given as <name>=<value>. Can be given several times. Overrides the variables defined in the image definition and with UBUNTU_IMAGE_VAR_<name> environment variables." value-name:"NAME=VALUE"`
+	RedactedVars   []string          `long:"redact-variable" description:"Record the value of a variable substituted in the image definition as <redacted> in the build metadata, for example for secrets. Can be given several times." value-name:"NAME"`
+	PrintDef       bool              `long:"print-image-definition" description:"Print the image definition resolved from the image definitions it extends, with the default values set."`
+	Strict         bool              `long:"strict" description:"Fail the build when the lint rules find warnings in the image definition or the gadget.yaml."`
+}
+
 type ClassicCommand struct {
 	ClassicArgsPassed ClassicArgs `positional-args:"true" required:"false"`
+	ClassicOptsPassed ClassicOpts
 }
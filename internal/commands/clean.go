@@ -0,0 +1,10 @@
+package commands
+
+// CleanOpts holds all flags that are specific to the clean command
+type CleanOpts struct {
+	Delete bool `long:"delete" description:"Delete the workdir once everything set up in it by the build was torn down."`
+}
+
+type CleanCommand struct {
+	CleanOptsPassed CleanOpts
+}
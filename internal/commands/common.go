@@ -16,20 +16,30 @@ type CommonOpts struct {
 	Validation string `long:"validation" description:"Control whether validations should be ignored or enforced" choice:"ignore" choice:"enforce"`                                                                      //nolint:staticcheck,SA5008
 	// The library we use to handle command-line flags (github.com/jessevdk/go-flags) relies on this method to list valid values for a flag, even though this is not a recommended way.
 	// Ignore these warnings until we use another library.
-	DryRun bool `long:"dry-run" description:"Print the states to be executed to build the image and return."`
+	DryRun       bool   `long:"dry-run" description:"Print the states to be executed to build the image and return."`
+	Progress     string `long:"progress" description:"Format of the progress of the build. With json, an event is written as a JSON line when each step starts, finishes or fails." choice:"text" choice:"json" value-name:"FORMAT" default:"text"` //nolint:staticcheck,SA5008
+	ProgressFile string `long:"progress-file" description:"File to write the json progress events to instead of stdout" value-name:"FILE"`
 }
 
 // StateMachineOpts stores the options that are related to the state machine
 type StateMachineOpts struct {
-	WorkDir string `short:"w" long:"workdir" description:"The working directory in which to download and unpack all the source files for the image. This directory can exist or not, and it is not removed after this program exits. If not given, a temporary working directory is used instead, which *is* deleted after this program exits. Use -w if you want to be able to resume a partial state machine run. Note: due to a current limitation, the resulting absolute path of the workdir cannot be longer than 80 characters." value-name:"DIRECTORY" group:"State Machine Options" default:""`
-	Until   string `short:"u" long:"until" description:"Run the state machine until the given STEP, non-inclusively. STEP must be the name of the step." value-name:"STEP" default:""`
-	Thru    string `short:"t" long:"thru" description:"Run the state machine through the given STEP, inclusively. STEP must be the name of the step." value-name:"STEP" default:""`
-	Resume  bool   `short:"r" long:"resume" description:"Continue the state machine from the previously saved state. It is an error if there is no previous state."`
+	WorkDir  string `short:"w" long:"workdir" description:"The working directory in which to download and unpack all the source files for the image. This directory can exist or not, and it is not removed after this program exits. If not given, a temporary working directory is used instead, which *is* deleted after this program exits. Use -w if you want to be able to resume a partial state machine run. Note: due to a current limitation, the resulting absolute path of the workdir cannot be longer than 80 characters." value-name:"DIRECTORY" group:"State Machine Options" default:""`
+	Until    string `short:"u" long:"until" description:"Run the state machine until the given STEP, non-inclusively. STEP must be the name of the step." value-name:"STEP" default:""`
+	Thru     string `short:"t" long:"thru" description:"Run the state machine through the given STEP, inclusively. STEP must be the name of the step." value-name:"STEP" default:""`
+	Resume   bool   `short:"r" long:"resume" description:"Continue the state machine from the previously saved state. It is an error if there is no previous state."`
+	From     string `long:"from" description:"Continue the state machine from the given STEP of the previously saved state, running again the steps already taken from STEP. It is an error if the outputs of the steps before STEP are missing from the workdir." value-name:"STEP" default:""`
+	Rewind   bool   `long:"rewind-on-change" description:"When the inputs of the build changed since the previous run, continue the state machine from the first step using them instead of failing."`
+	HooksDir string `long:"hooks-dir" description:"Directory containing hooks to run around the steps of the state machine. The executables in the pre-STEP.d and post-STEP.d subdirectories are run in lexical order before and after STEP. A failing hook fails the build." value-name:"DIRECTORY" default:""`
+	Snapshot bool   `long:"snapshot" description:"Snapshot the chroot or the rootfs before each step modifying it. If the step fails, they are restored and the state is saved, so the step can be retried from a clean tree with --resume. Requires --workdir."`
 }
 
 // UbuntuImageCommand is needed for the parser to store positional arguments and flags
 type UbuntuImageCommand struct {
-	Snap    SnapCommand    `command:"snap"`
-	Classic ClassicCommand `command:"classic"`
-	Pack    PackCommand    `command:"pack" hidden:"true"`
+	Snap     SnapCommand     `command:"snap"`
+	Classic  ClassicCommand  `command:"classic"`
+	Pack     PackCommand     `command:"pack" hidden:"true"`
+	Clean    CleanCommand    `command:"clean"`
+	Validate ValidateCommand `command:"validate"`
+	Schema   SchemaCommand   `command:"schema"`
+	Lint     LintCommand     `command:"lint"`
 }
@@ -0,0 +1,19 @@
+package commands
+
+// LintArgs holds the image definition to lint. positional arguments need their own struct
+type LintArgs struct {
+	ImageDefinition string `positional-arg-name:"image_definition" description:"Classic image definition file to lint."`
+}
+
+// LintOpts holds all flags that are specific to the lint command
+type LintOpts struct {
+	GadgetYaml string   `long:"gadget-yaml" description:"gadget.yaml file to lint." value-name:"GADGET-YAML"`
+	Variables  []string `long:"set" description:"Set a variable substituted in the image definition, given as <name>=<value>. Can be given several times." value-name:"NAME=VALUE"`
+	Format     string   `long:"format" description:"Format of the findings. With json, a single JSON document listing the findings is written to stdout." choice:"text" choice:"json" value-name:"FORMAT" default:"text"` //nolint:staticcheck,SA5008
+	Strict     bool     `long:"strict" description:"Fail when warnings are found."`
+}
+
+type LintCommand struct {
+	LintArgsPassed LintArgs `positional-args:"true"`
+	LintOptsPassed LintOpts
+}
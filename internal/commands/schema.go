@@ -0,0 +1,10 @@
+package commands
+
+// SchemaArgs holds the type of image to print the schema of. positional arguments need their own struct
+type SchemaArgs struct {
+	ImageType string `positional-arg-name:"image_type" description:"Type of image whose definition file the schema is printed for. Only classic is supported."`
+}
+
+type SchemaCommand struct {
+	SchemaArgsPassed SchemaArgs `positional-args:"true" required:"true"`
+}
@@ -0,0 +1,19 @@
+package commands
+
+// ValidateArgs holds the image definition to validate. positional arguments need their own struct
+type ValidateArgs struct {
+	ImageDefinition string `positional-arg-name:"image_definition" description:"Classic image definition file to validate."`
+}
+
+// ValidateOpts holds all flags that are specific to the validate command
+type ValidateOpts struct {
+	GadgetYaml     string   `long:"gadget-yaml" description:"gadget.yaml file to validate." value-name:"GADGET-YAML"`
+	ModelAssertion string   `long:"model-assertion" description:"Model assertion to validate." value-name:"MODEL-ASSERTION"`
+	Variables      []string `long:"set" description:"Set a variable substituted in the image definition, given as <name>=<value>. Can be given several times." value-name:"NAME=VALUE"`
+	Format         string   `long:"format" description:"Format of the errors found. With json, a single JSON document listing the errors is written to stdout." choice:"text" choice:"json" value-name:"FORMAT" default:"text"` //nolint:staticcheck,SA5008
+}
+
+type ValidateCommand struct {
+	ValidateArgsPassed ValidateArgs `positional-args:"true"`
+	ValidateOptsPassed ValidateOpts
+}
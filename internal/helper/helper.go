@@ -3,12 +3,14 @@ package helper
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/invopop/jsonschema"
@@ -62,10 +64,11 @@ func InitCommonOpts() (*commands.CommonOpts, *commands.StateMachineOpts) {
 	return commonOpts, new(commands.StateMachineOpts)
 }
 
-// RunScript runs scripts from disk. Currently only used for hooks
-func RunScript(hookScript string) error {
+// RunScript runs scripts from disk with the given variables added to the
+// environment. Currently only used for hooks
+func RunScript(hookScript string, env []string) error {
 	hookScriptCmd := exec.Command(hookScript)
-	hookScriptCmd.Env = os.Environ()
+	hookScriptCmd.Env = append(os.Environ(), env...)
 	hookScriptCmd.Stdout = os.Stdout
 	hookScriptCmd.Stderr = os.Stderr
 	if err := hookScriptCmd.Run(); err != nil {
@@ -206,12 +209,22 @@ func setDefaultToBasicType(field reflect.Value, elem reflect.Value, fieldIndex i
 	return nil
 }
 
+// ErrorLocationDetail is the detail of the custom gojsonschema errors holding
+// the path of the YAML key they are about, with its elements separated by ":"
+const ErrorLocationDetail = "location"
+
 // CheckEmptyFields iterates through the image definition struct and
 // checks for fields that are present but return IsZero == true.
 // TODO: I've created a PR upstream in xeipuuv/gojsonschema
 // https://github.com/xeipuuv/gojsonschema/pull/352
 // if it gets merged this can be deleted
 func CheckEmptyFields(Interface interface{}, result *gojsonschema.Result, schema *jsonschema.Schema) error {
+	return checkEmptyFields(Interface, result, schema, nil)
+}
+
+// checkEmptyFields checks for empty required fields in the struct found at
+// location in the YAML file
+func checkEmptyFields(Interface interface{}, result *gojsonschema.Result, schema *jsonschema.Schema, location []string) error {
 	value := reflect.ValueOf(Interface)
 	if value.Kind() != reflect.Ptr {
 		return fmt.Errorf("The argument to CheckEmptyFields must be a pointer")
@@ -219,23 +232,24 @@ func CheckEmptyFields(Interface interface{}, result *gojsonschema.Result, schema
 	elem := value.Elem()
 	for i := 0; i < elem.NumField(); i++ {
 		field := elem.Field(i)
+		tags := elem.Type().Field(i).Tag
+		fieldLocation := append(append([]string{}, location...), yamlKey(tags))
 		// if we're dealing with a slice, iterate through
 		// it and search for missing required fields in each
 		// element of the slice
 		if field.Type().Kind() == reflect.Slice {
-			err := checkEmptyFieldsInSlice(field, result, schema)
+			err := checkEmptyFieldsInSlice(field, result, schema, fieldLocation)
 			if err != nil {
 				return err
 			}
 		} else if field.Type().Kind() == reflect.Ptr {
 			// otherwise if it's just a pointer to a nested struct
 			// search it for empty required fields
-			err := checkEmptyFieldsInPtr(field, result, schema)
+			err := checkEmptyFieldsInPtr(field, result, schema, fieldLocation)
 			if err != nil {
 				return err
 			}
 		} else {
-			tags := elem.Type().Field(i).Tag
 			if !isRequiredFromTags(tags) && !isRequiredFromSchema(elem, i, schema) {
 				continue
 			}
@@ -245,8 +259,9 @@ func CheckEmptyFields(Interface interface{}, result *gojsonschema.Result, schema
 			}
 			jsonContext := gojsonschema.NewJsonContext("image_definition", nil)
 			errDetail := gojsonschema.ErrorDetails{
-				"property": tags.Get("yaml"),
-				"parent":   elem.Type().Name(),
+				"property":          tags.Get("yaml"),
+				"parent":            elem.Type().Name(),
+				ErrorLocationDetail: strings.Join(location, ":"),
 			}
 			result.AddError(
 				newMissingFieldError(
@@ -261,11 +276,12 @@ func CheckEmptyFields(Interface interface{}, result *gojsonschema.Result, schema
 	return nil
 }
 
-func checkEmptyFieldsInSlice(field reflect.Value, result *gojsonschema.Result, schema *jsonschema.Schema) error {
+func checkEmptyFieldsInSlice(field reflect.Value, result *gojsonschema.Result, schema *jsonschema.Schema, location []string) error {
 	for i := 0; i < field.Cap(); i++ {
 		sliceElem := field.Index(i)
 		if sliceElem.Kind() == reflect.Ptr && sliceElem.Elem().Kind() == reflect.Struct {
-			err := CheckEmptyFields(sliceElem.Interface(), result, schema)
+			elemLocation := append(append([]string{}, location...), strconv.Itoa(i))
+			err := checkEmptyFields(sliceElem.Interface(), result, schema, elemLocation)
 			if err != nil {
 				return err
 			}
@@ -274,9 +290,9 @@ func checkEmptyFieldsInSlice(field reflect.Value, result *gojsonschema.Result, s
 	return nil
 }
 
-func checkEmptyFieldsInPtr(field reflect.Value, result *gojsonschema.Result, schema *jsonschema.Schema) error {
+func checkEmptyFieldsInPtr(field reflect.Value, result *gojsonschema.Result, schema *jsonschema.Schema, location []string) error {
 	if field.Elem().Kind() == reflect.Struct {
-		err := CheckEmptyFields(field.Interface(), result, schema)
+		err := checkEmptyFields(field.Interface(), result, schema, location)
 		if err != nil {
 			return err
 		}
@@ -284,6 +300,12 @@ func checkEmptyFieldsInPtr(field reflect.Value, result *gojsonschema.Result, sch
 	return nil
 }
 
+// yamlKey returns the key of a field in the YAML file
+func yamlKey(tags reflect.StructTag) string {
+	key, _, _ := strings.Cut(tags.Get("yaml"), ",")
+	return key
+}
+
 // isRequiredFromTags checks if the field is required from the JSON tags
 func isRequiredFromTags(tags reflect.StructTag) bool {
 	jsonTag, hasJSON := tags.Lookup("json")
@@ -436,7 +458,8 @@ func ExtractTarArchive(src, dest string, debug bool) error {
 	return RunCmd(tarCommand, debug)
 }
 
-// CalculateSHA256 calculates the SHA256 sum of the file provided as an argument
+// CalculateSHA256 calculates the SHA256 sum of the file provided as an argument.
+// The sum is hex encoded, as printed by sha256sum and given in image definitions.
 func CalculateSHA256(fileName string) (string, error) {
 	f, err := os.Open(fileName)
 	if err != nil {
@@ -450,7 +473,7 @@ func CalculateSHA256(fileName string) (string, error) {
 		return "", fmt.Errorf("Error calculating SHA256 sum of file \"%s\": \"%s\"", fileName, err.Error())
 	}
 
-	return string(hasher.Sum(nil)), nil
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
 // CheckTags iterates through the keys in a struct and looks for
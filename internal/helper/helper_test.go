@@ -579,3 +579,19 @@ func TestPingXattrs(t *testing.T) {
 		t.Error("ping has lost the security.capability xattr after tar extraction")
 	}
 }
+
+// TestCalculateSHA256 ensures the SHA256 sum of a file is hex encoded
+func TestCalculateSHA256(t *testing.T) {
+	asserter := Asserter{T: t}
+	testFile := filepath.Join(t.TempDir(), "test-file")
+	err := os.WriteFile(testFile, []byte("ubuntu-image\n"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	sha256sum, err := CalculateSHA256(testFile)
+	asserter.AssertErrNil(err, true)
+	// the output of sha256sum for the same content
+	asserter.AssertEqual("42a7c385c67fe43f2ec00cc3859c305e42242c1c0e46787f94c4aeb981b7e938", sha256sum)
+
+	_, err = CalculateSHA256(filepath.Join(t.TempDir(), "inexistent"))
+	asserter.AssertErrContains(err, "Error opening file")
+}
@@ -64,6 +64,7 @@ type Seed struct {
 type Tarball struct {
 	TarballURL string `yaml:"url"       json:"TarballURL"          jsonschema:"type=string,format=uri"`
 	GPG        string `yaml:"gpg"       json:"GPG,omitempty"       jsonschema:"type=string,format=uri"`
+	Keyring    string `yaml:"keyring"   json:"Keyring,omitempty"   jsonschema:"type=string"`
 	SHA256sum  string `yaml:"sha256sum" json:"SHA256sum,omitempty" jsonschema:"minLength=64,maxLength=64"`
 }
 
@@ -217,10 +218,12 @@ type Filelist struct {
 	FilelistName string `yaml:"name" json:"FilelistName"`
 }
 
-// Changelog specifies the name of the changelog file.
+// Changelog specifies the name of the changelog file and optionally
+// a previous manifest to compare the installed packages against.
 // If left emtpy no changelog file will be created
 type Changelog struct {
-	ChangelogName string `yaml:"name" json:"ChangelogName"`
+	ChangelogName    string `yaml:"name"              json:"ChangelogName"`
+	PreviousManifest string `yaml:"previous-manifest" json:"PreviousManifest,omitempty"`
 }
 
 // RootfsTar specifies the name of a tarball to create from the
@@ -308,6 +311,44 @@ type DependentKeyError struct {
 	gojsonschema.ResultErrorFields
 }
 
+// NewInvalidLayerError fails the image definition parsing when the
+// layers of an installer image are not correctly ordered or named
+func NewInvalidLayerError(context *gojsonschema.JsonContext, value interface{}, details gojsonschema.ErrorDetails) *InvalidLayerError {
+	err := InvalidLayerError{}
+	err.SetContext(context)
+	err.SetType("invalid_layer_error")
+	err.SetDescriptionFormat("Invalid installer layers: {{.reason}}")
+	err.SetValue(value)
+	err.SetDetails(details)
+
+	return &err
+}
+
+// InvalidLayerError implements gojsonschema.ErrorType. It is used for custom
+// errors for installer layers that cannot be built
+type InvalidLayerError struct {
+	gojsonschema.ResultErrorFields
+}
+
+// NewDuplicatePreseedError fails the image definition parsing when two
+// preseed files of an installer image have the same name
+func NewDuplicatePreseedError(context *gojsonschema.JsonContext, value interface{}, details gojsonschema.ErrorDetails) *DuplicatePreseedError {
+	err := DuplicatePreseedError{}
+	err.SetContext(context)
+	err.SetType("duplicate_preseed_error")
+	err.SetDescriptionFormat("Preseed files {{.first}} and {{.second}} would both be copied to preseed/{{.name}} on the installer media")
+	err.SetValue(value)
+	err.SetDetails(details)
+
+	return &err
+}
+
+// DuplicatePreseedError implements gojsonschema.ErrorType. It is used for custom
+// errors for preseed files overwriting each other on the installer media
+type DuplicatePreseedError struct {
+	gojsonschema.ResultErrorFields
+}
+
 func (i ImageDefinition) securityMirror() string {
 	if i.Architecture == "amd64" || i.Architecture == "i386" {
 		return "http://security.ubuntu.com/ubuntu/"
@@ -0,0 +1,240 @@
+package imagedefinition
+
+import (
+	_ "embed"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/invopop/jsonschema"
+)
+
+// specification is the README documenting the keys of the image definition
+//
+//go:embed README.rst
+var specification string
+
+// SchemaTitle is the title of the JSON schema of image definition files
+const SchemaTitle = "ubuntu-image classic image definition"
+
+// specKeyRegex matches the keys of the specification in the README,
+// including the first key of the mappings of a list
+var specKeyRegex = regexp.MustCompile(`^( *)(?:- )?([a-z0-9-]+):(.*)$`)
+
+// keySpec describes a key of the image definition in the README
+type keySpec struct {
+	description string
+	optional    bool
+}
+
+// parseSpecification returns the keys described in the specification of the
+// README by their path, with their elements separated by "."
+func parseSpecification() map[string]keySpec {
+	keys := make(map[string]keySpec)
+	type parentKey struct {
+		indent int
+		key    string
+	}
+	var parents []parentKey
+	var comment []string
+	inSpec := false
+	for _, line := range strings.Split(specification, "\n") {
+		if !inSpec {
+			inSpec = strings.HasPrefix(line, ".. code:: yaml")
+			continue
+		}
+		// the specification is the first code block of the README
+		if line != "" && !strings.HasPrefix(line, " ") {
+			break
+		}
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "#") {
+			comment = append(comment, strings.TrimSpace(strings.TrimPrefix(trimmed, "#")))
+			continue
+		}
+		match := specKeyRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		// the keys of a list item are indented by "- "
+		indent := len(match[1])
+		if strings.HasPrefix(strings.TrimLeft(line, " "), "- ") {
+			indent += 2
+		}
+		for len(parents) > 0 && parents[len(parents)-1].indent >= indent {
+			parents = parents[:len(parents)-1]
+		}
+		path := make([]string, 0, len(parents)+1)
+		for _, parent := range parents {
+			path = append(path, parent.key)
+		}
+		path = append(path, match[2])
+		keys[strings.Join(path, ".")] = keySpec{
+			description: strings.Join(comment, " "),
+			optional:    strings.Contains(match[3], "(optional"),
+		}
+		parents = append(parents, parentKey{indent, match[2]})
+		comment = nil
+	}
+	return keys
+}
+
+// Schema returns the JSON schema of image definition files, for editors to
+// complete and validate them. Unlike the schema the decoded image definition is
+// validated against, the keys are named as in the YAML file. The descriptions
+// of the keys are taken from the README and their default values from the
+// default tags of the structs.
+func Schema() *jsonschema.Schema {
+	reflector := jsonschema.Reflector{
+		FieldNameTag: "yaml",
+		// the keys required are set from the tags and the README
+		RequiredFromJSONSchemaTags: true,
+	}
+	schema := reflector.Reflect(&ImageDefinition{})
+	schema.ID = ""
+	schema.Title = SchemaTitle
+
+	keys := parseSpecification()
+	completeDefinition(schema.Definitions, reflect.TypeOf(ImageDefinition{}), nil, keys)
+
+	root := schema.Definitions["ImageDefinition"]
+	addExtensionKeys(root, keys)
+	addConditionalRules(schema.Definitions)
+
+	return schema
+}
+
+// completeDefinition sets the descriptions, default values and required keys
+// of the definition of a struct found at path in the image definition
+func completeDefinition(definitions jsonschema.Definitions, structType reflect.Type, path []string, keys map[string]keySpec) {
+	definition, found := definitions[structType.Name()]
+	if !found {
+		return
+	}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		property, found := definition.Properties.Get(key)
+		if !found {
+			continue
+		}
+		fieldPath := append(append([]string{}, path...), key)
+		spec := keys[strings.Join(fieldPath, ".")]
+		property.Description = spec.description
+
+		defaultValue, hasDefault := field.Tag.Lookup("default")
+		jsonTag := field.Tag.Get("json")
+		if hasDefault {
+			property.Default = parseDefault(field.Type, defaultValue)
+		} else if !strings.Contains(jsonTag, "omitempty") && !spec.optional {
+			definition.Required = append(definition.Required, key)
+		}
+
+		fieldType := indirectType(field.Type)
+		if fieldType.Kind() == reflect.Slice {
+			// lists can be appended to the ones of the extended image definitions
+			definition.Properties.Set(key+"+", &jsonschema.Schema{
+				Ref:         property.Ref,
+				Type:        property.Type,
+				Items:       property.Items,
+				Description: "Appended to the " + key + " list of the extended image definitions.",
+			})
+			fieldType = indirectType(fieldType.Elem())
+		}
+		if fieldType.Kind() == reflect.Struct {
+			completeDefinition(definitions, fieldType, fieldPath, keys)
+		}
+	}
+}
+
+// indirectType returns the type pointed to by pointer types
+func indirectType(fieldType reflect.Type) reflect.Type {
+	for fieldType.Kind() == reflect.Ptr {
+		fieldType = fieldType.Elem()
+	}
+	return fieldType
+}
+
+// parseDefault converts the value of a default tag to the type of its field
+func parseDefault(fieldType reflect.Type, value string) interface{} {
+	switch indirectType(fieldType).Kind() {
+	case reflect.Slice:
+		return strings.Split(value, ",")
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err == nil {
+			return parsed
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseInt(value, 0, 64)
+		if err == nil {
+			return parsed
+		}
+	}
+	return value
+}
+
+// addExtensionKeys adds the keys extending image definitions and defining
+// their variables. Keys required may then be set by the extended image
+// definitions.
+func addExtensionKeys(root *jsonschema.Schema, keys map[string]keySpec) {
+	root.Properties.Set("extends", &jsonschema.Schema{
+		Description: keys["extends"].description,
+		OneOf: []*jsonschema.Schema{
+			{Type: "string"},
+			{Type: "array", Items: &jsonschema.Schema{Type: "string"}},
+		},
+	})
+	root.Properties.Set("variables", &jsonschema.Schema{
+		Description:          keys["variables"].description,
+		Type:                 "object",
+		AdditionalProperties: &jsonschema.Schema{Type: "string"},
+	})
+
+	required := root.Required
+	root.Required = nil
+	root.If = &jsonschema.Schema{Required: []string{"extends"}}
+	root.Else = &jsonschema.Schema{Required: required}
+}
+
+// addConditionalRules adds the rules checked once the image definition is
+// decoded which can be expressed in the schema
+func addConditionalRules(definitions jsonschema.Definitions) {
+	// gadgets built from git or a directory need a URL
+	gadget := definitions["Gadget"]
+	gadget.If = &jsonschema.Schema{
+		Properties: jsonschema.NewProperties(),
+		Required:   []string{"type"},
+	}
+	gadget.If.Properties.Set("type", &jsonschema.Schema{Const: "prebuilt"})
+	gadget.Else = &jsonschema.Schema{Required: []string{"url"}}
+
+	// private PPAs need the fingerprint of their signing key
+	definitions["PPA"].DependentRequired = map[string][]string{"auth": {"fingerprint"}}
+
+	// the paths in the rootfs are absolute
+	absolutePaths := map[string]string{"MakeDirs": "path", "CopyFile": "destination", "TouchFile": "path"}
+	for name, key := range absolutePaths {
+		property, found := definitions[name].Properties.Get(key)
+		if !found {
+			continue
+		}
+		property.Pattern = "^/"
+		property.Not = &jsonschema.Schema{Pattern: `/\.\./`}
+	}
+
+	// disk images are built from the volumes of the gadget
+	root := definitions["ImageDefinition"]
+	diskArtifacts := jsonschema.NewProperties()
+	diskArtifacts.Set("artifacts", &jsonschema.Schema{AnyOf: []*jsonschema.Schema{
+		{Required: []string{"img"}},
+		{Required: []string{"iso"}},
+		{Required: []string{"qcow2"}},
+	}})
+	root.AllOf = append(root.AllOf, &jsonschema.Schema{
+		If:   &jsonschema.Schema{Properties: diskArtifacts, Required: []string{"artifacts"}},
+		Then: &jsonschema.Schema{Required: []string{"gadget"}},
+	})
+}
@@ -0,0 +1,150 @@
+package imagedefinition
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v3"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+func TestParseSpecification(t *testing.T) {
+	t.Parallel()
+	asserter := helper.Asserter{T: t}
+	keys := parseSpecification()
+
+	asserter.AssertEqual("The name of the image.", keys["name"].description)
+	asserter.AssertEqual(false, keys["name"].optional)
+	asserter.AssertEqual(true, keys["revision"].optional)
+	asserter.AssertEqual(true, keys["gadget"].optional)
+	asserter.AssertEqual(false, keys["gadget.type"].optional)
+	// the keys of the mappings of a list are found in their list
+	_, found := keys["customization.extra-ppas.name"]
+	asserter.AssertEqual(true, found)
+	_, found = keys["customization.extra-ppas.fingerprint"]
+	asserter.AssertEqual(true, found)
+	// the examples following the specification are ignored
+	_, found = keys["name.name"]
+	asserter.AssertEqual(false, found)
+}
+
+// schemaProperty returns the property of a definition of the schema
+func schemaProperty(t *testing.T, schema map[string]interface{}, definition string, key string) map[string]interface{} {
+	t.Helper()
+	definitions := schema["$defs"].(map[string]interface{})
+	properties := definitions[definition].(map[string]interface{})["properties"].(map[string]interface{})
+	property, found := properties[key]
+	if !found {
+		t.Fatalf("Key %s not found in the definition of %s", key, definition)
+	}
+	return property.(map[string]interface{})
+}
+
+// marshalledSchema returns the schema as decoded by the users of its JSON
+func marshalledSchema(t *testing.T) map[string]interface{} {
+	t.Helper()
+	asserter := helper.Asserter{T: t}
+	data, err := json.Marshal(Schema())
+	asserter.AssertErrNil(err, true)
+	var schema map[string]interface{}
+	err = json.Unmarshal(data, &schema)
+	asserter.AssertErrNil(err, true)
+	return schema
+}
+
+func TestSchema(t *testing.T) {
+	t.Parallel()
+	asserter := helper.Asserter{T: t}
+	schema := marshalledSchema(t)
+
+	asserter.AssertEqual("https://json-schema.org/draft/2020-12/schema", schema["$schema"])
+	asserter.AssertEqual(SchemaTitle, schema["title"])
+
+	name := schemaProperty(t, schema, "ImageDefinition", "name")
+	asserter.AssertEqual("The name of the image.", name["description"])
+
+	mirror := schemaProperty(t, schema, "Rootfs", "mirror")
+	asserter.AssertEqual("http://archive.ubuntu.com/ubuntu/", mirror["default"])
+	components := schemaProperty(t, schema, "Rootfs", "components")
+	asserter.AssertEqual([]interface{}{"main", "restricted"}, components["default"])
+	keepEnabled := schemaProperty(t, schema, "PPA", "keep-enabled")
+	asserter.AssertEqual(true, keepEnabled["default"])
+
+	appended := schemaProperty(t, schema, "Customization", "extra-packages+")
+	asserter.AssertEqual("Appended to the extra-packages list of the extended image definitions.",
+		appended["description"])
+
+	root := schema["$defs"].(map[string]interface{})["ImageDefinition"].(map[string]interface{})
+	_, found := root["required"]
+	asserter.AssertEqual(false, found)
+	// the keys required may be set by the extended image definitions
+	asserter.AssertEqual(map[string]interface{}{"required": []interface{}{"extends"}}, root["if"])
+	asserter.AssertEqual([]interface{}{"name", "display-name", "architecture", "series", "rootfs", "class"},
+		root["else"].(map[string]interface{})["required"])
+}
+
+// draft7Schema converts the schema to the draft supported by gojsonschema
+func draft7Schema(t *testing.T) gojsonschema.JSONLoader {
+	t.Helper()
+	asserter := helper.Asserter{T: t}
+	data, err := json.Marshal(Schema())
+	asserter.AssertErrNil(err, true)
+	draft7 := strings.NewReplacer(
+		`"$schema":"https://json-schema.org/draft/2020-12/schema",`, "",
+		`"$defs"`, `"definitions"`,
+		`"#/$defs/`, `"#/definitions/`,
+		`"dependentRequired"`, `"dependencies"`,
+	).Replace(string(data))
+	return gojsonschema.NewStringLoader(draft7)
+}
+
+// TestSchema_Validate ensures image definitions are validated by the schema
+// as they are when building images
+func TestSchema_Validate(t *testing.T) {
+	t.Parallel()
+	const imageDefinition = `name: ubuntu-server
+display-name: Ubuntu Server
+revision: 1
+architecture: amd64
+series: noble
+class: preinstalled
+rootfs:
+  archive-tasks: [minimal]
+`
+	testCases := []struct {
+		name            string
+		imageDefinition string
+		shouldPass      bool
+	}{
+		{"valid", imageDefinition, true},
+		{"prebuilt_gadget", imageDefinition + "gadget:\n  type: prebuilt\n  url: file:///gadget\n", true},
+		{"extends", "extends: base.yaml\nname: child\ncustomization:\n  extra-snaps+:\n    - name: hello\n", true},
+		{"missing_name", strings.Replace(imageDefinition, "name: ubuntu-server\n", "", 1), false},
+		{"unknown_key", imageDefinition + "unknown: key\n", false},
+		{"git_gadget_without_url", imageDefinition + "gadget:\n  type: git\n", false},
+		{"private_ppa_without_fingerprint", imageDefinition +
+			"customization:\n  extra-ppas:\n    - name: private/ppa\n      auth: user:password\n", false},
+		{"relative_path", imageDefinition + "customization:\n  manual:\n    touch-file:\n      - path: relative\n", false},
+		{"parent_path", imageDefinition + "customization:\n  manual:\n    touch-file:\n      - path: /../malicious\n", false},
+		{"img_without_gadget", imageDefinition + "artifacts:\n  img:\n    - name: ubuntu.img\n", false},
+	}
+	schema := draft7Schema(t)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var document interface{}
+			err := yaml.Unmarshal([]byte(tc.imageDefinition), &document)
+			asserter.AssertErrNil(err, true)
+
+			result, err := gojsonschema.Validate(schema, gojsonschema.NewGoLoader(document))
+			asserter.AssertErrNil(err, true)
+			if result.Valid() != tc.shouldPass {
+				t.Errorf("Expected the image definition to be valid: %t, got errors %v",
+					tc.shouldPass, result.Errors())
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// buildResultFile is the report written in the output directory
+// once the build is complete
+const buildResultFile = "build-result.json"
+
+// buildArtifact describes a file produced by the build
+type buildArtifact struct {
+	Path   string `json:"path"`
+	Type   string `json:"type"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Volume string `json:"volume,omitempty"`
+}
+
+// buildInputs describes what the image was built from
+type buildInputs struct {
+	ImageDefinition string `json:"image-definition,omitempty"`
+	// image definitions extended by the image definition, merged under it
+	ExtendedImageDefinitions []string `json:"extended-image-definitions,omitempty"`
+	Name                     string   `json:"name,omitempty"`
+	Revision                 int      `json:"revision,omitempty"`
+	Series                   string   `json:"series,omitempty"`
+	Architecture             string   `json:"architecture,omitempty"`
+	Class                    string   `json:"class,omitempty"`
+	Model                    string   `json:"model,omitempty"`
+	GadgetCommit             string   `json:"gadget-commit,omitempty"`
+	// variables substituted in the image definition
+	Variables map[string]string `json:"variables,omitempty"`
+}
+
+// buildResult is the content of the build result report
+type buildResult struct {
+	Inputs    buildInputs     `json:"inputs"`
+	Artifacts []buildArtifact `json:"artifacts"`
+}
+
+// plannedArtifact is an artifact the build is expected to produce
+type plannedArtifact struct {
+	name         string
+	artifactType string
+	volume       string
+}
+
+// volumeArtifacts returns the .img files of the volumes
+func (stateMachine *StateMachine) volumeArtifacts() []plannedArtifact {
+	var artifacts []plannedArtifact
+	for volume, name := range stateMachine.VolumeNames {
+		artifacts = append(artifacts, plannedArtifact{name: name, artifactType: "img", volume: volume})
+	}
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].volume < artifacts[j].volume })
+	return artifacts
+}
+
+// classicArtifacts returns the artifacts of the image definition
+func classicArtifacts(artifacts *imagedefinition.Artifact) []plannedArtifact {
+	if artifacts == nil {
+		return nil
+	}
+	var planned []plannedArtifact
+	if artifacts.Qcow2 != nil {
+		for _, qcow2 := range *artifacts.Qcow2 {
+			planned = append(planned, plannedArtifact{name: qcow2.Qcow2Name, artifactType: "qcow2", volume: qcow2.Qcow2Volume})
+		}
+	}
+	if artifacts.Iso != nil {
+		for _, iso := range *artifacts.Iso {
+			planned = append(planned, plannedArtifact{name: iso.IsoName, artifactType: "iso", volume: iso.IsoVolume})
+		}
+	}
+	if artifacts.Manifest != nil {
+		planned = append(planned, plannedArtifact{name: artifacts.Manifest.ManifestName, artifactType: "manifest"})
+	}
+	if artifacts.Filelist != nil {
+		planned = append(planned, plannedArtifact{name: artifacts.Filelist.FilelistName, artifactType: "filelist"})
+	}
+	if artifacts.Changelog != nil {
+		planned = append(planned, plannedArtifact{name: artifacts.Changelog.ChangelogName, artifactType: "changelog"})
+	}
+	if artifacts.RootfsTar != nil {
+		planned = append(planned, plannedArtifact{name: artifacts.RootfsTar.RootfsTarName, artifactType: "tarball"})
+	}
+	return planned
+}
+
+// plannedBuildResult returns the inputs of the build and the artifacts it
+// is expected to produce. ok is false for image types without a report.
+func (stateMachine *StateMachine) plannedBuildResult() (inputs buildInputs, artifacts []plannedArtifact, ok bool) {
+	artifacts = stateMachine.volumeArtifacts()
+	switch parent := stateMachine.parent.(type) {
+	case *ClassicStateMachine:
+		inputs = buildInputs{
+			ImageDefinition:          parent.Args.ImageDefinition,
+			ExtendedImageDefinitions: stateMachine.extendedImageDefs,
+			Name:                     parent.ImageDef.ImageName,
+			Revision:                 parent.ImageDef.Revision,
+			Series:                   parent.ImageDef.Series,
+			Architecture:             parent.ImageDef.Architecture,
+			Class:                    parent.ImageDef.Class,
+			Variables:                stateMachine.Variables,
+		}
+		artifacts = append(artifacts, classicArtifacts(parent.ImageDef.Artifacts)...)
+	case *SnapStateMachine:
+		inputs = buildInputs{
+			Model: parent.Args.ModelAssertion,
+		}
+		artifacts = append(artifacts,
+			plannedArtifact{name: "seed.manifest", artifactType: "seed.manifest"},
+			plannedArtifact{name: "snaps.manifest", artifactType: "snaps.manifest"},
+		)
+	default:
+		return buildInputs{}, nil, false
+	}
+	inputs.GadgetCommit = stateMachine.GadgetCommit
+	return inputs, artifacts, true
+}
+
+// writeBuildResult writes a report of the artifacts produced by the build,
+// with their size and SHA256 sum, in the output directory. It fails if an
+// artifact of the build was not produced.
+func (stateMachine *StateMachine) writeBuildResult() error {
+	inputs, planned, ok := stateMachine.plannedBuildResult()
+	if !ok {
+		return nil
+	}
+
+	result := buildResult{
+		Inputs:    inputs,
+		Artifacts: make([]buildArtifact, 0, len(planned)),
+	}
+	seen := make(map[string]bool)
+	for _, artifact := range planned {
+		path := filepath.Join(stateMachine.commonFlags.OutputDir, artifact.name)
+		if seen[path] {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("Error reading artifact \"%s\": the %s artifact was not produced by the build",
+					path, artifact.artifactType)
+			}
+			return fmt.Errorf("Error reading artifact \"%s\": %s", path, err.Error())
+		}
+		sha256sum, err := helper.CalculateSHA256(path)
+		if err != nil {
+			return err
+		}
+		seen[path] = true
+		result.Artifacts = append(result.Artifacts, buildArtifact{
+			Path:   path,
+			Type:   artifact.artifactType,
+			Size:   info.Size(),
+			SHA256: sha256sum,
+			Volume: artifact.volume,
+		})
+	}
+
+	resultJSON, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding the build result: %s", err.Error())
+	}
+	err = osWriteFile(filepath.Join(stateMachine.commonFlags.OutputDir, buildResultFile), append(resultJSON, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing the build result: %s", err.Error())
+	}
+	return nil
+}
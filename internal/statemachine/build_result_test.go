@@ -0,0 +1,185 @@
+package statemachine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestStateMachine_writeBuildResult(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	outputDir := t.TempDir()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.OutputDir = outputDir
+	stateMachine.Args.ImageDefinition = "image.yaml"
+	stateMachine.GadgetCommit = "0123456789abcdef0123456789abcdef01234567"
+	stateMachine.VolumeNames = map[string]string{
+		"pc":   "pc.img",
+		"data": "data.img",
+	}
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		ImageName:    "ubuntu-server",
+		Revision:     3,
+		Series:       "noble",
+		Architecture: "amd64",
+		Class:        "preinstalled",
+		Artifacts: &imagedefinition.Artifact{
+			Qcow2:    &[]imagedefinition.Qcow2{{Qcow2Name: "pc.qcow2", Qcow2Volume: "pc"}},
+			Manifest: &imagedefinition.Manifest{ManifestName: "pc.manifest"},
+			Filelist: &imagedefinition.Filelist{FilelistName: "pc.filelist"},
+			RootfsTar: &imagedefinition.RootfsTar{
+				RootfsTarName: "rootfs.tar.gz",
+				Compression:   "gzip",
+			},
+		},
+	}
+
+	stateMachine.extendedImageDefs = []string{"/defs/base.yaml", "/defs/server.yaml"}
+	stateMachine.Variables = map[string]string{"SERIES": "noble"}
+
+	files := map[string]string{
+		"pc.img":        "image",
+		"data.img":      "data",
+		"pc.qcow2":      "qcow2",
+		"pc.manifest":   "manifest",
+		"pc.filelist":   "filelist",
+		"rootfs.tar.gz": "tarball",
+		"unrelated":     "unrelated",
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(outputDir, name), []byte(content), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+
+	err := stateMachine.writeBuildResult()
+	asserter.AssertErrNil(err, true)
+
+	resultJSON, err := os.ReadFile(filepath.Join(outputDir, "build-result.json"))
+	asserter.AssertErrNil(err, true)
+	var gotResult buildResult
+	err = json.Unmarshal(resultJSON, &gotResult)
+	asserter.AssertErrNil(err, true)
+
+	asserter.AssertEqual(buildResult{
+		Inputs: buildInputs{
+			ImageDefinition:          "image.yaml",
+			ExtendedImageDefinitions: []string{"/defs/base.yaml", "/defs/server.yaml"},
+			Name:                     "ubuntu-server",
+			Revision:                 3,
+			Series:                   "noble",
+			Architecture:             "amd64",
+			Class:                    "preinstalled",
+			GadgetCommit:             "0123456789abcdef0123456789abcdef01234567",
+			Variables:                map[string]string{"SERIES": "noble"},
+		},
+		Artifacts: []buildArtifact{
+			{Path: filepath.Join(outputDir, "data.img"), Type: "img", Size: 4, SHA256: sha256Hex("data"), Volume: "data"},
+			{Path: filepath.Join(outputDir, "pc.img"), Type: "img", Size: 5, SHA256: sha256Hex("image"), Volume: "pc"},
+			{Path: filepath.Join(outputDir, "pc.qcow2"), Type: "qcow2", Size: 5, SHA256: sha256Hex("qcow2"), Volume: "pc"},
+			{Path: filepath.Join(outputDir, "pc.manifest"), Type: "manifest", Size: 8, SHA256: sha256Hex("manifest")},
+			{Path: filepath.Join(outputDir, "pc.filelist"), Type: "filelist", Size: 8, SHA256: sha256Hex("filelist")},
+			{Path: filepath.Join(outputDir, "rootfs.tar.gz"), Type: "tarball", Size: 7, SHA256: sha256Hex("tarball")},
+		},
+	}, gotResult)
+
+	// an artifact of the build was not produced
+	err = os.Remove(filepath.Join(outputDir, "pc.filelist"))
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.writeBuildResult()
+	asserter.AssertErrContains(err, "the filelist artifact was not produced by the build")
+	err = os.WriteFile(filepath.Join(outputDir, "pc.filelist"), []byte("filelist"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() { osWriteFile = os.WriteFile })
+	err = stateMachine.writeBuildResult()
+	asserter.AssertErrContains(err, "Error writing the build result")
+}
+
+func TestSnapStateMachine_writeBuildResult(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	outputDir := t.TempDir()
+
+	var stateMachine SnapStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.OutputDir = outputDir
+	stateMachine.Args.ModelAssertion = "model.assertion"
+	stateMachine.VolumeNames = map[string]string{"pc": "pc.img"}
+
+	for _, name := range []string{"pc.img", "seed.manifest", "snaps.manifest"} {
+		err := os.WriteFile(filepath.Join(outputDir, name), []byte(name), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+
+	err := stateMachine.writeBuildResult()
+	asserter.AssertErrNil(err, true)
+
+	resultJSON, err := os.ReadFile(filepath.Join(outputDir, "build-result.json"))
+	asserter.AssertErrNil(err, true)
+	var gotResult buildResult
+	err = json.Unmarshal(resultJSON, &gotResult)
+	asserter.AssertErrNil(err, true)
+
+	asserter.AssertEqual(buildResult{
+		Inputs: buildInputs{Model: "model.assertion"},
+		Artifacts: []buildArtifact{
+			{Path: filepath.Join(outputDir, "pc.img"), Type: "img", Size: 6, SHA256: sha256Hex("pc.img"), Volume: "pc"},
+			{Path: filepath.Join(outputDir, "seed.manifest"), Type: "seed.manifest", Size: 13, SHA256: sha256Hex("seed.manifest")},
+			{Path: filepath.Join(outputDir, "snaps.manifest"), Type: "snaps.manifest", Size: 14, SHA256: sha256Hex("snaps.manifest")},
+		},
+	}, gotResult)
+}
+
+// TestStateMachine_Run_buildResult ensures the build result is only
+// written once all the states ran
+func TestStateMachine_Run_buildResult(t *testing.T) {
+	tests := []struct {
+		name        string
+		until       string
+		thru        string
+		wantWritten bool
+	}{
+		{name: "complete build", wantWritten: true},
+		{name: "thru last state", thru: "second", wantWritten: true},
+		{name: "until", until: "second"},
+		{name: "thru", thru: "first"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+			stateMachine.commonFlags.OutputDir = t.TempDir()
+			stateMachine.commonFlags.Quiet = true
+			stateMachine.stateMachineFlags.Until = tc.until
+			stateMachine.stateMachineFlags.Thru = tc.thru
+			stateMachine.states = []stateFunc{
+				{"first", func(*StateMachine) error { return nil }},
+				{"second", func(*StateMachine) error { return nil }},
+			}
+
+			err := stateMachine.Run()
+			asserter.AssertErrNil(err, true)
+
+			_, err = os.Stat(filepath.Join(stateMachine.commonFlags.OutputDir, "build-result.json"))
+			asserter.AssertEqual(tc.wantWritten, err == nil)
+		})
+	}
+}
@@ -0,0 +1,344 @@
+package statemachine
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/strutil"
+)
+
+// maxSymlinks is the maximum number of symlinks followed while resolving
+// a path in the rootfs
+const maxSymlinks = 255
+
+// changelogHeaderRegex matches the first line of a Debian changelog entry
+// and captures the version
+var changelogHeaderRegex = regexp.MustCompile(`^\S+ \(([^)]+)\)`)
+
+// dpkgPackage holds the information about an installed package
+// needed to generate the changelog
+type dpkgPackage struct {
+	name          string
+	version       string
+	source        string
+	sourceVersion string
+}
+
+// changelogEntry is a single entry of a Debian changelog
+type changelogEntry struct {
+	version string
+	text    string
+}
+
+// sourcePackage groups the installed binary packages built from the same source
+type sourcePackage struct {
+	name     string
+	version  string
+	binaries []dpkgPackage
+}
+
+// parseDpkgStatus parses a dpkg status file and returns the installed packages
+func parseDpkgStatus(statusPath string) ([]dpkgPackage, error) {
+	statusFile, err := osOpen(statusPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening dpkg status file: %s", err.Error())
+	}
+	defer statusFile.Close()
+
+	var packages []dpkgPackage
+	fields := make(map[string]string)
+
+	addPackage := func() {
+		defer func() { fields = make(map[string]string) }()
+		if fields["Package"] == "" || !strings.HasSuffix(fields["Status"], " installed") {
+			return
+		}
+		pkg := dpkgPackage{
+			name:          fields["Package"],
+			version:       fields["Version"],
+			source:        fields["Package"],
+			sourceVersion: fields["Version"],
+		}
+		// the Source field is either "name" or "name (version)"
+		if source := fields["Source"]; source != "" {
+			sourceName, sourceVersion, found := strings.Cut(source, " ")
+			pkg.source = sourceName
+			if found {
+				pkg.sourceVersion = strings.Trim(sourceVersion, "()")
+			}
+		}
+		packages = append(packages, pkg)
+	}
+
+	scanner := bufio.NewScanner(statusFile)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			addPackage()
+			continue
+		}
+		// ignore continuation lines of multiline fields
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		key, value, found := strings.Cut(line, ":")
+		if found {
+			fields[key] = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading dpkg status file: %s", err.Error())
+	}
+	addPackage()
+
+	return packages, nil
+}
+
+// groupBySource groups binary packages by source package, sorted by name
+func groupBySource(packages []dpkgPackage) []*sourcePackage {
+	sourcesMap := make(map[string]*sourcePackage)
+	for _, pkg := range packages {
+		source, found := sourcesMap[pkg.source]
+		if !found {
+			source = &sourcePackage{name: pkg.source, version: pkg.sourceVersion}
+			sourcesMap[pkg.source] = source
+		}
+		// multi-arch packages can be installed several times
+		duplicate := false
+		for _, binary := range source.binaries {
+			if binary.name == pkg.name {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			source.binaries = append(source.binaries, pkg)
+		}
+	}
+
+	sources := make([]*sourcePackage, 0, len(sourcesMap))
+	for _, source := range sourcesMap {
+		sources = append(sources, source)
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].name < sources[j].name })
+	return sources
+}
+
+// readManifest reads a manifest in the format generated by generatePackageManifest
+// and returns a map of package names to versions
+func readManifest(manifestPath string) (map[string]string, error) {
+	manifestFile, err := osOpen(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening manifest file: %s", err.Error())
+	}
+	defer manifestFile.Close()
+
+	versions := make(map[string]string)
+	scanner := bufio.NewScanner(manifestFile)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		// the package name may be qualified with its architecture
+		name, _, _ := strings.Cut(fields[0], ":")
+		versions[name] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading manifest file: %s", err.Error())
+	}
+	return versions, nil
+}
+
+// resolveRootfsPath resolves the symlinks in p as if rootfs was the root
+// directory, so absolute symlinks in the rootfs do not point to the host
+func resolveRootfsPath(rootfs string, p string) (string, error) {
+	resolved := "/"
+	remaining := strings.Split(p, "/")
+	links := 0
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		candidate := path.Join(resolved, component)
+		fileInfo, err := os.Lstat(filepath.Join(rootfs, candidate))
+		if err != nil {
+			return "", err
+		}
+		if fileInfo.Mode()&os.ModeSymlink == 0 {
+			resolved = candidate
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", p)
+		}
+		target, err := os.Readlink(filepath.Join(rootfs, candidate))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+	return filepath.Join(rootfs, resolved), nil
+}
+
+// readChangelogEntries reads the Debian changelog of a binary package
+// installed in the rootfs and returns its entries, the most recent first.
+// No entries and no error are returned if the package has no changelog.
+func readChangelogEntries(rootfs string, pkgName string) ([]changelogEntry, error) {
+	var changelogPath string
+	for _, changelogName := range []string{"changelog.Debian.gz", "changelog.gz"} {
+		p, err := resolveRootfsPath(rootfs, path.Join("/usr/share/doc", pkgName, changelogName))
+		if err == nil {
+			changelogPath = p
+			break
+		}
+	}
+	if changelogPath == "" {
+		return nil, nil
+	}
+
+	changelogFile, err := osOpen(changelogPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening changelog of %s: %s", pkgName, err.Error())
+	}
+	defer changelogFile.Close()
+
+	gzipReader, err := gzip.NewReader(changelogFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading changelog of %s: %s", pkgName, err.Error())
+	}
+	defer gzipReader.Close()
+
+	return parseChangelog(gzipReader)
+}
+
+// parseChangelog splits a Debian changelog into its entries
+func parseChangelog(r io.Reader) ([]changelogEntry, error) {
+	var entries []changelogEntry
+	var current *changelogEntry
+	var text strings.Builder
+
+	closeEntry := func() {
+		if current != nil {
+			current.text = strings.TrimRight(text.String(), "\n") + "\n"
+			entries = append(entries, *current)
+		}
+		text.Reset()
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := changelogHeaderRegex.FindStringSubmatch(line); match != nil {
+			closeEntry()
+			current = &changelogEntry{version: match[1]}
+		}
+		if current == nil {
+			continue
+		}
+		text.WriteString(line + "\n")
+		// the trailer line ends the entry, anything until the next
+		// header (such as the old changelog notice) is ignored
+		if strings.HasPrefix(line, " -- ") {
+			closeEntry()
+			current = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error parsing changelog: %s", err.Error())
+	}
+	closeEntry()
+
+	return entries, nil
+}
+
+// sourceChangelogEntries returns the changelog entries of a source package,
+// using the changelog shipped by the first of its binaries that has one
+func sourceChangelogEntries(rootfs string, source *sourcePackage) ([]changelogEntry, error) {
+	for _, binary := range source.binaries {
+		entries, err := readChangelogEntries(rootfs, binary.name)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			return entries, nil
+		}
+	}
+	return nil, nil
+}
+
+// compareDebianVersions compares two versions of Debian packages, returning
+// -1, 0 or +1 when a is older than, equal to or newer than b
+func compareDebianVersions(a, b string) (int, error) {
+	epochA, restA, err := splitDebianEpoch(a)
+	if err != nil {
+		return 0, err
+	}
+	epochB, restB, err := splitDebianEpoch(b)
+	if err != nil {
+		return 0, err
+	}
+	if epochA != epochB {
+		if epochA < epochB {
+			return -1, nil
+		}
+		return 1, nil
+	}
+	return strutil.VersionCompare(restA, restB)
+}
+
+// splitDebianEpoch splits the epoch from a Debian version, 0 if it has none
+func splitDebianEpoch(version string) (int, string, error) {
+	epoch, rest, found := strings.Cut(version, ":")
+	if !found {
+		return 0, version, nil
+	}
+	n, err := strconv.Atoi(epoch)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid epoch in version %q", version)
+	}
+	return n, rest, nil
+}
+
+// entriesSince returns the changelog entries more recent than the given
+// version, stopping at the first entry that is not. The version of a binary
+// rebuild, such as 1.0-1build1 or 1.0-1+b1, has no entry of its own in the
+// changelog of the source. All entries are returned if the versions cannot
+// be compared and the version cannot be found.
+func entriesSince(entries []changelogEntry, version string) []changelogEntry {
+	for i, entry := range entries {
+		cmp, err := compareDebianVersions(entry.version, version)
+		if err != nil {
+			if entry.version == version {
+				return entries[:i]
+			}
+			continue
+		}
+		if cmp <= 0 {
+			return entries[:i]
+		}
+	}
+	return entries
+}
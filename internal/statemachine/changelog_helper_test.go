@@ -0,0 +1,164 @@
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+func Test_resolveRootfsPath(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	rootfs := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(rootfs, "usr", "share", "doc", "foo"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(rootfs, "usr", "share", "doc", "foo", "changelog.Debian.gz"), []byte{}, 0600)
+	asserter.AssertErrNil(err, true)
+	err = os.Symlink("foo", filepath.Join(rootfs, "usr", "share", "doc", "relative"))
+	asserter.AssertErrNil(err, true)
+	err = os.Symlink("/usr/share/doc/foo", filepath.Join(rootfs, "usr", "share", "doc", "absolute"))
+	asserter.AssertErrNil(err, true)
+	err = os.Symlink("../../../../../usr/share/doc/foo", filepath.Join(rootfs, "usr", "share", "doc", "escaping"))
+	asserter.AssertErrNil(err, true)
+	err = os.Symlink("loop", filepath.Join(rootfs, "usr", "share", "doc", "loop"))
+	asserter.AssertErrNil(err, true)
+
+	tests := []struct {
+		name          string
+		path          string
+		want          string
+		expectedError string
+	}{
+		{
+			name: "regular path",
+			path: "/usr/share/doc/foo/changelog.Debian.gz",
+			want: "/usr/share/doc/foo/changelog.Debian.gz",
+		},
+		{
+			name: "relative symlink",
+			path: "/usr/share/doc/relative/changelog.Debian.gz",
+			want: "/usr/share/doc/foo/changelog.Debian.gz",
+		},
+		{
+			name: "absolute symlink",
+			path: "/usr/share/doc/absolute/changelog.Debian.gz",
+			want: "/usr/share/doc/foo/changelog.Debian.gz",
+		},
+		{
+			name: "symlink escaping the rootfs",
+			path: "/usr/share/doc/escaping/changelog.Debian.gz",
+			want: "/usr/share/doc/foo/changelog.Debian.gz",
+		},
+		{
+			name:          "symlink loop",
+			path:          "/usr/share/doc/loop/changelog.Debian.gz",
+			expectedError: "too many levels of symbolic links",
+		},
+		{
+			name:          "missing file",
+			path:          "/usr/share/doc/bar/changelog.Debian.gz",
+			expectedError: "no such file or directory",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			got, err := resolveRootfsPath(rootfs, tc.path)
+			if len(tc.expectedError) > 0 {
+				asserter.AssertErrContains(err, tc.expectedError)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.want, strings.TrimPrefix(got, rootfs))
+		})
+	}
+}
+
+func Test_parseChangelog(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	changelog := `foo (1.1) noble; urgency=medium
+
+  * Second release.
+
+ -- Someone <someone@example.com>  Mon, 01 Jan 2024 00:00:00 +0000
+
+foo (1.0) jammy; urgency=medium
+
+  * Initial release.
+
+ -- Someone <someone@example.com>  Mon, 01 Jan 2022 00:00:00 +0000
+
+Old Changelog:
+
+`
+	entries, err := parseChangelog(strings.NewReader(changelog))
+	asserter.AssertErrNil(err, true)
+	if len(entries) != 2 {
+		t.Fatalf("Got %d entries, expected 2", len(entries))
+	}
+	asserter.AssertEqual("1.1", entries[0].version)
+	asserter.AssertEqual("1.0", entries[1].version)
+	asserter.AssertEqual("foo (1.0) jammy; urgency=medium\n\n  * Initial release.\n\n -- Someone <someone@example.com>  Mon, 01 Jan 2022 00:00:00 +0000\n", entries[1].text)
+	asserter.AssertEqual(0, len(entriesSince(entries, "1.1")))
+	asserter.AssertEqual(1, len(entriesSince(entries, "1.0")))
+	asserter.AssertEqual(2, len(entriesSince(entries, "0.9")))
+}
+
+func TestEntriesSince(t *testing.T) {
+	t.Parallel()
+	entries := []changelogEntry{
+		{version: "1:2.0-1"},
+		{version: "1.5-2"},
+		{version: "1.5-1"},
+		{version: "1.0~rc1-1"},
+	}
+	testCases := []struct {
+		name         string
+		version      string
+		wantVersions []string
+	}{
+		{"latest", "1:2.0-1", []string{}},
+		{"exact", "1.5-1", []string{"1:2.0-1", "1.5-2"}},
+		{"binary_rebuild", "1.5-1build1", []string{"1:2.0-1", "1.5-2"}},
+		{"binnmu", "1.5-2+b1", []string{"1:2.0-1"}},
+		{"tilde", "1.0~rc1-1", []string{"1:2.0-1", "1.5-2", "1.5-1"}},
+		{"older_than_all", "0.9-1", []string{"1:2.0-1", "1.5-2", "1.5-1", "1.0~rc1-1"}},
+		{"invalid_epoch", "a:1.5-1", []string{"1:2.0-1", "1.5-2", "1.5-1", "1.0~rc1-1"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			gotVersions := []string{}
+			for _, entry := range entriesSince(entries, tc.version) {
+				gotVersions = append(gotVersions, entry.version)
+			}
+			asserter.AssertEqual(tc.wantVersions, gotVersions)
+		})
+	}
+}
+
+func TestCompareDebianVersions(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0-1", "1.0-1", 0},
+		{"1.0-1", "1.0-1+b1", -1},
+		{"1.0-1build1", "1.0-1", 1},
+		{"1.0~rc1", "1.0", -1},
+		{"1:0.1", "2.0", 1},
+		{"2.0", "1:0.1", -1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.a+"_"+tc.b, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			got, err := compareDebianVersions(tc.a, tc.b)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.want, got)
+		})
+	}
+}
@@ -2,7 +2,6 @@ package statemachine
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
 	"strings"
 
@@ -11,6 +10,7 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/canonical/ubuntu-image/internal/commands"
+	"github.com/canonical/ubuntu-image/internal/helper"
 	"github.com/canonical/ubuntu-image/internal/imagedefinition"
 )
 
@@ -19,6 +19,11 @@ var rootfsSeedStates = []stateFunc{
 	createChrootState,
 }
 
+var rootfsTasksStates = []stateFunc{
+	createChrootState,
+	buildRootfsFromTasksState,
+}
+
 var imageCreationStates = []stateFunc{
 	calculateRootfsSizeState,
 	populateBootfsContentsState,
@@ -30,10 +35,11 @@ type ClassicStateMachine struct {
 	StateMachine
 	ImageDef imagedefinition.ImageDefinition
 	Args     commands.ClassicArgs
+	Opts     commands.ClassicOpts
 }
 
 // Setup assigns variables and calls other functions that must be executed before Run()
-func (classicStateMachine *ClassicStateMachine) Setup() error {
+func (classicStateMachine *ClassicStateMachine) Setup() (err error) {
 	// set the parent pointer of the embedded struct
 	classicStateMachine.parent = classicStateMachine
 
@@ -61,6 +67,21 @@ func (classicStateMachine *ClassicStateMachine) Setup() error {
 		return err
 	}
 
+	// record the inputs of the build to detect their changes on --resume
+	if err := classicStateMachine.hashInputs(); err != nil {
+		return err
+	}
+
+	// keep concurrent builds from using the same workdir
+	if err := classicStateMachine.lockWorkDir(); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = classicStateMachine.unlockWorkDir()
+		}
+	}()
+
 	// if --resume was passed, figure out where to start
 	if err := classicStateMachine.readMetadata(metadataStateFile); err != nil {
 		return err
@@ -92,13 +113,30 @@ func (classicStateMachine *ClassicStateMachine) SetSeries() error {
 func (stateMachine *StateMachine) parseImageDefinition() error {
 	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
 
-	imageDefinition, err := readImageDefinition(classicStateMachine.Args.ImageDefinition)
+	overrides, err := parseVariableOverrides(classicStateMachine.Opts.Variables)
+	if err != nil {
+		return err
+	}
+	imageDefinition, sources, err := readImageDefinition(classicStateMachine.Args.ImageDefinition, overrides)
 	if err != nil {
 		return err
 	}
+	stateMachine.extendedImageDefs = sources.files[:len(sources.files)-1]
+	stateMachine.Variables = redactVariables(sources.variables, classicStateMachine.Opts.RedactedVars)
+
+	// the lint rules tell the keys not set from the ones set to their default value
+	if err := stateMachine.reportLintFindings(lintImageDefinition(imageDefinition, sources.files)); err != nil {
+		return err
+	}
 
-	if imageDefinition.Rootfs != nil && imageDefinition.Rootfs.SourcesListDeb822 == nil {
-		fmt.Print("WARNING: rootfs.sources-list-deb822 was not set. Please explicitly set the format desired for sources list in your image definition.\n")
+	// class defaults are applied first so the sections they create
+	// also get their default values
+	classDefaults := applyClassDefaults(imageDefinition)
+	if len(classDefaults) > 0 && (stateMachine.commonFlags.DryRun || stateMachine.commonFlags.Debug) {
+		fmt.Printf("Defaults applied for class %s:\n", imageDefinition.Class)
+		for _, classDefault := range classDefaults {
+			fmt.Printf("  - %s\n", classDefault)
+		}
 	}
 
 	// populate the default values for imageDefinition if they were not provided in
@@ -107,10 +145,10 @@ func (stateMachine *StateMachine) parseImageDefinition() error {
 		return err
 	}
 
-	if imageDefinition.Rootfs != nil && *imageDefinition.Rootfs.SourcesListDeb822 {
-		fmt.Print("WARNING: rootfs.sources-list-deb822 is set to true. The DEB822 format will be used to manage sources list. Please make sure you are not building an image older than noble.\n")
-	} else {
-		fmt.Print("WARNING: rootfs.sources-list-deb822 is set to false. The deprecated format will be used to manage sources list. Please if possible adopt the new format.\n")
+	if classicStateMachine.Opts.PrintDef {
+		if err := printImageDefinition(imageDefinition); err != nil {
+			return err
+		}
 	}
 
 	err = validateImageDefinition(imageDefinition)
@@ -123,18 +161,87 @@ func (stateMachine *StateMachine) parseImageDefinition() error {
 	return nil
 }
 
-func readImageDefinition(imageDefPath string) (*imagedefinition.ImageDefinition, error) {
-	imageDefinition := &imagedefinition.ImageDefinition{}
-	imageFile, err := os.Open(imageDefPath)
+// cloudClassPackages are the packages installed by default in cloud images.
+// cloud-guest-utils provides growpart, used by cloud-init to grow the
+// root partition to the size of the disk on first boot.
+var cloudClassPackages = []string{"cloud-init", "cloud-guest-utils"}
+
+// applyClassDefaults sets the customizations implied by the class of the
+// image when they are not given in the image definition and returns a
+// description of the defaults that were applied, if any.
+// Cloud images are configured by cloud-init at first boot. The states
+// specific to each class, such as disabling console-conf in cloud images,
+// are added by calculateStates.
+func applyClassDefaults(imageDefinition *imagedefinition.ImageDefinition) []string {
+	if imageDefinition.Class != "cloud" {
+		return nil
+	}
+
+	var applied []string
+	if imageDefinition.Customization == nil {
+		imageDefinition.Customization = &imagedefinition.Customization{}
+	}
+	customization := imageDefinition.Customization
+
+	if customization.CloudInit == nil {
+		customization.CloudInit = &imagedefinition.CloudInit{}
+		applied = append(applied, "cloud-init NoCloud datasource")
+	}
+
+	for _, packageName := range cloudClassPackages {
+		found := false
+		for _, extraPackage := range customization.ExtraPackages {
+			if extraPackage.PackageName == packageName {
+				found = true
+			}
+		}
+		if !found {
+			customization.ExtraPackages = append(customization.ExtraPackages,
+				&imagedefinition.Package{PackageName: packageName})
+			applied = append(applied, "extra package "+packageName)
+		}
+	}
+
+	return applied
+}
+
+// imageDefinitionSources describes what an image definition was resolved from
+type imageDefinitionSources struct {
+	files     []string          // the files read, the extended image definitions first
+	variables map[string]string // the variables substituted, with their values
+}
+
+// readImageDefinition reads the image definition at imageDefPath merged onto
+// the image definitions it extends, and substitutes its variables
+func readImageDefinition(imageDefPath string, overrides map[string]string) (*imagedefinition.ImageDefinition, *imageDefinitionSources, error) {
+	resolved, treeFiles, err := readImageDefinitionTree(imageDefPath, nil)
 	if err != nil {
-		return nil, fmt.Errorf("Error opening image definition file: %s", err.Error())
+		return nil, nil, err
 	}
-	defer imageFile.Close()
-	if err := yaml.NewDecoder(imageFile).Decode(imageDefinition); err != nil {
-		return nil, err
+	sources := &imageDefinitionSources{}
+	// an image definition may be extended several times
+	for _, file := range treeFiles {
+		if !helper.SliceHasElement(sources.files, file) {
+			sources.files = append(sources.files, file)
+		}
+	}
+
+	resolved, sources.variables, err = substituteVariables(resolved, overrides)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error substituting the variables of the image definition: %w", err)
 	}
 
-	return imageDefinition, nil
+	// decode the merged image definition as a single file
+	content, err := yaml.Marshal(resolved)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error marshalling the image definition: %s", err.Error())
+	}
+	imageDefinition := &imagedefinition.ImageDefinition{}
+	if err := yaml.Unmarshal(content, imageDefinition); err != nil {
+		return nil, nil, err
+	}
+
+	return imageDefinition, sources, nil
 }
 
 // validateImageDefinition validates the given imageDefinition
@@ -145,6 +252,21 @@ func readImageDefinition(imageDefPath string) (*imagedefinition.ImageDefinition,
 // 2. Load the created schema and parsed yaml into types defined by gojsonschema
 // 3. Use the gojsonschema library to validate the parsed YAML against the schema
 func validateImageDefinition(imageDefinition *imagedefinition.ImageDefinition) error {
+	result, err := checkImageDefinition(imageDefinition)
+	if err != nil {
+		return err
+	}
+
+	if !result.Valid() {
+		return fmt.Errorf("Schema validation failed: %s", result.Errors())
+	}
+
+	return nil
+}
+
+// checkImageDefinition validates the given imageDefinition against the
+// schema and the custom rules, and returns the result with every error found
+func checkImageDefinition(imageDefinition *imagedefinition.ImageDefinition) (*gojsonschema.Result, error) {
 	var jsonReflector jsonschema.Reflector
 
 	// 1. parse the ImageDefinition struct into a schema using the jsonschema tags
@@ -157,32 +279,30 @@ func validateImageDefinition(imageDefinition *imagedefinition.ImageDefinition) e
 	// 3. validate the parsed data against the schema
 	result, err := gojsonschemaValidate(schemaLoader, imageDefinitionLoader)
 	if err != nil {
-		return fmt.Errorf("Schema validation returned an error: %s", err.Error())
+		return nil, fmt.Errorf("Schema validation returned an error: %s", err.Error())
 	}
 
 	err = validateGadget(imageDefinition, result)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = validateCustomization(imageDefinition, result)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	validateInstaller(imageDefinition, result)
+
 	// TODO: I've created a PR upstream in xeipuuv/gojsonschema
 	// https://github.com/xeipuuv/gojsonschema/pull/352
 	// if it gets merged this can be removed
 	err = helperCheckEmptyFields(imageDefinition, result, schema)
 	if err != nil {
-		return err
-	}
-
-	if !result.Valid() {
-		return fmt.Errorf("Schema validation failed: %s", result.Errors())
+		return nil, err
 	}
 
-	return nil
+	return result, nil
 }
 
 // validateGadget validates the Gadget section of the image definition
@@ -192,8 +312,9 @@ func validateGadget(imageDefinition *imagedefinition.ImageDefinition, result *go
 		if imageDefinition.Gadget.GadgetType != "prebuilt" && imageDefinition.Gadget.GadgetURL == "" {
 			jsonContext := gojsonschema.NewJsonContext("gadget_validation", nil)
 			errDetail := gojsonschema.ErrorDetails{
-				"key":   "gadget:type",
-				"value": imageDefinition.Gadget.GadgetType,
+				"key":                      "gadget:type",
+				"value":                    imageDefinition.Gadget.GadgetType,
+				helper.ErrorLocationDetail: "gadget:type",
 			}
 			result.AddError(
 				imagedefinition.NewMissingURLError(
@@ -212,8 +333,9 @@ func validateGadget(imageDefinition *imagedefinition.ImageDefinition, result *go
 		if diskUsed != "" {
 			jsonContext := gojsonschema.NewJsonContext("image_without_gadget", nil)
 			errDetail := gojsonschema.ErrorDetails{
-				"key1": diskUsed,
-				"key2": "gadget:",
+				"key1":                     diskUsed,
+				"key2":                     "gadget:",
+				helper.ErrorLocationDetail: "artifacts:" + diskUsed,
 			}
 			result.AddError(
 				imagedefinition.NewDependentKeyError(
@@ -246,13 +368,103 @@ func validateCustomization(imageDefinition *imagedefinition.ImageDefinition, res
 	return nil
 }
 
+// validateInstaller validates the installer specific parts of the image definition
+func validateInstaller(imageDefinition *imagedefinition.ImageDefinition, result *gojsonschema.Result) {
+	var installer *imagedefinition.Installer
+	if imageDefinition.Customization != nil {
+		installer = imageDefinition.Customization.Installer
+	}
+
+	jsonContext := gojsonschema.NewJsonContext("installer_validation", nil)
+	addDependentKeyError := func(key1 string, key2 string, location string) {
+		errDetail := gojsonschema.ErrorDetails{
+			"key1":                     key1,
+			"key2":                     key2,
+			helper.ErrorLocationDetail: location,
+		}
+		result.AddError(
+			imagedefinition.NewDependentKeyError(
+				gojsonschema.NewJsonContext("dependentKey", jsonContext),
+				52,
+				errDetail,
+			),
+			errDetail,
+		)
+	}
+
+	if imageDefinition.Class != "installer" {
+		if installer != nil {
+			addDependentKeyError("customization:installer", "class: installer", "customization:installer")
+		}
+		return
+	}
+
+	if installer == nil || len(installer.Layers) == 0 {
+		addDependentKeyError("class: installer", "customization:installer:layers", "class")
+		return
+	}
+
+	layers, err := parseInstallerLayers(installer.Layers)
+	if err != nil {
+		errDetail := gojsonschema.ErrorDetails{
+			"reason":                   err.Error(),
+			helper.ErrorLocationDetail: "customization:installer:layers",
+		}
+		result.AddError(
+			imagedefinition.NewInvalidLayerError(
+				gojsonschema.NewJsonContext("invalidLayer", jsonContext),
+				52,
+				errDetail,
+			),
+			errDetail,
+		)
+		return
+	}
+
+	// layers other than the base one are built from seeds
+	if len(layers) > 1 && (imageDefinition.Rootfs == nil || imageDefinition.Rootfs.Seed == nil) {
+		addDependentKeyError("customization:installer:layers", "rootfs:seed", "customization:installer:layers")
+	}
+
+	// the installer media is only written as an iso
+	if imageDefinition.Artifacts == nil || imageDefinition.Artifacts.Iso == nil || len(*imageDefinition.Artifacts.Iso) == 0 {
+		addDependentKeyError("class: installer", "artifacts:iso", "class")
+	}
+
+	// preseed files are copied to the same directory of the installer media
+	preseedNames := make(map[string]string)
+	for i, preseed := range installer.Preseeds {
+		name := filepath.Base(preseed)
+		first, found := preseedNames[name]
+		if !found {
+			preseedNames[name] = preseed
+			continue
+		}
+		errDetail := gojsonschema.ErrorDetails{
+			"first":                    first,
+			"second":                   preseed,
+			"name":                     name,
+			helper.ErrorLocationDetail: fmt.Sprintf("customization:installer:preseeds:%d", i),
+		}
+		result.AddError(
+			imagedefinition.NewDuplicatePreseedError(
+				gojsonschema.NewJsonContext("duplicatePreseed", jsonContext),
+				52,
+				errDetail,
+			),
+			errDetail,
+		)
+	}
+}
+
 // validateExtraPPAs validates the Customization.ExtraPPAs section of the image definition
 func validateExtraPPAs(imageDefinition *imagedefinition.ImageDefinition, result *gojsonschema.Result) {
-	for _, p := range imageDefinition.Customization.ExtraPPAs {
+	for i, p := range imageDefinition.Customization.ExtraPPAs {
 		if p.Auth != "" && p.Fingerprint == "" {
 			jsonContext := gojsonschema.NewJsonContext("ppa_validation", nil)
 			errDetail := gojsonschema.ErrorDetails{
-				"ppaName": p.Name,
+				"ppaName":                  p.Name,
+				helper.ErrorLocationDetail: fmt.Sprintf("customization:extra-ppas:%d", i),
 			}
 			result.AddError(
 				imagedefinition.NewInvalidPPAError(
@@ -272,8 +484,9 @@ func validateManualMakeDirs(imageDefinition *imagedefinition.ImageDefinition, re
 	if imageDefinition.Customization.Manual.MakeDirs == nil {
 		return
 	}
-	for _, mkdir := range imageDefinition.Customization.Manual.MakeDirs {
-		validateAbsolutePath(mkdir.Path, "customization:manual:mkdir:destination", result, jsonContext)
+	for i, mkdir := range imageDefinition.Customization.Manual.MakeDirs {
+		validateAbsolutePath(mkdir.Path, "customization:manual:mkdir:destination",
+			fmt.Sprintf("customization:manual:make-dirs:%d:path", i), result, jsonContext)
 	}
 }
 
@@ -282,8 +495,9 @@ func validateManualCopyFile(imageDefinition *imagedefinition.ImageDefinition, re
 	if imageDefinition.Customization.Manual.CopyFile == nil {
 		return
 	}
-	for _, copy := range imageDefinition.Customization.Manual.CopyFile {
-		validateAbsolutePath(copy.Dest, "customization:manual:copy-file:destination", result, jsonContext)
+	for i, copy := range imageDefinition.Customization.Manual.CopyFile {
+		validateAbsolutePath(copy.Dest, "customization:manual:copy-file:destination",
+			fmt.Sprintf("customization:manual:copy-file:%d:destination", i), result, jsonContext)
 	}
 }
 
@@ -292,19 +506,21 @@ func validateManualTouchFile(imageDefinition *imagedefinition.ImageDefinition, r
 	if imageDefinition.Customization.Manual.TouchFile == nil {
 		return
 	}
-	for _, touch := range imageDefinition.Customization.Manual.TouchFile {
-		validateAbsolutePath(touch.TouchPath, "customization:manual:touch-file:path", result, jsonContext)
+	for i, touch := range imageDefinition.Customization.Manual.TouchFile {
+		validateAbsolutePath(touch.TouchPath, "customization:manual:touch-file:path",
+			fmt.Sprintf("customization:manual:touch-file:%d:path", i), result, jsonContext)
 	}
 }
 
-// validateAbsolutePath validates the
-func validateAbsolutePath(path string, errorKey string, result *gojsonschema.Result, jsonContext *gojsonschema.JsonContext) {
+// validateAbsolutePath validates the path found at location is absolute
+func validateAbsolutePath(path string, errorKey string, location string, result *gojsonschema.Result, jsonContext *gojsonschema.JsonContext) {
 	// XXX: filepath.IsAbs() does returns true for paths like ../../../something
 	// and those are NOT absolute paths.
 	if !filepath.IsAbs(path) || strings.Contains(path, "/../") {
 		errDetail := gojsonschema.ErrorDetails{
-			"key":   errorKey,
-			"value": path,
+			"key":                      errorKey,
+			"value":                    path,
+			helper.ErrorLocationDetail: location,
 		}
 		result.AddError(
 			imagedefinition.NewPathNotAbsoluteError(
@@ -353,7 +569,7 @@ func (s *StateMachine) calculateStates() error {
 	} else if c.ImageDef.Rootfs.Seed != nil {
 		s.addRootfsFromSeedStates(&rootfsCreationStates)
 	} else {
-		rootfsCreationStates = append(rootfsCreationStates, buildRootfsFromTasksState)
+		s.addRootfsFromTasksStates(&rootfsCreationStates)
 	}
 
 	// Before customization, make sure we clean unwanted secrets/values that
@@ -376,6 +592,13 @@ func (s *StateMachine) calculateStates() error {
 		rootfsCreationStates = append(rootfsCreationStates, generateDiskInfoState)
 	}
 
+	if c.ImageDef.Class == "installer" {
+		rootfsCreationStates = append(rootfsCreationStates,
+			buildInstallerLayersState,
+			prepareInstallerMediaState,
+		)
+	}
+
 	s.addArtifactsStates(c, &rootfsCreationStates)
 
 	// Append the newly calculated states to the slice of funcs in the parent struct
@@ -404,6 +627,10 @@ func (s *StateMachine) addRootfsFromTarballStates(states *[]stateFunc) {
 	c := s.parent.(*ClassicStateMachine)
 
 	*states = append(*states, extractRootfsTarState)
+	// the tarball may come from an image whose first boot setup was disabled
+	if c.ImageDef.Class == "preinstalled" {
+		*states = append(*states, enableConsoleConfState)
+	}
 	if c.ImageDef.Customization == nil {
 		return
 	}
@@ -429,9 +656,19 @@ func (s *StateMachine) addRootfsFromTarballStates(states *[]stateFunc) {
 }
 
 func (s *StateMachine) addRootfsFromSeedStates(states *[]stateFunc) {
-	c := s.parent.(*ClassicStateMachine)
-
 	*states = append(*states, rootfsSeedStates...)
+	s.addPackagesAndSnapsStates(states)
+}
+
+func (s *StateMachine) addRootfsFromTasksStates(states *[]stateFunc) {
+	*states = append(*states, rootfsTasksStates...)
+	s.addPackagesAndSnapsStates(states)
+}
+
+// addPackagesAndSnapsStates adds the states installing packages and snaps
+// in a freshly bootstrapped chroot
+func (s *StateMachine) addPackagesAndSnapsStates(states *[]stateFunc) {
+	c := s.parent.(*ClassicStateMachine)
 
 	if c.ImageDef.Customization == nil {
 		*states = append(*states, installPackagesState)
@@ -456,7 +693,6 @@ func (s *StateMachine) addRootfsFromSeedStates(states *[]stateFunc) {
 
 // addCustomizationStates determines any customization that needs to run before the image
 // is created
-// TODO: installer image customization... eventually.
 func (s *StateMachine) addCustomizationStates(states *[]stateFunc) {
 	c := s.parent.(*ClassicStateMachine)
 
@@ -469,6 +705,9 @@ func (s *StateMachine) addCustomizationStates(states *[]stateFunc) {
 	if c.ImageDef.Customization.Manual != nil {
 		*states = append(*states, manualCustomizationState)
 	}
+	if c.ImageDef.Class == "cloud" {
+		*states = append(*states, disableConsoleConfState)
+	}
 }
 
 // addArtifactsStates adds the needed states to generates the artifacts
@@ -484,10 +723,18 @@ func (s *StateMachine) addArtifactsStates(c *ClassicStateMachine, states *[]stat
 		s.addQcow2States(states)
 	}
 
+	if c.ImageDef.Artifacts.Iso != nil {
+		*states = append(*states, makeIsoState)
+	}
+
 	if c.ImageDef.Artifacts.Manifest != nil {
 		*states = append(*states, generatePackageManifestState)
 	}
 
+	if c.ImageDef.Artifacts.Changelog != nil {
+		*states = append(*states, generateChangelogState)
+	}
+
 	if c.ImageDef.Artifacts.Filelist != nil {
 		*states = append(*states, generateFilelistState)
 	}
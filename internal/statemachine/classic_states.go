@@ -2,7 +2,6 @@ package statemachine
 
 import (
 	"bufio"
-	"context"
 	"fmt"
 	"io"
 	"os"
@@ -11,6 +10,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/snapcore/snapd/image"
@@ -19,7 +19,7 @@ import (
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/seed/seedwriter"
 	"github.com/snapcore/snapd/snap"
-	"github.com/snapcore/snapd/store"
+	"github.com/snapcore/snapd/store/tooling"
 
 	"github.com/canonical/ubuntu-image/internal/helper"
 	"github.com/canonical/ubuntu-image/internal/imagedefinition"
@@ -81,10 +81,11 @@ func (classicStateMachine *ClassicStateMachine) prepareGadgetDir(gadgetDir strin
 
 	switch classicStateMachine.ImageDef.Gadget.GadgetType {
 	case "git":
-		err := cloneGitRepo(classicStateMachine.ImageDef, gadgetDir)
+		commit, err := cloneGitRepo(classicStateMachine.ImageDef, gadgetDir)
 		if err != nil {
 			return fmt.Errorf("Error cloning gadget repository: \"%s\"", err.Error())
 		}
+		classicStateMachine.GadgetCommit = commit
 	case "directory":
 		gadgetTreePath := strings.TrimPrefix(classicStateMachine.ImageDef.Gadget.GadgetURL, "file://")
 		if !filepath.IsAbs(gadgetTreePath) {
@@ -171,8 +172,12 @@ func (stateMachine *StateMachine) createChroot() error {
 		return fmt.Errorf("Failed to create chroot directory %s : %s", stateMachine.tempDirs.chroot, err.Error())
 	}
 
+	// binaries of a foreign architecture are run in the chroot with qemu,
+	// which can only be copied in after the first stage of debootstrap
+	crossArch := isCrossArch(classicStateMachine.ImageDef.Architecture)
 	debootstrapCmd := generateDebootstrapCmd(classicStateMachine.ImageDef,
 		stateMachine.tempDirs.chroot,
+		crossArch,
 	)
 
 	debootstrapOutput := helper.SetCommandOutput(debootstrapCmd, classicStateMachine.commonFlags.Debug)
@@ -182,6 +187,22 @@ func (stateMachine *StateMachine) createChroot() error {
 			debootstrapCmd.String(), err.Error(), debootstrapOutput.String())
 	}
 
+	if crossArch {
+		err := copyQemuStatic(classicStateMachine.ImageDef.Architecture, stateMachine.tempDirs.chroot)
+		if err != nil {
+			return err
+		}
+
+		secondStageCmd := execCommand("chroot", stateMachine.tempDirs.chroot,
+			"/debootstrap/debootstrap", "--second-stage")
+		secondStageOutput := helper.SetCommandOutput(secondStageCmd, classicStateMachine.commonFlags.Debug)
+
+		if err := secondStageCmd.Run(); err != nil {
+			return fmt.Errorf("Error running debootstrap second stage command \"%s\". Error is \"%s\". Output is: \n%s",
+				secondStageCmd.String(), err.Error(), secondStageOutput.String())
+		}
+	}
+
 	err := stateMachine.fixHostname()
 	if err != nil {
 		return err
@@ -252,6 +273,14 @@ func (stateMachine *StateMachine) installPackages() error {
 
 	stateMachine.gatherPackages(&classicStateMachine.ImageDef)
 
+	return stateMachine.installPackagesInChroot(classicStateMachine.tempDirs.chroot, classicStateMachine.Packages)
+}
+
+// installPackagesInChroot installs the given packages in a chroot, with the
+// needed filesystems mounted and services prevented from starting
+func (stateMachine *StateMachine) installPackagesInChroot(chroot string, packages []string) error {
+	var err error
+
 	// setupCmds should be filled as a FIFO list
 	var setupCmds []*exec.Cmd
 
@@ -262,38 +291,38 @@ func (stateMachine *StateMachine) installPackages() error {
 
 	// Make sure we left the system as clean as possible if something has gone wrong
 	defer func() {
-		err = teardownMount(stateMachine.tempDirs.chroot, mountPoints, teardownCmds, err, stateMachine.commonFlags.Debug)
+		err = teardownMount(chroot, mountPoints, teardownCmds, err, stateMachine.commonFlags.Debug)
 	}()
 
 	// mount some necessary partitions in the chroot
 	mountPoints = append(mountPoints,
 		&mountPoint{
 			src:      "devtmpfs-build",
-			basePath: stateMachine.tempDirs.chroot,
+			basePath: chroot,
 			relpath:  "/dev",
 			typ:      "devtmpfs",
 		},
 		&mountPoint{
 			src:      "devpts-build",
-			basePath: stateMachine.tempDirs.chroot,
+			basePath: chroot,
 			relpath:  "/dev/pts",
 			typ:      "devpts",
 			opts:     []string{"nodev", "nosuid"},
 		},
 		&mountPoint{
 			src:      "proc-build",
-			basePath: stateMachine.tempDirs.chroot,
+			basePath: chroot,
 			relpath:  "/proc",
 			typ:      "proc",
 		},
 		&mountPoint{
 			src:      "sysfs-build",
-			basePath: stateMachine.tempDirs.chroot,
+			basePath: chroot,
 			relpath:  "/sys",
 			typ:      "sysfs",
 		},
 		&mountPoint{
-			basePath: stateMachine.tempDirs.chroot,
+			basePath: chroot,
 			relpath:  "/run",
 			bind:     true,
 		},
@@ -310,15 +339,15 @@ func (stateMachine *StateMachine) installPackages() error {
 		execCommand("udevadm", "settle"),
 	}, teardownCmds...)
 
-	policyRcDPath := filepath.Join(classicStateMachine.tempDirs.chroot, "usr", "sbin", "policy-rc.d")
+	policyRcDPath := filepath.Join(chroot, "usr", "sbin", "policy-rc.d")
 
 	if osutil.FileExists(policyRcDPath) {
-		divertCmd, undivertCmd := divertPolicyRcD(stateMachine.tempDirs.chroot)
+		divertCmd, undivertCmd := divertPolicyRcD(chroot)
 		setupCmds = append(setupCmds, divertCmd)
 		teardownCmds = append([]*exec.Cmd{undivertCmd}, teardownCmds...)
 	}
 
-	err = helper.RunCmds(setupCmds, classicStateMachine.commonFlags.Debug)
+	err = helper.RunCmds(setupCmds, stateMachine.commonFlags.Debug)
 	if err != nil {
 		return err
 	}
@@ -332,7 +361,7 @@ func (stateMachine *StateMachine) installPackages() error {
 		err = unsetDenyingPolicyRcD(err)
 	}()
 
-	restoreStartStopDaemon, err := backupReplaceStartStopDaemon(classicStateMachine.tempDirs.chroot)
+	restoreStartStopDaemon, err := backupReplaceStartStopDaemon(chroot)
 	if err != nil {
 		return err
 	}
@@ -341,10 +370,10 @@ func (stateMachine *StateMachine) installPackages() error {
 		err = restoreStartStopDaemon(err)
 	}()
 
-	initctlPath := filepath.Join(classicStateMachine.tempDirs.chroot, "sbin", "initctl")
+	initctlPath := filepath.Join(chroot, "sbin", "initctl")
 
 	if osutil.FileExists(initctlPath) {
-		restoreInitctl, err := backupReplaceInitctl(classicStateMachine.tempDirs.chroot)
+		restoreInitctl, err := backupReplaceInitctl(chroot)
 		if err != nil {
 			return err
 		}
@@ -354,9 +383,9 @@ func (stateMachine *StateMachine) installPackages() error {
 		}()
 	}
 
-	installPackagesCmds := generateAptCmds(stateMachine.tempDirs.chroot, classicStateMachine.Packages)
+	installPackagesCmds := generateAptCmds(chroot, packages)
 
-	err = helper.RunCmds(installPackagesCmds, classicStateMachine.commonFlags.Debug)
+	err = helper.RunCmds(installPackagesCmds, stateMachine.commonFlags.Debug)
 	if err != nil {
 		return err
 	}
@@ -430,9 +459,14 @@ func (stateMachine *StateMachine) verifyArtifactNames() error {
 		if err != nil {
 			return err
 		}
+		err = stateMachine.prepareIsoArtifactsMultipleVolumes(classicStateMachine.ImageDef.Artifacts)
+		if err != nil {
+			return err
+		}
 	} else {
 		stateMachine.prepareImgArtifactOneVolume(classicStateMachine.ImageDef.Artifacts)
 		stateMachine.prepareQcow2ArtifactOneVolume(classicStateMachine.ImageDef.Artifacts)
+		stateMachine.prepareIsoArtifactOneVolume(classicStateMachine.ImageDef.Artifacts)
 	}
 	return nil
 }
@@ -531,11 +565,56 @@ func (stateMachine *StateMachine) prepareQcow2ArtifactOneVolume(artifacts *image
 	}
 }
 
+// .iso artifacts are built from the rootfs and the content of the
+// volumes, so they do not need an entry in the VolumeNames map. We only
+// make sure the volume to use is known.
+func (stateMachine *StateMachine) prepareIsoArtifactsMultipleVolumes(artifacts *imagedefinition.Artifact) error {
+	if artifacts.Iso == nil {
+		return nil
+	}
+	for _, iso := range *artifacts.Iso {
+		if iso.IsoVolume == "" {
+			return fmt.Errorf("Volume names must be specified for each image when using a gadget with more than one volume")
+		}
+		if _, found := stateMachine.GadgetInfo.Volumes[iso.IsoVolume]; !found {
+			return fmt.Errorf("volume %s of iso artifact %s is not defined in the gadget", iso.IsoVolume, iso.IsoName)
+		}
+	}
+	return nil
+}
+
+func (stateMachine *StateMachine) prepareIsoArtifactOneVolume(artifacts *imagedefinition.Artifact) {
+	if artifacts.Iso == nil {
+		return
+	}
+	iso := (*artifacts.Iso)[0]
+	if iso.IsoVolume == "" {
+		// there is only one volume, so get it from the map
+		iso.IsoVolume = reflect.ValueOf(stateMachine.GadgetInfo.Volumes).MapKeys()[0].String()
+		(*artifacts.Iso)[0] = iso
+	}
+}
+
 var buildRootfsFromTasksState = stateFunc{"build_rootfs_from_tasks", (*StateMachine).buildRootfsFromTasks}
 
-// Build a rootfs from a list of archive tasks
+// archiveTaskRegex matches valid archive task names, which follow the
+// same rules as Debian package names
+var archiveTaskRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+$`)
+
+// Build a rootfs from a list of archive tasks.
+// The tasks are resolved by apt using the "task^" syntax when the
+// packages are installed in the chroot, so we only have to add them to the
+// list of packages to install.
 func (stateMachine *StateMachine) buildRootfsFromTasks() error {
-	// currently a no-op pending implementation of the classic image redesign
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	for _, task := range classicStateMachine.ImageDef.Rootfs.ArchiveTasks {
+		if !archiveTaskRegex.MatchString(task) {
+			return fmt.Errorf("Error building rootfs from archive tasks: invalid task name \"%s\"", task)
+		}
+		classicStateMachine.Packages = append(classicStateMachine.Packages, task+"^")
+	}
+
 	return nil
 }
 
@@ -550,12 +629,14 @@ func (stateMachine *StateMachine) extractRootfsTar() error {
 		return fmt.Errorf("Failed to create chroot directory: %s", err.Error())
 	}
 
-	// convert the URL to a file path
-	// no need to check error here as the validity of the URL
-	// has been confirmed by the schema validation
-	tarPath := strings.TrimPrefix(classicStateMachine.ImageDef.Rootfs.Tarball.TarballURL, "file://")
-	if !filepath.IsAbs(tarPath) {
-		tarPath = filepath.Join(stateMachine.ConfDefPath, tarPath)
+	tarball := classicStateMachine.ImageDef.Rootfs.Tarball
+	if isRemoteURL(tarball.TarballURL) && tarball.SHA256sum == "" {
+		fmt.Printf("WARNING: no SHA256 sum was given for %s, it will be downloaded "+
+			"again by every build\n", tarball.TarballURL)
+	}
+	tarPath, err := classicStateMachine.fetchTarballFile(tarball.TarballURL, tarball.SHA256sum)
+	if err != nil {
+		return err
 	}
 
 	// if the sha256 sum of the tarball is provided, make sure it matches
@@ -571,8 +652,93 @@ func (stateMachine *StateMachine) extractRootfsTar() error {
 		}
 	}
 
+	// if a gpg signature of the tarball is provided, make sure it is valid
+	err = classicStateMachine.verifyRootfsTarSignature(tarPath)
+	if err != nil {
+		return err
+	}
+
 	// now extract the archive
-	return helper.ExtractTarArchive(tarPath, stateMachine.tempDirs.chroot, stateMachine.commonFlags.Debug)
+	err = helper.ExtractTarArchive(tarPath, stateMachine.tempDirs.chroot, stateMachine.commonFlags.Debug)
+	if err != nil {
+		return err
+	}
+
+	// packages may be installed in a rootfs of a foreign architecture
+	if isCrossArch(classicStateMachine.ImageDef.Architecture) {
+		return copyQemuStatic(classicStateMachine.ImageDef.Architecture, stateMachine.tempDirs.chroot)
+	}
+	return nil
+}
+
+// fetchTarballFile returns the local path of a file referenced by the
+// tarball section of the image definition. Files at http(s) URLs are
+// downloaded to the cache directory, other URLs are converted to paths.
+func (classicStateMachine *ClassicStateMachine) fetchTarballFile(url string, sha256sum string) (string, error) {
+	if isRemoteURL(url) {
+		cacheDir, err := classicStateMachine.downloadCacheDir()
+		if err != nil {
+			return "", err
+		}
+		return fetchToCache(url, sha256sum, cacheDir)
+	}
+
+	// convert the URL to a file path
+	// no need to check error here as the validity of the URL
+	// has been confirmed by the schema validation
+	filePath := strings.TrimPrefix(url, "file://")
+	if !filepath.IsAbs(filePath) {
+		filePath = filepath.Join(classicStateMachine.ConfDefPath, filePath)
+	}
+	return filePath, nil
+}
+
+// verifyRootfsTarSignature verifies the rootfs tarball against its detached
+// gpg signature. The keyring given on the command line takes precedence
+// over the one set in the image definition.
+func (classicStateMachine *ClassicStateMachine) verifyRootfsTarSignature(tarPath string) error {
+	tarball := classicStateMachine.ImageDef.Rootfs.Tarball
+
+	keyringPath := classicStateMachine.Opts.TarballKeyring
+	if keyringPath == "" && tarball.Keyring != "" {
+		keyringPath = tarball.Keyring
+		if !filepath.IsAbs(keyringPath) {
+			keyringPath = filepath.Join(classicStateMachine.ConfDefPath, keyringPath)
+		}
+	}
+
+	if tarball.GPG == "" {
+		if keyringPath != "" {
+			return fmt.Errorf("A keyring was given to verify the rootfs tarball but " +
+				"no gpg signature is specified in the image definition")
+		}
+		return nil
+	}
+	if keyringPath == "" {
+		return fmt.Errorf("A keyring must be given in the image definition or with " +
+			"--tarball-keyring to verify the gpg signature of the rootfs tarball")
+	}
+
+	// gpgv looks for relative keyrings in its home directory
+	keyringPath, err := filepath.Abs(keyringPath)
+	if err != nil {
+		return fmt.Errorf("Error resolving the path of the keyring: %s", err.Error())
+	}
+
+	sigPath, err := classicStateMachine.fetchTarballFile(tarball.GPG, "")
+	if err != nil {
+		return err
+	}
+
+	gpgvCmd := execCommand("gpgv", "--keyring", keyringPath, sigPath, tarPath)
+	gpgvOutput := helper.SetCommandOutput(gpgvCmd, classicStateMachine.commonFlags.Debug)
+	err = gpgvCmd.Run()
+	if err != nil {
+		return fmt.Errorf("Error verifying the gpg signature \"%s\" of rootfs tarball \"%s\" "+
+			"with keyring \"%s\". Error is \"%s\". Full output below:\n%s",
+			sigPath, tarPath, keyringPath, err.Error(), gpgvOutput.String())
+	}
+	return nil
 }
 
 var germinateState = stateFunc{"germinate", (*StateMachine).germinate}
@@ -720,6 +886,38 @@ func (stateMachine *StateMachine) customizeCloudInit() error {
 	return err
 }
 
+var disableConsoleConfState = stateFunc{"disable_console_conf", (*StateMachine).disableConsoleConf}
+
+// disableConsoleConf prevents console-conf from running at first boot, if
+// it is installed, the same way snap prepare-image does for core images
+func (stateMachine *StateMachine) disableConsoleConf() error {
+	consoleConfDir := filepath.Join(stateMachine.tempDirs.chroot, "var", "lib", "console-conf")
+	err := osMkdirAll(consoleConfDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating console-conf directory: %s", err.Error())
+	}
+
+	err = osWriteFile(filepath.Join(consoleConfDir, "complete"),
+		[]byte("console-conf has been disabled by image customization\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Error disabling console-conf: %s", err.Error())
+	}
+	return nil
+}
+
+var enableConsoleConfState = stateFunc{"enable_console_conf", (*StateMachine).enableConsoleConf}
+
+// enableConsoleConf makes console-conf run at first boot again if it was
+// disabled, so preinstalled images keep their first boot setup
+func (stateMachine *StateMachine) enableConsoleConf() error {
+	completePath := filepath.Join(stateMachine.tempDirs.chroot, "var", "lib", "console-conf", "complete")
+	err := osRemove(completePath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error enabling console-conf: %s", err.Error())
+	}
+	return nil
+}
+
 var customizeFstabState = stateFunc{"customize_fstab", (*StateMachine).customizeFstab}
 
 // Customize /etc/fstab based on values in the image definition
@@ -827,7 +1025,15 @@ func (stateMachine *StateMachine) prepareClassicImage() error {
 		return err
 	}
 
-	err = ensureSnapBasesInstalled(imageOpts)
+	setModelFile(imageOpts, classicStateMachine.ImageDef.ModelAssertion, stateMachine.ConfDefPath)
+
+	storeID, err := modelStore(imageOpts.ModelFile)
+	if err != nil {
+		return err
+	}
+	authFile := classicStateMachine.Opts.StoreAuth[storeName(storeID)]
+
+	err = ensureSnapBasesInstalled(imageOpts, storeID, classicStateMachine.ImageDef.Architecture, authFile)
 	if err != nil {
 		return err
 	}
@@ -837,7 +1043,12 @@ func (stateMachine *StateMachine) prepareClassicImage() error {
 		return err
 	}
 
-	setModelFile(imageOpts, classicStateMachine.ImageDef.ModelAssertion, stateMachine.ConfDefPath)
+	err = fetchStoreSnaps(imageOpts, &classicStateMachine.ImageDef, storeID,
+		classicStateMachine.ImageDef.Architecture, classicStateMachine.Opts.StoreAuth,
+		filepath.Join(classicStateMachine.tempDirs.scratch, "snaps"))
+	if err != nil {
+		return err
+	}
 
 	imageOpts.Classic = true
 	imageOpts.Architecture = classicStateMachine.ImageDef.Architecture
@@ -855,11 +1066,19 @@ func (stateMachine *StateMachine) prepareClassicImage() error {
 		}()
 	}
 
-	if err := imagePrepare(imageOpts); err != nil {
+	// image.Prepare reads the credentials of the store of the model
+	// assertion from the environment
+	restoreEnv, err := setTemporaryEnv(storeAuthEnv(authFile))
+	if err != nil {
+		return err
+	}
+	err = imagePrepare(imageOpts)
+	restoreErr := restoreEnv()
+	if err != nil {
 		return fmt.Errorf("Error preparing image: %s", err.Error())
 	}
 
-	return nil
+	return restoreErr
 }
 
 // resetPreseeding checks if the rootfs is already preseeded and reset if necessary.
@@ -907,19 +1126,29 @@ func resetPreseeding(imageOpts *image.Options, chroot string, debug, verbose boo
 // ensureSnapBasesInstalled iterates through the list of snaps and ensure that all
 // of their bases are also set to be installed. Note we only do this for snaps that
 // are seeded. Users are expected to specify all base and content provider snaps
-// in the image definition.
-func ensureSnapBasesInstalled(imageOpts *image.Options) error {
-	snapStore := store.New(nil, nil)
-	snapContext := context.Background()
+// in the image definition. The snaps are looked up in the store image.Prepare
+// seeds them from, the one of the model assertion.
+func ensureSnapBasesInstalled(imageOpts *image.Options, storeID string, arch string, authFile string) error {
+	if len(imageOpts.Snaps) == 0 {
+		return nil
+	}
+	toolingStore, err := newToolingStore(storeID, arch, authFile)
+	if err != nil {
+		return fmt.Errorf("Error connecting to store \"%s\": %s", storeName(storeID), err.Error())
+	}
 	for _, seededSnap := range imageOpts.Snaps {
-		snapSpec := store.SnapSpec{Name: seededSnap}
-		snapInfo, err := snapStore.SnapInfo(snapContext, snapSpec, nil)
+		// only the information of the snap is fetched when no component is downloaded
+		snapInfo, err := toolingStore.DownloadSnap(seededSnap, nil, tooling.DownloadSnapOptions{
+			Channel:        imageOpts.SnapChannels[seededSnap],
+			OnlyComponents: true,
+		})
 		if err != nil {
 			return fmt.Errorf("Error getting info for snap %s: \"%s\"",
 				seededSnap, err.Error())
 		}
-		if snapInfo.Base != "" && !helper.SliceHasElement(imageOpts.Snaps, snapInfo.Base) {
-			imageOpts.Snaps = append(imageOpts.Snaps, snapInfo.Base)
+		base := snapInfo.Info.Base
+		if base != "" && !helper.SliceHasElement(imageOpts.Snaps, base) {
+			imageOpts.Snaps = append(imageOpts.Snaps, base)
 		}
 	}
 	return nil
@@ -1062,6 +1291,15 @@ func (stateMachine *StateMachine) populateClassicRootfsContents() error {
 		return fmt.Errorf("Error restoring /etc/resolv.conf in the chroot: \"%s\"", err.Error())
 	}
 
+	// the emulator used to build a rootfs of a foreign architecture
+	// must not end up in the image
+	if isCrossArch(classicStateMachine.ImageDef.Architecture) {
+		err = removeQemuStatic(classicStateMachine.ImageDef.Architecture, stateMachine.tempDirs.chroot)
+		if err != nil {
+			return err
+		}
+	}
+
 	files, err := osReadDir(stateMachine.tempDirs.chroot)
 	if err != nil {
 		return fmt.Errorf("Error reading chroot dir: %s", err.Error())
@@ -1231,6 +1469,115 @@ func (stateMachine *StateMachine) setDefaultLocale() error {
 	return nil
 }
 
+var buildInstallerLayersState = stateFunc{"build_installer_layers", (*StateMachine).buildInstallerLayers}
+
+// buildInstallerLayers builds the layers of an installer image and
+// creates a squashfs image for each of them
+func (stateMachine *StateMachine) buildInstallerLayers() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	layers, err := parseInstallerLayers(classicStateMachine.ImageDef.Customization.Installer.Layers)
+	if err != nil {
+		return fmt.Errorf("Error parsing installer layers: %s", err.Error())
+	}
+
+	casperDir := filepath.Join(stateMachine.installerMediaDir(), "casper")
+	err = osMkdirAll(casperDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating casper directory: %s", err.Error())
+	}
+
+	germinateDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "germinate")
+
+	for i, layer := range layers {
+		// the kernel and initrd booted by the installer media are
+		// taken from the top-most layer
+		kernelDestDir := ""
+		if i == len(layers)-1 {
+			kernelDestDir = casperDir
+		}
+
+		contentDirs := stateMachine.layerContentDirs(layers, layer.name)
+		if layer.parent == "" {
+			if kernelDestDir != "" {
+				err = copyInstallerKernel(stateMachine.tempDirs.rootfs, kernelDestDir)
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			packages, err := packagesFromSeed(".seed", []string{layer.seed}, germinateDir)
+			if err != nil {
+				return err
+			}
+			err = stateMachine.buildInstallerLayer(stateMachine.installerLayerDir(layer.name),
+				contentDirs[1:], packages, kernelDestDir)
+			if err != nil {
+				return err
+			}
+		}
+
+		squashfsCmd := execCommand("mksquashfs",
+			contentDirs[0],
+			filepath.Join(casperDir, layer.name+".squashfs"),
+			"-noappend",
+			"-comp", "xz",
+		)
+		err = helper.RunCmd(squashfsCmd, stateMachine.commonFlags.Debug)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var prepareInstallerMediaState = stateFunc{"prepare_installer_media", (*StateMachine).prepareInstallerMedia}
+
+// prepareInstallerMedia adds the metadata describing the installable layers
+// and the preseed files to the installer media
+func (stateMachine *StateMachine) prepareInstallerMedia() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	installer := classicStateMachine.ImageDef.Customization.Installer
+
+	layers, err := parseInstallerLayers(installer.Layers)
+	if err != nil {
+		return fmt.Errorf("Error parsing installer layers: %s", err.Error())
+	}
+
+	installSources, err := stateMachine.generateInstallSources(layers, classicStateMachine.ImageDef.DisplayName)
+	if err != nil {
+		return err
+	}
+	installSourcesPath := filepath.Join(stateMachine.installerMediaDir(), "casper", "install-sources.yaml")
+	err = osWriteFile(installSourcesPath, installSources, 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing install-sources.yaml: %s", err.Error())
+	}
+
+	if len(installer.Preseeds) == 0 {
+		return nil
+	}
+
+	preseedDir := filepath.Join(stateMachine.installerMediaDir(), "preseed")
+	err = osMkdirAll(preseedDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating preseed directory: %s", err.Error())
+	}
+	for _, preseed := range installer.Preseeds {
+		preseedPath := preseed
+		if !filepath.IsAbs(preseedPath) {
+			preseedPath = filepath.Join(stateMachine.ConfDefPath, preseedPath)
+		}
+		err = osutilCopyFile(preseedPath, filepath.Join(preseedDir, filepath.Base(preseedPath)), osutil.CopyFlagDefault)
+		if err != nil {
+			return fmt.Errorf("Error copying preseed file %s: %s", preseed, err.Error())
+		}
+	}
+
+	return nil
+}
+
 var generatePackageManifestState = stateFunc{"generate_package_manifest", (*StateMachine).generatePackageManifest}
 
 // Generate the manifest
@@ -1262,6 +1609,126 @@ func (stateMachine *StateMachine) generatePackageManifest() error {
 	return nil
 }
 
+var generateChangelogState = stateFunc{"generate_changelog", (*StateMachine).generateChangelog}
+
+// generateChangelog collects the changelog entries of the packages installed
+// in the rootfs. By default, the latest entry of every source package is
+// collected. If a previous manifest is given, only the entries added since
+// the versions listed in it are collected.
+func (stateMachine *StateMachine) generateChangelog() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	changelogArtifact := classicStateMachine.ImageDef.Artifacts.Changelog
+
+	packages, err := parseDpkgStatus(filepath.Join(stateMachine.tempDirs.rootfs, "var", "lib", "dpkg", "status"))
+	if err != nil {
+		return err
+	}
+
+	var previousVersions map[string]string
+	if changelogArtifact.PreviousManifest != "" {
+		manifestPath := changelogArtifact.PreviousManifest
+		if !filepath.IsAbs(manifestPath) {
+			manifestPath = filepath.Join(stateMachine.ConfDefPath, manifestPath)
+		}
+		previousVersions, err = readManifest(manifestPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	outputPath := filepath.Join(stateMachine.commonFlags.OutputDir, changelogArtifact.ChangelogName)
+	changelogFile, err := osCreate(outputPath)
+	if err != nil {
+		return fmt.Errorf("Error creating changelog file: %s", err.Error())
+	}
+	defer changelogFile.Close()
+
+	installed := make(map[string]bool)
+	for _, source := range groupBySource(packages) {
+		for _, binary := range source.binaries {
+			installed[binary.name] = true
+		}
+
+		header, entries, err := stateMachine.sourceChangelog(source, previousVersions)
+		if err != nil {
+			return err
+		}
+		if header == "" {
+			continue
+		}
+
+		_, err = fmt.Fprintf(changelogFile, "%s\n\n", header)
+		if err != nil {
+			return fmt.Errorf("Error writing the changelog file: %s", err.Error())
+		}
+		for _, entry := range entries {
+			_, err = fmt.Fprintf(changelogFile, "%s\n", entry.text)
+			if err != nil {
+				return fmt.Errorf("Error writing the changelog file: %s", err.Error())
+			}
+		}
+	}
+
+	var removed []string
+	for name, version := range previousVersions {
+		if !installed[name] {
+			removed = append(removed, fmt.Sprintf("%s (%s)", name, version))
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	sort.Strings(removed)
+	_, err = fmt.Fprintf(changelogFile, "Removed packages:\n  %s\n", strings.Join(removed, "\n  "))
+	if err != nil {
+		return fmt.Errorf("Error writing the changelog file: %s", err.Error())
+	}
+
+	return nil
+}
+
+// sourceChangelog returns the header and the changelog entries to write for a
+// source package. An empty header is returned if the package did not change
+// since the previous manifest.
+func (stateMachine *StateMachine) sourceChangelog(source *sourcePackage, previousVersions map[string]string) (string, []changelogEntry, error) {
+	var previousVersion string
+	if previousVersions != nil {
+		installedBefore := false
+		for _, binary := range source.binaries {
+			version, found := previousVersions[binary.name]
+			if !found {
+				continue
+			}
+			installedBefore = true
+			if version != binary.version {
+				previousVersion = version
+				break
+			}
+		}
+		if installedBefore && previousVersion == "" {
+			return "", nil, nil
+		}
+	}
+
+	entries, err := sourceChangelogEntries(stateMachine.tempDirs.rootfs, source)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if previousVersion == "" {
+		if len(entries) > 0 {
+			entries = entries[:1]
+		}
+		if previousVersions != nil {
+			return fmt.Sprintf("%s (new: %s)", source.name, source.version), entries, nil
+		}
+		return fmt.Sprintf("%s (%s)", source.name, source.version), entries, nil
+	}
+
+	return fmt.Sprintf("%s (%s -> %s)", source.name, previousVersion, source.version),
+		entriesSince(entries, previousVersion), nil
+}
+
 var generateFilelistState = stateFunc{"generate_filelist", (*StateMachine).generateFilelist}
 
 // Generate the manifest
@@ -1336,6 +1803,53 @@ func (stateMachine *StateMachine) makeQcow2Img() error {
 	return nil
 }
 
+var makeIsoState = stateFunc{"make_iso", (*StateMachine).makeIso}
+
+// makeIso creates the .iso artifacts with xorriso, either with a
+// generated command line or with the one given in the image definition
+func (stateMachine *StateMachine) makeIso() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	for _, iso := range *classicStateMachine.ImageDef.Artifacts.Iso {
+		isoPath := filepath.Join(stateMachine.commonFlags.OutputDir, iso.IsoName)
+		volumeDir := filepath.Join(stateMachine.tempDirs.volumes, iso.IsoVolume)
+
+		var xorrisoCmd *exec.Cmd
+		if iso.Command != "" {
+			// run through a shell so users can rely on quoting and
+			// on the environment variables set below
+			xorrisoCmd = execCommand("/bin/sh", "-c", "xorriso "+iso.Command)
+		} else {
+			var err error
+			xorrisoCmd, err = stateMachine.generateXorrisoCmd(iso, isoPath)
+			if err != nil {
+				return err
+			}
+		}
+		// Env is sometimes used for mocking command calls in tests,
+		// so only overwrite env if it is nil
+		if xorrisoCmd.Env == nil {
+			xorrisoCmd.Env = os.Environ()
+		}
+		xorrisoCmd.Env = append(xorrisoCmd.Env,
+			"ROOTFS_DIR="+stateMachine.tempDirs.rootfs,
+			"VOLUME_DIR="+volumeDir,
+			"ISO_PATH="+isoPath,
+			"ARCH="+classicStateMachine.ImageDef.Architecture,
+			"SERIES="+classicStateMachine.ImageDef.Series,
+		)
+		if classicStateMachine.ImageDef.Class == "installer" {
+			xorrisoCmd.Env = append(xorrisoCmd.Env, "INSTALLER_MEDIA_DIR="+stateMachine.installerMediaDir())
+		}
+
+		err := runCmd(xorrisoCmd, stateMachine.commonFlags.Debug)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 var updateBootloaderState = stateFunc{"update_bootloader", (*StateMachine).updateBootloader}
 
 // updateBootloader determines the bootloader for each volume
@@ -4,10 +4,13 @@ package statemachine
 
 import (
 	"bufio"
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path"
@@ -86,6 +89,16 @@ func TestYAMLSchemaParsing(t *testing.T) {
 		{"invalid_paths_in_manual_touch_file", "test_invalid_paths_in_manual_touch_file.yaml", false, "needs to be an absolute path (../../malicious)"},
 		{"invalid_paths_in_manual_touch_file_bug", "test_invalid_paths_in_manual_touch_file.yaml", false, "needs to be an absolute path (/../../malicious)"},
 		{"img_specified_without_gadget", "test_image_without_gadget.yaml", false, "Key img cannot be used without key gadget:"},
+		{"valid_installer", "test_installer.yaml", true, ""},
+		{"installer_without_layers", "test_installer_without_layers.yaml", false, "Key class: installer cannot be used without key customization:installer:layers"},
+		{"installer_bad_layers", "test_installer_bad_layers.yaml", false, "Invalid installer layers: the parent layer minimal.standard must be listed before"},
+		{"installer_layers_without_seed", "test_installer_layers_without_seed.yaml", false, "Key customization:installer:layers cannot be used without key rootfs:seed"},
+		{"installer_wrong_class", "test_installer_wrong_class.yaml", false, "Key customization:installer cannot be used without key class: installer"},
+		{"installer_without_iso", "test_installer_without_iso.yaml", false, "Key class: installer cannot be used without key artifacts:iso"},
+		{"installer_duplicate_preseeds", "test_installer_duplicate_preseeds.yaml", false, "Preseed files server.seed and preseeds/server.seed would both be copied to preseed/server.seed on the installer media"},
+		{"valid_extends", "test_extends_arm64.yaml", true, ""},
+		{"extends_loop", "test_extends_loop.yaml", false, "test_extends_loop.yaml extends itself"},
+		{"valid_variables", "test_variables.yaml", true, ""},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -109,6 +122,126 @@ func TestYAMLSchemaParsing(t *testing.T) {
 	}
 }
 
+// Test_applyClassDefaults tests the customizations added for each class of image
+func Test_applyClassDefaults(t *testing.T) {
+	testCases := []struct {
+		name                  string
+		imageDefinition       imagedefinition.ImageDefinition
+		expectedCustomization *imagedefinition.Customization
+		expectedApplied       []string
+	}{
+		{
+			name:            "preinstalled",
+			imageDefinition: imagedefinition.ImageDefinition{Class: "preinstalled"},
+		},
+		{
+			name:            "cloud without customization",
+			imageDefinition: imagedefinition.ImageDefinition{Class: "cloud"},
+			expectedCustomization: &imagedefinition.Customization{
+				CloudInit: &imagedefinition.CloudInit{},
+				ExtraPackages: []*imagedefinition.Package{
+					{PackageName: "cloud-init"},
+					{PackageName: "cloud-guest-utils"},
+				},
+			},
+			expectedApplied: []string{
+				"cloud-init NoCloud datasource",
+				"extra package cloud-init",
+				"extra package cloud-guest-utils",
+			},
+		},
+		{
+			name: "cloud with customization",
+			imageDefinition: imagedefinition.ImageDefinition{
+				Class: "cloud",
+				Customization: &imagedefinition.Customization{
+					CloudInit: &imagedefinition.CloudInit{MetaData: "instance-id: test"},
+					ExtraPackages: []*imagedefinition.Package{
+						{PackageName: "cloud-init"},
+					},
+				},
+			},
+			expectedCustomization: &imagedefinition.Customization{
+				CloudInit: &imagedefinition.CloudInit{MetaData: "instance-id: test"},
+				ExtraPackages: []*imagedefinition.Package{
+					{PackageName: "cloud-init"},
+					{PackageName: "cloud-guest-utils"},
+				},
+			},
+			expectedApplied: []string{
+				"extra package cloud-guest-utils",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			gotApplied := applyClassDefaults(&tc.imageDefinition)
+			asserter.AssertEqual(tc.expectedApplied, gotApplied)
+			asserter.AssertEqual(tc.expectedCustomization, tc.imageDefinition.Customization)
+		})
+	}
+}
+
+// TestDisableConsoleConf unit tests the disableConsoleConf function
+func TestDisableConsoleConf(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine StateMachine
+	stateMachine.tempDirs.chroot = t.TempDir()
+
+	err := stateMachine.disableConsoleConf()
+	asserter.AssertErrNil(err, true)
+
+	_, err = os.Stat(filepath.Join(stateMachine.tempDirs.chroot, "var", "lib", "console-conf", "complete"))
+	asserter.AssertErrNil(err, true)
+
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() {
+		osWriteFile = os.WriteFile
+	})
+	err = stateMachine.disableConsoleConf()
+	asserter.AssertErrContains(err, "Error disabling console-conf")
+	osWriteFile = os.WriteFile
+
+	osMkdirAll = mockMkdirAll
+	t.Cleanup(func() {
+		osMkdirAll = os.MkdirAll
+	})
+	err = stateMachine.disableConsoleConf()
+	asserter.AssertErrContains(err, "Error creating console-conf directory")
+}
+
+// TestEnableConsoleConf unit tests the enableConsoleConf function
+func TestEnableConsoleConf(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine StateMachine
+	stateMachine.tempDirs.chroot = t.TempDir()
+
+	// console-conf is already enabled
+	err := stateMachine.enableConsoleConf()
+	asserter.AssertErrNil(err, true)
+
+	err = stateMachine.disableConsoleConf()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.enableConsoleConf()
+	asserter.AssertErrNil(err, true)
+
+	completePath := filepath.Join(stateMachine.tempDirs.chroot, "var", "lib", "console-conf", "complete")
+	_, err = os.Stat(completePath)
+	if !os.IsNotExist(err) {
+		t.Errorf("File \"%s\" should not exist anymore", completePath)
+	}
+
+	err = stateMachine.disableConsoleConf()
+	asserter.AssertErrNil(err, true)
+	osRemove = mockRemove
+	t.Cleanup(func() {
+		osRemove = os.Remove
+	})
+	err = stateMachine.enableConsoleConf()
+	asserter.AssertErrContains(err, "Error enabling console-conf")
+}
+
 // TestFailedParseImageDefinition mocks function calls to test
 // failure cases in the parseImageDefinition state
 func TestFailedParseImageDefinition(t *testing.T) {
@@ -162,6 +295,25 @@ func TestFailedParseImageDefinition(t *testing.T) {
 	helperCheckTags = helper.CheckTags
 }
 
+// TestParseImageDefinitionStrict ensures the lint warnings fail the build with --strict
+func TestParseImageDefinitionStrict(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Quiet = true
+	stateMachine.parent = &stateMachine
+	// sources-list-deb822 is not set
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+		"test_cloud.yaml")
+
+	err := stateMachine.parseImageDefinition()
+	asserter.AssertErrNil(err, true)
+
+	stateMachine.Opts.Strict = true
+	err = stateMachine.parseImageDefinition()
+	asserter.AssertErrContains(err, "1 lint warning found with --strict")
+}
+
 // TestClassicStateMachine_calculateStates reads in a variety of yaml files and ensures
 // that the correct states are added to the state machine
 // TODO: manually assemble the image definitions instead of relying on the parseImageDefinition() function to make this more of a unit test
@@ -233,6 +385,7 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 				"load_gadget_yaml",
 				"verify_artifact_names",
 				"extract_rootfs_tar",
+				"enable_console_conf",
 				"add_extra_ppas",
 				"install_packages",
 				"clean_extra_ppas",
@@ -291,6 +444,7 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 				"load_gadget_yaml",
 				"verify_artifact_names",
 				"extract_rootfs_tar",
+				"enable_console_conf",
 				"install_packages",
 				"clean_rootfs",
 				"customize_sources_list",
@@ -314,8 +468,33 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 				"load_gadget_yaml",
 				"verify_artifact_names",
 				"extract_rootfs_tar",
+				"enable_console_conf",
+				"clean_rootfs",
+				"customize_sources_list",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"update_bootloader",
+				"generate_package_manifest",
+			},
+		},
+		{
+			name:            "cloud_class",
+			imageDefinition: "test_cloud.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"extract_rootfs_tar",
+				"install_packages",
 				"clean_rootfs",
 				"customize_sources_list",
+				"customize_cloud_init",
+				"disable_console_conf",
 				"set_default_locale",
 				"populate_rootfs_contents",
 				"calculate_rootfs_size",
@@ -360,7 +539,11 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 				"prepare_gadget_tree",
 				"load_gadget_yaml",
 				"verify_artifact_names",
+				"create_chroot",
 				"build_rootfs_from_tasks",
+				"install_packages",
+				"prepare_image",
+				"preseed_image",
 				"clean_rootfs",
 				"customize_sources_list",
 				"customize_cloud_init",
@@ -431,6 +614,55 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 				"make_qcow2_image",
 			},
 		},
+		{
+			name:            "installer",
+			imageDefinition: "test_installer.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"germinate",
+				"create_chroot",
+				"install_packages",
+				"prepare_image",
+				"preseed_image",
+				"clean_rootfs",
+				"customize_sources_list",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"build_installer_layers",
+				"prepare_installer_media",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_iso",
+			},
+		},
+		{
+			name:            "iso",
+			imageDefinition: "test_iso.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"germinate",
+				"create_chroot",
+				"install_packages",
+				"prepare_image",
+				"preseed_image",
+				"clean_rootfs",
+				"customize_sources_list",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_iso",
+				"generate_changelog",
+			},
+		},
 		{
 			name:            "no artifact",
 			imageDefinition: "test_no_artifact.yaml",
@@ -857,6 +1089,7 @@ func TestVerifyArtifactNames(t *testing.T) {
 		qcow2            *[]imagedefinition.Qcow2
 		expectedVolNames map[string]string
 		shouldPass       bool
+		expectedError    string
 	}{
 		{
 			name:             "no artifact ",
@@ -948,6 +1181,7 @@ func TestVerifyArtifactNames(t *testing.T) {
 			},
 			expectedVolNames: map[string]string{},
 			shouldPass:       false,
+			expectedError:    "Volume names must be specified for each image",
 		},
 		{
 			name:       "mutli_volume_some_specified",
@@ -972,6 +1206,7 @@ func TestVerifyArtifactNames(t *testing.T) {
 			},
 			expectedVolNames: map[string]string{},
 			shouldPass:       false,
+			expectedError:    "Volume names must be specified for each image",
 		},
 		{
 			name:       "mutli_volume_only_create_some_images",
@@ -1068,6 +1303,7 @@ func TestVerifyArtifactNames(t *testing.T) {
 			},
 			expectedVolNames: map[string]string{},
 			shouldPass:       false,
+			expectedError:    "Volume names must be specified for each image",
 		},
 		{
 			name:       "qcow2_mutli_volume_no_img",
@@ -1182,6 +1418,52 @@ func TestVerifyArtifactNames(t *testing.T) {
 			},
 			shouldPass: true,
 		},
+		{
+			name:       "iso_single_volume_not_specified",
+			gadgetYAML: "gadget_tree/meta/gadget.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Iso: &[]imagedefinition.Iso{
+					{
+						IsoName: "test1.iso",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{},
+			shouldPass:       true,
+		},
+		{
+			name:       "iso_mutli_volume_not_specified",
+			gadgetYAML: "gadget-multi.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Iso: &[]imagedefinition.Iso{
+					{
+						IsoName:   "test1.iso",
+						IsoVolume: "first",
+					},
+					{
+						IsoName: "test2.iso",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{},
+			shouldPass:       false,
+			expectedError:    "Volume names must be specified for each image",
+		},
+		{
+			name:       "iso_mutli_volume_inexistent",
+			gadgetYAML: "gadget-multi.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Iso: &[]imagedefinition.Iso{
+					{
+						IsoName:   "test1.iso",
+						IsoVolume: "inexistent",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{},
+			shouldPass:       false,
+			expectedError:    "volume inexistent of iso artifact test1.iso is not defined in the gadget",
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -1221,8 +1503,15 @@ func TestVerifyArtifactNames(t *testing.T) {
 					fmt.Println(stateMachine.VolumeNames)
 					t.Errorf("Expected volume names does not match calculated volume names")
 				}
+				if tc.artifacts != nil && tc.artifacts.Iso != nil {
+					for _, iso := range *tc.artifacts.Iso {
+						if iso.IsoVolume == "" {
+							t.Errorf("Volume of iso %s was not set", iso.IsoName)
+						}
+					}
+				}
 			} else {
-				asserter.AssertErrContains(err, "Volume names must be specified for each image")
+				asserter.AssertErrContains(err, tc.expectedError)
 			}
 		})
 	}
@@ -1231,17 +1520,50 @@ func TestVerifyArtifactNames(t *testing.T) {
 // TestBuildRootfsFromTasks unit tests the buildRootfsFromTasks function
 func TestBuildRootfsFromTasks(t *testing.T) {
 	t.Parallel()
-	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
-
-	var stateMachine ClassicStateMachine
-	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-
-	err := stateMachine.buildRootfsFromTasks()
-	asserter.AssertErrNil(err, true)
+	testCases := []struct {
+		name             string
+		archiveTasks     []string
+		expectedPackages []string
+		expectedError    string
+	}{
+		{
+			name:             "valid_tasks",
+			archiveTasks:     []string{"ubuntu-server-minimal", "ubuntu-server"},
+			expectedPackages: []string{"ubuntu-minimal", "ubuntu-server-minimal^", "ubuntu-server^"},
+		},
+		{
+			name:             "no_tasks",
+			archiveTasks:     []string{},
+			expectedPackages: []string{"ubuntu-minimal"},
+		},
+		{
+			name:          "invalid_task",
+			archiveTasks:  []string{"ubuntu-server", "Invalid Task"},
+			expectedError: "invalid task name \"Invalid Task\"",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.Packages = []string{"ubuntu-minimal"}
+			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+				Rootfs: &imagedefinition.Rootfs{
+					ArchiveTasks: tc.archiveTasks,
+				},
+			}
 
-	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			err := stateMachine.buildRootfsFromTasks()
+			if tc.expectedError != "" {
+				asserter.AssertErrContains(err, tc.expectedError)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expectedPackages, stateMachine.Packages)
+		})
+	}
 }
 
 // TestExtractRootfsTar unit tests the extractRootfsTar function
@@ -1252,6 +1574,9 @@ func TestExtractRootfsTar(t *testing.T) {
 		name          string
 		rootfsTar     string
 		SHA256sum     string
+		gpg           string
+		keyring       string
+		cliKeyring    string
 		expectedFiles []string
 	}{
 		{
@@ -1281,6 +1606,27 @@ func TestExtractRootfsTar(t *testing.T) {
 				"test_tar2",
 			},
 		},
+		{
+			name:      "vanilla_tar with gpg signature",
+			rootfsTar: filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar"),
+			gpg:       filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar.gpg"),
+			keyring:   filepath.Join("testdata", "rootfs_tarballs", "keyring.gpg"),
+			expectedFiles: []string{
+				"test_tar1",
+				"test_tar2",
+			},
+		},
+		{
+			name:       "vanilla_tar with gpg signature and keyring on the command line",
+			rootfsTar:  filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar"),
+			gpg:        "file://" + filepath.Join(wd, "testdata", "rootfs_tarballs", "rootfs.tar.gpg"),
+			keyring:    filepath.Join("testdata", "rootfs_tarballs", "other_keyring.gpg"),
+			cliKeyring: filepath.Join("testdata", "rootfs_tarballs", "keyring.gpg"),
+			expectedFiles: []string{
+				"test_tar1",
+				"test_tar2",
+			},
+		},
 		{
 			name:      "gz",
 			rootfsTar: filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar.gz"),
@@ -1333,9 +1679,13 @@ func TestExtractRootfsTar(t *testing.T) {
 				Rootfs: &imagedefinition.Rootfs{
 					Tarball: &imagedefinition.Tarball{
 						TarballURL: fmt.Sprintf("file://%s", tc.rootfsTar),
+						SHA256sum:  tc.SHA256sum,
+						GPG:        tc.gpg,
+						Keyring:    tc.keyring,
 					},
 				},
 			}
+			stateMachine.Opts.TarballKeyring = tc.cliKeyring
 
 			err := stateMachine.setConfDefDir(filepath.Join(wd, "image_definition.yaml"))
 			asserter.AssertErrNil(err, true)
@@ -1406,38 +1756,112 @@ func TestFailedExtractRootfsTar(t *testing.T) {
 	stateMachine.ImageDef.Rootfs.Tarball.TarballURL = "file:///fakefile"
 	err = stateMachine.extractRootfsTar()
 	asserter.AssertErrContains(err, "Error opening file \"/fakefile\" to calculate SHA256 sum")
-	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
-}
-
-// TestStateMachine_customizeCloudInit unit tests the customizeCloudInit method
-func TestStateMachine_customizeCloudInit(t *testing.T) {
-	testCases := []struct {
-		name                   string
-		cloudInitCustomization imagedefinition.CloudInit
-		wantMetaData           string
-		wantUserData           string
-		wantNetworkConfig      string
-	}{
-		{
-			name: "full cloudinit conf",
-			cloudInitCustomization: imagedefinition.CloudInit{
-				MetaData: `#cloud-config
+	os.RemoveAll(stateMachine.tempDirs.chroot)
 
-foo: bar`,
-				UserData: `#cloud-config
+	// a signature without a keyring cannot be verified
+	stateMachine.ImageDef.Rootfs.Tarball.TarballURL = fmt.Sprintf("file://%s", tarPath)
+	stateMachine.ImageDef.Rootfs.Tarball.SHA256sum = ""
+	stateMachine.ImageDef.Rootfs.Tarball.GPG = filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar.gpg")
+	err = stateMachine.extractRootfsTar()
+	asserter.AssertErrContains(err, "A keyring must be given")
+	os.RemoveAll(stateMachine.tempDirs.chroot)
 
-foo: baz`,
-				NetworkConfig: `#cloud-config
+	// a keyring without a signature is likely a mistake
+	stateMachine.ImageDef.Rootfs.Tarball.GPG = ""
+	stateMachine.Opts.TarballKeyring = filepath.Join("testdata", "rootfs_tarballs", "keyring.gpg")
+	err = stateMachine.extractRootfsTar()
+	asserter.AssertErrContains(err, "no gpg signature is specified")
+	os.RemoveAll(stateMachine.tempDirs.chroot)
 
-foobar: foobar`,
-			},
-			wantMetaData: `#cloud-config
+	// the signature was not made by a key of the keyring
+	stateMachine.ImageDef.Rootfs.Tarball.GPG = filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar.gpg")
+	stateMachine.Opts.TarballKeyring = filepath.Join("testdata", "rootfs_tarballs", "other_keyring.gpg")
+	err = stateMachine.extractRootfsTar()
+	asserter.AssertErrContains(err, "Error verifying the gpg signature")
+	os.RemoveAll(stateMachine.tempDirs.chroot)
 
-foo: bar`,
-			wantUserData: `#cloud-config
+	// the signature does not match the tarball
+	stateMachine.ImageDef.Rootfs.Tarball.TarballURL = fmt.Sprintf("file://%s",
+		filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar.gz"))
+	stateMachine.Opts.TarballKeyring = filepath.Join("testdata", "rootfs_tarballs", "keyring.gpg")
+	err = stateMachine.extractRootfsTar()
+	asserter.AssertErrContains(err, "Error verifying the gpg signature")
+	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+}
 
-foo: baz`,
-			wantNetworkConfig: `#cloud-config
+// TestExtractRootfsTarFromURL tests extracting a rootfs tarball and
+// verifying its signature when both are downloaded from an http server
+func TestExtractRootfsTarFromURL(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	server := httptest.NewServer(http.FileServer(http.Dir(filepath.Join("testdata", "rootfs_tarballs"))))
+	t.Cleanup(server.Close)
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.Opts.CacheDir = t.TempDir()
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: getHostArch(),
+		Series:       getHostSuite(),
+		Rootfs: &imagedefinition.Rootfs{
+			Tarball: &imagedefinition.Tarball{
+				TarballURL: server.URL + "/rootfs.tar",
+				SHA256sum:  "ec01fd8488b0f35d2ca69e6f82edfaecef5725da70913bab61240419ce574918",
+				GPG:        server.URL + "/rootfs.tar.gpg",
+				Keyring:    filepath.Join("testdata", "rootfs_tarballs", "keyring.gpg"),
+			},
+		},
+	}
+
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	err = stateMachine.extractRootfsTar()
+	asserter.AssertErrNil(err, true)
+
+	for _, testFile := range []string{"test_tar1", "test_tar2"} {
+		_, err := os.Stat(filepath.Join(stateMachine.tempDirs.chroot, testFile))
+		if err != nil {
+			t.Errorf("File %s should be in chroot, but is missing", testFile)
+		}
+	}
+	_, err = os.Stat(filepath.Join(stateMachine.Opts.CacheDir, "sha256",
+		stateMachine.ImageDef.Rootfs.Tarball.SHA256sum))
+	if err != nil {
+		t.Errorf("The rootfs tarball should be in the download cache: %s", err.Error())
+	}
+}
+
+// TestStateMachine_customizeCloudInit unit tests the customizeCloudInit method
+func TestStateMachine_customizeCloudInit(t *testing.T) {
+	testCases := []struct {
+		name                   string
+		cloudInitCustomization imagedefinition.CloudInit
+		wantMetaData           string
+		wantUserData           string
+		wantNetworkConfig      string
+	}{
+		{
+			name: "full cloudinit conf",
+			cloudInitCustomization: imagedefinition.CloudInit{
+				MetaData: `#cloud-config
+
+foo: bar`,
+				UserData: `#cloud-config
+
+foo: baz`,
+				NetworkConfig: `#cloud-config
+
+foobar: foobar`,
+			},
+			wantMetaData: `#cloud-config
+
+foo: bar`,
+			wantUserData: `#cloud-config
+
+foo: baz`,
+			wantNetworkConfig: `#cloud-config
 
 foobar: foobar`,
 		},
@@ -4768,6 +5192,531 @@ func TestGenerateRootfsTarball(t *testing.T) {
 	}
 }
 
+// TestMakeIso unit tests the makeIso function
+func TestMakeIso(t *testing.T) {
+	testCases := []struct {
+		name          string
+		class         string
+		iso           imagedefinition.Iso
+		withESP       bool
+		expectedCmd   string
+		expectedEnv   []string
+		expectedError string
+	}{
+		{
+			name: "default_command_without_esp",
+			iso: imagedefinition.Iso{
+				IsoName:   "test.iso",
+				IsoVolume: "pc",
+			},
+			expectedError: "no image of a system-boot structure was found in volume pc",
+		},
+		{
+			name: "default_command_with_esp",
+			iso: imagedefinition.Iso{
+				IsoName:   "test.iso",
+				IsoVolume: "pc",
+			},
+			withESP:     true,
+			expectedCmd: "xorriso -as mkisofs -r -J -joliet-long -V ubuntu-server-amd64-with-a-very- -o OUTPUT/test.iso -append_partition 2 0xef VOLUMES/pc/part2.img -appended_part_as_gpt -e --interval:appended_partition_2:all:: -no-emul-boot ROOTFS",
+		},
+		{
+			name:  "installer",
+			class: "installer",
+			iso: imagedefinition.Iso{
+				IsoName:   "test.iso",
+				IsoVolume: "pc",
+			},
+			withESP:     true,
+			expectedCmd: "xorriso -as mkisofs -r -J -joliet-long -V ubuntu-server-amd64-with-a-very- -o OUTPUT/test.iso -append_partition 2 0xef VOLUMES/pc/part2.img -appended_part_as_gpt -e --interval:appended_partition_2:all:: -no-emul-boot INSTALLER",
+			expectedEnv: []string{
+				"INSTALLER_MEDIA_DIR=INSTALLER",
+			},
+		},
+		{
+			name: "custom_command",
+			iso: imagedefinition.Iso{
+				IsoName:   "test.iso",
+				IsoVolume: "pc",
+				Command:   "-as mkisofs -o $ISO_PATH $ROOTFS_DIR",
+			},
+			expectedCmd: "/bin/sh -c xorriso -as mkisofs -o $ISO_PATH $ROOTFS_DIR",
+			expectedEnv: []string{
+				"ROOTFS_DIR=ROOTFS",
+				"VOLUME_DIR=VOLUMES/pc",
+				"ISO_PATH=OUTPUT/test.iso",
+				"ARCH=amd64",
+				"SERIES=jammy",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			restoreCWD := testhelper.SaveCWD()
+			defer restoreCWD()
+
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.YamlFilePath = filepath.Join("testdata", "gadget_tree", "meta", "gadget.yaml")
+			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+				ImageName:    "ubuntu-server-amd64-with-a-very-long-name",
+				Architecture: "amd64",
+				Series:       "jammy",
+				Class:        tc.class,
+				Artifacts: &imagedefinition.Artifact{
+					Iso: &[]imagedefinition.Iso{tc.iso},
+				},
+			}
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+			err = stateMachine.loadGadgetYaml()
+			asserter.AssertErrNil(err, true)
+
+			stateMachine.commonFlags.OutputDir = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "output")
+
+			if tc.withESP {
+				espImg := filepath.Join(stateMachine.tempDirs.volumes, "pc", "part2.img")
+				err = os.MkdirAll(filepath.Dir(espImg), 0755)
+				asserter.AssertErrNil(err, true)
+				err = os.WriteFile(espImg, []byte{}, 0600)
+				asserter.AssertErrNil(err, true)
+			}
+
+			mockCmder := NewMockRunCommand()
+			runCmd = mockCmder.runCmd
+			t.Cleanup(func() { runCmd = helper.RunCmd })
+
+			err = stateMachine.makeIso()
+			if tc.expectedError != "" {
+				asserter.AssertErrContains(err, tc.expectedError)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+
+			if len(mockCmder.cmds) != 1 {
+				t.Fatalf("%d commands executed, expected 1", len(mockCmder.cmds))
+			}
+			gotCmd := mockCmder.cmds[0]
+
+			replacer := strings.NewReplacer(
+				stateMachine.commonFlags.OutputDir, "OUTPUT",
+				stateMachine.installerMediaDir(), "INSTALLER",
+				stateMachine.tempDirs.volumes, "VOLUMES",
+				stateMachine.tempDirs.rootfs, "ROOTFS",
+			)
+			asserter.AssertEqual(tc.expectedCmd, replacer.Replace(strings.Join(gotCmd.Args, " ")))
+			for _, env := range tc.expectedEnv {
+				found := false
+				for _, gotEnv := range gotCmd.Env {
+					if replacer.Replace(gotEnv) == env {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("Expected %s in the environment of %s", env, gotCmd.String())
+				}
+			}
+		})
+	}
+}
+
+// writeGzipFile writes a gzip compressed file with the given content
+func writeGzipFile(t *testing.T, path string, content string) {
+	t.Helper()
+	asserter := helper.Asserter{T: t}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	asserter.AssertErrNil(err, true)
+	f, err := os.Create(path)
+	asserter.AssertErrNil(err, true)
+	defer f.Close()
+	gzipWriter := gzip.NewWriter(f)
+	_, err = gzipWriter.Write([]byte(content))
+	asserter.AssertErrNil(err, true)
+	err = gzipWriter.Close()
+	asserter.AssertErrNil(err, true)
+}
+
+// TestGenerateChangelog unit tests the generateChangelog function
+func TestGenerateChangelog(t *testing.T) {
+	t.Parallel()
+	dpkgStatus := `Package: hello
+Status: install ok installed
+Version: 2.10-3
+Description: example package
+ with a multiline description
+
+Package: libfoo1
+Status: install ok installed
+Source: foo (1.2-2)
+Version: 1.2-2
+
+Package: foo-common
+Status: install ok installed
+Source: foo
+Version: 1.2-2
+
+Package: removed-config
+Status: deinstall ok config-files
+Version: 0.1
+`
+	helloChangelog := `hello (2.10-3) noble; urgency=medium
+
+  * New upload.
+
+ -- Someone <someone@example.com>  Mon, 01 Jan 2024 00:00:00 +0000
+
+hello (2.10-2) jammy; urgency=medium
+
+  * Older upload.
+
+ -- Someone <someone@example.com>  Mon, 01 Jan 2022 00:00:00 +0000
+`
+	fooChangelog := `foo (1.2-2) noble; urgency=medium
+
+  * Fix a bug.
+
+ -- Someone <someone@example.com>  Mon, 01 Jan 2024 00:00:00 +0000
+
+foo (1.2-1) noble; urgency=medium
+
+  * New upstream release.
+
+ -- Someone <someone@example.com>  Mon, 01 Dec 2023 00:00:00 +0000
+
+foo (1.1-1) jammy; urgency=medium
+
+  * Initial release.
+
+ -- Someone <someone@example.com>  Mon, 01 Jan 2022 00:00:00 +0000
+`
+	testCases := []struct {
+		name              string
+		previousManifest  string
+		expectedChangelog string
+	}{
+		{
+			name: "latest_entries",
+			expectedChangelog: `foo (1.2-2)
+
+foo (1.2-2) noble; urgency=medium
+
+  * Fix a bug.
+
+ -- Someone <someone@example.com>  Mon, 01 Jan 2024 00:00:00 +0000
+
+hello (2.10-3)
+
+hello (2.10-3) noble; urgency=medium
+
+  * New upload.
+
+ -- Someone <someone@example.com>  Mon, 01 Jan 2024 00:00:00 +0000
+
+`,
+		},
+		{
+			name:             "previous_manifest",
+			previousManifest: "libfoo1 1.1-1\nfoo-common 1.1-1\nbar 3.0\n",
+			expectedChangelog: `foo (1.1-1 -> 1.2-2)
+
+foo (1.2-2) noble; urgency=medium
+
+  * Fix a bug.
+
+ -- Someone <someone@example.com>  Mon, 01 Jan 2024 00:00:00 +0000
+
+foo (1.2-1) noble; urgency=medium
+
+  * New upstream release.
+
+ -- Someone <someone@example.com>  Mon, 01 Dec 2023 00:00:00 +0000
+
+hello (new: 2.10-3)
+
+hello (2.10-3) noble; urgency=medium
+
+  * New upload.
+
+ -- Someone <someone@example.com>  Mon, 01 Jan 2024 00:00:00 +0000
+
+Removed packages:
+  bar (3.0)
+`,
+		},
+		{
+			name:              "unchanged_packages",
+			previousManifest:  "hello 2.10-3\nlibfoo1 1.2-2\nfoo-common 1.2-2\n",
+			expectedChangelog: "",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			tmpDir := t.TempDir()
+
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.commonFlags.OutputDir = filepath.Join(tmpDir, "output")
+			stateMachine.tempDirs.rootfs = filepath.Join(tmpDir, "rootfs")
+			stateMachine.ConfDefPath = tmpDir
+			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+				Artifacts: &imagedefinition.Artifact{
+					Changelog: &imagedefinition.Changelog{
+						ChangelogName: "filesystem.changelog",
+					},
+				},
+			}
+			err := os.MkdirAll(stateMachine.commonFlags.OutputDir, 0755)
+			asserter.AssertErrNil(err, true)
+
+			// prepare a rootfs with the dpkg status and some changelogs,
+			// including a doc dir symlinked to another package's one
+			rootfs := stateMachine.tempDirs.rootfs
+			err = os.MkdirAll(filepath.Join(rootfs, "var", "lib", "dpkg"), 0755)
+			asserter.AssertErrNil(err, true)
+			err = os.WriteFile(filepath.Join(rootfs, "var", "lib", "dpkg", "status"), []byte(dpkgStatus), 0600)
+			asserter.AssertErrNil(err, true)
+			writeGzipFile(t, filepath.Join(rootfs, "usr", "share", "doc", "hello", "changelog.Debian.gz"), helloChangelog)
+			writeGzipFile(t, filepath.Join(rootfs, "usr", "share", "doc", "foo-common", "changelog.Debian.gz"), fooChangelog)
+			err = os.Symlink("/usr/share/doc/foo-common", filepath.Join(rootfs, "usr", "share", "doc", "libfoo1"))
+			asserter.AssertErrNil(err, true)
+
+			if tc.previousManifest != "" {
+				err = os.WriteFile(filepath.Join(tmpDir, "previous.manifest"), []byte(tc.previousManifest), 0600)
+				asserter.AssertErrNil(err, true)
+				stateMachine.ImageDef.Artifacts.Changelog.PreviousManifest = "previous.manifest"
+			}
+
+			err = stateMachine.generateChangelog()
+			asserter.AssertErrNil(err, true)
+
+			changelog, err := os.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir, "filesystem.changelog"))
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expectedChangelog, string(changelog))
+		})
+	}
+}
+
+// TestFailedGenerateChangelog tests failures in the generateChangelog function
+func TestFailedGenerateChangelog(t *testing.T) {
+	t.Parallel()
+	asserter := helper.Asserter{T: t}
+	tmpDir := t.TempDir()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.OutputDir = tmpDir
+	stateMachine.tempDirs.rootfs = filepath.Join(tmpDir, "rootfs")
+	stateMachine.ConfDefPath = tmpDir
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Artifacts: &imagedefinition.Artifact{
+			Changelog: &imagedefinition.Changelog{
+				ChangelogName:    "filesystem.changelog",
+				PreviousManifest: "does-not-exist.manifest",
+			},
+		},
+	}
+
+	err := stateMachine.generateChangelog()
+	asserter.AssertErrContains(err, "Error opening dpkg status file")
+
+	err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.rootfs, "var", "lib", "dpkg"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(stateMachine.tempDirs.rootfs, "var", "lib", "dpkg", "status"), []byte{}, 0600)
+	asserter.AssertErrNil(err, true)
+
+	err = stateMachine.generateChangelog()
+	asserter.AssertErrContains(err, "Error opening manifest file")
+}
+
+// TestBuildInstallerLayers unit tests the buildInstallerLayers function
+func TestBuildInstallerLayers(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Debug = true
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: getHostArch(),
+		Customization: &imagedefinition.Customization{
+			Installer: &imagedefinition.Installer{
+				Layers: []string{"minimal", "minimal.standard", "minimal.standard.live"},
+			},
+		},
+	}
+
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	// prepare the germinate output of the seeds used by the layers
+	germinateDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "germinate")
+	err = os.MkdirAll(germinateDir, 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(germinateDir, "standard.seed"), []byte("standard-pkg 1.0\n"), 0600)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(germinateDir, "live.seed"), []byte("casper 1.0\n"), 0600)
+	asserter.AssertErrNil(err, true)
+
+	// overlays are not really mounted, so prepare what is expected in
+	// the merged directories
+	for _, layer := range []string{"minimal.standard", "minimal.standard.live"} {
+		mergedDir := filepath.Join(stateMachine.installerLayerDir(layer), "merged")
+		err = os.MkdirAll(filepath.Join(mergedDir, "sbin"), 0755)
+		asserter.AssertErrNil(err, true)
+		_, err = os.Create(filepath.Join(mergedDir, "sbin", "start-stop-daemon"))
+		asserter.AssertErrNil(err, true)
+	}
+	liveMergedDir := filepath.Join(stateMachine.installerLayerDir("minimal.standard.live"), "merged")
+	err = os.MkdirAll(filepath.Join(liveMergedDir, "boot"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(liveMergedDir, "boot", "vmlinuz-6.8.0-1"), []byte("kernel"), 0600)
+	asserter.AssertErrNil(err, true)
+	err = os.Symlink("vmlinuz-6.8.0-1", filepath.Join(liveMergedDir, "boot", "vmlinuz"))
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(liveMergedDir, "boot", "initrd.img"), []byte("initrd"), 0600)
+	asserter.AssertErrNil(err, true)
+
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfSuccess
+	t.Cleanup(func() {
+		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
+	})
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
+
+	err = stateMachine.buildInstallerLayers()
+	asserter.AssertErrNil(err, true)
+
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+
+	expectedCmds := []*regexp.Regexp{
+		regexp.MustCompile("(?m)^mksquashfs /tmp.*/root /tmp.*/installer/media/casper/minimal.squashfs -noappend -comp xz$"),
+		regexp.MustCompile("(?m)^mount -t overlay overlay -o lowerdir=/tmp.*/root,upperdir=/tmp.*/installer/layers/minimal.standard/upper,workdir=/tmp.*/installer/layers/minimal.standard/work /tmp.*/installer/layers/minimal.standard/merged$"),
+		regexp.MustCompile("(?m)^chroot /tmp.*/installer/layers/minimal.standard/merged apt install .* standard-pkg$"),
+		regexp.MustCompile("(?m)^mksquashfs /tmp.*/installer/layers/minimal.standard/upper /tmp.*/installer/media/casper/minimal.standard.squashfs -noappend -comp xz$"),
+		regexp.MustCompile("(?m)^mount -t overlay overlay -o lowerdir=/tmp.*/installer/layers/minimal.standard/upper:/tmp.*/root,upperdir=/tmp.*/installer/layers/minimal.standard.live/upper,.*$"),
+		regexp.MustCompile("(?m)^chroot /tmp.*/installer/layers/minimal.standard.live/merged apt install .* casper$"),
+		regexp.MustCompile("(?m)^umount --recursive /tmp.*/installer/layers/minimal.standard.live/merged$"),
+		regexp.MustCompile("(?m)^mksquashfs /tmp.*/installer/layers/minimal.standard.live/upper /tmp.*/installer/media/casper/minimal.standard.live.squashfs -noappend -comp xz$"),
+	}
+	for _, expected := range expectedCmds {
+		if !expected.Match(readStdout) {
+			t.Errorf("Expected command matching %s to be run. Got:\n%s", expected.String(), readStdout)
+		}
+	}
+
+	// the kernel and initrd of the top-most layer are on the media
+	casperDir := filepath.Join(stateMachine.installerMediaDir(), "casper")
+	kernel, err := os.ReadFile(filepath.Join(casperDir, "vmlinuz"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("kernel", string(kernel))
+	initrd, err := os.ReadFile(filepath.Join(casperDir, "initrd"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("initrd", string(initrd))
+}
+
+// TestFailedBuildInstallerLayers tests failures in the buildInstallerLayers function
+func TestFailedBuildInstallerLayers(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Customization: &imagedefinition.Customization{
+			Installer: &imagedefinition.Installer{
+				Layers: []string{"minimal", "minimal.standard"},
+			},
+		},
+	}
+
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	// the germinate output is missing
+	err = stateMachine.buildInstallerLayers()
+	asserter.AssertErrContains(err, "Error opening seed file")
+
+	osMkdirAll = mockMkdirAll
+	t.Cleanup(func() { osMkdirAll = os.MkdirAll })
+	err = stateMachine.buildInstallerLayers()
+	asserter.AssertErrContains(err, "Error creating casper directory")
+	osMkdirAll = os.MkdirAll
+
+	stateMachine.ImageDef.Customization.Installer.Layers = []string{"minimal.standard"}
+	err = stateMachine.buildInstallerLayers()
+	asserter.AssertErrContains(err, "Error parsing installer layers")
+}
+
+// TestPrepareInstallerMedia unit tests the prepareInstallerMedia function
+func TestPrepareInstallerMedia(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ConfDefPath = t.TempDir()
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		DisplayName: "Ubuntu Server",
+		Customization: &imagedefinition.Customization{
+			Installer: &imagedefinition.Installer{
+				Preseeds: []string{"server.seed"},
+				Layers:   []string{"minimal", "minimal.live"},
+			},
+		},
+	}
+
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	err = os.MkdirAll(filepath.Join(stateMachine.installerMediaDir(), "casper"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.MkdirAll(filepath.Join(stateMachine.installerLayerDir("minimal.live"), "upper"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(stateMachine.ConfDefPath, "server.seed"), []byte("d-i preseed"), 0600)
+	asserter.AssertErrNil(err, true)
+
+	err = stateMachine.prepareInstallerMedia()
+	asserter.AssertErrNil(err, true)
+
+	installSources, err := os.ReadFile(filepath.Join(stateMachine.installerMediaDir(), "casper", "install-sources.yaml"))
+	asserter.AssertErrNil(err, true)
+	if !strings.Contains(string(installSources), "path: minimal.squashfs") {
+		t.Errorf("install-sources.yaml does not list the minimal layer:\n%s", installSources)
+	}
+	if strings.Contains(string(installSources), "minimal.live") {
+		t.Errorf("install-sources.yaml should not list the live layer:\n%s", installSources)
+	}
+
+	preseed, err := os.ReadFile(filepath.Join(stateMachine.installerMediaDir(), "preseed", "server.seed"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("d-i preseed", string(preseed))
+
+	// a missing preseed file is an error
+	stateMachine.ImageDef.Customization.Installer.Preseeds = []string{"missing.seed"}
+	err = stateMachine.prepareInstallerMedia()
+	asserter.AssertErrContains(err, "Error copying preseed file missing.seed")
+}
+
 // TestFailedMakeQcow2Img tests failures in the makeQcow2Img function
 func TestFailedMakeQcow2Img(t *testing.T) {
 	asserter := helper.Asserter{T: t}
@@ -0,0 +1,97 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/canonical/ubuntu-image/internal/commands"
+)
+
+var cleanStates = []stateFunc{
+	unmountWorkDirState,
+	detachLoopDevicesState,
+	restoreChrootFilesState,
+}
+
+// CleanStateMachine embeds StateMachine and adds the command line flags specific to
+// cleaning up the workdir of a build that did not tear down properly
+type CleanStateMachine struct {
+	StateMachine
+	Opts commands.CleanOpts
+}
+
+// Setup assigns variables and calls other functions that must be executed before Run()
+func (cleanStateMachine *CleanStateMachine) Setup() error {
+	// set the parent pointer of the embedded struct
+	cleanStateMachine.parent = cleanStateMachine
+
+	cleanStateMachine.states = make([]stateFunc, 0)
+	cleanStateMachine.states = append(cleanStateMachine.states, cleanStates...)
+	if cleanStateMachine.Opts.Delete {
+		cleanStateMachine.states = append(cleanStateMachine.states, deleteWorkDirState)
+	}
+
+	if err := cleanStateMachine.validateCleanInput(); err != nil {
+		return err
+	}
+
+	// validate values of until and thru
+	if err := cleanStateMachine.validateUntilThru(); err != nil {
+		return err
+	}
+
+	cleanStateMachine.displayStates()
+
+	// a running build is not cleaned, while the lock left by a crashed one
+	// is expected
+	lock, err := lockWorkDir(cleanStateMachine.stateMachineFlags.WorkDir, true)
+	if err != nil {
+		return err
+	}
+	cleanStateMachine.lock = lock
+
+	// the workdir is not populated, only its existing content is cleaned
+	workDir := cleanStateMachine.stateMachineFlags.WorkDir
+	cleanStateMachine.tempDirs.rootfs = filepath.Join(workDir, "root")
+	cleanStateMachine.tempDirs.unpack = filepath.Join(workDir, "unpack")
+	cleanStateMachine.tempDirs.volumes = filepath.Join(workDir, "volumes")
+	cleanStateMachine.tempDirs.chroot = filepath.Join(workDir, "chroot")
+	cleanStateMachine.tempDirs.scratch = filepath.Join(workDir, "scratch")
+
+	return nil
+}
+
+// validateCleanInput validates the command line options of the clean command
+func (cleanStateMachine *CleanStateMachine) validateCleanInput() error {
+	if err := cleanStateMachine.validateInput(); err != nil {
+		return err
+	}
+	if cleanStateMachine.stateMachineFlags.Resume || cleanStateMachine.stateMachineFlags.From != "" {
+		return fmt.Errorf("the clean command cannot be resumed")
+	}
+	if cleanStateMachine.stateMachineFlags.WorkDir == "" {
+		return fmt.Errorf("must specify the workdir to clean with --workdir")
+	}
+	workDir, err := filepath.Abs(cleanStateMachine.stateMachineFlags.WorkDir)
+	if err != nil {
+		return fmt.Errorf("Error finding the absolute path of the workdir: %s", err.Error())
+	}
+	info, err := os.Stat(workDir)
+	if err != nil || !info.IsDir() {
+		return fmt.Errorf("workdir %s does not exist or is not a directory", workDir)
+	}
+	cleanStateMachine.stateMachineFlags.WorkDir = workDir
+	return nil
+}
+
+// Placeholder method to satisfy the interface. This is not used when cleaning.
+func (cleanStateMachine *CleanStateMachine) SetSeries() error {
+	return nil
+}
+
+// Teardown leaves the state of the cleaned build untouched so that it can
+// still be resumed, and releases the lock of the workdir
+func (cleanStateMachine *CleanStateMachine) Teardown() error {
+	return cleanStateMachine.unlockWorkDir()
+}
@@ -0,0 +1,144 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/snapcore/snapd/osutil"
+)
+
+var unmountWorkDirState = stateFunc{"unmount_workdir", (*StateMachine).unmountWorkDir}
+
+// unmountWorkDir unmounts everything left mounted under the workdir,
+// deepest mountpoints first
+func (stateMachine *StateMachine) unmountWorkDir() error {
+	// a workdir that is itself a mountpoint is left mounted
+	mountPoints, err := listMounts(stateMachine.stateMachineFlags.WorkDir + string(filepath.Separator))
+	if err != nil {
+		return fmt.Errorf("Error listing mountpoints: %s", err.Error())
+	}
+	// parseMounts lists the last mounted first, keep this order between
+	// mountpoints of the same depth
+	sort.SliceStable(mountPoints, func(i, j int) bool {
+		return strings.Count(mountPoints[i].path, "/") > strings.Count(mountPoints[j].path, "/")
+	})
+
+	var umountCmds []*exec.Cmd
+	for _, m := range mountPoints {
+		fmt.Printf("Unmounting %s\n", m.path)
+		umountCmds = append(umountCmds, execCommand("umount", m.path))
+	}
+	return execTeardownCmds(umountCmds, stateMachine.commonFlags.Debug, nil)
+}
+
+var detachLoopDevicesState = stateFunc{"detach_loop_devices", (*StateMachine).detachLoopDevices}
+
+// detachLoopDevices detaches the loop devices backed by files of the workdir
+func (stateMachine *StateMachine) detachLoopDevices() error {
+	losetupCmd := execCommand("losetup", "--list", "--noheadings", "--output", "NAME,BACK-FILE")
+	losetupOutput, err := losetupCmd.Output()
+	if err != nil {
+		return fmt.Errorf("Error listing loop devices with \"%s\": %s", losetupCmd.String(), err.Error())
+	}
+
+	var detachCmds []*exec.Cmd
+	for _, line := range strings.Split(string(losetupOutput), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		loopDevice := fields[0]
+		backFile := strings.TrimSuffix(strings.Join(fields[1:], " "), " (deleted)")
+		if !strings.HasPrefix(backFile, stateMachine.stateMachineFlags.WorkDir+string(filepath.Separator)) {
+			continue
+		}
+		fmt.Printf("Detaching %s backed by %s\n", loopDevice, backFile)
+		detachCmds = append(detachCmds, execCommand("losetup", "--detach", loopDevice))
+	}
+	return execTeardownCmds(detachCmds, stateMachine.commonFlags.Debug, nil)
+}
+
+// replacedChrootFiles are the files of the chroot replaced by
+// backupReplaceStartStopDaemon and backupReplaceInitctl
+var replacedChrootFiles = []string{
+	filepath.Join("sbin", "start-stop-daemon"),
+	filepath.Join("sbin", "initctl"),
+}
+
+// divertedChrootFiles are the files of the chroot diverted with dpkgDivert
+var divertedChrootFiles = []string{
+	"/usr/sbin/policy-rc.d",
+	"/etc/grub.d/30_os-prober",
+}
+
+var restoreChrootFilesState = stateFunc{"restore_chroot_files", (*StateMachine).restoreChrootFiles}
+
+// restoreChrootFiles puts back the files of the chroot replaced or diverted
+// while packages were installed in it
+func (stateMachine *StateMachine) restoreChrootFiles() error {
+	chroot := stateMachine.tempDirs.chroot
+	if _, err := os.Stat(chroot); err != nil {
+		return nil
+	}
+
+	policyRcD := filepath.Join(chroot, "usr", "sbin", "policy-rc.d")
+	policyRcDContent, err := osReadFile(policyRcD)
+	if err == nil && string(policyRcDContent) == policyRcDDisableAll {
+		fmt.Printf("Removing %s\n", policyRcD)
+		if err := osRemove(policyRcD); err != nil {
+			return fmt.Errorf("Error removing %s: %s", policyRcD, err.Error())
+		}
+	}
+
+	var undivertCmds []*exec.Cmd
+	for _, target := range divertedChrootFiles {
+		if !osutil.FileExists(filepath.Join(chroot, target+".dpkg-divert")) {
+			continue
+		}
+		fmt.Printf("Removing the diversion of %s\n", target)
+		_, undivertCmd := dpkgDivert(chroot, target)
+		undivertCmds = append(undivertCmds, undivertCmd)
+	}
+	err = execTeardownCmds(undivertCmds, stateMachine.commonFlags.Debug, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, replaced := range replacedChrootFiles {
+		target := filepath.Join(chroot, replaced)
+		backup := target + ".REAL"
+		if !osutil.FileExists(backup) {
+			continue
+		}
+		fmt.Printf("Restoring %s\n", target)
+		if err := osRename(backup, target); err != nil {
+			return fmt.Errorf("Error moving file \"%s\" to \"%s\": %s", backup, target, err.Error())
+		}
+	}
+
+	return helperRestoreResolvConf(chroot)
+}
+
+var deleteWorkDirState = stateFunc{"delete_workdir", (*StateMachine).deleteWorkDir}
+
+// deleteWorkDir deletes the cleaned workdir
+func (stateMachine *StateMachine) deleteWorkDir() error {
+	workDir := stateMachine.stateMachineFlags.WorkDir
+	// never delete files of the host through a mountpoint left behind
+	mountPoints, err := listMounts(workDir + string(filepath.Separator))
+	if err != nil {
+		return fmt.Errorf("Error listing mountpoints: %s", err.Error())
+	}
+	if len(mountPoints) > 0 {
+		return fmt.Errorf("cannot delete workdir %s as %s is still mounted", workDir, mountPoints[0].path)
+	}
+	fmt.Printf("Deleting %s\n", workDir)
+	if err := osRemoveAll(workDir); err != nil {
+		return fmt.Errorf("Error deleting workdir: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/testhelper"
+)
+
+// mockProcMounts makes listMounts read the given mounts
+func mockProcMounts(t *testing.T, procMounts string) {
+	t.Helper()
+	osReadFile = func(name string) ([]byte, error) {
+		if name == "/proc/self/mounts" {
+			return []byte(procMounts), nil
+		}
+		return os.ReadFile(name)
+	}
+	t.Cleanup(func() { osReadFile = os.ReadFile })
+}
+
+// recordCommands records the commands run instead of running them. The
+// output of the commands starting with one of the given prefixes is faked.
+func recordCommands(t *testing.T, outputs map[string]string) *[]string {
+	t.Helper()
+	gotCmds := &[]string{}
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		cmd := strings.Join(append([]string{name}, args...), " ")
+		for prefix, output := range outputs {
+			if strings.HasPrefix(cmd, prefix) {
+				return exec.Command("printf", "%s", output)
+			}
+		}
+		*gotCmds = append(*gotCmds, cmd)
+		return exec.Command("true")
+	}
+	t.Cleanup(func() { execCommand = exec.Command })
+	return gotCmds
+}
+
+func TestCleanStateMachine_Setup(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+	tmpDir := t.TempDir()
+	err := os.Chdir(tmpDir)
+	asserter.AssertErrNil(err, true)
+	err = os.Mkdir("workdir", 0755)
+	asserter.AssertErrNil(err, true)
+
+	var stateMachine CleanStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+	err = stateMachine.Setup()
+	asserter.AssertErrContains(err, "must specify the workdir to clean with --workdir")
+
+	stateMachine.stateMachineFlags.WorkDir = "inexistent"
+	err = stateMachine.Setup()
+	asserter.AssertErrContains(err, "does not exist or is not a directory")
+
+	stateMachine.stateMachineFlags.WorkDir = "workdir"
+	stateMachine.stateMachineFlags.Resume = true
+	err = stateMachine.Setup()
+	asserter.AssertErrContains(err, "the clean command cannot be resumed")
+	stateMachine.stateMachineFlags.Resume = false
+
+	err = stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(filepath.Join(tmpDir, "workdir"), stateMachine.stateMachineFlags.WorkDir)
+	asserter.AssertEqual(filepath.Join(tmpDir, "workdir", "chroot"), stateMachine.tempDirs.chroot)
+	asserter.AssertEqual(len(cleanStates), len(stateMachine.states))
+	err = stateMachine.Teardown()
+	asserter.AssertErrNil(err, true)
+
+	// a running build is not cleaned
+	lock, err := lockWorkDir(stateMachine.stateMachineFlags.WorkDir, false)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.Setup()
+	asserter.AssertErrContains(err, "is in use by another ubuntu-image process")
+	err = lock.release()
+	asserter.AssertErrNil(err, true)
+
+	// the lock left by a crashed build is removed
+	err = os.WriteFile(filepath.Join("workdir", lockFileName), []byte("4242\n"), 0644)
+	asserter.AssertErrNil(err, true)
+	stateMachine.Opts.Delete = true
+	err = stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(deleteWorkDirState.name, stateMachine.states[len(stateMachine.states)-1].name)
+	err = stateMachine.Teardown()
+	asserter.AssertErrNil(err, true)
+}
+
+// TestCleanStateMachine_Run cleans and deletes a workdir
+func TestCleanStateMachine_Run(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	workDir := t.TempDir()
+	mockProcMounts(t, "")
+	gotCmds := recordCommands(t, map[string]string{"losetup --list": ""})
+
+	var stateMachine CleanStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Quiet = true
+	stateMachine.stateMachineFlags.WorkDir = workDir
+	stateMachine.Opts.Delete = true
+
+	err := stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.Run()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.Teardown()
+	asserter.AssertErrNil(err, true)
+
+	asserter.AssertEqual([]string{}, *gotCmds)
+	_, err = os.Stat(workDir)
+	if !os.IsNotExist(err) {
+		t.Errorf("The workdir was not deleted: %v", err)
+	}
+}
+
+// TestCleanStateMachine_Run_fail ensures the lock of a workdir not fully
+// cleaned is kept, so that it is reported as stale to the next build
+func TestCleanStateMachine_Run_fail(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	workDir := t.TempDir()
+	mockProcMounts(t, "devpts-build "+filepath.Join(workDir, "chroot", "dev", "pts")+" devpts rw 0 0\n")
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		return exec.Command("false")
+	}
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	var stateMachine CleanStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Quiet = true
+	stateMachine.stateMachineFlags.WorkDir = workDir
+
+	err := stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.Run()
+	if err == nil {
+		t.Fatal("Expected an error, but got none")
+	}
+
+	_, err = os.Stat(filepath.Join(workDir, lockFileName))
+	asserter.AssertErrNil(err, true)
+	_, err = lockWorkDir(workDir, false)
+	asserter.AssertErrContains(err, "which did not exit cleanly")
+
+	// the workdir can be cleaned again
+	lock, err := lockWorkDir(workDir, true)
+	asserter.AssertErrNil(err, true)
+	err = lock.release()
+	asserter.AssertErrNil(err, true)
+}
+
+func TestStateMachine_unmountWorkDir(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	procMounts := `/dev/sda1 /work ext4 rw 0 0
+devtmpfs-build /work/chroot/dev devtmpfs rw 0 0
+devpts-build /work/chroot/dev/pts devpts rw 0 0
+proc-build /work/chroot/proc proc rw 0 0
+/dev/loop0p2 /work/scratch/loopback ext4 rw 0 0
+proc-build /work/scratch/loopback/proc proc rw 0 0
+tmpfs /work2/chroot tmpfs rw 0 0
+`
+	mockProcMounts(t, procMounts)
+	gotCmds := recordCommands(t, nil)
+
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.stateMachineFlags.WorkDir = "/work"
+
+	err := stateMachine.unmountWorkDir()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual([]string{
+		"umount /work/scratch/loopback/proc",
+		"umount /work/chroot/dev/pts",
+		"umount /work/scratch/loopback",
+		"umount /work/chroot/proc",
+		"umount /work/chroot/dev",
+	}, *gotCmds)
+
+	execCommand = func(string, ...string) *exec.Cmd { return exec.Command("false") }
+	err = stateMachine.unmountWorkDir()
+	asserter.AssertErrContains(err, "teardown failed")
+
+	osReadFile = mockReadFile
+	err = stateMachine.unmountWorkDir()
+	asserter.AssertErrContains(err, "Error listing mountpoints")
+}
+
+func TestStateMachine_detachLoopDevices(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	losetupOutput := `/dev/loop0 /work/pc.img
+/dev/loop1 /var/lib/snapd/snaps/core_1.snap
+/dev/loop2 /work/scratch/my image.img (deleted)
+/dev/loop3 /work2/pc.img
+`
+	gotCmds := recordCommands(t, map[string]string{"losetup --list": losetupOutput})
+
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.stateMachineFlags.WorkDir = "/work"
+
+	err := stateMachine.detachLoopDevices()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual([]string{
+		"losetup --detach /dev/loop0",
+		"losetup --detach /dev/loop2",
+	}, *gotCmds)
+
+	execCommand = func(string, ...string) *exec.Cmd { return exec.Command("false") }
+	err = stateMachine.detachLoopDevices()
+	asserter.AssertErrContains(err, "Error listing loop devices")
+}
+
+func TestStateMachine_restoreChrootFiles(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	workDir := t.TempDir()
+	chroot := filepath.Join(workDir, "chroot")
+
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.stateMachineFlags.WorkDir = workDir
+	stateMachine.tempDirs.chroot = chroot
+
+	// nothing to do without a chroot
+	err := stateMachine.restoreChrootFiles()
+	asserter.AssertErrNil(err, true)
+
+	files := map[string]string{
+		"usr/sbin/policy-rc.d":                policyRcDDisableAll,
+		"usr/sbin/policy-rc.d.dpkg-divert":    "original policy",
+		"sbin/start-stop-daemon":              "fake",
+		"sbin/start-stop-daemon.REAL":         "original start-stop-daemon",
+		"sbin/initctl":                        "initctl",
+		"etc/grub.d/30_os-prober.dpkg-divert": "os-prober",
+		"etc/resolv.conf":                     "host resolv.conf",
+		"etc/resolv.conf.tmp":                 "original resolv.conf",
+	}
+	for name, content := range files {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(chroot, name)), 0755)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(filepath.Join(chroot, name), []byte(content), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+	gotCmds := recordCommands(t, nil)
+
+	err = stateMachine.restoreChrootFiles()
+	asserter.AssertErrNil(err, true)
+	// dpkgDivert also creates the unused command diverting the file
+	var undivertCmds []string
+	for _, cmd := range *gotCmds {
+		if strings.Contains(cmd, "--remove") {
+			undivertCmds = append(undivertCmds, cmd)
+		}
+	}
+	asserter.AssertEqual([]string{
+		fmt.Sprintf("chroot %s dpkg-divert --remove --local --divert /usr/sbin/policy-rc.d.dpkg-divert --rename /usr/sbin/policy-rc.d", chroot),
+		fmt.Sprintf("chroot %s dpkg-divert --remove --local --divert /etc/grub.d/30_os-prober.dpkg-divert --rename /etc/grub.d/30_os-prober", chroot),
+	}, undivertCmds)
+
+	_, err = os.Stat(filepath.Join(chroot, "usr", "sbin", "policy-rc.d"))
+	if !os.IsNotExist(err) {
+		t.Errorf("The denying policy-rc.d was not removed: %v", err)
+	}
+	wantFiles := map[string]string{
+		"sbin/start-stop-daemon": "original start-stop-daemon",
+		"sbin/initctl":           "initctl",
+		"etc/resolv.conf":        "original resolv.conf",
+	}
+	for name, wantContent := range wantFiles {
+		content, err := os.ReadFile(filepath.Join(chroot, name))
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual(wantContent, string(content))
+	}
+
+	// a policy-rc.d not set by ubuntu-image is kept
+	err = os.WriteFile(filepath.Join(chroot, "usr", "sbin", "policy-rc.d"), []byte("custom"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.restoreChrootFiles()
+	asserter.AssertErrNil(err, true)
+	_, err = os.Stat(filepath.Join(chroot, "usr", "sbin", "policy-rc.d"))
+	asserter.AssertErrNil(err, true)
+}
+
+func TestStateMachine_deleteWorkDir(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	workDir := t.TempDir()
+
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.stateMachineFlags.WorkDir = workDir
+
+	mockProcMounts(t, fmt.Sprintf("proc-build %s/chroot/proc proc rw 0 0\n", workDir))
+	err := stateMachine.deleteWorkDir()
+	asserter.AssertErrContains(err, "is still mounted")
+	_, err = os.Stat(workDir)
+	asserter.AssertErrNil(err, true)
+
+	mockProcMounts(t, "")
+	osRemoveAll = mockRemoveAll
+	err = stateMachine.deleteWorkDir()
+	asserter.AssertErrContains(err, "Error deleting workdir")
+	osRemoveAll = os.RemoveAll
+
+	err = stateMachine.deleteWorkDir()
+	asserter.AssertErrNil(err, true)
+	_, err = os.Stat(workDir)
+	if !os.IsNotExist(err) {
+		t.Errorf("The workdir was not deleted: %v", err)
+	}
+}
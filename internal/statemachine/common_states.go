@@ -122,7 +122,7 @@ var generateDiskInfoState = stateFunc{"generate_disk_info", (*StateMachine).gene
 func (stateMachine *StateMachine) generateDiskInfo() error {
 	if stateMachine.commonFlags.DiskInfo != "" {
 		diskInfoDir := filepath.Join(stateMachine.tempDirs.rootfs, ".disk")
-		if err := osMkdir(diskInfoDir, 0755); err != nil {
+		if err := osMkdir(diskInfoDir, 0755); err != nil && !os.IsExist(err) {
 			return fmt.Errorf("Failed to create disk info directory: %s", err.Error())
 		}
 		diskInfoFile := filepath.Join(diskInfoDir, "info")
@@ -0,0 +1,253 @@
+package statemachine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// maxDownloadAttempts is the number of times an interrupted download
+// is tried before giving up
+const maxDownloadAttempts = 3
+
+var httpClient = &http.Client{}
+
+// isRemoteURL returns whether the given URL points to a file that must
+// be downloaded rather than a local file
+func isRemoteURL(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// remoteFileVersion returns the ETag or the last modification date of a
+// remote file, or an empty string if the server does not report them
+func remoteFileVersion(url string) string {
+	resp, err := httpClient.Head(url)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// downloadCacheDir returns the directory in which downloaded files are cached
+func (classicStateMachine *ClassicStateMachine) downloadCacheDir() (string, error) {
+	if classicStateMachine.Opts.CacheDir != "" {
+		return classicStateMachine.Opts.CacheDir, nil
+	}
+	userCacheDir, err := osUserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("Error finding the user cache directory, use --cache-dir "+
+			"to set the download cache directory: %s", err.Error())
+	}
+	return filepath.Join(userCacheDir, "ubuntu-image"), nil
+}
+
+// fetchToCache downloads a file into the cache directory and returns its
+// path. Downloaded files are stored under their SHA256 sum so that a file
+// with a known SHA256 sum is only downloaded once. Partial downloads are
+// kept and resumed by later attempts, as long as the server reports the
+// file did not change since. Without a SHA256 sum to verify the resumed
+// download, a partial download is discarded if the server cannot tell.
+func fetchToCache(url string, sha256sum string, cacheDir string) (string, error) {
+	contentDir := filepath.Join(cacheDir, "sha256")
+	partialDir := filepath.Join(cacheDir, "partial")
+	for _, dir := range []string{contentDir, partialDir} {
+		err := osMkdirAll(dir, 0755)
+		if err != nil {
+			return "", fmt.Errorf("Error creating download cache directory: %s", err.Error())
+		}
+	}
+
+	if sha256sum != "" {
+		cachedPath := filepath.Join(contentDir, sha256sum)
+		if _, err := os.Stat(cachedPath); err == nil {
+			cachedSHA256, err := helper.CalculateSHA256(cachedPath)
+			if err != nil {
+				return "", err
+			}
+			if cachedSHA256 == sha256sum {
+				fmt.Printf("Using cached download of %s\n", url)
+				return cachedPath, nil
+			}
+			// the cached file was altered, download it again
+			err = osRemove(cachedPath)
+			if err != nil {
+				return "", fmt.Errorf("Error removing corrupted cached file \"%s\": %s",
+					cachedPath, err.Error())
+			}
+		}
+	}
+
+	// partial downloads are named after the URL and the expected content
+	// so a resumed download cannot mix different files
+	partialKey := sha256.Sum256([]byte(url + "\n" + sha256sum))
+	partialPath := filepath.Join(partialDir, hex.EncodeToString(partialKey[:]))
+
+	var err error
+	for attempt := 1; attempt <= maxDownloadAttempts; attempt++ {
+		err = resumeDownload(url, partialPath, sha256sum != "")
+		if err == nil {
+			break
+		}
+		if attempt < maxDownloadAttempts {
+			fmt.Printf("WARNING: download of %s failed, retrying: %s\n", url, err.Error())
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	downloadedSHA256, err := helper.CalculateSHA256(partialPath)
+	if err != nil {
+		return "", err
+	}
+	// the version of the file is only needed to resume the download
+	removeErr := osRemove(partialPath + validatorSuffix)
+	if removeErr != nil && !os.IsNotExist(removeErr) {
+		fmt.Printf("WARNING: could not remove the version of partial download \"%s\": %s\n",
+			partialPath, removeErr.Error())
+	}
+	if sha256sum != "" && downloadedSHA256 != sha256sum {
+		removeErr := osRemove(partialPath)
+		if removeErr != nil {
+			fmt.Printf("WARNING: could not remove partial download \"%s\": %s\n",
+				partialPath, removeErr.Error())
+		}
+		return "", fmt.Errorf("Calculated SHA256 sum of file downloaded from %s \"%s\" does not "+
+			"match the expected value \"%s\"", url, downloadedSHA256, sha256sum)
+	}
+
+	cachedPath := filepath.Join(contentDir, downloadedSHA256)
+	err = osRename(partialPath, cachedPath)
+	if err != nil {
+		return "", fmt.Errorf("Error moving downloaded file to the cache: %s", err.Error())
+	}
+	return cachedPath, nil
+}
+
+// validatorSuffix is the suffix of the file next to a partial download
+// holding the version of the file reported by the server
+const validatorSuffix = ".validator"
+
+// resumeDownload downloads a file to dest. If dest already holds the
+// beginning of the file, only the remaining content is requested, provided
+// the file did not change since on the server. If the server did not report
+// the version of the file, the partial download is only resumed when it is
+// verified once complete.
+func resumeDownload(url string, dest string, verified bool) error {
+	destFile, err := osOpenFile(dest, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening download destination \"%s\": %s", dest, err.Error())
+	}
+	defer destFile.Close()
+
+	offset, err := destFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("Error reading partial download \"%s\": %s", dest, err.Error())
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("Error creating request for %s: %s", url, err.Error())
+	}
+	validator, err := osReadFile(dest + validatorSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error reading the version of partial download \"%s\": %s", dest, err.Error())
+	}
+	if offset > 0 && len(validator) == 0 && !verified {
+		// the partial download may be the beginning of another version of the file
+		if err := truncateDownload(destFile, dest); err != nil {
+			return err
+		}
+		offset = 0
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if len(validator) > 0 {
+			req.Header.Set("If-Range", string(validator))
+		}
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error downloading %s: %s", url, err.Error())
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent &&
+		strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+		// the server sends the remaining content
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable &&
+		resp.Header.Get("Content-Range") == fmt.Sprintf("bytes */%d", offset):
+		// the partial download is already complete
+		return nil
+	case resp.StatusCode == http.StatusOK ||
+		resp.StatusCode == http.StatusPartialContent ||
+		resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// the whole file is sent, or the partial download cannot be resumed
+		if err := truncateDownload(destFile, dest); err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Error resuming download of %s: unexpected range in response", url)
+		}
+		if err := writeDownloadValidator(resp, dest); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Error downloading %s: server returned \"%s\"", url, resp.Status)
+	}
+
+	_, err = io.Copy(destFile, resp.Body)
+	if err != nil {
+		return fmt.Errorf("Error downloading %s: %s", url, err.Error())
+	}
+	return nil
+}
+
+// truncateDownload empties a partial download to download it again
+func truncateDownload(destFile *os.File, dest string) error {
+	if err := destFile.Truncate(0); err != nil {
+		return fmt.Errorf("Error truncating partial download \"%s\": %s", dest, err.Error())
+	}
+	if _, err := destFile.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("Error truncating partial download \"%s\": %s", dest, err.Error())
+	}
+	return nil
+}
+
+// writeDownloadValidator saves the version of the file being downloaded, its
+// strong ETag or else its last modification date, to resume the download
+// only if the file did not change
+func writeDownloadValidator(resp *http.Response, dest string) error {
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	if validator == "" {
+		err := osRemove(dest + validatorSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error removing the version of partial download \"%s\": %s", dest, err.Error())
+		}
+		return nil
+	}
+	err := osWriteFile(dest+validatorSuffix, []byte(validator), 0644)
+	if err != nil {
+		return fmt.Errorf("Error saving the version of partial download \"%s\": %s", dest, err.Error())
+	}
+	return nil
+}
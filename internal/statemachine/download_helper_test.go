@@ -0,0 +1,220 @@
+package statemachine
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+var downloadContent = bytes.Repeat([]byte("ubuntu-image download test content\n"), 100)
+
+func downloadContentSHA256() string {
+	sum := sha256.Sum256(downloadContent)
+	return hex.EncodeToString(sum[:])
+}
+
+func Test_fetchToCache(t *testing.T) {
+	tests := []struct {
+		name string
+		// handler serves downloadContent, requests counts the requests
+		handler func(requests int32, w http.ResponseWriter, r *http.Request)
+		// partialContent is the content of a previously interrupted download
+		partialContent []byte
+		// partialValidator is the version of the file partially downloaded
+		partialValidator string
+		sha256sum        string
+		cached           bool
+		expectedRequests int32
+		expectedRanges   []string
+		expectedError    string
+	}{
+		{
+			name:             "download with sha256sum",
+			sha256sum:        downloadContentSHA256(),
+			expectedRequests: 1,
+			expectedRanges:   []string{""},
+		},
+		{
+			name:             "download without sha256sum",
+			expectedRequests: 1,
+			expectedRanges:   []string{""},
+		},
+		{
+			name:             "cached download",
+			sha256sum:        downloadContentSHA256(),
+			cached:           true,
+			expectedRequests: 0,
+		},
+		{
+			name:             "resume a partial download",
+			sha256sum:        downloadContentSHA256(),
+			partialContent:   downloadContent[:1000],
+			expectedRequests: 1,
+			expectedRanges:   []string{"bytes=1000-"},
+		},
+		{
+			name:             "complete partial download",
+			sha256sum:        downloadContentSHA256(),
+			partialContent:   downloadContent,
+			expectedRequests: 1,
+			expectedRanges:   []string{"bytes=3500-"},
+		},
+		{
+			name:             "discard a partial download without sha256sum nor version",
+			partialContent:   []byte("garbage"),
+			expectedRequests: 1,
+			expectedRanges:   []string{""},
+		},
+		{
+			name:             "resume a partial download without sha256sum",
+			partialContent:   downloadContent[:1000],
+			partialValidator: `"v1"`,
+			expectedRequests: 1,
+			expectedRanges:   []string{"bytes=1000-"},
+		},
+		{
+			name:             "partial download of a changed file",
+			partialContent:   []byte("garbage"),
+			partialValidator: `"v0"`,
+			expectedRequests: 1,
+			expectedRanges:   []string{"bytes=7-"},
+		},
+		{
+			name:           "server ignoring ranges",
+			sha256sum:      downloadContentSHA256(),
+			partialContent: []byte("garbage"),
+			handler: func(requests int32, w http.ResponseWriter, r *http.Request) {
+				w.Write(downloadContent) // nolint: errcheck
+			},
+			expectedRequests: 1,
+			expectedRanges:   []string{"bytes=7-"},
+		},
+		{
+			name:      "resume an interrupted download",
+			sha256sum: downloadContentSHA256(),
+			handler: func(requests int32, w http.ResponseWriter, r *http.Request) {
+				if requests == 1 {
+					// announce the whole content but only send half of it
+					w.Header().Set("Content-Length", "3500")
+					w.Write(downloadContent[:1750]) // nolint: errcheck
+					return
+				}
+				http.ServeContent(w, r, "rootfs.tar", time.Time{}, bytes.NewReader(downloadContent))
+			},
+			expectedRequests: 2,
+			expectedRanges:   []string{"", "bytes=1750-"},
+		},
+		{
+			name:             "wrong sha256sum",
+			sha256sum:        strings.Repeat("0", 64),
+			expectedRequests: 1,
+			expectedError:    "does not match the expected value",
+		},
+		{
+			name: "missing file",
+			handler: func(requests int32, w http.ResponseWriter, r *http.Request) {
+				http.NotFound(w, r)
+			},
+			expectedRequests: maxDownloadAttempts,
+			expectedError:    "server returned \"404 Not Found\"",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var requests int32
+			var ranges []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&requests, 1)
+				ranges = append(ranges, r.Header.Get("Range"))
+				if tc.handler != nil {
+					tc.handler(n, w, r)
+					return
+				}
+				w.Header().Set("ETag", `"v1"`)
+				http.ServeContent(w, r, "rootfs.tar", time.Time{}, bytes.NewReader(downloadContent))
+			}))
+			t.Cleanup(server.Close)
+
+			url := server.URL + "/rootfs.tar"
+			cacheDir := t.TempDir()
+
+			if tc.cached {
+				err := os.MkdirAll(filepath.Join(cacheDir, "sha256"), 0755)
+				asserter.AssertErrNil(err, true)
+				err = os.WriteFile(filepath.Join(cacheDir, "sha256", tc.sha256sum), downloadContent, 0644)
+				asserter.AssertErrNil(err, true)
+			}
+			if tc.partialContent != nil {
+				partialKey := sha256.Sum256([]byte(url + "\n" + tc.sha256sum))
+				partialPath := filepath.Join(cacheDir, "partial", hex.EncodeToString(partialKey[:]))
+				err := os.MkdirAll(filepath.Dir(partialPath), 0755)
+				asserter.AssertErrNil(err, true)
+				err = os.WriteFile(partialPath, tc.partialContent, 0644)
+				asserter.AssertErrNil(err, true)
+				if tc.partialValidator != "" {
+					err = os.WriteFile(partialPath+validatorSuffix, []byte(tc.partialValidator), 0644)
+					asserter.AssertErrNil(err, true)
+				}
+			}
+
+			gotPath, err := fetchToCache(url, tc.sha256sum, cacheDir)
+			if got := atomic.LoadInt32(&requests); got != tc.expectedRequests {
+				t.Errorf("Expected %d requests but got %d", tc.expectedRequests, got)
+			}
+			if len(tc.expectedError) != 0 {
+				asserter.AssertErrContains(err, tc.expectedError)
+				partialFiles, _ := os.ReadDir(filepath.Join(cacheDir, "partial"))
+				if tc.sha256sum != "" && len(partialFiles) != 0 {
+					t.Errorf("Partial download with a wrong SHA256 sum should have been removed")
+				}
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expectedRanges, ranges)
+			asserter.AssertEqual(filepath.Join(cacheDir, "sha256", downloadContentSHA256()), gotPath)
+			partialFiles, _ := os.ReadDir(filepath.Join(cacheDir, "partial"))
+			if len(partialFiles) != 0 {
+				t.Errorf("The partial download was not moved to the cache")
+			}
+
+			gotContent, err := os.ReadFile(gotPath)
+			asserter.AssertErrNil(err, true)
+			if !bytes.Equal(downloadContent, gotContent) {
+				t.Errorf("Downloaded content does not match the served content")
+			}
+		})
+	}
+}
+
+func TestStateMachine_downloadCacheDir(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+
+	stateMachine.Opts.CacheDir = "/cache"
+	gotDir, err := stateMachine.downloadCacheDir()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("/cache", gotDir)
+
+	savedUserCacheDir := osUserCacheDir
+	t.Cleanup(func() { osUserCacheDir = savedUserCacheDir })
+	stateMachine.Opts.CacheDir = ""
+	osUserCacheDir = func() (string, error) { return "/home/user/.cache", nil }
+	gotDir, err = stateMachine.downloadCacheDir()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("/home/user/.cache/ubuntu-image", gotDir)
+
+	osUserCacheDir = func() (string, error) { return "", os.ErrNotExist }
+	_, err = stateMachine.downloadCacheDir()
+	asserter.AssertErrContains(err, "use --cache-dir")
+}
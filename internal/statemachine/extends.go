@@ -0,0 +1,228 @@
+package statemachine
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// extendsKey is the key of an image definition listing the image definitions
+// it extends
+const extendsKey = "extends"
+
+// appendSuffix is added to the key of a list to append it to the list of the
+// extended image definitions rather than replace it
+const appendSuffix = "+"
+
+// readImageDefinitionTree reads the image definition at imageDefPath merged onto
+// the image definitions it extends. The paths of the files read are returned,
+// the extended image definitions first.
+func readImageDefinitionTree(imageDefPath string, extendedBy []string) (map[interface{}]interface{}, []string, error) {
+	absPath, err := filepath.Abs(imageDefPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error finding the absolute path of %s: %s", imageDefPath, err.Error())
+	}
+	for _, child := range extendedBy {
+		if child == absPath {
+			return nil, nil, fmt.Errorf("image definition %s extends itself", imageDefPath)
+		}
+	}
+
+	content, err := osReadFile(imageDefPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error opening image definition file: %s", err.Error())
+	}
+	definition := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal(content, &definition); err != nil {
+		return nil, nil, &imageDefinitionFileError{"parsing", imageDefPath, err}
+	}
+
+	extended, err := extendedImageDefinitions(definition[extendsKey])
+	if err != nil {
+		return nil, nil, &imageDefinitionFileError{"parsing", imageDefPath, err}
+	}
+	delete(definition, extendsKey)
+
+	resolved := make(map[interface{}]interface{})
+	var files []string
+	for _, parentPath := range extended {
+		// extended image definitions are relative to the one extending them
+		if !filepath.IsAbs(parentPath) {
+			parentPath = filepath.Join(filepath.Dir(imageDefPath), parentPath)
+		}
+		chain := append(append([]string{}, extendedBy...), absPath)
+		parent, parentFiles, err := readImageDefinitionTree(parentPath, chain)
+		if err != nil {
+			return nil, nil, err
+		}
+		resolved, err = mergeImageDefinitions(resolved, parent)
+		if err != nil {
+			return nil, nil, &imageDefinitionFileError{"merging", parentPath, err}
+		}
+		files = append(files, parentFiles...)
+	}
+
+	resolved, err = mergeImageDefinitions(resolved, definition)
+	if err != nil {
+		return nil, nil, &imageDefinitionFileError{"merging", imageDefPath, err}
+	}
+	return resolved, append(files, imageDefPath), nil
+}
+
+// imageDefinitionFileError is an error found in one of the files an image
+// definition is read from
+type imageDefinitionFileError struct {
+	action string
+	path   string
+	err    error
+}
+
+func (e *imageDefinitionFileError) Error() string {
+	return fmt.Sprintf("Error %s image definition file %s: %s", e.action, e.path, e.err.Error())
+}
+
+func (e *imageDefinitionFileError) Unwrap() error {
+	return e.err
+}
+
+// mergeError is an error merging the key at location of an image definition
+type mergeError struct {
+	location []string
+	message  string
+}
+
+func (e *mergeError) Error() string {
+	// the key the error is about is already named in the message
+	return strings.Join(append(append([]string{}, e.location[:len(e.location)-1]...), e.message), ": ")
+}
+
+// extendedImageDefinitions returns the paths listed by the extends key, given
+// as a single path or a list of paths
+func extendedImageDefinitions(extends interface{}) ([]string, error) {
+	switch value := extends.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []interface{}:
+		paths := make([]string, 0, len(value))
+		for _, item := range value {
+			path, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a path or a list of paths", extendsKey)
+			}
+			paths = append(paths, path)
+		}
+		return paths, nil
+	default:
+		return nil, fmt.Errorf("%s must be a path or a list of paths", extendsKey)
+	}
+}
+
+// mergeImageDefinitions merges an image definition onto the one it extends:
+//   - mappings are merged key by key
+//   - lists and scalars replace the extended ones, while a list given with
+//     a key ending with "+" is appended to the extended list
+//   - a null value removes the key from the extended image definition
+func mergeImageDefinitions(base, overlay map[interface{}]interface{}) (map[interface{}]interface{}, error) {
+	merged := make(map[interface{}]interface{}, len(base))
+	for key, value := range base {
+		merged[key] = value
+	}
+
+	for key, value := range overlay {
+		name, isString := key.(string)
+		if isString && strings.HasSuffix(name, appendSuffix) {
+			name = strings.TrimSuffix(name, appendSuffix)
+			if _, found := overlay[name]; found {
+				return nil, &mergeError{[]string{name}, fmt.Sprintf("keys %s and %s cannot be used together", name, key)}
+			}
+			list, isList := value.([]interface{})
+			if !isList {
+				return nil, &mergeError{[]string{name}, fmt.Sprintf("key %s can only be used with a list", key)}
+			}
+			baseList, isList := merged[name].([]interface{})
+			if merged[name] != nil && !isList {
+				return nil, &mergeError{[]string{name}, fmt.Sprintf("key %s cannot be appended to %s which is not a list", key, name)}
+			}
+			merged[name] = append(append([]interface{}{}, baseList...), list...)
+			continue
+		}
+
+		if value == nil {
+			delete(merged, key)
+			continue
+		}
+
+		overlayMap, isMap := value.(map[interface{}]interface{})
+		if !isMap {
+			merged[key] = value
+			continue
+		}
+		// the keys of a mapping not in the extended image definition may
+		// still end with "+"
+		baseMap, isMap := merged[key].(map[interface{}]interface{})
+		if !isMap {
+			baseMap = make(map[interface{}]interface{})
+		}
+		mergedMap, err := mergeImageDefinitions(baseMap, overlayMap)
+		if err != nil {
+			nestedErr := err.(*mergeError)
+			nestedErr.location = append([]string{fmt.Sprint(key)}, nestedErr.location...)
+			return nil, nestedErr
+		}
+		merged[key] = mergedMap
+	}
+	return merged, nil
+}
+
+// pruneImageDefinition removes the empty values of a decoded image definition
+// so that only the keys set are printed
+func pruneImageDefinition(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case yaml.MapSlice:
+		pruned := yaml.MapSlice{}
+		for _, item := range typed {
+			if item.Value = pruneImageDefinition(item.Value); item.Value != nil {
+				pruned = append(pruned, item)
+			}
+		}
+		if len(pruned) == 0 {
+			return nil
+		}
+		return pruned
+	case []interface{}:
+		if len(typed) == 0 {
+			return nil
+		}
+		for i, item := range typed {
+			typed[i] = pruneImageDefinition(item)
+		}
+	case string:
+		if typed == "" {
+			return nil
+		}
+	}
+	return value
+}
+
+// printImageDefinition prints the resolved image definition as YAML, keeping
+// the order of the keys of the image definition struct
+func printImageDefinition(imageDefinition interface{}) error {
+	content, err := yaml.Marshal(imageDefinition)
+	if err != nil {
+		return fmt.Errorf("Error marshalling the image definition: %s", err.Error())
+	}
+	decoded := yaml.MapSlice{}
+	if err := yaml.Unmarshal(content, &decoded); err != nil {
+		return fmt.Errorf("Error marshalling the image definition: %s", err.Error())
+	}
+	content, err = yaml.Marshal(pruneImageDefinition(decoded))
+	if err != nil {
+		return fmt.Errorf("Error marshalling the image definition: %s", err.Error())
+	}
+	fmt.Printf("Resolved image definition:\n%s", content)
+	return nil
+}
@@ -0,0 +1,180 @@
+package statemachine
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+func Test_mergeImageDefinitions(t *testing.T) {
+	testCases := []struct {
+		name        string
+		base        string
+		overlay     string
+		want        string
+		expectedErr string
+	}{
+		{
+			name:    "scalars replaced",
+			base:    "name: base\nseries: jammy\n",
+			overlay: "name: child\n",
+			want:    "name: child\nseries: jammy\n",
+		},
+		{
+			name:    "mappings merged",
+			base:    "rootfs:\n  flavor: ubuntu\n  pocket: release\n",
+			overlay: "rootfs:\n  pocket: updates\n",
+			want:    "rootfs:\n  flavor: ubuntu\n  pocket: updates\n",
+		},
+		{
+			name:    "lists replaced",
+			base:    "rootfs:\n  components: [main, universe]\n",
+			overlay: "rootfs:\n  components: [restricted]\n",
+			want:    "rootfs:\n  components: [restricted]\n",
+		},
+		{
+			name:    "lists appended",
+			base:    "rootfs:\n  components: [main, universe]\n",
+			overlay: "rootfs:\n  components+: [restricted]\n",
+			want:    "rootfs:\n  components: [main, universe, restricted]\n",
+		},
+		{
+			name:    "list appended to a missing one",
+			base:    "name: base\n",
+			overlay: "customization:\n  extra-packages+: [{name: hello}]\n",
+			want:    "name: base\ncustomization:\n  extra-packages: [{name: hello}]\n",
+		},
+		{
+			name:    "null removes the key",
+			base:    "gadget:\n  type: git\nkernel: linux-generic\n",
+			overlay: "gadget: null\n",
+			want:    "kernel: linux-generic\n",
+		},
+		{
+			name:        "list and appended list",
+			base:        "name: base\n",
+			overlay:     "rootfs:\n  components: [main]\n  components+: [universe]\n",
+			expectedErr: "rootfs: keys components and components+ cannot be used together",
+		},
+		{
+			name:        "appending a mapping",
+			base:        "name: base\n",
+			overlay:     "rootfs+:\n  flavor: ubuntu\n",
+			expectedErr: "key rootfs+ can only be used with a list",
+		},
+		{
+			name:        "appending to a mapping",
+			base:        "rootfs:\n  flavor: ubuntu\n",
+			overlay:     "rootfs+: [ubuntu]\n",
+			expectedErr: "key rootfs+ cannot be appended to rootfs which is not a list",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			base := make(map[interface{}]interface{})
+			err := yaml.Unmarshal([]byte(tc.base), &base)
+			asserter.AssertErrNil(err, true)
+			overlay := make(map[interface{}]interface{})
+			err = yaml.Unmarshal([]byte(tc.overlay), &overlay)
+			asserter.AssertErrNil(err, true)
+
+			got, err := mergeImageDefinitions(base, overlay)
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			want := make(map[interface{}]interface{})
+			err = yaml.Unmarshal([]byte(tc.want), &want)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(want, got)
+		})
+	}
+}
+
+// Test_readImageDefinition_extends reads an image definition extending
+// another one
+func Test_readImageDefinition_extends(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	imageDefPath := filepath.Join("testdata", "image_definitions", "test_extends_arm64.yaml")
+
+	imageDef, sources, err := readImageDefinition(imageDefPath, nil)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual([]string{
+		filepath.Join("testdata", "image_definitions", "test_amd64.yaml"),
+		imageDefPath,
+	}, sources.files)
+
+	asserter.AssertEqual("ubuntu-server-arm64", imageDef.ImageName)
+	asserter.AssertEqual("arm64", imageDef.Architecture)
+	asserter.AssertEqual("jammy", imageDef.Series)
+	asserter.AssertEqual([]*imagedefinition.Package{
+		{PackageName: "hello-ubuntu-image-public"},
+		{PackageName: "hello-ubuntu-image-private"},
+		{PackageName: "linux-firmware-raspi"},
+	}, imageDef.Customization.ExtraPackages)
+	asserter.AssertEqual(&[]imagedefinition.Img{{ImgName: "pc-arm64.img"}}, imageDef.Artifacts.Img)
+	asserter.AssertEqual(true, imageDef.Artifacts.Qcow2 == nil)
+	asserter.AssertEqual("filesystem-manifest.txt", imageDef.Artifacts.Manifest.ManifestName)
+}
+
+func Test_readImageDefinitionTree_fail(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"missing.yaml":     "extends: inexistent.yaml\n",
+		"bad_extends.yaml": "extends:\n  name: base\n",
+		"bad_merge.yaml":   "extends: base.yaml\nrootfs+: [main]\n",
+		"base.yaml":        "rootfs:\n  flavor: ubuntu\n",
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+
+	_, _, err := readImageDefinitionTree(filepath.Join(tmpDir, "missing.yaml"), nil)
+	asserter.AssertErrContains(err, "Error opening image definition file")
+
+	_, _, err = readImageDefinitionTree(filepath.Join(tmpDir, "bad_extends.yaml"), nil)
+	asserter.AssertErrContains(err, "extends must be a path or a list of paths")
+
+	_, _, err = readImageDefinitionTree(filepath.Join(tmpDir, "bad_merge.yaml"), nil)
+	asserter.AssertErrContains(err, "cannot be appended to rootfs which is not a list")
+}
+
+func Test_printImageDefinition(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	imageDef := &imagedefinition.ImageDefinition{
+		ImageName:    "ubuntu-server-arm64",
+		Architecture: "arm64",
+		Rootfs: &imagedefinition.Rootfs{
+			Flavor:            "ubuntu",
+			SourcesListDeb822: helper.BoolPtr(false),
+		},
+		Customization: &imagedefinition.Customization{},
+	}
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	err = printImageDefinition(imageDef)
+	restoreStdout()
+	asserter.AssertErrNil(err, true)
+	output, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+
+	asserter.AssertEqual(`Resolved image definition:
+name: ubuntu-server-arm64
+revision: 0
+architecture: arm64
+rootfs:
+  flavor: ubuntu
+  sources-list-deb822: false
+`, string(output))
+}
@@ -44,6 +44,32 @@ func (stateMachine *StateMachine) validateInput() error {
 	if stateMachine.stateMachineFlags.WorkDir == "" && stateMachine.stateMachineFlags.Resume {
 		return fmt.Errorf("must specify workdir when using --resume flag")
 	}
+	if stateMachine.stateMachineFlags.WorkDir == "" && stateMachine.stateMachineFlags.From != "" {
+		return fmt.Errorf("must specify workdir when using --from flag")
+	}
+	if stateMachine.stateMachineFlags.From != "" && (stateMachine.stateMachineFlags.Resume ||
+		stateMachine.stateMachineFlags.Until != "" || stateMachine.stateMachineFlags.Thru != "") {
+		return fmt.Errorf("cannot specify --from with --resume, --until or --thru")
+	}
+	if stateMachine.stateMachineFlags.WorkDir == "" && stateMachine.stateMachineFlags.Snapshot {
+		return fmt.Errorf("must specify workdir when using --snapshot flag")
+	}
+	if stateMachine.commonFlags.ProgressFile != "" && stateMachine.commonFlags.Progress != "json" {
+		return fmt.Errorf("--progress-file can only be used with --progress=json")
+	}
+	if stateMachine.stateMachineFlags.HooksDir != "" {
+		hooksDir, err := filepath.Abs(stateMachine.stateMachineFlags.HooksDir)
+		if err != nil {
+			return fmt.Errorf("Error resolving the path of the hooks directory: %s", err.Error())
+		}
+		hooksDirInfo, err := os.Stat(hooksDir)
+		if err != nil || !hooksDirInfo.IsDir() {
+			return fmt.Errorf("hooks directory %s does not exist or is not a directory", hooksDir)
+		}
+		// the hooks directory must not depend on the current directory
+		// which may change while building
+		stateMachine.stateMachineFlags.HooksDir = hooksDir
+	}
 
 	logLevelFlags := []bool{stateMachine.commonFlags.Debug,
 		stateMachine.commonFlags.Verbose,
@@ -564,8 +590,9 @@ func generateGerminateCmd(imageDefinition imagedefinition.ImageDefinition) *exec
 }
 
 // cloneGitRepo takes options from the image definition and clones the git
-// repo with the corresponding options
-func cloneGitRepo(imageDefinition imagedefinition.ImageDefinition, workDir string) error {
+// repo with the corresponding options. If a ref is given, the whole history
+// is fetched and the ref is checked out. The commit checked out is returned.
+func cloneGitRepo(imageDefinition imagedefinition.ImageDefinition, workDir string) (string, error) {
 	// clone the repo
 	cloneOptions := &git.CloneOptions{
 		URL:          imageDefinition.Gadget.GadgetURL,
@@ -575,24 +602,88 @@ func cloneGitRepo(imageDefinition imagedefinition.ImageDefinition, workDir strin
 	if imageDefinition.Gadget.GadgetBranch != "" {
 		cloneOptions.ReferenceName = plumbing.NewBranchReferenceName(imageDefinition.Gadget.GadgetBranch)
 	}
+	if imageDefinition.Gadget.Ref != "" {
+		// the ref may be a tag or a commit of any branch
+		cloneOptions.SingleBranch = false
+		cloneOptions.Depth = 0
+		cloneOptions.Tags = git.AllTags
+	}
 
 	err := cloneOptions.Validate()
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	_, err = git.PlainClone(workDir, false, cloneOptions)
-	return err
+	repo, err := git.PlainClone(workDir, false, cloneOptions)
+	if err != nil {
+		return "", err
+	}
+
+	if imageDefinition.Gadget.Ref == "" {
+		head, err := repo.Head()
+		if err != nil {
+			return "", fmt.Errorf("Error reading the cloned commit: %s", err.Error())
+		}
+		return head.Hash().String(), nil
+	}
+
+	commit, err := resolveGitRef(repo, imageDefinition.Gadget.Ref)
+	if err != nil {
+		return "", fmt.Errorf("Error resolving ref \"%s\": %s", imageDefinition.Gadget.Ref, err.Error())
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return "", err
+	}
+	err = worktree.Checkout(&git.CheckoutOptions{Hash: commit})
+	if err != nil {
+		return "", fmt.Errorf("Error checking out ref \"%s\": %s", imageDefinition.Gadget.Ref, err.Error())
+	}
+	return commit.String(), nil
+}
+
+// resolveGitRef returns the commit pointed to by a tag or a commit SHA
+func resolveGitRef(repo *git.Repository, ref string) (plumbing.Hash, error) {
+	tagRef, err := repo.Tag(ref)
+	if err == nil {
+		// annotated tags point to a tag object rather than a commit
+		tagObject, err := repo.TagObject(tagRef.Hash())
+		if errors.Is(err, plumbing.ErrObjectNotFound) {
+			// lightweight tags point directly to the commit
+			return tagRef.Hash(), nil
+		}
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		commit, err := tagObject.Commit()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		return commit.Hash, nil
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return *hash, nil
 }
 
 // generateDebootstrapCmd generates the debootstrap command used to create a chroot
-// environment that will eventually become the rootfs of the resulting image
-func generateDebootstrapCmd(imageDefinition imagedefinition.ImageDefinition, targetDir string) *exec.Cmd {
+// environment that will eventually become the rootfs of the resulting image.
+// If foreign is set, only the first stage of debootstrap is run so that the
+// second stage can be run in the chroot with an emulator.
+func generateDebootstrapCmd(imageDefinition imagedefinition.ImageDefinition, targetDir string, foreign bool) *exec.Cmd {
 	debootstrapCmd := execCommand("debootstrap",
 		"--arch", imageDefinition.Architecture,
 		"--variant=minbase",
 	)
 
+	if foreign {
+		debootstrapCmd.Args = append(debootstrapCmd.Args, "--foreign")
+	}
+
 	if imageDefinition.Customization != nil && len(imageDefinition.Customization.ExtraPPAs) > 0 {
 		// ca-certificates is needed to use PPAs
 		debootstrapCmd.Args = append(debootstrapCmd.Args, "--include=ca-certificates")
@@ -637,11 +728,83 @@ func generateAptCmds(targetDir string, packageList []string) []*exec.Cmd {
 	return []*exec.Cmd{updateCmd, installCmd}
 }
 
-func setDenyingPolicyRcD(path string) (func(error) error, error) {
-	const policyRcDDisableAll = `#!/bin/sh
+// isoVolumeIDMaxLen is the maximum length of an ISO 9660 volume identifier
+const isoVolumeIDMaxLen = 32
+
+// generateXorrisoCmd generates the default xorriso command used to create an
+// .iso artifact from the rootfs, or from the installer media for installer
+// images. The image of the system-boot structure of the volume is appended to
+// the ISO as an EFI system partition to make the resulting media bootable on
+// UEFI systems. A volume without one needs a custom xorriso command.
+func (stateMachine *StateMachine) generateXorrisoCmd(iso imagedefinition.Iso, isoPath string) (*exec.Cmd, error) {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	volumeID := classicStateMachine.ImageDef.ImageName
+	if len(volumeID) > isoVolumeIDMaxLen {
+		volumeID = volumeID[:isoVolumeIDMaxLen]
+	}
+
+	xorrisoCmd := execCommand("xorriso",
+		"-as", "mkisofs",
+		"-r",
+		"-J",
+		"-joliet-long",
+		"-V", volumeID,
+		"-o", isoPath,
+	)
+
+	espImg := stateMachine.findSystemBootImage(iso.IsoVolume)
+	if espImg == "" {
+		return nil, fmt.Errorf("Error creating iso artifact %s: no image of a system-boot structure "+
+			"was found in volume %s to make it bootable. Set xorriso-command to build it from this volume",
+			iso.IsoName, iso.IsoVolume)
+	}
+	xorrisoCmd.Args = append(xorrisoCmd.Args,
+		"-append_partition", "2", "0xef", espImg,
+		"-appended_part_as_gpt",
+		"-e", "--interval:appended_partition_2:all::",
+		"-no-emul-boot",
+	)
+
+	// installer images boot the layers of the installer media
+	// instead of containing the rootfs
+	contentDir := stateMachine.tempDirs.rootfs
+	if classicStateMachine.ImageDef.Class == "installer" {
+		contentDir = stateMachine.installerMediaDir()
+	}
+	xorrisoCmd.Args = append(xorrisoCmd.Args, contentDir)
+
+	return xorrisoCmd, nil
+}
+
+// findSystemBootImage returns the path to the image of the system-boot
+// structure of the given volume, or an empty string if there is none
+func (stateMachine *StateMachine) findSystemBootImage(volumeName string) string {
+	volume, found := stateMachine.GadgetInfo.Volumes[volumeName]
+	if !found {
+		return ""
+	}
+	for structIndex := range volume.Structure {
+		if !helper.IsSystemBootStructure(&volume.Structure[structIndex]) {
+			continue
+		}
+		partImg := filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+			"part"+strconv.Itoa(structIndex)+".img")
+		if _, err := os.Stat(partImg); err == nil {
+			return partImg
+		}
+	}
+	return ""
+}
+
+// policyRcDDisableAll is the policy-rc.d preventing services from being
+// started while packages are installed in the chroot
+const policyRcDDisableAll = `#!/bin/sh
 echo "All runlevel operations denied by policy" >&2
 exit 101
 `
+
+func setDenyingPolicyRcD(path string) (func(error) error, error) {
 	err := osMkdirAll(filepath.Dir(path), 0755)
 	if err != nil {
 		return nil, fmt.Errorf("Error creating policy-rc.d dir: %s", err.Error())
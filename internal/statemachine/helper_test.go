@@ -10,9 +10,14 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/google/uuid"
 	"github.com/snapcore/snapd/gadget"
 	"github.com/snapcore/snapd/gadget/quantity"
@@ -1369,3 +1374,126 @@ func TestStateMachine_setMk2fsConf(t *testing.T) {
 		})
 	}
 }
+
+// createTestGitRepo creates a git repository with three commits, the
+// first one tagged with an annotated tag and the second one with a
+// lightweight tag. The commits are returned in order.
+func createTestGitRepo(t *testing.T, repoDir string) []plumbing.Hash {
+	t.Helper()
+	asserter := helper.Asserter{T: t}
+	repo, err := git.PlainInit(repoDir, false)
+	asserter.AssertErrNil(err, true)
+	worktree, err := repo.Worktree()
+	asserter.AssertErrNil(err, true)
+
+	signature := &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(0, 0)}
+	var commits []plumbing.Hash
+	for i := 1; i <= 3; i++ {
+		err = os.WriteFile(filepath.Join(repoDir, "version"), []byte(strconv.Itoa(i)), 0644)
+		asserter.AssertErrNil(err, true)
+		_, err = worktree.Add("version")
+		asserter.AssertErrNil(err, true)
+		commit, err := worktree.Commit(fmt.Sprintf("commit %d", i), &git.CommitOptions{Author: signature})
+		asserter.AssertErrNil(err, true)
+		commits = append(commits, commit)
+	}
+
+	_, err = repo.CreateTag("v1", commits[0], &git.CreateTagOptions{Tagger: signature, Message: "v1"})
+	asserter.AssertErrNil(err, true)
+	_, err = repo.CreateTag("v2", commits[1], nil)
+	asserter.AssertErrNil(err, true)
+
+	return commits
+}
+
+func Test_cloneGitRepo(t *testing.T) {
+	repoDir := t.TempDir()
+	commits := createTestGitRepo(t, repoDir)
+
+	tests := []struct {
+		name            string
+		ref             string
+		expectedCommit  plumbing.Hash
+		expectedVersion string
+		expectedError   string
+	}{
+		{
+			name:            "no ref",
+			expectedCommit:  commits[2],
+			expectedVersion: "3",
+		},
+		{
+			name:            "annotated tag",
+			ref:             "v1",
+			expectedCommit:  commits[0],
+			expectedVersion: "1",
+		},
+		{
+			name:            "lightweight tag",
+			ref:             "v2",
+			expectedCommit:  commits[1],
+			expectedVersion: "2",
+		},
+		{
+			name:            "commit",
+			ref:             commits[1].String(),
+			expectedCommit:  commits[1],
+			expectedVersion: "2",
+		},
+		{
+			name:          "unknown ref",
+			ref:           "v4",
+			expectedError: "Error resolving ref \"v4\"",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			imageDef := imagedefinition.ImageDefinition{
+				Gadget: &imagedefinition.Gadget{
+					GadgetURL:  "file://" + repoDir,
+					GadgetType: "git",
+					Ref:        tc.ref,
+				},
+			}
+			cloneDir := filepath.Join(t.TempDir(), "gadget")
+
+			gotCommit, err := cloneGitRepo(imageDef, cloneDir)
+			if len(tc.expectedError) != 0 {
+				asserter.AssertErrContains(err, tc.expectedError)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expectedCommit.String(), gotCommit)
+
+			gotVersion, err := os.ReadFile(filepath.Join(cloneDir, "version"))
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expectedVersion, string(gotVersion))
+		})
+	}
+}
+
+// Test_resolveGitRef_corruptTag ensures tag objects that cannot be read are
+// not mistaken for lightweight tags
+func Test_resolveGitRef_corruptTag(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	repoDir := t.TempDir()
+	createTestGitRepo(t, repoDir)
+
+	repo, err := git.PlainOpen(repoDir)
+	asserter.AssertErrNil(err, true)
+	tagRef, err := repo.Tag("v1")
+	asserter.AssertErrNil(err, true)
+
+	tagHash := tagRef.Hash().String()
+	tagObjectPath := filepath.Join(repoDir, ".git", "objects", tagHash[:2], tagHash[2:])
+	err = os.Chmod(tagObjectPath, 0644)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(tagObjectPath, []byte("corrupt"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	_, err = resolveGitRef(repo, "v1")
+	if err == nil {
+		t.Error("Expected an error resolving a corrupt tag, but there was none")
+	}
+}
@@ -0,0 +1,69 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	preHook  = "pre"
+	postHook = "post"
+)
+
+// hookEnv returns the environment variables describing the build to the
+// hooks run around the given state
+func (stateMachine *StateMachine) hookEnv(hookType string, stateName string) []string {
+	return []string{
+		"UBUNTU_IMAGE_HOOK=" + hookType,
+		"UBUNTU_IMAGE_HOOK_STATE=" + stateName,
+		"UBUNTU_IMAGE_HOOK_STEP=" + strconv.Itoa(stateMachine.StepsTaken),
+		"UBUNTU_IMAGE_HOOK_WORKDIR=" + stateMachine.stateMachineFlags.WorkDir,
+		"UBUNTU_IMAGE_HOOK_CHROOT=" + stateMachine.tempDirs.chroot,
+		"UBUNTU_IMAGE_HOOK_ROOTFS=" + stateMachine.tempDirs.rootfs,
+		"UBUNTU_IMAGE_HOOK_VOLUMES=" + stateMachine.tempDirs.volumes,
+		"UBUNTU_IMAGE_HOOK_OUTPUT_DIR=" + stateMachine.commonFlags.OutputDir,
+	}
+}
+
+// runHooks runs in lexical order the executables found in the
+// <hookType>-<stateName>.d directory of the hooks directory.
+// Files that are not executable are skipped.
+func (stateMachine *StateMachine) runHooks(hookType string, stateName string) error {
+	if stateMachine.stateMachineFlags.HooksDir == "" {
+		return nil
+	}
+
+	hookDir := filepath.Join(stateMachine.stateMachineFlags.HooksDir, hookType+"-"+stateName+".d")
+	hooks, err := osReadDir(hookDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Error reading hooks directory \"%s\": %s", hookDir, err.Error())
+	}
+
+	env := stateMachine.hookEnv(hookType, stateName)
+	for _, hook := range hooks {
+		hookPath := filepath.Join(hookDir, hook.Name())
+		hookInfo, err := os.Stat(hookPath)
+		if err != nil {
+			return fmt.Errorf("Error reading hook \"%s\": %s", hookPath, err.Error())
+		}
+		if hookInfo.IsDir() || hookInfo.Mode().Perm()&0111 == 0 {
+			if stateMachine.commonFlags.Debug {
+				fmt.Printf("Skipping hook %s as it is not an executable file\n", hookPath)
+			}
+			continue
+		}
+		if stateMachine.commonFlags.Debug {
+			fmt.Printf("Running hook %s\n", hookPath)
+		}
+		err = helperRunScript(hookPath, env)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
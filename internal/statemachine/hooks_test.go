@@ -0,0 +1,84 @@
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/testhelper"
+)
+
+// writeHook writes a hook script in the given directory of the hooks directory
+func writeHook(t *testing.T, hooksDir string, dir string, name string, content string, perm os.FileMode) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Join(hooksDir, dir), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(hooksDir, dir, name), []byte("#!/bin/sh\n"+content+"\n"), perm)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStateMachine_runHooks(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	hooksDir := t.TempDir()
+	logFile := filepath.Join(t.TempDir(), "hooks.log")
+	logLine := `echo "$(basename $0) $UBUNTU_IMAGE_HOOK $UBUNTU_IMAGE_HOOK_STATE $UBUNTU_IMAGE_HOOK_STEP $UBUNTU_IMAGE_HOOK_WORKDIR" >> ` + logFile
+
+	writeHook(t, hooksDir, "pre-test_succeed.d", "20-second", logLine, 0755)
+	writeHook(t, hooksDir, "pre-test_succeed.d", "10-first", logLine, 0755)
+	writeHook(t, hooksDir, "pre-test_succeed.d", "30-not-executable", logLine, 0644)
+	writeHook(t, hooksDir, "post-test_succeed.d", "10-post", logLine, 0755)
+	writeHook(t, hooksDir, "pre-other_state.d", "10-other", logLine, 0755)
+
+	var stateMachine testStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+	stateMachine.stateMachineFlags.HooksDir = hooksDir
+	stateMachine.states = testStates
+	stateMachine.StepsTaken = 3
+
+	err := stateMachine.Run()
+	asserter.AssertErrNil(err, true)
+
+	gotLog, err := os.ReadFile(logFile)
+	asserter.AssertErrNil(err, true)
+	workDir := stateMachine.stateMachineFlags.WorkDir
+	asserter.AssertEqual([]string{
+		"10-first pre test_succeed 3 " + workDir,
+		"20-second pre test_succeed 3 " + workDir,
+		"10-post post test_succeed 3 " + workDir,
+	}, strings.Split(strings.TrimSpace(string(gotLog)), "\n"))
+
+	// a failing hook fails the build
+	writeHook(t, hooksDir, "post-test_succeed.d", "20-fail", "exit 1", 0755)
+	err = stateMachine.Run()
+	asserter.AssertErrContains(err, "Error running hook script "+filepath.Join(hooksDir, "post-test_succeed.d", "20-fail"))
+}
+
+func TestStateMachine_validateInput_hooksDir(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+	stateMachine.stateMachineFlags.HooksDir = filepath.Join(t.TempDir(), "inexistent")
+	err := stateMachine.validateInput()
+	asserter.AssertErrContains(err, "does not exist or is not a directory")
+
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+	tmpDir := t.TempDir()
+	err = os.Chdir(tmpDir)
+	asserter.AssertErrNil(err, true)
+	err = os.Mkdir("hooks", 0755)
+	asserter.AssertErrNil(err, true)
+
+	stateMachine.stateMachineFlags.HooksDir = "hooks"
+	err = stateMachine.validateInput()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(filepath.Join(tmpDir, "hooks"), stateMachine.stateMachineFlags.HooksDir)
+}
@@ -0,0 +1,376 @@
+package statemachine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// stateInput is a file, a directory or a content the build is made from
+type stateInput struct {
+	name    string   // describes the input in messages and keys its hash
+	path    string   // the file or directory to hash
+	content []byte   // hashed instead of path when set
+	states  []string // the states using the input, all of them if empty
+}
+
+// imageDefinitionKeyStates are the states using the keys of the image
+// definition. The keys not listed are used by every state. The keys of
+// customization are listed on their own as they are used by distinct states.
+var imageDefinitionKeyStates = map[string][]string{
+	"gadget":          {buildGadgetTreeState.name, prepareGadgetTreeState.name, loadGadgetYamlState.name},
+	"model-assertion": {prepareClassicImageState.name},
+	"rootfs":          {germinateState.name, createChrootState.name, extractRootfsTarState.name},
+	"customization":   {germinateState.name, createChrootState.name, extractRootfsTarState.name},
+	"artifacts": {
+		verifyArtifactNamesState.name,
+		calculateRootfsSizeState.name,
+		makeQcow2ImgState.name,
+		makeIsoState.name,
+		generatePackageManifestState.name,
+		generateChangelogState.name,
+		generateFilelistState.name,
+		generateRootfsTarballState.name,
+	},
+	"customization:extra-snaps": {prepareClassicImageState.name},
+	"customization:cloud-init":  {customizeCloudInitState.name},
+	"customization:fstab":       {customizeFstabState.name},
+	"customization:manual":      {manualCustomizationState.name},
+	"customization:installer":   {buildInstallerLayersState.name},
+}
+
+// trackedInputs returns the inputs of the build whose changes are detected
+// on --resume
+func (stateMachine *StateMachine) trackedInputs() []stateInput {
+	var inputs []stateInput
+	switch parent := stateMachine.parent.(type) {
+	case *ClassicStateMachine:
+		// the keys of the image definition are tracked once the files
+		// extended are merged and the variables substituted
+		inputs = append(inputs, parent.imageDefinitionInputs()...)
+		if parent.ImageDef.Gadget != nil {
+			gadgetTree := strings.TrimPrefix(parent.ImageDef.Gadget.GadgetURL, "file://")
+			switch parent.ImageDef.Gadget.GadgetType {
+			case "git":
+				if commit := remoteGadgetCommit(parent.ImageDef.Gadget); commit != "" {
+					inputs = append(inputs, stateInput{
+						name:    "gadget repository",
+						path:    parent.ImageDef.Gadget.GadgetURL,
+						content: []byte(commit),
+						states:  []string{buildGadgetTreeState.name},
+					})
+				}
+			case "directory":
+				if !filepath.IsAbs(gadgetTree) {
+					gadgetTree = filepath.Join(stateMachine.ConfDefPath, gadgetTree)
+				}
+				inputs = append(inputs, stateInput{
+					name:   "gadget tree",
+					path:   gadgetTree,
+					states: []string{buildGadgetTreeState.name},
+				})
+			case "prebuilt":
+				inputs = append(inputs, stateInput{
+					name:   "gadget tree",
+					path:   gadgetTree,
+					states: []string{prepareGadgetTreeState.name},
+				})
+			}
+		}
+		if parent.ImageDef.Rootfs != nil && parent.ImageDef.Rootfs.Tarball != nil {
+			inputs = append(inputs, parent.rootfsTarballInput(parent.ImageDef.Rootfs.Tarball))
+		}
+	case *SnapStateMachine:
+		inputs = append(inputs, stateInput{
+			name:   "model assertion",
+			path:   parent.Args.ModelAssertion,
+			states: []string{prepareImageState.name},
+		})
+	}
+	return append(inputs, stateMachine.hooksInputs()...)
+}
+
+// imageDefinitionInputs returns the keys of the image definition as inputs
+// of the states using them
+func (classicStateMachine *ClassicStateMachine) imageDefinitionInputs() []stateInput {
+	content, err := yaml.Marshal(classicStateMachine.ImageDef)
+	if err != nil {
+		return nil
+	}
+	var keys yaml.MapSlice
+	if err := yaml.Unmarshal(content, &keys); err != nil {
+		return nil
+	}
+
+	var inputs []stateInput
+	addInput := func(key string, value interface{}) {
+		content, err := yaml.Marshal(value)
+		if err != nil {
+			return
+		}
+		inputs = append(inputs, stateInput{
+			name:    "image definition key " + key,
+			path:    classicStateMachine.Args.ImageDefinition,
+			content: content,
+			states:  imageDefinitionKeyStates[key],
+		})
+	}
+	for _, item := range keys {
+		key := fmt.Sprint(item.Key)
+		customization, isMap := item.Value.(yaml.MapSlice)
+		if key != "customization" || !isMap {
+			addInput(key, item.Value)
+			continue
+		}
+		var otherKeys yaml.MapSlice
+		for _, customizationItem := range customization {
+			customizationKey := "customization:" + fmt.Sprint(customizationItem.Key)
+			if _, found := imageDefinitionKeyStates[customizationKey]; found {
+				addInput(customizationKey, customizationItem.Value)
+			} else {
+				otherKeys = append(otherKeys, customizationItem)
+			}
+		}
+		addInput(key, otherKeys)
+	}
+	return inputs
+}
+
+// rootfsTarballInput returns the rootfs tarball as an input of the build.
+// A remote tarball is tracked by its SHA256 sum if given, or else by the
+// version of the file reported by the server.
+func (classicStateMachine *ClassicStateMachine) rootfsTarballInput(tarball *imagedefinition.Tarball) stateInput {
+	input := stateInput{
+		name:   "rootfs tarball",
+		path:   tarball.TarballURL,
+		states: []string{extractRootfsTarState.name},
+	}
+	switch {
+	case !isRemoteURL(tarball.TarballURL):
+		input.path, _ = classicStateMachine.fetchTarballFile(tarball.TarballURL, "")
+	case tarball.SHA256sum != "":
+		input.content = []byte(tarball.TarballURL + "\n" + tarball.SHA256sum)
+	default:
+		input.content = []byte(tarball.TarballURL + "\n" + remoteFileVersion(tarball.TarballURL))
+	}
+	return input
+}
+
+// hooksInputs returns the directories of hooks as inputs of the states they
+// are run around
+func (stateMachine *StateMachine) hooksInputs() []stateInput {
+	if stateMachine.stateMachineFlags.HooksDir == "" {
+		return nil
+	}
+	var inputs []stateInput
+	for _, state := range stateMachine.states {
+		for _, hookType := range []string{preHook, postHook} {
+			hookDir := hookType + "-" + state.name + ".d"
+			inputs = append(inputs, stateInput{
+				name:   hookDir + " hooks",
+				path:   filepath.Join(stateMachine.stateMachineFlags.HooksDir, hookDir),
+				states: []string{state.name},
+			})
+		}
+	}
+	return inputs
+}
+
+// remoteGadgetCommit returns the commit of the gadget repository to build,
+// or an empty string if it cannot be found
+func remoteGadgetCommit(gadget *imagedefinition.Gadget) string {
+	// a commit SHA cannot change
+	if plumbing.IsHash(gadget.Ref) {
+		return gadget.Ref
+	}
+	refs, err := gitRemoteList(gadget.GadgetURL)
+	if err != nil {
+		return ""
+	}
+	wantedRefs := []plumbing.ReferenceName{plumbing.HEAD}
+	switch {
+	case gadget.Ref != "":
+		wantedRefs = []plumbing.ReferenceName{
+			plumbing.NewTagReferenceName(gadget.Ref),
+			plumbing.NewBranchReferenceName(gadget.Ref),
+		}
+	case gadget.GadgetBranch != "":
+		wantedRefs = []plumbing.ReferenceName{plumbing.NewBranchReferenceName(gadget.GadgetBranch)}
+	}
+	for _, wantedRef := range wantedRefs {
+		for _, ref := range refs {
+			if ref.Name() != wantedRef {
+				continue
+			}
+			if ref.Type() == plumbing.SymbolicReference {
+				wantedRef = ref.Target()
+				continue
+			}
+			return ref.Hash().String()
+		}
+	}
+	return ""
+}
+
+// listGitRemote lists the references of a git repository
+func listGitRemote(url string) ([]*plumbing.Reference, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{url},
+	})
+	return remote.List(&git.ListOptions{})
+}
+
+// hashInput returns the SHA256 sum of a file, or of the names, types and
+// contents of the files of a directory
+func hashInput(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return helper.CalculateSHA256(path)
+	}
+
+	hasher := sha256.New()
+	err = filepath.WalkDir(path, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(path, filePath)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hasher, "%s\x00%s\x00", relPath, entry.Type().String())
+		switch {
+		case entry.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hasher, "%s\x00", target)
+		case entry.Type().IsRegular():
+			f, err := os.Open(filePath)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(hasher, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// hashInputs records the SHA256 sums of the inputs of the build. Missing
+// inputs are left out, the states using them report the error. The inputs
+// are only needed to resume a build, so they are not hashed without a
+// persistent workdir.
+func (stateMachine *StateMachine) hashInputs() error {
+	if stateMachine.stateMachineFlags.WorkDir == "" || stateMachine.commonFlags.DryRun {
+		return nil
+	}
+	stateMachine.InputHashes = make(map[string]string)
+	for _, input := range stateMachine.trackedInputs() {
+		if input.content != nil {
+			contentHash := sha256.Sum256(input.content)
+			stateMachine.InputHashes[input.name] = hex.EncodeToString(contentHash[:])
+			continue
+		}
+		if _, err := os.Stat(input.path); err != nil {
+			continue
+		}
+		inputHash, err := hashInput(input.path)
+		if err != nil {
+			return fmt.Errorf("Error calculating the SHA256 sum of the %s \"%s\": %s",
+				input.name, input.path, err.Error())
+		}
+		stateMachine.InputHashes[input.name] = inputHash
+	}
+	return nil
+}
+
+// changedInputs returns the inputs whose SHA256 sums differ from the ones
+// recorded by the previous run
+func (stateMachine *StateMachine) changedInputs(previousHashes map[string]string) []stateInput {
+	// metadata written before the inputs were tracked
+	if previousHashes == nil {
+		return nil
+	}
+	var changed []stateInput
+	for _, input := range stateMachine.trackedInputs() {
+		if stateMachine.InputHashes[input.name] != previousHashes[input.name] {
+			changed = append(changed, input)
+		}
+	}
+	return changed
+}
+
+// checkInputs compares the inputs of the build with the ones of the
+// previous run. Changed inputs only used by states not taken yet are
+// fine. Otherwise, unless --rewind-on-change was given, a change is an
+// error, and with it the steps taken are rewound to the first state using
+// a changed input, returning the state saved before it.
+func (stateMachine *StateMachine) checkInputs(previousHashes map[string]string) (*savedState, error) {
+	rewindIndex := stateMachine.StepsTaken
+	var changedNames []string
+	for _, input := range stateMachine.changedInputs(previousHashes) {
+		inputIndex := stateMachine.firstStateIndex(input.states)
+		// inputs not used by any state of the build, or by states not taken yet
+		if inputIndex == -1 || inputIndex >= stateMachine.StepsTaken {
+			continue
+		}
+		changedNames = append(changedNames, fmt.Sprintf("%s \"%s\"", input.name, input.path))
+		if inputIndex < rewindIndex {
+			rewindIndex = inputIndex
+		}
+	}
+	if len(changedNames) == 0 {
+		return nil, nil
+	}
+	sort.Strings(changedNames)
+	if !stateMachine.stateMachineFlags.Rewind {
+		return nil, fmt.Errorf("the inputs of the build changed since the previous run: %s. "+
+			"Use --rewind-on-change to run again the steps using them",
+			strings.Join(changedNames, ", "))
+	}
+	fmt.Printf("The inputs of the build changed since the previous run: %s. Running again from step %s\n",
+		strings.Join(changedNames, ", "), stateMachine.states[rewindIndex].name)
+	return stateMachine.rewindTo(stateMachine.states[rewindIndex].name)
+}
+
+// firstStateIndex returns the index of the first of the given states in the
+// state machine, 0 if no state is given, or -1 if none of them is in it
+func (stateMachine *StateMachine) firstStateIndex(stateNames []string) int {
+	if len(stateNames) == 0 {
+		return 0
+	}
+	for i, state := range stateMachine.states {
+		for _, stateName := range stateNames {
+			if state.name == stateName {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,310 @@
+package statemachine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+func Test_hashInput(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	dir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, "meta"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(dir, "meta", "gadget.yaml"), []byte("volumes:"), 0644)
+	asserter.AssertErrNil(err, true)
+	err = os.Symlink("meta/gadget.yaml", filepath.Join(dir, "link"))
+	asserter.AssertErrNil(err, true)
+
+	fileHash, err := hashInput(filepath.Join(dir, "meta", "gadget.yaml"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(sha256Hex("volumes:"), fileHash)
+
+	dirHash, err := hashInput(dir)
+	asserter.AssertErrNil(err, true)
+	sameDirHash, err := hashInput(dir)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(dirHash, sameDirHash)
+
+	// changing the content of a file changes the hash of the directory
+	err = os.WriteFile(filepath.Join(dir, "meta", "gadget.yaml"), []byte("volumes: {}"), 0644)
+	asserter.AssertErrNil(err, true)
+	changedDirHash, err := hashInput(dir)
+	asserter.AssertErrNil(err, true)
+	if changedDirHash == dirHash {
+		t.Errorf("The hash of the directory did not change")
+	}
+
+	// so does renaming a file
+	err = os.Rename(filepath.Join(dir, "link"), filepath.Join(dir, "other-link"))
+	asserter.AssertErrNil(err, true)
+	renamedDirHash, err := hashInput(dir)
+	asserter.AssertErrNil(err, true)
+	if renamedDirHash == changedDirHash {
+		t.Errorf("The hash of the directory did not change")
+	}
+
+	_, err = hashInput(filepath.Join(dir, "inexistent"))
+	asserter.AssertErrContains(err, "no such file or directory")
+}
+
+// TestClassicStateMachine_checkInputs ensures changes of the inputs of a
+// classic build are detected on --resume
+func TestClassicStateMachine_checkInputs(t *testing.T) {
+	testCases := []struct {
+		name           string
+		stepsTaken     int
+		change         func(stateMachine *ClassicStateMachine, confDir string) error
+		rewind         bool
+		wantStepsTaken int
+		expectedError  string
+	}{
+		{
+			name:           "no change",
+			stepsTaken:     3,
+			wantStepsTaken: 3,
+		},
+		{
+			name:          "gadget tree changed",
+			stepsTaken:    3,
+			change:        changeGadgetTree,
+			expectedError: "the inputs of the build changed since the previous run: gadget tree",
+		},
+		{
+			name:           "gadget tree changed with rewind",
+			stepsTaken:     3,
+			change:         changeGadgetTree,
+			rewind:         true,
+			wantStepsTaken: 1,
+		},
+		{
+			name:           "gadget tree changed before being used",
+			stepsTaken:     1,
+			change:         changeGadgetTree,
+			wantStepsTaken: 1,
+		},
+		{
+			name:       "architecture changed with rewind",
+			stepsTaken: 3,
+			change: func(stateMachine *ClassicStateMachine, confDir string) error {
+				stateMachine.ImageDef.Architecture = "arm64"
+				return nil
+			},
+			rewind:         true,
+			wantStepsTaken: 0,
+		},
+		{
+			name:       "manual customization changed with rewind",
+			stepsTaken: 5,
+			change: func(stateMachine *ClassicStateMachine, confDir string) error {
+				stateMachine.ImageDef.Customization.Manual.MakeDirs[0].Path = "/var/other"
+				return nil
+			},
+			rewind:         true,
+			wantStepsTaken: 3,
+		},
+		{
+			name:       "key used by no state changed",
+			stepsTaken: 5,
+			change: func(stateMachine *ClassicStateMachine, confDir string) error {
+				stateMachine.ImageDef.Customization.CloudInit = &imagedefinition.CloudInit{UserData: "#cloud-config"}
+				return nil
+			},
+			wantStepsTaken: 5,
+		},
+		{
+			name:       "hook changed with rewind",
+			stepsTaken: 5,
+			change: func(stateMachine *ClassicStateMachine, confDir string) error {
+				return os.WriteFile(filepath.Join(confDir, "hooks", "post-germinate.d", "hook"), []byte("#!/bin/sh"), 0755)
+			},
+			rewind:         true,
+			wantStepsTaken: 2,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			confDir := t.TempDir()
+			imageDefPath := filepath.Join(confDir, "image.yaml")
+			err := os.Mkdir(filepath.Join(confDir, "gadget"), 0755)
+			asserter.AssertErrNil(err, true)
+			err = os.WriteFile(filepath.Join(confDir, "gadget", "Makefile"), []byte("all:"), 0644)
+			asserter.AssertErrNil(err, true)
+			err = os.MkdirAll(filepath.Join(confDir, "hooks", "post-germinate.d"), 0755)
+			asserter.AssertErrNil(err, true)
+
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+			stateMachine.stateMachineFlags.HooksDir = filepath.Join(confDir, "hooks")
+			stateMachine.stateMachineFlags.Rewind = tc.rewind
+			stateMachine.Args.ImageDefinition = imageDefPath
+			stateMachine.ConfDefPath = confDir
+			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+				Architecture: "amd64",
+				Gadget: &imagedefinition.Gadget{
+					GadgetType: "directory",
+					GadgetURL:  "gadget",
+				},
+				Customization: &imagedefinition.Customization{
+					Manual: &imagedefinition.Manual{
+						MakeDirs: []*imagedefinition.MakeDirs{{Path: "/var/test", Permissions: 0755}},
+					},
+				},
+			}
+			stateMachine.states = []stateFunc{
+				setArtifactNamesState,
+				buildGadgetTreeState,
+				germinateState,
+				manualCustomizationState,
+				makeDiskState,
+			}
+			for _, state := range stateMachine.states {
+				err = stateMachine.writeCheckpoint(state.name)
+				asserter.AssertErrNil(err, true)
+				for _, output := range stateOutputs[state.name] {
+					outputPath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, output)
+					err = os.MkdirAll(outputPath, 0755)
+					asserter.AssertErrNil(err, true)
+					err = os.WriteFile(filepath.Join(outputPath, "content"), []byte("content"), 0644)
+					asserter.AssertErrNil(err, true)
+				}
+			}
+
+			err = stateMachine.hashInputs()
+			asserter.AssertErrNil(err, true)
+			previousHashes := stateMachine.InputHashes
+
+			if tc.change != nil {
+				err = tc.change(&stateMachine, confDir)
+				asserter.AssertErrNil(err, true)
+			}
+			err = stateMachine.hashInputs()
+			asserter.AssertErrNil(err, true)
+
+			stateMachine.StepsTaken = tc.stepsTaken
+			rewoundState, err := stateMachine.checkInputs(previousHashes)
+			if tc.expectedError != "" {
+				asserter.AssertErrContains(err, tc.expectedError)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.wantStepsTaken, stateMachine.StepsTaken)
+			if tc.wantStepsTaken != tc.stepsTaken && rewoundState == nil {
+				t.Error("the state saved before the step rewound to was not returned")
+			}
+
+			// metadata written before the inputs were tracked is not checked
+			stateMachine.StepsTaken = tc.stepsTaken
+			_, err = stateMachine.checkInputs(nil)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.stepsTaken, stateMachine.StepsTaken)
+		})
+	}
+}
+
+func changeGadgetTree(stateMachine *ClassicStateMachine, confDir string) error {
+	return os.WriteFile(filepath.Join(confDir, "gadget", "Makefile"), []byte("install:"), 0644)
+}
+
+// TestStateMachine_hashInputs_noWorkDir ensures the inputs are not hashed
+// when the build cannot be resumed
+func TestStateMachine_hashInputs_noWorkDir(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine SnapStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+	stateMachine.states = snapStates
+
+	err := stateMachine.hashInputs()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(map[string]string(nil), stateMachine.InputHashes)
+
+	stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+	stateMachine.commonFlags.DryRun = true
+	err = stateMachine.hashInputs()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(map[string]string(nil), stateMachine.InputHashes)
+}
+
+// TestClassicStateMachine_trackedInputs_remote ensures the remote inputs
+// are tracked by their version
+func TestClassicStateMachine_trackedInputs_remote(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	etag := `"1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+	}))
+	t.Cleanup(server.Close)
+
+	commit := "5e2fd0a1a0d7a5b5b0a3b25f3c1e4f1e2c5d3e4f"
+	gitRemoteList = func(url string) ([]*plumbing.Reference, error) {
+		return []*plumbing.Reference{
+			plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName("main")),
+			plumbing.NewHashReference(plumbing.NewBranchReferenceName("main"), plumbing.NewHash(commit)),
+		}, nil
+	}
+	t.Cleanup(func() { gitRemoteList = listGitRemote })
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Gadget: &imagedefinition.Gadget{
+			GadgetType: "git",
+			GadgetURL:  "https://example.com/gadget.git",
+		},
+		Rootfs: &imagedefinition.Rootfs{
+			Tarball: &imagedefinition.Tarball{TarballURL: server.URL + "/rootfs.tar"},
+		},
+	}
+	stateMachine.states = []stateFunc{buildGadgetTreeState, extractRootfsTarState}
+
+	err := stateMachine.hashInputs()
+	asserter.AssertErrNil(err, true)
+	previousHashes := stateMachine.InputHashes
+	asserter.AssertEqual(sha256Hex(commit), previousHashes["gadget repository"])
+
+	etag = `"2"`
+	commit = "6e2fd0a1a0d7a5b5b0a3b25f3c1e4f1e2c5d3e4f"
+	err = stateMachine.hashInputs()
+	asserter.AssertErrNil(err, true)
+	var changedNames []string
+	for _, input := range stateMachine.changedInputs(previousHashes) {
+		changedNames = append(changedNames, input.name)
+	}
+	asserter.AssertEqual([]string{"gadget repository", "rootfs tarball"}, changedNames)
+}
+
+func TestSnapStateMachine_hashInputs(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	modelPath := filepath.Join(t.TempDir(), "model.assertion")
+	err := os.WriteFile(modelPath, []byte("model"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	var stateMachine SnapStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+	stateMachine.Args.ModelAssertion = modelPath
+	stateMachine.states = snapStates
+
+	err = stateMachine.hashInputs()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(map[string]string{"model assertion": sha256Hex("model")}, stateMachine.InputHashes)
+
+	stateMachine.StepsTaken = 2
+	_, err = stateMachine.checkInputs(map[string]string{"model assertion": sha256Hex("old model")})
+	asserter.AssertErrContains(err, "model assertion \""+modelPath+"\"")
+}
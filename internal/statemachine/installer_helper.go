@@ -0,0 +1,249 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/snapd/osutil"
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// installerLayer is a layer of an installer image. The base layer is the
+// rootfs, every other layer is built on top of its parent by installing the
+// packages of a seed. Layers are named after the seeds they are made of,
+// separated by dots, such as "minimal.standard.live".
+type installerLayer struct {
+	name   string
+	parent string
+	seed   string
+}
+
+// installSource is an entry of the install-sources.yaml file read by
+// subiquity to list the installable variants of the system
+type installSource struct {
+	Default     bool              `yaml:"default"`
+	Description map[string]string `yaml:"description"`
+	ID          string            `yaml:"id"`
+	Name        map[string]string `yaml:"name"`
+	Path        string            `yaml:"path"`
+	Size        uint64            `yaml:"size"`
+	Type        string            `yaml:"type"`
+	Variant     string            `yaml:"variant"`
+}
+
+// parseInstallerLayers parses the list of layers of an installer image.
+// The first layer must be the base one and every other layer must be
+// listed after its parent.
+func parseInstallerLayers(layerNames []string) ([]installerLayer, error) {
+	layers := make([]installerLayer, 0, len(layerNames))
+	known := make(map[string]bool)
+	for i, name := range layerNames {
+		if known[name] {
+			return nil, fmt.Errorf("layer %s is listed more than once", name)
+		}
+		lastDot := strings.LastIndex(name, ".")
+		if lastDot == -1 {
+			if i != 0 {
+				return nil, fmt.Errorf("layer %s must be built on top of another layer", name)
+			}
+			layers = append(layers, installerLayer{name: name})
+			known[name] = true
+			continue
+		}
+		if i == 0 {
+			return nil, fmt.Errorf("the first layer %s must be the base layer", name)
+		}
+		layer := installerLayer{
+			name:   name,
+			parent: name[:lastDot],
+			seed:   name[lastDot+1:],
+		}
+		if !known[layer.parent] {
+			return nil, fmt.Errorf("the parent layer %s must be listed before", layer.parent)
+		}
+		layers = append(layers, layer)
+		known[name] = true
+	}
+	return layers, nil
+}
+
+// isLiveLayer returns whether the layer only holds the live environment
+// of the installer and therefore is not an installable system
+func (l installerLayer) isLiveLayer() bool {
+	return l.seed == "live"
+}
+
+// installerMediaDir returns the directory holding the content of the installer media
+func (stateMachine *StateMachine) installerMediaDir() string {
+	return filepath.Join(stateMachine.stateMachineFlags.WorkDir, "installer", "media")
+}
+
+// installerLayerDir returns the directory in which a layer is built
+func (stateMachine *StateMachine) installerLayerDir(layerName string) string {
+	return filepath.Join(stateMachine.stateMachineFlags.WorkDir, "installer", "layers", layerName)
+}
+
+// layerContentDirs returns the directories holding the content of the
+// given layer, from the top-most to the rootfs
+func (stateMachine *StateMachine) layerContentDirs(layers []installerLayer, layerName string) []string {
+	parents := make(map[string]string)
+	for _, layer := range layers {
+		parents[layer.name] = layer.parent
+	}
+	var contentDirs []string
+	for name := layerName; parents[name] != ""; name = parents[name] {
+		contentDirs = append(contentDirs, filepath.Join(stateMachine.installerLayerDir(name), "upper"))
+	}
+	return append(contentDirs, stateMachine.tempDirs.rootfs)
+}
+
+// buildInstallerLayer installs packages in a layer mounted as an overlay
+// on top of its lower layers. If kernelDestDir is not empty, the kernel and
+// initrd of the resulting system are copied in it.
+func (stateMachine *StateMachine) buildInstallerLayer(layerDir string, lowerDirs []string, packages []string, kernelDestDir string) (err error) {
+	upperDir := filepath.Join(layerDir, "upper")
+	workDir := filepath.Join(layerDir, "work")
+	mergedDir := filepath.Join(layerDir, "merged")
+	for _, dir := range []string{upperDir, workDir} {
+		err = osMkdirAll(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("Error creating layer directory: %s", err.Error())
+		}
+	}
+
+	mountPoints := []*mountPoint{
+		{
+			src:      "overlay",
+			basePath: layerDir,
+			relpath:  "merged",
+			typ:      "overlay",
+			opts: []string{
+				"lowerdir=" + strings.Join(lowerDirs, ":"),
+				"upperdir=" + upperDir,
+				"workdir=" + workDir,
+			},
+		},
+	}
+	mountCmds, umountCmds, err := generateMountPointCmds(mountPoints, stateMachine.tempDirs.scratch)
+	if err != nil {
+		return err
+	}
+
+	err = helper.RunCmds(mountCmds, stateMachine.commonFlags.Debug)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = execTeardownCmds(umountCmds, stateMachine.commonFlags.Debug, err)
+	}()
+
+	err = helperBackupAndCopyResolvConf(mergedDir)
+	if err != nil {
+		return fmt.Errorf("Error setting up /etc/resolv.conf in the layer: \"%s\"", err.Error())
+	}
+	defer func() {
+		restoreErr := helperRestoreResolvConf(mergedDir)
+		if restoreErr != nil {
+			restoreErr = fmt.Errorf("Error restoring /etc/resolv.conf in the layer: \"%s\"", restoreErr.Error())
+		}
+		err = joinTeardownError(err, restoreErr)
+	}()
+
+	// the emulator was removed from the rootfs once it was populated
+	arch := stateMachine.parent.(*ClassicStateMachine).ImageDef.Architecture
+	if isCrossArch(arch) {
+		err = copyQemuStatic(arch, mergedDir)
+		// the emulator may have been partially copied
+		defer func() {
+			err = joinTeardownError(err, removeQemuStatic(arch, mergedDir))
+		}()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = stateMachine.installPackagesInChroot(mergedDir, packages)
+	if err != nil {
+		return err
+	}
+
+	if kernelDestDir == "" {
+		return nil
+	}
+	return copyInstallerKernel(mergedDir, kernelDestDir)
+}
+
+// joinTeardownError returns the error of a teardown step, after the error
+// of the steps it follows if any
+func joinTeardownError(err error, teardownErr error) error {
+	if teardownErr == nil {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%s after previous error: %w", teardownErr.Error(), err)
+	}
+	return teardownErr
+}
+
+// copyInstallerKernel copies the kernel and initrd of a system to the
+// casper directory of the installer media, if they exist
+func copyInstallerKernel(rootDir string, casperDir string) error {
+	bootFiles := map[string]string{
+		"/boot/vmlinuz":    "vmlinuz",
+		"/boot/initrd.img": "initrd",
+	}
+	for src, dst := range bootFiles {
+		srcPath, err := resolveRootfsPath(rootDir, src)
+		if err != nil {
+			if os.IsNotExist(err) {
+				fmt.Printf("WARNING: %s not found, it will not be copied to the installer media\n", src)
+				continue
+			}
+			return fmt.Errorf("Error finding %s: %s", src, err.Error())
+		}
+		err = osutilCopyFile(srcPath, filepath.Join(casperDir, dst), osutil.CopyFlagDefault)
+		if err != nil {
+			return fmt.Errorf("Error copying %s to the installer media: %s", src, err.Error())
+		}
+	}
+	return nil
+}
+
+// generateInstallSources generates the content of the install-sources.yaml
+// file listing the installable layers. The last installable layer is the
+// default one.
+func (stateMachine *StateMachine) generateInstallSources(layers []installerLayer, displayName string) ([]byte, error) {
+	var sources []installSource
+	for _, layer := range layers {
+		if layer.isLiveLayer() {
+			continue
+		}
+		var size uint64
+		for _, contentDir := range stateMachine.layerContentDirs(layers, layer.name) {
+			contentSize, err := helper.Du(contentDir)
+			if err != nil {
+				return nil, fmt.Errorf("Error getting the size of layer %s: %s", layer.name, err.Error())
+			}
+			size += uint64(contentSize)
+		}
+		sources = append(sources, installSource{
+			Description: map[string]string{"en": fmt.Sprintf("The %s layer of %s.", layer.name, displayName)},
+			ID:          layer.name,
+			Name:        map[string]string{"en": fmt.Sprintf("%s (%s)", displayName, layer.name)},
+			Path:        layer.name + ".squashfs",
+			Size:        size,
+			Type:        "fsimage-layered",
+			Variant:     "server",
+		})
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("No installable layer found")
+	}
+	sources[len(sources)-1].Default = true
+
+	return yaml.Marshal(sources)
+}
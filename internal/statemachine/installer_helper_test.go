@@ -0,0 +1,176 @@
+package statemachine
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+func Test_parseInstallerLayers(t *testing.T) {
+	tests := []struct {
+		name          string
+		layerNames    []string
+		want          []installerLayer
+		expectedError string
+	}{
+		{
+			name:       "base layer only",
+			layerNames: []string{"minimal"},
+			want: []installerLayer{
+				{name: "minimal"},
+			},
+		},
+		{
+			name:       "stacked layers",
+			layerNames: []string{"minimal", "minimal.standard", "minimal.standard.live", "minimal.enhanced"},
+			want: []installerLayer{
+				{name: "minimal"},
+				{name: "minimal.standard", parent: "minimal", seed: "standard"},
+				{name: "minimal.standard.live", parent: "minimal.standard", seed: "live"},
+				{name: "minimal.enhanced", parent: "minimal", seed: "enhanced"},
+			},
+		},
+		{
+			name:          "first layer is not the base one",
+			layerNames:    []string{"minimal.standard", "minimal"},
+			expectedError: "the first layer minimal.standard must be the base layer",
+		},
+		{
+			name:          "several base layers",
+			layerNames:    []string{"minimal", "standard"},
+			expectedError: "layer standard must be built on top of another layer",
+		},
+		{
+			name:          "missing parent",
+			layerNames:    []string{"minimal", "minimal.standard.live"},
+			expectedError: "the parent layer minimal.standard must be listed before",
+		},
+		{
+			name:          "duplicated layer",
+			layerNames:    []string{"minimal", "minimal.standard", "minimal.standard"},
+			expectedError: "layer minimal.standard is listed more than once",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			got, err := parseInstallerLayers(tc.layerNames)
+			if len(tc.expectedError) > 0 {
+				asserter.AssertErrContains(err, tc.expectedError)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			if len(tc.want) != len(got) {
+				t.Fatalf("Got %d layers, expected %d", len(got), len(tc.want))
+			}
+			for i := range got {
+				asserter.AssertEqual(tc.want[i].name, got[i].name)
+				asserter.AssertEqual(tc.want[i].parent, got[i].parent)
+				asserter.AssertEqual(tc.want[i].seed, got[i].seed)
+			}
+		})
+	}
+}
+
+func TestStateMachine_generateInstallSources(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+	stateMachine.tempDirs.rootfs = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "root")
+
+	layers, err := parseInstallerLayers([]string{"minimal", "minimal.standard", "minimal.standard.live"})
+	asserter.AssertErrNil(err, true)
+
+	for _, dir := range stateMachine.layerContentDirs(layers, "minimal.standard.live") {
+		err = os.MkdirAll(dir, 0755)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(filepath.Join(dir, "file"), make([]byte, 8192), 0600)
+		asserter.AssertErrNil(err, true)
+	}
+
+	installSourcesYaml, err := stateMachine.generateInstallSources(layers, "Ubuntu Server")
+	asserter.AssertErrNil(err, true)
+
+	var installSources []installSource
+	err = yaml.Unmarshal(installSourcesYaml, &installSources)
+	asserter.AssertErrNil(err, true)
+
+	if len(installSources) != 2 {
+		t.Fatalf("Got %d install sources, expected 2", len(installSources))
+	}
+	asserter.AssertEqual("minimal", installSources[0].ID)
+	asserter.AssertEqual("minimal.squashfs", installSources[0].Path)
+	asserter.AssertEqual(false, installSources[0].Default)
+	asserter.AssertEqual("minimal.standard", installSources[1].ID)
+	asserter.AssertEqual("minimal.standard.squashfs", installSources[1].Path)
+	asserter.AssertEqual("fsimage-layered", installSources[1].Type)
+	asserter.AssertEqual(true, installSources[1].Default)
+	if installSources[1].Size <= installSources[0].Size {
+		t.Errorf("Size of layer minimal.standard (%d) should be bigger than the one of minimal (%d)",
+			installSources[1].Size, installSources[0].Size)
+	}
+
+	_, err = stateMachine.generateInstallSources(layers[2:], "Ubuntu Server")
+	asserter.AssertErrContains(err, "No installable layer found")
+}
+
+// TestStateMachine_buildInstallerLayer_fail ensures the layer is cleaned up
+// when its packages cannot be installed
+func TestStateMachine_buildInstallerLayer_fail(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	mockQemuStatic(t)
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{Architecture: "arm64"}
+	stateMachine.tempDirs.scratch = t.TempDir()
+	layerDir := filepath.Join(t.TempDir(), "minimal.standard")
+
+	// the overlay is not really mounted, so prepare what is expected in it
+	mergedDir := filepath.Join(layerDir, "merged")
+	err := os.MkdirAll(filepath.Join(mergedDir, "sbin"), 0755)
+	asserter.AssertErrNil(err, true)
+	_, err = os.Create(filepath.Join(mergedDir, "sbin", "start-stop-daemon"))
+	asserter.AssertErrNil(err, true)
+
+	// only the installation of the packages fails
+	execCommand = func(cmd string, args ...string) *exec.Cmd {
+		if cmd == "chroot" {
+			return exec.Command("false")
+		}
+		//nolint:gosec,G204
+		return exec.Command("echo", append([]string{cmd}, args...)...)
+	}
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	restored := false
+	helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfSuccess
+	helperRestoreResolvConf = func(chroot string) error {
+		restored = true
+		return nil
+	}
+	t.Cleanup(func() {
+		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
+		helperRestoreResolvConf = helper.RestoreResolvConf
+	})
+
+	err = stateMachine.buildInstallerLayer(layerDir, []string{t.TempDir()}, []string{"standard-pkg"}, "")
+	asserter.AssertErrContains(err, "Error running command")
+
+	if !restored {
+		t.Error("/etc/resolv.conf should have been restored in the layer")
+	}
+	chrootQemuStatic := filepath.Join(mergedDir, "usr", "bin", "qemu-aarch64-static")
+	_, err = os.Stat(chrootQemuStatic)
+	if !os.IsNotExist(err) {
+		t.Errorf("File \"%s\" should not exist anymore", chrootQemuStatic)
+	}
+}
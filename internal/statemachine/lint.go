@@ -0,0 +1,233 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/snapcore/snapd/gadget"
+
+	"github.com/canonical/ubuntu-image/internal/commands"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// lintFinding is a construct flagged by a lint rule in a file
+type lintFinding struct {
+	validationError
+	Rule     string       `json:"rule"`
+	Severity lintSeverity `json:"severity"`
+}
+
+func (f lintFinding) String() string {
+	return fmt.Sprintf("%s: %s: %s [%s]", f.position(), f.Severity, f.Message, f.Rule)
+}
+
+// lintReport is written to stdout with --format=json
+type lintReport struct {
+	Findings []lintFinding `json:"findings"`
+	Warnings int           `json:"warnings"`
+	Info     int           `json:"info"`
+}
+
+// StrictLintError is returned when warnings were found with --strict.
+// Reported is true when the warnings were already reported by the lint command.
+type StrictLintError struct {
+	Warnings int
+	Reported bool
+}
+
+func (e *StrictLintError) Error() string {
+	if e.Warnings == 1 {
+		return "1 lint warning found with --strict"
+	}
+	return fmt.Sprintf("%d lint warnings found with --strict", e.Warnings)
+}
+
+// lintImageDefinition returns the constructs flagged by the lint rules in an
+// image definition, located in the files it was read from
+func lintImageDefinition(imageDefinition *imagedefinition.ImageDefinition, files []string) []lintFinding {
+	var findings []lintFinding
+	var locator *yamlLocator
+	for _, rule := range imageDefinitionLintRules {
+		for _, match := range rule.check(imageDefinition) {
+			if locator == nil {
+				locator = newYAMLLocator(files)
+			}
+			findings = append(findings, newLintFinding(locator, rule.id, rule.severity, match))
+		}
+	}
+	return findings
+}
+
+// lintGadgetInfo returns the constructs flagged by the lint rules in a gadget.yaml
+func lintGadgetInfo(gadgetInfo *gadget.Info, gadgetYamlPath string) []lintFinding {
+	var findings []lintFinding
+	var locator *yamlLocator
+	for _, rule := range gadgetLintRules {
+		for _, match := range rule.check(gadgetInfo) {
+			if locator == nil {
+				locator = newYAMLLocator([]string{gadgetYamlPath})
+			}
+			findings = append(findings, newLintFinding(locator, rule.id, rule.severity, match))
+		}
+	}
+	return findings
+}
+
+// newLintFinding locates a construct flagged by a lint rule
+func newLintFinding(locator *yamlLocator, rule string, severity lintSeverity, match lintMatch) lintFinding {
+	position := locator.locate(match.location)
+	position.Message = match.message
+	return lintFinding{validationError: position, Rule: rule, Severity: severity}
+}
+
+// sortLintFindings sorts the findings by their position
+func sortLintFindings(findings []lintFinding) {
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// countLintWarnings returns the number of findings with the warning severity
+func countLintWarnings(findings []lintFinding) int {
+	warnings := 0
+	for _, finding := range findings {
+		if finding.Severity == lintWarning {
+			warnings++
+		}
+	}
+	return warnings
+}
+
+// reportLintFindings prints the constructs flagged by the lint rules during a
+// build, only those of quietLintRules with --quiet. Classic builds fail with
+// --strict when warnings were found.
+func (stateMachine *StateMachine) reportLintFindings(findings []lintFinding) error {
+	sortLintFindings(findings)
+	for _, finding := range findings {
+		if stateMachine.commonFlags.Quiet && !quietLintRules[finding.Rule] {
+			continue
+		}
+		fmt.Printf("%s: %s: %s [%s]\n", strings.ToUpper(string(finding.Severity)),
+			finding.position(), finding.Message, finding.Rule)
+	}
+
+	warnings := countLintWarnings(findings)
+	classicStateMachine, isClassic := stateMachine.parent.(*ClassicStateMachine)
+	if warnings > 0 && isClassic && classicStateMachine.Opts.Strict {
+		return &StrictLintError{Warnings: warnings}
+	}
+	return nil
+}
+
+// LintStateMachine embeds StateMachine and adds the command line flags specific to
+// linting image definitions and gadget.yaml files
+type LintStateMachine struct {
+	StateMachine
+	Opts commands.LintOpts
+	Args commands.LintArgs
+
+	lintFindings []lintFinding
+}
+
+// Setup assigns variables and calls other functions that must be executed before Run()
+func (lintStateMachine *LintStateMachine) Setup() error {
+	// set the parent pointer of the embedded struct
+	lintStateMachine.parent = lintStateMachine
+
+	lintStateMachine.states = make([]stateFunc, 0)
+	if lintStateMachine.Args.ImageDefinition != "" {
+		lintStateMachine.states = append(lintStateMachine.states, lintImageDefinitionState)
+	}
+	if lintStateMachine.Opts.GadgetYaml != "" {
+		lintStateMachine.states = append(lintStateMachine.states, lintGadgetYamlState)
+	}
+
+	return lintStateMachine.validateLintInput()
+}
+
+// validateLintInput validates the command line options of the lint command
+func (lintStateMachine *LintStateMachine) validateLintInput() error {
+	if len(lintStateMachine.states) == 0 {
+		return fmt.Errorf("must specify an image definition or a gadget.yaml with --gadget-yaml")
+	}
+	if lintStateMachine.stateMachineFlags.Resume || lintStateMachine.stateMachineFlags.From != "" {
+		return fmt.Errorf("the lint command cannot be resumed")
+	}
+	return nil
+}
+
+// Run runs every lint rule on the files given and reports the constructs flagged
+func (lintStateMachine *LintStateMachine) Run() error {
+	for _, state := range lintStateMachine.states {
+		if lintStateMachine.commonFlags.Debug {
+			fmt.Printf("[%s]\n", state.name)
+		}
+		if err := state.function(&lintStateMachine.StateMachine); err != nil {
+			return err
+		}
+	}
+
+	sortLintFindings(lintStateMachine.lintFindings)
+	if err := lintStateMachine.report(); err != nil {
+		return err
+	}
+
+	warnings := countLintWarnings(lintStateMachine.lintFindings)
+	if warnings > 0 && lintStateMachine.Opts.Strict {
+		return &StrictLintError{Warnings: warnings, Reported: true}
+	}
+	return nil
+}
+
+// report prints the findings in the format requested with --format
+func (lintStateMachine *LintStateMachine) report() error {
+	findings := lintStateMachine.lintFindings
+	warnings := countLintWarnings(findings)
+	if lintStateMachine.Opts.Format == "json" {
+		report := lintReport{
+			Findings: findings,
+			Warnings: warnings,
+			Info:     len(findings) - warnings,
+		}
+		if report.Findings == nil {
+			report.Findings = []lintFinding{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			return fmt.Errorf("Error writing the lint report: %s", err.Error())
+		}
+		return nil
+	}
+
+	for _, finding := range findings {
+		fmt.Println(finding.String())
+	}
+	if lintStateMachine.commonFlags.Quiet {
+		return nil
+	}
+	if warnings == 1 {
+		fmt.Printf("1 warning, %d info\n", len(findings)-warnings)
+	} else {
+		fmt.Printf("%d warnings, %d info\n", warnings, len(findings)-warnings)
+	}
+	return nil
+}
+
+// Placeholder method to satisfy the interface. This is not used when linting.
+func (lintStateMachine *LintStateMachine) SetSeries() error {
+	return nil
+}
+
+// Teardown has nothing to do since nothing is written when linting
+func (lintStateMachine *LintStateMachine) Teardown() error {
+	return nil
+}
@@ -0,0 +1,222 @@
+package statemachine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/gadget"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// lintSeverity is the severity of the constructs flagged by a lint rule.
+// Only warnings fail the build with --strict.
+type lintSeverity string
+
+const (
+	lintWarning lintSeverity = "warning"
+	lintInfo    lintSeverity = "info"
+)
+
+// lintMatch is a construct flagged by a lint rule, at the location of its
+// key in the YAML file
+type lintMatch struct {
+	location []string
+	message  string
+}
+
+// imageDefinitionLintRule flags constructs of image definitions. The rules are
+// checked before the default values are set, to tell the keys not set from
+// the ones set to their default value. Their ids are stable and must not be
+// reused.
+type imageDefinitionLintRule struct {
+	id       string
+	severity lintSeverity
+	check    func(imageDefinition *imagedefinition.ImageDefinition) []lintMatch
+}
+
+// gadgetLintRule flags constructs of gadget.yaml files
+type gadgetLintRule struct {
+	id       string
+	severity lintSeverity
+	check    func(gadgetInfo *gadget.Info) []lintMatch
+}
+
+var imageDefinitionLintRules = []imageDefinitionLintRule{
+	{"sources-list-format-unset", lintWarning, lintSourcesListFormatUnset},
+	{"sources-list-deprecated-format", lintInfo, lintSourcesListDeprecatedFormat},
+	{"sources-list-deb822-requires-noble", lintInfo, lintSourcesListDeb822RequiresNoble},
+	{"proposed-pocket", lintWarning, lintProposedPocket},
+	{"ppa-credentials-kept", lintWarning, lintPPACredentialsKept},
+	{"snap-revision-without-channel", lintWarning, lintSnapRevisionWithoutChannel},
+	{"relative-execute-path", lintWarning, lintRelativeExecutePath},
+	{"plaintext-password", lintWarning, lintPlaintextPassword},
+}
+
+// quietLintRules are the rules whose findings are printed during builds even
+// with --quiet, as the warnings they replaced were
+var quietLintRules = map[string]bool{
+	"sources-list-format-unset":          true,
+	"sources-list-deprecated-format":     true,
+	"sources-list-deb822-requires-noble": true,
+}
+
+var gadgetLintRules = []gadgetLintRule{
+	{"system-boot-label", lintWarning, lintSystemBootLabel},
+}
+
+// lintSourcesListFormatUnset flags image definitions relying on the default
+// format of the sources list, which will change
+func lintSourcesListFormatUnset(imageDefinition *imagedefinition.ImageDefinition) []lintMatch {
+	if imageDefinition.Rootfs == nil || imageDefinition.Rootfs.SourcesListDeb822 != nil {
+		return nil
+	}
+	return []lintMatch{{
+		location: []string{"rootfs"},
+		message: "rootfs:sources-list-deb822 is not set. Please explicitly set the format desired " +
+			"for sources list in your image definition.",
+	}}
+}
+
+// lintSourcesListDeprecatedFormat flags image definitions using the one-line
+// format of the sources list
+func lintSourcesListDeprecatedFormat(imageDefinition *imagedefinition.ImageDefinition) []lintMatch {
+	if imageDefinition.Rootfs == nil || imageDefinition.Rootfs.SourcesListDeb822 == nil ||
+		*imageDefinition.Rootfs.SourcesListDeb822 {
+		return nil
+	}
+	return []lintMatch{{
+		location: []string{"rootfs", "sources-list-deb822"},
+		message: "the deprecated format will be used to manage sources list. " +
+			"Please if possible adopt the DEB822 format, supported since noble.",
+	}}
+}
+
+// lintSourcesListDeb822RequiresNoble flags image definitions using the DEB822
+// format of the sources list, which is only supported since noble
+func lintSourcesListDeb822RequiresNoble(imageDefinition *imagedefinition.ImageDefinition) []lintMatch {
+	if imageDefinition.Rootfs == nil || imageDefinition.Rootfs.SourcesListDeb822 == nil ||
+		!*imageDefinition.Rootfs.SourcesListDeb822 {
+		return nil
+	}
+	return []lintMatch{{
+		location: []string{"rootfs", "sources-list-deb822"},
+		message: "the DEB822 format will be used to manage sources list. " +
+			"Please make sure you are not building an image older than noble.",
+	}}
+}
+
+// lintProposedPocket flags images built with packages not yet released
+func lintProposedPocket(imageDefinition *imagedefinition.ImageDefinition) []lintMatch {
+	var matches []lintMatch
+	if imageDefinition.Rootfs != nil && strings.EqualFold(imageDefinition.Rootfs.Pocket, "proposed") {
+		matches = append(matches, lintMatch{
+			location: []string{"rootfs", "pocket"},
+			message:  "the rootfs is built from the proposed pocket, whose packages are not released yet",
+		})
+	}
+	if imageDefinition.Customization != nil && strings.EqualFold(imageDefinition.Customization.Pocket, "proposed") {
+		matches = append(matches, lintMatch{
+			location: []string{"customization", "pocket"},
+			message:  "the proposed pocket, whose packages are not released yet, is enabled in the image",
+		})
+	}
+	return matches
+}
+
+// lintPPACredentialsKept flags private PPAs whose credentials are left in the
+// sources list of the image
+func lintPPACredentialsKept(imageDefinition *imagedefinition.ImageDefinition) []lintMatch {
+	if imageDefinition.Customization == nil {
+		return nil
+	}
+	var matches []lintMatch
+	for i, ppa := range imageDefinition.Customization.ExtraPPAs {
+		// PPAs are kept enabled by default
+		if ppa.Auth == "" || (ppa.KeepEnabled != nil && !*ppa.KeepEnabled) {
+			continue
+		}
+		matches = append(matches, lintMatch{
+			location: []string{"customization", "extra-ppas", strconv.Itoa(i), "auth"},
+			message: fmt.Sprintf("the credentials of the private PPA %s are kept in the sources list "+
+				"of the image. Set keep-enabled to false to remove them.", ppa.Name),
+		})
+	}
+	return matches
+}
+
+// lintSnapRevisionWithoutChannel flags snaps pinned to a revision which will
+// be refreshed from the default channel
+func lintSnapRevisionWithoutChannel(imageDefinition *imagedefinition.ImageDefinition) []lintMatch {
+	if imageDefinition.Customization == nil {
+		return nil
+	}
+	var matches []lintMatch
+	for i, snap := range imageDefinition.Customization.ExtraSnaps {
+		if snap.SnapRevision == 0 || snap.Channel != "" {
+			continue
+		}
+		matches = append(matches, lintMatch{
+			location: []string{"customization", "extra-snaps", strconv.Itoa(i), "revision"},
+			message: fmt.Sprintf("revision %d of snap %s is pinned without a channel. "+
+				"The snap will track and be refreshed from the default channel.", snap.SnapRevision, snap.SnapName),
+		})
+	}
+	return matches
+}
+
+// lintRelativeExecutePath flags scripts whose path in the rootfs is not
+// absolute, and may be looked for in the PATH of the chroot
+func lintRelativeExecutePath(imageDefinition *imagedefinition.ImageDefinition) []lintMatch {
+	if imageDefinition.Customization == nil || imageDefinition.Customization.Manual == nil {
+		return nil
+	}
+	var matches []lintMatch
+	for i, execute := range imageDefinition.Customization.Manual.Execute {
+		if strings.HasPrefix(execute.ExecutePath, "/") {
+			continue
+		}
+		matches = append(matches, lintMatch{
+			location: []string{"customization", "manual", "execute", strconv.Itoa(i), "path"},
+			message:  fmt.Sprintf("the script %s executed in the rootfs is not an absolute path", execute.ExecutePath),
+		})
+	}
+	return matches
+}
+
+// lintPlaintextPassword flags the passwords of users written in plain text
+func lintPlaintextPassword(imageDefinition *imagedefinition.ImageDefinition) []lintMatch {
+	if imageDefinition.Customization == nil || imageDefinition.Customization.Manual == nil {
+		return nil
+	}
+	var matches []lintMatch
+	for i, user := range imageDefinition.Customization.Manual.AddUser {
+		if user.Password == "" || user.PasswordType != "text" {
+			continue
+		}
+		matches = append(matches, lintMatch{
+			location: []string{"customization", "manual", "add-user", strconv.Itoa(i), "password"},
+			message: fmt.Sprintf("the password of user %s is written in plain text. "+
+				"Set password-type to hash and give its hash instead.", user.UserName),
+		})
+	}
+	return matches
+}
+
+// lintSystemBootLabel flags structures whose role is given by their filesystem label
+func lintSystemBootLabel(gadgetInfo *gadget.Info) []lintMatch {
+	var matches []lintMatch
+	for volumeName, volume := range gadgetInfo.Volumes {
+		for _, structure := range volume.Structure {
+			if structure.Role != "" || structure.Label != gadget.SystemBoot {
+				continue
+			}
+			matches = append(matches, lintMatch{
+				location: []string{"volumes", volumeName, "structure", strconv.Itoa(structure.YamlIndex)},
+				message:  "filesystem-label system-boot used for defining partition roles; use role instead",
+			})
+		}
+	}
+	return matches
+}
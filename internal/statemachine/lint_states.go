@@ -0,0 +1,50 @@
+package statemachine
+
+import (
+	"fmt"
+
+	"github.com/snapcore/snapd/gadget"
+)
+
+var lintImageDefinitionState = stateFunc{"lint_image_definition", (*StateMachine).lintImageDefinitionFile}
+
+// lintImageDefinitionFile reads the image definition as a build would and
+// records the constructs flagged by the lint rules
+func (stateMachine *StateMachine) lintImageDefinitionFile() error {
+	lintStateMachine := stateMachine.parent.(*LintStateMachine)
+
+	overrides, err := parseVariableOverrides(lintStateMachine.Opts.Variables)
+	if err != nil {
+		return err
+	}
+	imageDefinition, sources, err := readImageDefinition(lintStateMachine.Args.ImageDefinition, overrides)
+	if err != nil {
+		return err
+	}
+
+	lintStateMachine.lintFindings = append(lintStateMachine.lintFindings,
+		lintImageDefinition(imageDefinition, sources.files)...)
+	return nil
+}
+
+var lintGadgetYamlState = stateFunc{"lint_gadget_yaml", (*StateMachine).lintGadgetYaml}
+
+// lintGadgetYaml records the constructs flagged by the lint rules in the gadget.yaml
+func (stateMachine *StateMachine) lintGadgetYaml() error {
+	lintStateMachine := stateMachine.parent.(*LintStateMachine)
+	gadgetYamlPath := lintStateMachine.Opts.GadgetYaml
+
+	gadgetYamlBytes, err := osReadFile(gadgetYamlPath)
+	if err != nil {
+		return fmt.Errorf("Error reading gadget.yaml bytes: %s", err.Error())
+	}
+
+	gadgetInfo, err := gadget.InfoFromGadgetYaml(gadgetYamlBytes, nil)
+	if err != nil {
+		return fmt.Errorf("Error running InfoFromGadgetYaml: %s", err.Error())
+	}
+
+	lintStateMachine.lintFindings = append(lintStateMachine.lintFindings,
+		lintGadgetInfo(gadgetInfo, gadgetYamlPath)...)
+	return nil
+}
@@ -0,0 +1,387 @@
+package statemachine
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/testhelper"
+)
+
+func TestLintStateMachine_Setup(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine LintStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+	err := stateMachine.Setup()
+	asserter.AssertErrContains(err, "must specify an image definition or a gadget.yaml")
+
+	stateMachine.Args.ImageDefinition = "image-definition.yaml"
+	stateMachine.Opts.GadgetYaml = "gadget.yaml"
+	err = stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(2, len(stateMachine.states))
+	asserter.AssertEqual(lintImageDefinitionState.name, stateMachine.states[0].name)
+	asserter.AssertEqual(lintGadgetYamlState.name, stateMachine.states[1].name)
+
+	stateMachine.stateMachineFlags.From = "lint_gadget_yaml"
+	err = stateMachine.Setup()
+	asserter.AssertErrContains(err, "the lint command cannot be resumed")
+}
+
+// lintedImageDefinition is only flagged for its sources list format
+const lintedImageDefinition = `name: ubuntu-server
+display-name: Ubuntu Server
+revision: 1
+architecture: amd64
+series: noble
+class: preinstalled
+rootfs:
+  archive-tasks: [minimal]
+  sources-list-deb822: true
+`
+
+// lintedImageDefinitionFinding is the finding of lintedImageDefinition in the given file
+func lintedImageDefinitionFinding(file string) lintFinding {
+	return lintFinding{
+		validationError: validationError{File: file, Line: 9, Column: 24,
+			Message: "the DEB822 format will be used to manage sources list. Please make sure you are not building an image older than noble."},
+		Rule:     "sources-list-deb822-requires-noble",
+		Severity: lintInfo,
+	}
+}
+
+func TestStateMachine_lintImageDefinitionFile(t *testing.T) {
+	testCases := []struct {
+		name  string
+		files map[string]string
+		want  []lintFinding
+	}{
+		{
+			name:  "DEB822 sources list format",
+			files: map[string]string{"image.yaml": lintedImageDefinition},
+			want:  []lintFinding{lintedImageDefinitionFinding("image.yaml")},
+		},
+		{
+			name: "sources list format",
+			files: map[string]string{
+				"image.yaml": "name: test\nrootfs:\n  archive-tasks: [minimal]\n",
+				"old.yaml":   "name: test\nrootfs:\n  sources-list-deb822: false\n",
+			},
+			want: []lintFinding{
+				{
+					validationError: validationError{File: "image.yaml", Line: 2, Column: 1,
+						Message: "rootfs:sources-list-deb822 is not set. Please explicitly set the format desired for sources list in your image definition."},
+					Rule:     "sources-list-format-unset",
+					Severity: lintWarning,
+				},
+			},
+		},
+		{
+			name: "deprecated sources list format",
+			files: map[string]string{
+				"image.yaml": "name: test\nrootfs:\n  sources-list-deb822: false\n",
+			},
+			want: []lintFinding{
+				{
+					validationError: validationError{File: "image.yaml", Line: 3, Column: 24,
+						Message: "the deprecated format will be used to manage sources list. Please if possible adopt the DEB822 format, supported since noble."},
+					Rule:     "sources-list-deprecated-format",
+					Severity: lintInfo,
+				},
+			},
+		},
+		{
+			name: "risky customizations",
+			files: map[string]string{"image.yaml": lintedImageDefinition + `  pocket: Proposed
+customization:
+  extra-ppas:
+    - name: public/ppa
+    - name: private/ppa
+      auth: user:password
+      fingerprint: ABCDEF
+    - name: removed/ppa
+      auth: user:password
+      fingerprint: ABCDEF
+      keep-enabled: false
+  extra-snaps:
+    - name: hello
+      revision: 42
+    - name: world
+      revision: 43
+      channel: edge
+  manual:
+    execute:
+      - path: /usr/bin/true
+      - path: script.sh
+    add-user:
+      - name: ubuntu
+        password: ubuntu
+        password-type: text
+      - name: admin
+        password: $6$hash
+`},
+			want: []lintFinding{
+				lintedImageDefinitionFinding("image.yaml"),
+				{
+					validationError: validationError{File: "image.yaml", Line: 10, Column: 11,
+						Message: "the rootfs is built from the proposed pocket, whose packages are not released yet"},
+					Rule:     "proposed-pocket",
+					Severity: lintWarning,
+				},
+				{
+					validationError: validationError{File: "image.yaml", Line: 15, Column: 13,
+						Message: "the credentials of the private PPA private/ppa are kept in the sources list of the image. Set keep-enabled to false to remove them."},
+					Rule:     "ppa-credentials-kept",
+					Severity: lintWarning,
+				},
+				{
+					validationError: validationError{File: "image.yaml", Line: 23, Column: 17,
+						Message: "revision 42 of snap hello is pinned without a channel. The snap will track and be refreshed from the default channel."},
+					Rule:     "snap-revision-without-channel",
+					Severity: lintWarning,
+				},
+				{
+					validationError: validationError{File: "image.yaml", Line: 30, Column: 15,
+						Message: "the script script.sh executed in the rootfs is not an absolute path"},
+					Rule:     "relative-execute-path",
+					Severity: lintWarning,
+				},
+				{
+					validationError: validationError{File: "image.yaml", Line: 33, Column: 19,
+						Message: "the password of user ubuntu is written in plain text. Set password-type to hash and give its hash instead."},
+					Rule:     "plaintext-password",
+					Severity: lintWarning,
+				},
+			},
+		},
+		{
+			name: "finding in an extended image definition",
+			files: map[string]string{
+				"base.yaml":  lintedImageDefinition + "customization:\n  pocket: proposed\n",
+				"image.yaml": "extends: base.yaml\nname: child\n",
+			},
+			want: []lintFinding{
+				lintedImageDefinitionFinding("base.yaml"),
+				{
+					validationError: validationError{File: "base.yaml", Line: 11, Column: 11,
+						Message: "the proposed pocket, whose packages are not released yet, is enabled in the image"},
+					Rule:     "proposed-pocket",
+					Severity: lintWarning,
+				},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			tmpDir := writeValidatedFiles(t, tc.files)
+
+			var stateMachine LintStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.Args.ImageDefinition = filepath.Join(tmpDir, "image.yaml")
+
+			err := stateMachine.lintImageDefinitionFile()
+			asserter.AssertErrNil(err, true)
+			sortLintFindings(stateMachine.lintFindings)
+			for i := range tc.want {
+				tc.want[i].File = filepath.Join(tmpDir, tc.want[i].File)
+			}
+			asserter.AssertEqual(tc.want, stateMachine.lintFindings, cmp.AllowUnexported(lintFinding{}))
+		})
+	}
+}
+
+func TestStateMachine_lintImageDefinitionFile_fail(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine LintStateMachine
+	stateMachine.parent = &stateMachine
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions", "test_invalid_yaml.yaml")
+
+	err := stateMachine.lintImageDefinitionFile()
+	asserter.AssertErrContains(err, "Error parsing image definition file")
+
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions", "test_raspi.yaml")
+	stateMachine.Opts.Variables = []string{"invalid"}
+	err = stateMachine.lintImageDefinitionFile()
+	asserter.AssertErrContains(err, "invalid")
+}
+
+const systemBootGadgetYaml = `volumes:
+  pc:
+    schema: mbr
+    bootloader: grub
+    structure:
+      - name: boot
+        type: 0C
+        filesystem: vfat
+        filesystem-label: system-boot
+        size: 100M
+      - name: data
+        type: 83
+        filesystem: ext4
+        role: system-data
+        size: 1G
+`
+
+func TestStateMachine_lintGadgetYaml(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	tmpDir := writeValidatedFiles(t, map[string]string{
+		"gadget.yaml":  systemBootGadgetYaml,
+		"invalid.yaml": "volumes:\n  pc: [\n",
+	})
+
+	var stateMachine LintStateMachine
+	stateMachine.parent = &stateMachine
+	stateMachine.Opts.GadgetYaml = filepath.Join(tmpDir, "gadget.yaml")
+
+	err := stateMachine.lintGadgetYaml()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual([]lintFinding{{
+		validationError: validationError{File: stateMachine.Opts.GadgetYaml, Line: 6, Column: 9,
+			Message: "filesystem-label system-boot used for defining partition roles; use role instead"},
+		Rule:     "system-boot-label",
+		Severity: lintWarning,
+	}}, stateMachine.lintFindings, cmp.AllowUnexported(lintFinding{}))
+
+	stateMachine.Opts.GadgetYaml = filepath.Join(tmpDir, "invalid.yaml")
+	err = stateMachine.lintGadgetYaml()
+	asserter.AssertErrContains(err, "Error running InfoFromGadgetYaml")
+
+	stateMachine.Opts.GadgetYaml = filepath.Join(tmpDir, "inexistent.yaml")
+	err = stateMachine.lintGadgetYaml()
+	asserter.AssertErrContains(err, "Error reading gadget.yaml bytes")
+}
+
+// TestLintStateMachine_Run ensures every finding is reported in the format
+// requested, and that warnings only fail with --strict
+func TestLintStateMachine_Run(t *testing.T) {
+	testCases := []struct {
+		name   string
+		format string
+		strict bool
+		want   string
+	}{
+		{
+			name:   "text",
+			format: "text",
+			want: `gadget.yaml:6:9: warning: filesystem-label system-boot used for defining partition roles; use role instead [system-boot-label]
+image.yaml:9:24: info: the deprecated format will be used to manage sources list. Please if possible adopt the DEB822 format, supported since noble. [sources-list-deprecated-format]
+1 warning, 1 info
+`,
+		},
+		{
+			name:   "json",
+			format: "json",
+			strict: true,
+			want: `{"findings":[{"file":"gadget.yaml","line":6,"column":9,"message":"filesystem-label system-boot used for defining partition roles; use role instead","rule":"system-boot-label","severity":"warning"},` +
+				`{"file":"image.yaml","line":9,"column":24,"message":"the deprecated format will be used to manage sources list. Please if possible adopt the DEB822 format, supported since noble.","rule":"sources-list-deprecated-format","severity":"info"}],"warnings":1,"info":1}
+`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			tmpDir := writeValidatedFiles(t, map[string]string{
+				"image.yaml":  lintedImageDefinition[:len(lintedImageDefinition)-len("true\n")] + "false\n",
+				"gadget.yaml": systemBootGadgetYaml,
+			})
+			restoreCWD := testhelper.SaveCWD()
+			defer restoreCWD()
+			err := os.Chdir(tmpDir)
+			asserter.AssertErrNil(err, true)
+
+			var stateMachine LintStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.Args.ImageDefinition = "image.yaml"
+			stateMachine.Opts.GadgetYaml = "gadget.yaml"
+			stateMachine.Opts.Format = tc.format
+			stateMachine.Opts.Strict = tc.strict
+
+			err = stateMachine.Setup()
+			asserter.AssertErrNil(err, true)
+
+			stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.Run()
+			restoreStdout()
+			if tc.strict {
+				var strictLintErr *StrictLintError
+				if !errors.As(err, &strictLintErr) || strictLintErr.Warnings != 1 || !strictLintErr.Reported {
+					t.Errorf("Expected 1 reported lint warning, got %v", err)
+				}
+			} else {
+				asserter.AssertErrNil(err, true)
+			}
+			output, err := io.ReadAll(stdout)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.want, string(output))
+
+			err = stateMachine.Teardown()
+			asserter.AssertErrNil(err, true)
+		})
+	}
+}
+
+// TestStateMachine_reportLintFindings ensures the findings are printed during
+// builds, and fail classic builds with --strict
+func TestStateMachine_reportLintFindings(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	findings := []lintFinding{
+		{
+			validationError: validationError{File: "image.yaml", Line: 3, Column: 3, Message: "second"},
+			Rule:            "sources-list-deprecated-format",
+			Severity:        lintInfo,
+		},
+		{
+			validationError: validationError{File: "image.yaml", Line: 2, Column: 1, Message: "first"},
+			Rule:            "sources-list-format-unset",
+			Severity:        lintWarning,
+		},
+	}
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.reportLintFindings(findings)
+	restoreStdout()
+	asserter.AssertErrNil(err, true)
+	output, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("WARNING: image.yaml:2:1: first [sources-list-format-unset]\n"+
+		"INFO: image.yaml:3:3: second [sources-list-deprecated-format]\n", string(output))
+
+	// only the findings replacing the former warnings are printed with --quiet
+	stateMachine.commonFlags.Quiet = true
+	quietFindings := append([]lintFinding{{
+		validationError: validationError{File: "image.yaml", Line: 4, Column: 3, Message: "third"},
+		Rule:            "proposed-pocket",
+		Severity:        lintWarning,
+	}}, findings...)
+	stdout, restoreStdout, err = helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.reportLintFindings(quietFindings)
+	restoreStdout()
+	asserter.AssertErrNil(err, true)
+	output, err = io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("WARNING: image.yaml:2:1: first [sources-list-format-unset]\n"+
+		"INFO: image.yaml:3:3: second [sources-list-deprecated-format]\n", string(output))
+
+	stateMachine.Opts.Strict = true
+	err = stateMachine.reportLintFindings(findings)
+	asserter.AssertErrContains(err, "1 lint warning found with --strict")
+
+	// info findings do not fail builds with --strict
+	err = stateMachine.reportLintFindings([]lintFinding{{Rule: "sources-list-deprecated-format", Severity: lintInfo}})
+	asserter.AssertErrNil(err, true)
+}
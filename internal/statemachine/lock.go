@@ -0,0 +1,140 @@
+package statemachine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var syscallFlock = syscall.Flock
+
+// lockFileName is the file of the workdir holding the PID of the ubuntu-image
+// process using it
+const lockFileName = "ubuntu-image.lock"
+
+// workDirLock is an exclusive lock on a workdir. The lock is released by the
+// kernel when the process dies, while the lock file is only removed when the
+// lock is released cleanly, which tells a dead process apart.
+type workDirLock struct {
+	file *os.File
+	path string
+}
+
+// lockHolder returns the PID written in a lock file, 0 if unknown
+func lockHolder(file *os.File) int {
+	content := make([]byte, 32)
+	n, _ := file.ReadAt(content, 0)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content[:n])))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// lockWorkDir takes an exclusive lock on the workdir. A lock left by a
+// process that did not exit cleanly is an error unless allowStale is set.
+func lockWorkDir(workDir string, allowStale bool) (*workDirLock, error) {
+	lockPath := filepath.Join(workDir, lockFileName)
+	for {
+		file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening the lock of the workdir: %s", err.Error())
+		}
+		err = syscallFlock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			pid := lockHolder(file)
+			file.Close()
+			return nil, fmt.Errorf("workdir %s is in use by another ubuntu-image process (pid %d), "+
+				"wait for it to finish or use another --workdir", workDir, pid)
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Error locking the workdir: %s", err.Error())
+		}
+
+		// the lock file may have been removed by the process releasing it
+		// between our open and lock, lock the new one instead
+		lockedInfo, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Error locking the workdir: %s", err.Error())
+		}
+		currentInfo, err := os.Stat(lockPath)
+		if err != nil || !os.SameFile(lockedInfo, currentInfo) {
+			file.Close()
+			continue
+		}
+
+		if lockedInfo.Size() > 0 {
+			pid := lockHolder(file)
+			if !allowStale {
+				file.Close()
+				return nil, fmt.Errorf("workdir %s was locked by ubuntu-image process %d which did not "+
+					"exit cleanly, filesystems may still be mounted in it. Run \"ubuntu-image clean "+
+					"--workdir %s\" before using it again", workDir, pid, workDir)
+			}
+			fmt.Printf("Removing the stale lock left by ubuntu-image process %d\n", pid)
+		}
+
+		if err := file.Truncate(0); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Error writing the lock of the workdir: %s", err.Error())
+		}
+		if _, err := file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Error writing the lock of the workdir: %s", err.Error())
+		}
+		return &workDirLock{file: file, path: lockPath}, nil
+	}
+}
+
+// release removes the lock file before unlocking it
+func (l *workDirLock) release() error {
+	if l == nil {
+		return nil
+	}
+	// the workdir may have been deleted while locked
+	err := os.Remove(l.path)
+	l.file.Close()
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing the lock of the workdir: %s", err.Error())
+	}
+	return nil
+}
+
+// keep unlocks the workdir but leaves the lock file, so that the lock is
+// reported as stale to the next ubuntu-image process using the workdir
+func (l *workDirLock) keep() {
+	if l == nil {
+		return
+	}
+	l.file.Close()
+}
+
+// lockWorkDir locks the workdir given with --workdir until Teardown. A
+// temporary workdir is not shared and is not locked.
+func (stateMachine *StateMachine) lockWorkDir() error {
+	if stateMachine.stateMachineFlags.WorkDir == "" || stateMachine.commonFlags.DryRun {
+		return nil
+	}
+	if err := osMkdirAll(stateMachine.stateMachineFlags.WorkDir, 0755); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Error creating work directory: %s", err.Error())
+	}
+	lock, err := lockWorkDir(stateMachine.stateMachineFlags.WorkDir, false)
+	if err != nil {
+		return err
+	}
+	stateMachine.lock = lock
+	return nil
+}
+
+// unlockWorkDir releases the lock on the workdir, if any
+func (stateMachine *StateMachine) unlockWorkDir() error {
+	err := stateMachine.lock.release()
+	stateMachine.lock = nil
+	return err
+}
@@ -0,0 +1,138 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+func Test_lockWorkDir(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	workDir := t.TempDir()
+	lockPath := filepath.Join(workDir, lockFileName)
+
+	lock, err := lockWorkDir(workDir, false)
+	asserter.AssertErrNil(err, true)
+	content, err := os.ReadFile(lockPath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(strconv.Itoa(os.Getpid())+"\n", string(content))
+
+	// the lock is per open file, so it conflicts within the same process
+	_, err = lockWorkDir(workDir, true)
+	asserter.AssertErrContains(err, fmt.Sprintf("is in use by another ubuntu-image process (pid %d)", os.Getpid()))
+
+	err = lock.release()
+	asserter.AssertErrNil(err, true)
+	_, err = os.Stat(lockPath)
+	if !os.IsNotExist(err) {
+		t.Errorf("The lock file was not removed: %v", err)
+	}
+
+	lock, err = lockWorkDir(workDir, false)
+	asserter.AssertErrNil(err, true)
+	err = lock.release()
+	asserter.AssertErrNil(err, true)
+
+	// a released lock of a deleted workdir
+	lock, err = lockWorkDir(workDir, false)
+	asserter.AssertErrNil(err, true)
+	err = os.RemoveAll(workDir)
+	asserter.AssertErrNil(err, true)
+	err = lock.release()
+	asserter.AssertErrNil(err, true)
+
+	_, err = lockWorkDir(workDir, false)
+	asserter.AssertErrContains(err, "Error opening the lock of the workdir")
+}
+
+// Test_lockWorkDir_stale ensures the lock left by a process that did not
+// release it is detected
+func Test_lockWorkDir_stale(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	workDir := t.TempDir()
+	lockPath := filepath.Join(workDir, lockFileName)
+	err := os.WriteFile(lockPath, []byte("4242\n"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	_, err = lockWorkDir(workDir, false)
+	asserter.AssertErrContains(err, "was locked by ubuntu-image process 4242 which did not exit cleanly")
+	asserter.AssertErrContains(err, "ubuntu-image clean --workdir "+workDir)
+
+	lock, err := lockWorkDir(workDir, true)
+	asserter.AssertErrNil(err, true)
+	content, err := os.ReadFile(lockPath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(strconv.Itoa(os.Getpid())+"\n", string(content))
+	err = lock.release()
+	asserter.AssertErrNil(err, true)
+}
+
+func Test_lockWorkDir_fail(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	syscallFlock = func(int, int) error { return syscall.ENOLCK }
+	t.Cleanup(func() { syscallFlock = syscall.Flock })
+
+	_, err := lockWorkDir(t.TempDir(), false)
+	asserter.AssertErrContains(err, "Error locking the workdir")
+}
+
+// TestStateMachine_lockWorkDir ensures the workdir is locked from Setup until
+// Teardown, or until the build fails
+func TestStateMachine_lockWorkDir(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	workDir := filepath.Join(t.TempDir(), "workdir")
+	lockPath := filepath.Join(workDir, lockFileName)
+
+	newStateMachine := func() *testStateMachine {
+		var stateMachine testStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.commonFlags.Quiet = true
+		stateMachine.stateMachineFlags.WorkDir = workDir
+		stateMachine.states = []stateFunc{
+			{"fail", func(*StateMachine) error { return fmt.Errorf("failing state") }},
+		}
+		return &stateMachine
+	}
+
+	stateMachine := newStateMachine()
+	err := stateMachine.lockWorkDir()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(true, stateMachine.lock != nil)
+
+	// a concurrent build, or resuming the build while it runs
+	concurrentStateMachine := newStateMachine()
+	concurrentStateMachine.stateMachineFlags.Resume = true
+	err = concurrentStateMachine.lockWorkDir()
+	asserter.AssertErrContains(err, "is in use by another ubuntu-image process")
+
+	err = stateMachine.Run()
+	asserter.AssertErrContains(err, "failing state")
+	_, err = os.Stat(lockPath)
+	if !os.IsNotExist(err) {
+		t.Errorf("The lock was not released on failure: %v", err)
+	}
+
+	err = stateMachine.lockWorkDir()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.Teardown()
+	asserter.AssertErrNil(err, true)
+	_, err = os.Stat(lockPath)
+	if !os.IsNotExist(err) {
+		t.Errorf("The lock was not released by Teardown: %v", err)
+	}
+
+	// neither temporary workdirs nor dry runs are locked
+	stateMachine.stateMachineFlags.WorkDir = ""
+	err = stateMachine.lockWorkDir()
+	asserter.AssertErrNil(err, true)
+	stateMachine.stateMachineFlags.WorkDir = workDir
+	stateMachine.commonFlags.DryRun = true
+	err = stateMachine.lockWorkDir()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(true, stateMachine.lock == nil)
+}
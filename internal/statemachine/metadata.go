@@ -0,0 +1,174 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// metadataVersion is the version of the format of the saved state. It must
+// be increased, and a migration from the previous version added to
+// metadataMigrations, whenever a field is added, renamed, removed or changes
+// meaning, so that an older ubuntu-image refuses a state it would only
+// partly read.
+const metadataVersion = 2
+
+// savedState is the format of the state saved in the workdir, read back
+// by --resume
+type savedState struct {
+	Version        int                      `json:"Version"`
+	CurrentStep    string                   `json:"CurrentStep"`
+	StepsTaken     int                      `json:"StepsTaken"`
+	StepNames      []string                 `json:"StepNames"`
+	ConfDefPath    string                   `json:"ConfDefPath"`
+	YamlFilePath   string                   `json:"YamlFilePath"`
+	IsSeeded       bool                     `json:"IsSeeded"`
+	RootfsVolName  string                   `json:"RootfsVolName"`
+	RootfsPartNum  int                      `json:"RootfsPartNum"`
+	SectorSize     quantity.Size            `json:"SectorSize"`
+	RootfsSize     quantity.Size            `json:"RootfsSize"`
+	GadgetInfo     *gadget.Info             `json:"GadgetInfo"`
+	ImageSizes     map[string]quantity.Size `json:"ImageSizes"`
+	VolumeOrder    []string                 `json:"VolumeOrder"`
+	VolumeNames    map[string]string        `json:"VolumeNames"`
+	MainVolumeName string                   `json:"MainVolumeName"`
+	Packages       []string                 `json:"Packages"`
+	Snaps          []string                 `json:"Snaps"`
+	GadgetCommit   string                   `json:"GadgetCommit"`
+	InputHashes    map[string]string        `json:"InputHashes"`
+	Variables      map[string]string        `json:"Variables"`
+}
+
+// metadataMigration upgrades a saved state to the next version of the
+// format. stateNames are the names of the states of the build resumed.
+type metadataMigration func(state map[string]json.RawMessage, stateNames []string) error
+
+// metadataMigrations upgrade a saved state from the version given as key
+// to the next one
+var metadataMigrations = map[int]metadataMigration{
+	// GadgetCommit and InputHashes were added in version 1. They are left
+	// unset, so the inputs of the previous run are not checked.
+	0: func(map[string]json.RawMessage, []string) error { return nil },
+	// StepNames and Variables were added in version 2. The names of the
+	// steps taken are those of this build, provided the step saved as the
+	// current one is where they expect it.
+	1: migrateStepNames,
+}
+
+// migrateStepNames sets the names of the steps taken by a state saved
+// before they were recorded
+func migrateStepNames(state map[string]json.RawMessage, stateNames []string) error {
+	var stepsTaken int
+	var currentStep string
+	if rawStepsTaken, found := state["StepsTaken"]; found {
+		if err := json.Unmarshal(rawStepsTaken, &stepsTaken); err != nil {
+			return fmt.Errorf("invalid steps taken: %s", err.Error())
+		}
+	}
+	if rawCurrentStep, found := state["CurrentStep"]; found {
+		if err := json.Unmarshal(rawCurrentStep, &currentStep); err != nil {
+			return fmt.Errorf("invalid current step: %s", err.Error())
+		}
+	}
+	// an invalid count is reported when the state is loaded
+	if stepsTaken < 0 || stepsTaken > len(stateNames) {
+		return nil
+	}
+	// the current step is the last step taken, or the one the previous run stopped at
+	if currentStep != "" {
+		lastStepFound := stepsTaken > 0 && stateNames[stepsTaken-1] == currentStep
+		nextStepFound := stepsTaken < len(stateNames) && stateNames[stepsTaken] == currentStep
+		if !lastStepFound && !nextStepFound {
+			return fmt.Errorf("the step %s saved as the current one is not step %d or %d of this build, "+
+				"start the build again", currentStep, stepsTaken-1, stepsTaken)
+		}
+	}
+	rawStepNames, err := json.Marshal(stateNames[:stepsTaken])
+	if err != nil {
+		return err
+	}
+	state["StepNames"] = rawStepNames
+	return nil
+}
+
+// savedState returns the state to save in the workdir
+func (stateMachine *StateMachine) savedState() *savedState {
+	return &savedState{
+		Version:        metadataVersion,
+		CurrentStep:    stateMachine.CurrentStep,
+		StepsTaken:     stateMachine.StepsTaken,
+		StepNames:      stateMachine.stepNames,
+		ConfDefPath:    stateMachine.ConfDefPath,
+		YamlFilePath:   stateMachine.YamlFilePath,
+		IsSeeded:       stateMachine.IsSeeded,
+		RootfsVolName:  stateMachine.RootfsVolName,
+		RootfsPartNum:  stateMachine.RootfsPartNum,
+		SectorSize:     stateMachine.SectorSize,
+		RootfsSize:     stateMachine.RootfsSize,
+		GadgetInfo:     stateMachine.GadgetInfo,
+		ImageSizes:     stateMachine.ImageSizes,
+		VolumeOrder:    stateMachine.VolumeOrder,
+		VolumeNames:    stateMachine.VolumeNames,
+		MainVolumeName: stateMachine.MainVolumeName,
+		Packages:       stateMachine.Packages,
+		Snaps:          stateMachine.Snaps,
+		GadgetCommit:   stateMachine.GadgetCommit,
+		InputHashes:    stateMachine.InputHashes,
+		Variables:      stateMachine.Variables,
+	}
+}
+
+// migrateMetadata upgrades a saved state to the given version of the format
+func migrateMetadata(state map[string]json.RawMessage, toVersion int, stateNames []string) error {
+	version := 0
+	if rawVersion, found := state["Version"]; found {
+		if err := json.Unmarshal(rawVersion, &version); err != nil {
+			return fmt.Errorf("invalid version of the saved state: %s", err.Error())
+		}
+	}
+	if version > toVersion {
+		return fmt.Errorf("the state was saved by a newer version of ubuntu-image using the "+
+			"format version %d, while this version only supports up to version %d. Resume the "+
+			"build with the same or a newer version of ubuntu-image, or start it again",
+			version, toVersion)
+	}
+	for ; version < toVersion; version++ {
+		migration, found := metadataMigrations[version]
+		if !found {
+			return fmt.Errorf("cannot migrate the saved state from format version %d", version)
+		}
+		if err := migration(state, stateNames); err != nil {
+			return fmt.Errorf("error migrating the saved state from format version %d: %s",
+				version, err.Error())
+		}
+	}
+	rawVersion, err := json.Marshal(toVersion)
+	if err != nil {
+		return err
+	}
+	state["Version"] = rawVersion
+	return nil
+}
+
+// decodeMetadata decodes a saved state, migrating it to the current version
+// of the format
+func decodeMetadata(content []byte, stateNames []string) (*savedState, error) {
+	var rawState map[string]json.RawMessage
+	if err := json.Unmarshal(content, &rawState); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata file: %s", err.Error())
+	}
+	if err := migrateMetadata(rawState, metadataVersion, stateNames); err != nil {
+		return nil, err
+	}
+	migratedContent, err := json.Marshal(rawState)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode migrated metadata: %s", err.Error())
+	}
+	state := &savedState{}
+	if err := json.Unmarshal(migratedContent, state); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata file: %s", err.Error())
+	}
+	return state, nil
+}
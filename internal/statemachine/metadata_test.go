@@ -0,0 +1,188 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+func Test_migrateMetadata(t *testing.T) {
+	testCases := []struct {
+		name          string
+		state         string
+		toVersion     int
+		migrations    map[int]metadataMigration
+		wantState     string
+		expectedError string
+	}{
+		{
+			name:      "unversioned state",
+			state:     `{"CurrentStep":"load_gadget_yaml","StepsTaken":2}`,
+			toVersion: metadataVersion,
+			wantState: `{"CurrentStep":"load_gadget_yaml","StepNames":["prepare_gadget_tree","load_gadget_yaml"],"StepsTaken":2,"Version":2}`,
+		},
+		{
+			name:      "state stopped before a step",
+			state:     `{"CurrentStep":"make_disk","StepsTaken":2,"Version":1}`,
+			toVersion: metadataVersion,
+			wantState: `{"CurrentStep":"make_disk","StepNames":["prepare_gadget_tree","load_gadget_yaml"],"StepsTaken":2,"Version":2}`,
+		},
+		{
+			name:      "no step taken",
+			state:     `{"StepsTaken":0,"Version":1}`,
+			toVersion: metadataVersion,
+			wantState: `{"StepNames":[],"StepsTaken":0,"Version":2}`,
+		},
+		{
+			name:          "current step of another build",
+			state:         `{"CurrentStep":"germinate","StepsTaken":2,"Version":1}`,
+			toVersion:     metadataVersion,
+			expectedError: "the step germinate saved as the current one is not step 1 or 2 of this build",
+		},
+		{
+			name:      "more steps taken than in the build",
+			state:     `{"CurrentStep":"make_disk","StepsTaken":4,"Version":1}`,
+			toVersion: metadataVersion,
+			wantState: `{"CurrentStep":"make_disk","StepsTaken":4,"Version":2}`,
+		},
+		{
+			name:      "current version",
+			state:     `{"StepNames":["prepare_gadget_tree"],"StepsTaken":1,"Version":2}`,
+			toVersion: metadataVersion,
+			wantState: `{"StepNames":["prepare_gadget_tree"],"StepsTaken":1,"Version":2}`,
+		},
+		{
+			name:      "successive migrations",
+			state:     `{"Steps":2,"Version":1}`,
+			toVersion: 3,
+			migrations: map[int]metadataMigration{
+				1: func(state map[string]json.RawMessage, stateNames []string) error {
+					state["StepsTaken"] = state["Steps"]
+					delete(state, "Steps")
+					return nil
+				},
+				2: func(state map[string]json.RawMessage, stateNames []string) error {
+					state["Packages"] = json.RawMessage(`[]`)
+					return nil
+				},
+			},
+			wantState: `{"Packages":[],"StepsTaken":2,"Version":3}`,
+		},
+		{
+			name:          "newer version",
+			state:         `{"StepsTaken":2,"Version":3}`,
+			toVersion:     metadataVersion,
+			expectedError: "format version 3, while this version only supports up to version 2",
+		},
+		{
+			name:          "invalid version",
+			state:         `{"Version":"one"}`,
+			toVersion:     metadataVersion,
+			expectedError: "invalid version of the saved state",
+		},
+		{
+			name:          "missing migration",
+			state:         `{"Version":1}`,
+			toVersion:     2,
+			migrations:    map[int]metadataMigration{},
+			expectedError: "cannot migrate the saved state from format version 1",
+		},
+		{
+			name:      "failing migration",
+			state:     `{"Version":1}`,
+			toVersion: 2,
+			migrations: map[int]metadataMigration{
+				1: func(map[string]json.RawMessage, []string) error { return fmt.Errorf("Test Error") },
+			},
+			expectedError: "error migrating the saved state from format version 1: Test Error",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			if tc.migrations != nil {
+				savedMigrations := metadataMigrations
+				metadataMigrations = tc.migrations
+				t.Cleanup(func() { metadataMigrations = savedMigrations })
+			}
+
+			var state map[string]json.RawMessage
+			err := json.Unmarshal([]byte(tc.state), &state)
+			asserter.AssertErrNil(err, true)
+
+			err = migrateMetadata(state, tc.toVersion,
+				[]string{prepareGadgetTreeState.name, loadGadgetYamlState.name, makeDiskState.name})
+			if tc.expectedError != "" {
+				asserter.AssertErrContains(err, tc.expectedError)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			gotState, err := json.Marshal(state)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.wantState, string(gotState))
+		})
+	}
+}
+
+// TestStateMachine_savedState ensures a saved state is read back unchanged
+func TestStateMachine_savedState(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine StateMachine
+	stateMachine.StepsTaken = 4
+	stateMachine.stepNames = []string{"prepare_gadget_tree", "load_gadget_yaml", "calculate_rootfs_size", "make_disk"}
+	stateMachine.CurrentStep = "make_disk"
+	stateMachine.Packages = []string{"nginx"}
+	stateMachine.GadgetCommit = "0123456789abcdef0123456789abcdef01234567"
+	stateMachine.InputHashes = map[string]string{"image definition": "abcd"}
+
+	content, err := json.Marshal(stateMachine.savedState())
+	asserter.AssertErrNil(err, true)
+	gotState, err := decodeMetadata(content, nil)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(stateMachine.savedState(), gotState)
+
+	_, err = decodeMetadata([]byte(`{"StepsTaken":"two","Version":2}`), nil)
+	asserter.AssertErrContains(err, "failed to parse metadata file")
+}
+
+// TestSavedStateFields ensures the version of the format of the saved state
+// is increased when its fields change
+func TestSavedStateFields(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	fieldsByVersion := map[int][]string{
+		2: {"Version", "CurrentStep", "StepsTaken", "StepNames", "ConfDefPath", "YamlFilePath",
+			"IsSeeded", "RootfsVolName", "RootfsPartNum", "SectorSize", "RootfsSize", "GadgetInfo",
+			"ImageSizes", "VolumeOrder", "VolumeNames", "MainVolumeName", "Packages", "Snaps",
+			"GadgetCommit", "InputHashes", "Variables"},
+	}
+
+	var fields []string
+	savedStateType := reflect.TypeOf(savedState{})
+	for i := 0; i < savedStateType.NumField(); i++ {
+		fields = append(fields, savedStateType.Field(i).Tag.Get("json"))
+	}
+	wantFields, found := fieldsByVersion[metadataVersion]
+	if !found {
+		t.Fatalf("the fields of version %d of the saved state are not listed", metadataVersion)
+	}
+	asserter.AssertEqual(wantFields, fields)
+}
+
+// TestStateMachine_checkStepNames ensures a state saved by a build with
+// different steps is not resumed
+func TestStateMachine_checkStepNames(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine StateMachine
+	stateMachine.states = []stateFunc{prepareGadgetTreeState, loadGadgetYamlState, makeDiskState}
+	stateMachine.StepsTaken = 2
+
+	err := stateMachine.checkStepNames([]string{prepareGadgetTreeState.name, loadGadgetYamlState.name})
+	asserter.AssertErrNil(err, true)
+
+	err = stateMachine.checkStepNames([]string{buildGadgetTreeState.name, prepareGadgetTreeState.name})
+	asserter.AssertErrContains(err, "the steps taken by the previous run (build_gadget_tree, prepare_gadget_tree) "+
+		"are not the first steps of this build (prepare_gadget_tree, load_gadget_yaml)")
+}
@@ -25,7 +25,7 @@ type PackStateMachine struct {
 }
 
 // Setup assigns variables and calls other functions that must be executed before Run()
-func (packStateMachine *PackStateMachine) Setup() error {
+func (packStateMachine *PackStateMachine) Setup() (err error) {
 	fmt.Print("WARNING: this is an experimental feature.\n")
 
 	// set the parent pointer of the embedded struct
@@ -44,6 +44,16 @@ func (packStateMachine *PackStateMachine) Setup() error {
 		return err
 	}
 
+	// keep concurrent builds from using the same workdir
+	if err := packStateMachine.lockWorkDir(); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = packStateMachine.unlockWorkDir()
+		}
+	}()
+
 	// if --resume was passed, figure out where to start
 	if err := packStateMachine.readMetadata(metadataStateFile); err != nil {
 		return err
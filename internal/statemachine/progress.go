@@ -0,0 +1,170 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/snapcore/snapd/image"
+	"github.com/snapcore/snapd/image/preseed"
+)
+
+const (
+	progressStart   = "start"
+	progressFinish  = "finish"
+	progressFailure = "failure"
+)
+
+// progressEvent is an event of the machine-readable progress stream
+type progressEvent struct {
+	Event     string    `json:"event"`
+	Step      int       `json:"step"`
+	State     string    `json:"state"`
+	Time      time.Time `json:"time"`
+	Duration  float64   `json:"duration,omitempty"` // in seconds
+	Error     string    `json:"error,omitempty"`
+	Artifacts []string  `json:"artifacts,omitempty"`
+}
+
+// outputFileState identifies a version of a file of the output directory
+type outputFileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// progressReporter writes the machine-readable progress of the build as
+// JSON lines and tracks the artifacts produced by each state
+type progressReporter struct {
+	writer    io.WriteCloser
+	encoder   *json.Encoder
+	outputDir string
+	// files of the output directory when the current state started
+	outputFiles map[string]outputFileState
+	start       time.Time
+}
+
+// nopWriteCloser prevents closing stdout along with the progress stream
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// progressStdout is the stdout the progress events are written to when the
+// human readable output is sent to stderr by SeparateProgressOutput
+var progressStdout io.Writer
+
+// SeparateProgressOutput sends the human readable output of the build, from
+// ubuntu-image, snapd and the hooks, to stderr so that stdout only carries the
+// json progress events. It returns a function restoring the outputs
+func SeparateProgressOutput() (restore func()) {
+	oldStdout, oldImageStdout, oldPreseedStdout := os.Stdout, image.Stdout, preseed.Stdout
+	progressStdout = oldStdout
+	os.Stdout = os.Stderr
+	image.Stdout = os.Stderr
+	preseed.Stdout = os.Stderr
+	return func() {
+		progressStdout = nil
+		os.Stdout = oldStdout
+		image.Stdout = oldImageStdout
+		preseed.Stdout = oldPreseedStdout
+	}
+}
+
+// newProgressReporter returns a reporter writing to the progress file if one
+// is given, or to stdout
+func newProgressReporter(progressFile string, outputDir string) (*progressReporter, error) {
+	stdout := progressStdout
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	var writer io.WriteCloser = nopWriteCloser{stdout}
+	if progressFile != "" {
+		file, err := osCreate(progressFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating progress file: %s", err.Error())
+		}
+		writer = file
+	}
+	return &progressReporter{
+		writer:    writer,
+		encoder:   json.NewEncoder(writer),
+		outputDir: outputDir,
+	}, nil
+}
+
+// listOutputFiles returns the regular files at the top of the output directory
+func (p *progressReporter) listOutputFiles() map[string]outputFileState {
+	outputFiles := make(map[string]outputFileState)
+	entries, err := osReadDir(p.outputDir)
+	if err != nil {
+		return outputFiles
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		outputFiles[entry.Name()] = outputFileState{size: info.Size(), modTime: info.ModTime()}
+	}
+	return outputFiles
+}
+
+// producedArtifacts returns the files of the output directory that were
+// created or modified since the state started
+func (p *progressReporter) producedArtifacts() []string {
+	var artifacts []string
+	for name, fileState := range p.listOutputFiles() {
+		if previous, found := p.outputFiles[name]; !found || previous != fileState {
+			artifacts = append(artifacts, filepath.Join(p.outputDir, name))
+		}
+	}
+	sort.Strings(artifacts)
+	return artifacts
+}
+
+func (p *progressReporter) write(event progressEvent) error {
+	err := p.encoder.Encode(event)
+	if err != nil {
+		return fmt.Errorf("Error writing progress event: %s", err.Error())
+	}
+	return nil
+}
+
+// stateStarted reports the start of a state
+func (p *progressReporter) stateStarted(step int, state string) error {
+	p.start = time.Now()
+	p.outputFiles = p.listOutputFiles()
+	return p.write(progressEvent{
+		Event: progressStart,
+		Step:  step,
+		State: state,
+		Time:  p.start,
+	})
+}
+
+// stateFinished reports the end of a state, successful if stateErr is nil
+func (p *progressReporter) stateFinished(step int, state string, stateErr error) error {
+	event := progressEvent{
+		Event:    progressFinish,
+		Step:     step,
+		State:    state,
+		Time:     time.Now(),
+		Duration: time.Since(p.start).Seconds(),
+	}
+	if stateErr != nil {
+		event.Event = progressFailure
+		event.Error = stateErr.Error()
+	} else {
+		event.Artifacts = p.producedArtifacts()
+	}
+	return p.write(event)
+}
+
+func (p *progressReporter) close() error {
+	return p.writer.Close()
+}
@@ -0,0 +1,210 @@
+package statemachine
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// readProgressEvents decodes the json lines of a progress stream
+func readProgressEvents(t *testing.T, r io.Reader) []progressEvent {
+	t.Helper()
+	var events []progressEvent
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var event progressEvent
+		err := json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			t.Fatalf("Invalid progress event %q: %s", scanner.Text(), err.Error())
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestStateMachine_Run_progress(t *testing.T) {
+	outputDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(outputDir, "unchanged.img"), []byte("old"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	states := []stateFunc{
+		{"write_artifact", func(stateMachine *StateMachine) error {
+			return os.WriteFile(filepath.Join(stateMachine.commonFlags.OutputDir, "pc.img"), []byte("image"), 0644)
+		}},
+		{"no_artifact", func(*StateMachine) error { return nil }},
+		{"fail", func(*StateMachine) error { return fmt.Errorf("Test Error") }},
+		{"never_run", func(*StateMachine) error { return nil }},
+	}
+
+	tests := []struct {
+		name         string
+		progressFile bool
+	}{
+		{name: "stdout"},
+		{name: "file", progressFile: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine testStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+			stateMachine.commonFlags.OutputDir = outputDir
+			stateMachine.commonFlags.Progress = "json"
+			if tc.progressFile {
+				stateMachine.commonFlags.ProgressFile = filepath.Join(t.TempDir(), "progress.json")
+			}
+			stateMachine.states = states
+
+			stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.Run()
+			asserter.AssertErrContains(err, "Test Error")
+			restoreStdout()
+
+			var progressReader io.Reader = stdout
+			if tc.progressFile {
+				progressReader, err = os.Open(stateMachine.commonFlags.ProgressFile)
+				asserter.AssertErrNil(err, true)
+			}
+			events := readProgressEvents(t, progressReader)
+
+			type eventSummary struct {
+				Event     string
+				Step      int
+				State     string
+				Error     string
+				Artifacts []string
+			}
+			var gotEvents []eventSummary
+			for _, event := range events {
+				if event.Time.IsZero() {
+					t.Errorf("Event %s of state %s has no time", event.Event, event.State)
+				}
+				gotEvents = append(gotEvents, eventSummary{event.Event, event.Step, event.State, event.Error, event.Artifacts})
+			}
+			asserter.AssertEqual([]eventSummary{
+				{Event: "start", Step: 0, State: "write_artifact"},
+				{Event: "finish", Step: 0, State: "write_artifact", Artifacts: []string{filepath.Join(outputDir, "pc.img")}},
+				{Event: "start", Step: 1, State: "no_artifact"},
+				{Event: "finish", Step: 1, State: "no_artifact"},
+				{Event: "start", Step: 2, State: "fail"},
+				{Event: "failure", Step: 2, State: "fail", Error: "Test Error"},
+			}, gotEvents)
+		})
+	}
+}
+
+func TestStateMachine_validateInput_progress(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.ProgressFile = "progress.json"
+
+	err := stateMachine.validateInput()
+	asserter.AssertErrContains(err, "--progress-file can only be used with --progress=json")
+
+	stateMachine.commonFlags.Progress = "json"
+	err = stateMachine.validateInput()
+	asserter.AssertErrNil(err, true)
+}
+
+func TestStateMachine_Run_progress_fail(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine testStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Progress = "json"
+	stateMachine.commonFlags.ProgressFile = filepath.Join(t.TempDir(), "inexistent", "progress.json")
+	stateMachine.states = testStates
+
+	err := stateMachine.Run()
+	asserter.AssertErrContains(err, "Error creating progress file")
+}
+
+// TestSeparateProgressOutput makes sure the json progress events are the only
+// output on stdout once the human readable output is sent to stderr
+func TestSeparateProgressOutput(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine testStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+	stateMachine.commonFlags.OutputDir = t.TempDir()
+	stateMachine.commonFlags.Progress = "json"
+	stateMachine.states = []stateFunc{
+		{"print_warning", func(*StateMachine) error {
+			fmt.Println("WARNING: human readable output")
+			return nil
+		}},
+	}
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	stderr, restoreStderr, err := helper.CaptureStd(&os.Stderr)
+	asserter.AssertErrNil(err, true)
+	restoreOutput := SeparateProgressOutput()
+	err = stateMachine.Run()
+	restoreOutput()
+	restoreStderr()
+	restoreStdout()
+	asserter.AssertErrNil(err, true)
+
+	events := readProgressEvents(t, stdout)
+	if len(events) != 2 {
+		t.Errorf("Expected 2 progress events on stdout but got %d", len(events))
+	}
+	readStderr, err := io.ReadAll(stderr)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("WARNING: human readable output\n", string(readStderr))
+}
+
+// TestStateMachine_Run_buildSuccessful makes sure the end of the build is only
+// left out when the json progress events are written to stdout
+func TestStateMachine_Run_buildSuccessful(t *testing.T) {
+	tests := []struct {
+		name         string
+		quiet        bool
+		progress     string
+		progressFile bool
+		wantOutput   bool
+	}{
+		{name: "quiet", quiet: true, wantOutput: true},
+		{name: "json to file", progress: "json", progressFile: true, wantOutput: true},
+		{name: "json to stdout", progress: "json", wantOutput: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine testStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+			stateMachine.commonFlags.OutputDir = t.TempDir()
+			stateMachine.commonFlags.Quiet = tc.quiet
+			stateMachine.commonFlags.Progress = tc.progress
+			if tc.progressFile {
+				stateMachine.commonFlags.ProgressFile = filepath.Join(t.TempDir(), "progress.json")
+			}
+			stateMachine.states = []stateFunc{{"do_nothing", func(*StateMachine) error { return nil }}}
+
+			stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.Run()
+			restoreStdout()
+			asserter.AssertErrNil(err, true)
+
+			readStdout, err := io.ReadAll(stdout)
+			asserter.AssertErrNil(err, true)
+			if got := strings.Contains(string(readStdout), "Build successful"); got != tc.wantOutput {
+				t.Errorf("Expected \"Build successful\" in the output to be %t, got output %q", tc.wantOutput, readStdout)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/snapcore/snapd/osutil"
+)
+
+var hostArch = getHostArch
+var execLookPath = exec.LookPath
+
+// binfmtMiscDir is where the binfmt_misc interpreters are registered
+var binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+
+// isCrossArch returns whether the binaries of the given architecture
+// cannot be run natively on the host and need to be emulated with qemu
+func isCrossArch(arch string) bool {
+	host := hostArch()
+	if arch == host {
+		return false
+	}
+	// amd64 hosts run i386 binaries natively
+	return !(host == "amd64" && arch == "i386")
+}
+
+// qemuStaticChrootPath returns the path of the qemu static binary for the
+// given architecture in the chroot
+func qemuStaticChrootPath(chroot string, qemuStatic string) string {
+	return filepath.Join(chroot, "usr", "bin", qemuStatic)
+}
+
+// qemuStaticMarkerPath returns the path of the file recording that the qemu
+// static binary was copied in the chroot by ubuntu-image
+func qemuStaticMarkerPath(chroot string, qemuStatic string) string {
+	return qemuStaticChrootPath(chroot, qemuStatic) + ".ubuntu-image"
+}
+
+// copyQemuStatic copies the qemu static binary emulating the given
+// architecture in the chroot so commands can be run in it. A binary already
+// in the chroot, installed with qemu-user-static, is left as is.
+func copyQemuStatic(arch string, chroot string) error {
+	qemuStatic := getQemuStaticForArch(arch)
+	if qemuStatic == "" {
+		return fmt.Errorf("Building images for architecture %s on a %s host is not supported",
+			arch, hostArch())
+	}
+
+	hostQemuStatic, err := execLookPath(qemuStatic)
+	if err != nil {
+		return fmt.Errorf("Error finding %s, the qemu-user-static package is needed to build "+
+			"images for architecture %s: %s", qemuStatic, arch, err.Error())
+	}
+
+	// qemu-user-static registers the interpreters without their -static suffix
+	binfmtEntry := filepath.Join(binfmtMiscDir, strings.TrimSuffix(qemuStatic, "-static"))
+	if _, err := os.Stat(binfmtEntry); err != nil {
+		fmt.Printf("WARNING: %s is not registered in binfmt_misc, commands run in the "+
+			"chroot will likely fail\n", filepath.Base(binfmtEntry))
+	}
+
+	chrootQemuStatic := qemuStaticChrootPath(chroot, qemuStatic)
+	markerPath := qemuStaticMarkerPath(chroot, qemuStatic)
+	if osutil.FileExists(chrootQemuStatic) && !osutil.FileExists(markerPath) {
+		return nil
+	}
+
+	err = osMkdirAll(filepath.Join(chroot, "usr", "bin"), 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating /usr/bin in the chroot: %s", err.Error())
+	}
+	// the marker is written first so the binary is removed even if the copy fails
+	err = osWriteFile(markerPath, nil, 0644)
+	if err != nil {
+		return fmt.Errorf("Error copying %s in the chroot: %s", qemuStatic, err.Error())
+	}
+	err = osutilCopyFile(hostQemuStatic, chrootQemuStatic, osutil.CopyFlagOverwrite)
+	if err != nil {
+		return fmt.Errorf("Error copying %s in the chroot: %s", qemuStatic, err.Error())
+	}
+	return nil
+}
+
+// removeQemuStatic removes the qemu static binary emulating the given
+// architecture from the chroot, if it was copied there by copyQemuStatic
+func removeQemuStatic(arch string, chroot string) error {
+	qemuStatic := getQemuStaticForArch(arch)
+	if qemuStatic == "" {
+		return nil
+	}
+	markerPath := qemuStaticMarkerPath(chroot, qemuStatic)
+	if !osutil.FileExists(markerPath) {
+		return nil
+	}
+	for _, path := range []string{qemuStaticChrootPath(chroot, qemuStatic), markerPath} {
+		err := osRemove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error removing %s from the chroot: %s", qemuStatic, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package statemachine
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// mockQemuStatic makes the host look like an amd64 machine with
+// qemu-user-static installed and returns the path of the fake emulator
+func mockQemuStatic(t *testing.T) string {
+	t.Helper()
+	hostDir := t.TempDir()
+	qemuStatic := filepath.Join(hostDir, "qemu-aarch64-static")
+	err := os.WriteFile(qemuStatic, []byte("qemu"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostArch = func() string { return "amd64" }
+	execLookPath = func(file string) (string, error) {
+		if file != "qemu-aarch64-static" {
+			return "", exec.ErrNotFound
+		}
+		return qemuStatic, nil
+	}
+	binfmtMiscDir = hostDir
+	t.Cleanup(func() {
+		hostArch = getHostArch
+		execLookPath = exec.LookPath
+		binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+	})
+	return qemuStatic
+}
+
+func Test_isCrossArch(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostArch string
+		arch     string
+		want     bool
+	}{
+		{name: "same arch", hostArch: "amd64", arch: "amd64", want: false},
+		{name: "i386 on amd64", hostArch: "amd64", arch: "i386", want: false},
+		{name: "arm64 on amd64", hostArch: "amd64", arch: "arm64", want: true},
+		{name: "amd64 on arm64", hostArch: "arm64", arch: "amd64", want: true},
+		{name: "i386 on arm64", hostArch: "arm64", arch: "i386", want: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			hostArch = func() string { return tc.hostArch }
+			t.Cleanup(func() { hostArch = getHostArch })
+
+			asserter.AssertEqual(tc.want, isCrossArch(tc.arch))
+		})
+	}
+}
+
+func Test_copyQemuStatic(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	mockQemuStatic(t)
+	chroot := t.TempDir()
+
+	err := copyQemuStatic("arm64", chroot)
+	asserter.AssertErrNil(err, true)
+
+	chrootQemuStatic := filepath.Join(chroot, "usr", "bin", "qemu-aarch64-static")
+	info, err := os.Stat(chrootQemuStatic)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(os.FileMode(0755), info.Mode().Perm())
+
+	err = removeQemuStatic("arm64", chroot)
+	asserter.AssertErrNil(err, true)
+	_, err = os.Stat(chrootQemuStatic)
+	if !os.IsNotExist(err) {
+		t.Errorf("File \"%s\" should not exist anymore", chrootQemuStatic)
+	}
+
+	_, err = os.Stat(chrootQemuStatic + ".ubuntu-image")
+	if !os.IsNotExist(err) {
+		t.Errorf("File \"%s\" should not exist anymore", chrootQemuStatic+".ubuntu-image")
+	}
+
+	// removing it again is not an error
+	err = removeQemuStatic("arm64", chroot)
+	asserter.AssertErrNil(err, true)
+
+	// a binary installed in the chroot is neither replaced nor removed
+	err = os.WriteFile(chrootQemuStatic, []byte("rootfs"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = copyQemuStatic("arm64", chroot)
+	asserter.AssertErrNil(err, true)
+	err = removeQemuStatic("arm64", chroot)
+	asserter.AssertErrNil(err, true)
+	gotContent, err := os.ReadFile(chrootQemuStatic)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("rootfs", string(gotContent))
+	err = os.Remove(chrootQemuStatic)
+	asserter.AssertErrNil(err, true)
+
+	err = copyQemuStatic("riscv64", chroot)
+	asserter.AssertErrContains(err, "Building images for architecture riscv64 on a amd64 host is not supported")
+
+	err = copyQemuStatic("armhf", chroot)
+	asserter.AssertErrContains(err, "the qemu-user-static package is needed")
+
+	osMkdirAll = mockMkdirAll
+	t.Cleanup(func() { osMkdirAll = os.MkdirAll })
+	err = copyQemuStatic("arm64", chroot)
+	asserter.AssertErrContains(err, "Error creating /usr/bin in the chroot")
+}
+
+// TestCreateChrootCrossArch ensures a chroot of a foreign architecture is
+// bootstrapped in two stages with the emulator copied in between
+func TestCreateChrootCrossArch(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	mockQemuStatic(t)
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.tempDirs.chroot = filepath.Join(t.TempDir(), "chroot")
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: "arm64",
+		Series:       "noble",
+		Rootfs: &imagedefinition.Rootfs{
+			Mirror:            "http://ports.ubuntu.com/ubuntu-ports/",
+			SourcesListDeb822: helper.BoolPtr(false),
+		},
+		Customization: &imagedefinition.Customization{},
+	}
+	err := helper.SetDefaults(&stateMachine.ImageDef)
+	asserter.AssertErrNil(err, true)
+
+	// the commands are replaced by true, the arguments being added
+	// to them by the caller
+	var cmds []*exec.Cmd
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		if name == "chroot" {
+			// the emulator must be there for the second stage
+			_, err := os.Stat(filepath.Join(stateMachine.tempDirs.chroot, "usr", "bin", "qemu-aarch64-static"))
+			asserter.AssertErrNil(err, true)
+		}
+		if name == "debootstrap" {
+			for _, file := range []string{"hostname", "resolv.conf", filepath.Join("apt", "sources.list")} {
+				path := filepath.Join(stateMachine.tempDirs.chroot, "etc", file)
+				err := os.MkdirAll(filepath.Dir(path), 0755)
+				asserter.AssertErrNil(err, true)
+				err = os.WriteFile(path, []byte("host"), 0644)
+				asserter.AssertErrNil(err, true)
+			}
+		}
+		cmd := exec.Command("true", append([]string{name}, args...)...)
+		cmds = append(cmds, cmd)
+		return cmd
+	}
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	err = stateMachine.createChroot()
+	asserter.AssertErrNil(err, true)
+
+	chroot := stateMachine.tempDirs.chroot
+	gotCmds := make([]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		gotCmds = append(gotCmds, strings.Join(cmd.Args[1:], " "))
+	}
+	asserter.AssertEqual([]string{
+		"debootstrap --arch arm64 --variant=minbase --foreign --components=main,restricted noble " + chroot + " http://ports.ubuntu.com/ubuntu-ports/",
+		"chroot " + chroot + " /debootstrap/debootstrap --second-stage",
+	}, gotCmds)
+
+	// the emulator is removed once the rootfs is populated
+	stateMachine.ImageDef.Customization = nil
+	stateMachine.tempDirs.rootfs = filepath.Join(t.TempDir(), "rootfs")
+	err = os.Mkdir(stateMachine.tempDirs.rootfs, 0755)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.populateClassicRootfsContents()
+	asserter.AssertErrNil(err, true)
+	for _, dir := range []string{chroot, stateMachine.tempDirs.rootfs} {
+		_, err = os.Stat(filepath.Join(dir, "usr", "bin", "qemu-aarch64-static"))
+		if !os.IsNotExist(err) {
+			t.Errorf("The emulator should not be in \"%s\" anymore", dir)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/canonical/ubuntu-image/internal/commands"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// SchemaStateMachine embeds StateMachine and adds the arguments specific to
+// printing the JSON schema of image definition files
+type SchemaStateMachine struct {
+	StateMachine
+	Args commands.SchemaArgs
+}
+
+// Setup assigns variables and calls other functions that must be executed before Run()
+func (schemaStateMachine *SchemaStateMachine) Setup() error {
+	// set the parent pointer of the embedded struct
+	schemaStateMachine.parent = schemaStateMachine
+
+	if schemaStateMachine.Args.ImageType != "classic" {
+		return fmt.Errorf("no schema for %s images, only classic image definitions have one",
+			schemaStateMachine.Args.ImageType)
+	}
+	return nil
+}
+
+// Run prints the JSON schema of image definition files
+func (schemaStateMachine *SchemaStateMachine) Run() error {
+	schema, err := json.MarshalIndent(imagedefinition.Schema(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error marshalling the schema: %s", err.Error())
+	}
+	fmt.Println(string(schema))
+	return nil
+}
+
+// Placeholder method to satisfy the interface. This is not used when printing the schema.
+func (schemaStateMachine *SchemaStateMachine) SetSeries() error {
+	return nil
+}
+
+// Teardown has nothing to do since nothing is written when printing the schema
+func (schemaStateMachine *SchemaStateMachine) Teardown() error {
+	return nil
+}
@@ -0,0 +1,50 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+func TestSchemaStateMachine_Setup(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine SchemaStateMachine
+
+	stateMachine.Args.ImageType = "snap"
+	err := stateMachine.Setup()
+	asserter.AssertErrContains(err, "no schema for snap images")
+
+	stateMachine.Args.ImageType = "classic"
+	err = stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+}
+
+// TestSchemaStateMachine_Run ensures the schema is printed as JSON
+func TestSchemaStateMachine_Run(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine SchemaStateMachine
+	stateMachine.Args.ImageType = "classic"
+
+	err := stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.Run()
+	restoreStdout()
+	asserter.AssertErrNil(err, true)
+
+	output, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+	var schema map[string]interface{}
+	err = json.Unmarshal(output, &schema)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(imagedefinition.SchemaTitle, schema["title"])
+
+	err = stateMachine.Teardown()
+	asserter.AssertErrNil(err, true)
+}
@@ -0,0 +1,164 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var signalNotify = signal.Notify
+var signalStop = signal.Stop
+var syscallKill = syscall.Kill
+
+// procDir is where the processes are listed
+var procDir = "/proc"
+
+// interruptSignals are the signals stopping the build gracefully
+var interruptSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// InterruptedError is returned when the build was stopped by a signal
+type InterruptedError struct {
+	Signal os.Signal
+	Step   string
+	// whether the state was saved so that the build can be resumed
+	Resumable bool
+}
+
+func (e *InterruptedError) Error() string {
+	msg := fmt.Sprintf("build interrupted by %s during step %s", e.Signal, e.Step)
+	if e.Resumable {
+		msg += ", use --resume to continue it"
+	}
+	return msg
+}
+
+// ExitCode returns the exit code of a process killed by the signal
+func (e *InterruptedError) ExitCode() int {
+	if sig, ok := e.Signal.(syscall.Signal); ok {
+		return 128 + int(sig)
+	}
+	return 1
+}
+
+// interruptHandler catches the signals stopping the build so that the
+// current state can tear down what it set up before the build stops
+type interruptHandler struct {
+	signals  chan os.Signal
+	done     chan struct{}
+	mu       sync.Mutex
+	received os.Signal
+}
+
+// newInterruptHandler starts catching the interrupt signals
+func newInterruptHandler() *interruptHandler {
+	h := &interruptHandler{
+		signals: make(chan os.Signal, 1),
+		done:    make(chan struct{}),
+	}
+	signalNotify(h.signals, interruptSignals...)
+	go h.handle()
+	return h
+}
+
+// handle forwards the first signal to the commands run by the current state
+// so that they stop and the state returns. Later signals are ignored to not
+// interrupt the teardown commands.
+func (h *interruptHandler) handle() {
+	defer close(h.done)
+	for sig := range h.signals {
+		h.mu.Lock()
+		if h.received != nil {
+			h.mu.Unlock()
+			fmt.Printf("Received %s, the build is already stopping, waiting for the current "+
+				"step to tear down\n", sig)
+			continue
+		}
+		h.received = sig
+		h.mu.Unlock()
+		fmt.Printf("Received %s, stopping the build once the current step is torn down\n", sig)
+		if err := forwardSignal(sig); err != nil {
+			fmt.Printf("WARNING: %s\n", err.Error())
+		}
+	}
+}
+
+// interrupted returns the signal stopping the build, if any
+func (h *interruptHandler) interrupted() os.Signal {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.received
+}
+
+// stop restores the default handling of the signals
+func (h *interruptHandler) stop() {
+	signalStop(h.signals)
+	close(h.signals)
+	<-h.done
+}
+
+// childProcesses returns the PIDs of the direct children of a process
+func childProcesses(pid int) ([]int, error) {
+	entries, err := osReadDir(procDir)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing processes: %s", err.Error())
+	}
+	var children []int
+	for _, entry := range entries {
+		childPid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// the process may have exited in the meantime
+		stat, err := osReadFile(filepath.Join(procDir, entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// the command name, in parentheses, may contain spaces
+		fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		if ppid, err := strconv.Atoi(fields[1]); err == nil && ppid == pid {
+			children = append(children, childPid)
+		}
+	}
+	return children, nil
+}
+
+// forwardSignal sends the signal to the commands run by ubuntu-image. This is
+// needed when the signal is sent to ubuntu-image alone, like CI runners do,
+// rather than to its whole process group.
+func forwardSignal(sig os.Signal) error {
+	sysSig, ok := sig.(syscall.Signal)
+	if !ok {
+		return nil
+	}
+	children, err := childProcesses(os.Getpid())
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		// the child may have exited in the meantime
+		_ = syscallKill(child, sysSig)
+	}
+	return nil
+}
+
+// saveInterrupted saves the state of an interrupted build so that it can
+// be resumed
+func (stateMachine *StateMachine) saveInterrupted(sig os.Signal, stepName string) error {
+	interruptedErr := &InterruptedError{Signal: sig, Step: stepName}
+	if stateMachine.cleanWorkDir {
+		return interruptedErr
+	}
+	if err := stateMachine.writeMetadata(metadataStateFile); err != nil {
+		return fmt.Errorf("%s\nError saving the state: %s", interruptedErr.Error(), err.Error())
+	}
+	interruptedErr.Resumable = true
+	return interruptedErr
+}
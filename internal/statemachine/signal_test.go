@@ -0,0 +1,175 @@
+package statemachine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// mockSignals catches the signals channel of the interrupt handler and
+// fakes a child process of ubuntu-image. The returned channel receives
+// the signals forwarded to the child.
+func mockSignals(t *testing.T) (signals *chan<- os.Signal, forwarded chan syscall.Signal) {
+	t.Helper()
+	signals = new(chan<- os.Signal)
+	signalNotify = func(c chan<- os.Signal, sig ...os.Signal) { *signals = c }
+	signalStop = func(chan<- os.Signal) {}
+
+	procDir = t.TempDir()
+	err := os.MkdirAll(filepath.Join(procDir, "4242"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := fmt.Sprintf("4242 (apt-get) S %d 4242", os.Getpid())
+	err = os.WriteFile(filepath.Join(procDir, "4242", "stat"), []byte(stat), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forwarded = make(chan syscall.Signal, 1)
+	syscallKill = func(pid int, sig syscall.Signal) error {
+		if pid == 4242 {
+			forwarded <- sig
+		}
+		return nil
+	}
+
+	t.Cleanup(func() {
+		signalNotify = signal.Notify
+		signalStop = signal.Stop
+		procDir = "/proc"
+		syscallKill = syscall.Kill
+	})
+	return signals, forwarded
+}
+
+// TestStateMachine_Run_interrupted ensures an interrupted build stops once
+// the current state returned, and saves its state to be resumed
+func TestStateMachine_Run_interrupted(t *testing.T) {
+	testCases := []struct {
+		name           string
+		stateErr       error
+		wantStepsTaken int
+		wantStep       string
+	}{
+		{
+			name:           "state failing when interrupted",
+			stateErr:       fmt.Errorf("signal: terminated"),
+			wantStepsTaken: 1,
+			wantStep:       "interrupted",
+		},
+		{
+			name:           "state completing when interrupted",
+			wantStepsTaken: 2,
+			wantStep:       "interrupted",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			signals, forwarded := mockSignals(t)
+
+			workDir := t.TempDir()
+			var stateMachine testStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.Quiet = true
+			stateMachine.stateMachineFlags.WorkDir = workDir
+			stateMachine.states = []stateFunc{
+				{"first", func(*StateMachine) error { return nil }},
+				{"interrupted", func(*StateMachine) error {
+					*signals <- syscall.SIGTERM
+					// wait for the signal to be forwarded to the running commands
+					asserter.AssertEqual(syscall.SIGTERM, <-forwarded)
+					return tc.stateErr
+				}},
+				{"never_run", func(*StateMachine) error {
+					t.Error("The build was not stopped")
+					return nil
+				}},
+			}
+
+			err := stateMachine.Run()
+			var interruptedErr *InterruptedError
+			if !errors.As(err, &interruptedErr) {
+				t.Fatalf("Expected an interrupted error, got %v", err)
+			}
+			asserter.AssertEqual(&InterruptedError{
+				Signal:    syscall.SIGTERM,
+				Step:      tc.wantStep,
+				Resumable: true,
+			}, interruptedErr)
+
+			var resumedStateMachine testStateMachine
+			resumedStateMachine.commonFlags, resumedStateMachine.stateMachineFlags = helper.InitCommonOpts()
+			resumedStateMachine.stateMachineFlags.WorkDir = workDir
+			resumedStateMachine.stateMachineFlags.Resume = true
+			resumedStateMachine.states = stateMachine.states
+			err = resumedStateMachine.readMetadata(metadataStateFile)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.wantStepsTaken, resumedStateMachine.StepsTaken)
+		})
+	}
+}
+
+func TestStateMachine_saveInterrupted(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+	// a temporary workdir is removed, the build cannot be resumed
+	stateMachine.cleanWorkDir = true
+	err := stateMachine.saveInterrupted(os.Interrupt, "install_packages")
+	asserter.AssertEqual("build interrupted by interrupt during step install_packages", err.Error())
+
+	stateMachine.cleanWorkDir = false
+	stateMachine.stateMachineFlags.WorkDir = filepath.Join(t.TempDir(), "inexistent")
+	err = stateMachine.saveInterrupted(os.Interrupt, "install_packages")
+	asserter.AssertErrContains(err, "Error saving the state")
+
+	stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+	err = stateMachine.saveInterrupted(syscall.SIGTERM, "install_packages")
+	asserter.AssertEqual("build interrupted by terminated during step install_packages, "+
+		"use --resume to continue it", err.Error())
+	asserter.AssertEqual(143, err.(*InterruptedError).ExitCode())
+}
+
+func Test_childProcesses(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	procDir = t.TempDir()
+	t.Cleanup(func() { procDir = "/proc" })
+
+	stats := map[string]string{
+		"1":   "1 (systemd) S 0 1",
+		"100": "100 (ubuntu-image) S 1 100",
+		"101": "101 (apt get) S 100 100",
+		"102": "102 (sh) S 101 100",
+		"103": "103 (chroot) R 100 100",
+	}
+	for pid, stat := range stats {
+		err := os.Mkdir(filepath.Join(procDir, pid), 0755)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(filepath.Join(procDir, pid, "stat"), []byte(stat), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+	// not a process
+	err := os.Mkdir(filepath.Join(procDir, "sys"), 0755)
+	asserter.AssertErrNil(err, true)
+	// process that exited
+	err = os.Mkdir(filepath.Join(procDir, "104"), 0755)
+	asserter.AssertErrNil(err, true)
+
+	children, err := childProcesses(100)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual([]int{101, 103}, children)
+
+	procDir = filepath.Join(procDir, strconv.Itoa(999))
+	_, err = childProcesses(100)
+	asserter.AssertErrContains(err, "Error listing processes")
+}
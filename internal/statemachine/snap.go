@@ -31,7 +31,7 @@ type SnapStateMachine struct {
 }
 
 // Setup assigns variables and calls other functions that must be executed before Run().
-func (snapStateMachine *SnapStateMachine) Setup() error {
+func (snapStateMachine *SnapStateMachine) Setup() (err error) {
 	// set the parent pointer of the embedded struct
 	snapStateMachine.parent = snapStateMachine
 
@@ -52,6 +52,21 @@ func (snapStateMachine *SnapStateMachine) Setup() error {
 		return err
 	}
 
+	// record the inputs of the build to detect their changes on --resume
+	if err := snapStateMachine.hashInputs(); err != nil {
+		return err
+	}
+
+	// keep concurrent builds from using the same workdir
+	if err := snapStateMachine.lockWorkDir(); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = snapStateMachine.unlockWorkDir()
+		}
+	}()
+
 	// if --resume was passed, figure out where to start
 	if err := snapStateMachine.readMetadata(metadataStateFile); err != nil {
 		return err
@@ -103,6 +118,11 @@ func (snapStateMachine *SnapStateMachine) decodeModelAssertion() (*asserts.Model
 		return nil, fmt.Errorf("cannot read model assertion: %s", err)
 	}
 
+	return decodeModel(fn, rawAssert)
+}
+
+// decodeModel decodes the model assertion read from fn
+func decodeModel(fn string, rawAssert []byte) (*asserts.Model, error) {
 	assertion, err := asserts.Decode(rawAssert)
 	if err != nil {
 		return nil, fmt.Errorf("cannot decode model assertion %q: %s", fn, err)
@@ -0,0 +1,163 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// snapshotsDir is the directory of the workdir holding the snapshots
+const snapshotsDir = "snapshots"
+
+// snapshotStates maps the states modifying the chroot or the rootfs to the
+// directory, relative to the workdir, to snapshot before running them
+var snapshotStates = map[string]string{
+	addExtraPPAsState.name:                  "chroot",
+	installPackagesState.name:               "chroot",
+	cleanExtraPPAsState.name:                "chroot",
+	customizeCloudInitState.name:            "chroot",
+	disableConsoleConfState.name:            "chroot",
+	enableConsoleConfState.name:             "chroot",
+	customizeFstabState.name:                "chroot",
+	manualCustomizationState.name:           "chroot",
+	prepareClassicImageState.name:           "chroot",
+	preseedClassicImageState.name:           "chroot",
+	customizeSourcesListState.name:          "chroot",
+	setDefaultLocaleState.name:              "chroot",
+	cleanRootfsState.name:                   "chroot",
+	populateClassicRootfsContentsState.name: "root",
+}
+
+// snapshot is a copy of a directory of the workdir taken before a state
+type snapshot struct {
+	dir   string // the directory the snapshot was taken of
+	path  string // where the snapshot is stored
+	state []byte // the state saved when the snapshot was taken
+}
+
+// isBtrfsSubvolume returns whether the directory is a btrfs subvolume that
+// can be snapshotted with the btrfs tool
+func isBtrfsSubvolume(dir string) bool {
+	if _, err := execLookPath("btrfs"); err != nil {
+		return false
+	}
+	return execCommand("btrfs", "subvolume", "show", dir).Run() == nil
+}
+
+// takeSnapshot snapshots the directory modified by the given state. Btrfs
+// subvolumes are snapshotted, other directories are copied with reflinks
+// when the filesystem supports them, or with a plain copy otherwise.
+// Overlayfs is not used as its upper layer would have to be merged back
+// into the directory after each state.
+// A nil snapshot is returned for states that do not need one.
+func (stateMachine *StateMachine) takeSnapshot(stateName string) (*snapshot, error) {
+	dirName, found := snapshotStates[stateName]
+	if !found || !stateMachine.stateMachineFlags.Snapshot {
+		return nil, nil
+	}
+	s := &snapshot{
+		dir:  filepath.Join(stateMachine.stateMachineFlags.WorkDir, dirName),
+		path: filepath.Join(stateMachine.stateMachineFlags.WorkDir, snapshotsDir, dirName),
+	}
+	if _, err := os.Stat(s.dir); err != nil {
+		// nothing to snapshot yet
+		return nil, nil
+	}
+
+	// the state is encoded now as the state function modifies it in place
+	state, err := json.Marshal(stateMachine.savedState())
+	if err != nil {
+		return nil, fmt.Errorf("failed to JSON encode metadata: %w", err)
+	}
+	s.state = state
+
+	err = osRemoveAll(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("Error removing previous snapshot %s: %s", s.path, err.Error())
+	}
+	err = osMkdirAll(filepath.Dir(s.path), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating snapshots directory: %s", err.Error())
+	}
+
+	var snapshotCmd []string
+	if isBtrfsSubvolume(s.dir) {
+		snapshotCmd = []string{"btrfs", "subvolume", "snapshot", s.dir, s.path}
+	} else {
+		snapshotCmd = []string{"cp", "-a", "--reflink=auto", s.dir, s.path}
+	}
+	cmd := execCommand(snapshotCmd[0], snapshotCmd[1:]...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("Error taking snapshot of %s before step %s: %s\nCommand output: %s",
+			s.dir, stateName, err.Error(), string(output))
+	}
+	return s, nil
+}
+
+// restore replaces the directory with its snapshot. The directory left by
+// the failed state is kept next to the snapshot to be inspected.
+func (s *snapshot) restore() error {
+	failedPath := s.path + ".failed"
+	err := osRemoveAll(failedPath)
+	if err != nil {
+		return fmt.Errorf("Error removing previous failed tree %s: %s", failedPath, err.Error())
+	}
+	err = osRename(s.dir, failedPath)
+	if err != nil {
+		return fmt.Errorf("Error moving failed tree %s to %s: %s", s.dir, failedPath, err.Error())
+	}
+	err = osRename(s.path, s.dir)
+	if err != nil {
+		return fmt.Errorf("Error restoring snapshot %s: %s", s.path, err.Error())
+	}
+	return nil
+}
+
+// discard removes the snapshot once the state succeeded
+func (s *snapshot) discard() error {
+	err := osRemoveAll(s.path)
+	if err != nil {
+		return fmt.Errorf("Error removing snapshot %s: %s", s.path, err.Error())
+	}
+	return nil
+}
+
+// checkUnmounted makes sure nothing is left mounted in the directory, as
+// moving it would leave the mountpoints in the failed tree
+func (s *snapshot) checkUnmounted() error {
+	mountPoints, err := listMounts(s.dir)
+	if err != nil {
+		return fmt.Errorf("Error listing mountpoints: %s", err.Error())
+	}
+	for _, m := range mountPoints {
+		if m.path == s.dir || strings.HasPrefix(m.path, s.dir+string(filepath.Separator)) {
+			return fmt.Errorf("cannot restore the snapshot of %s as %s is still mounted. "+
+				"Unmount it with \"ubuntu-image clean\" and start the build again", s.dir, m.path)
+		}
+	}
+	return nil
+}
+
+// restoreSnapshot restores the snapshot taken before a failed state and
+// saves the state as it was then, so that the failed state is run again by
+// --resume
+func (stateMachine *StateMachine) restoreSnapshot(s *snapshot, stateName string) error {
+	err := s.checkUnmounted()
+	if err != nil {
+		return err
+	}
+	err = s.restore()
+	if err != nil {
+		return err
+	}
+	metadataPath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, metadataStateFile)
+	err = osWriteFile(metadataPath, s.state, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write metadata to file: %w", err)
+	}
+	fmt.Printf("Restored %s as it was before step %s. Use --resume to retry it.\n", s.dir, stateName)
+	return nil
+}
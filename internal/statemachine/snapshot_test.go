@@ -0,0 +1,250 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// TestStateMachine_Run_snapshot ensures the chroot is restored when a state
+// modifying it fails, and the state saved so it can be retried
+func TestStateMachine_Run_snapshot(t *testing.T) {
+	testCases := []struct {
+		name          string
+		stateErr      error
+		wantContent   string
+		wantFailed    bool
+		expectedError string
+	}{
+		{
+			name:        "success",
+			wantContent: "after",
+		},
+		{
+			name:          "failure",
+			stateErr:      fmt.Errorf("Test Error"),
+			wantContent:   "before",
+			wantFailed:    true,
+			expectedError: "Test Error",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			restoreExecLookPath := mockLookPath(false)
+			t.Cleanup(restoreExecLookPath)
+
+			workDir := t.TempDir()
+			chroot := filepath.Join(workDir, "chroot")
+			err := os.Mkdir(chroot, 0755)
+			asserter.AssertErrNil(err, true)
+			err = os.WriteFile(filepath.Join(chroot, "content"), []byte("before"), 0644)
+			asserter.AssertErrNil(err, true)
+
+			var stateMachine testStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.Quiet = true
+			stateMachine.stateMachineFlags.WorkDir = workDir
+			stateMachine.stateMachineFlags.Snapshot = true
+			stateMachine.StepsTaken = 2
+			stateMachine.stepNames = []string{allTestStates[0].name, allTestStates[1].name}
+			stateMachine.states = []stateFunc{
+				{installPackagesState.name, func(stateMachine *StateMachine) error {
+					stateMachine.Packages = append(stateMachine.Packages, "failed")
+					err := os.WriteFile(filepath.Join(chroot, "content"), []byte("after"), 0644)
+					if err != nil {
+						return err
+					}
+					return tc.stateErr
+				}},
+			}
+
+			err = stateMachine.Run()
+			if tc.expectedError != "" {
+				asserter.AssertErrContains(err, tc.expectedError)
+			} else {
+				asserter.AssertErrNil(err, true)
+			}
+
+			content, err := os.ReadFile(filepath.Join(chroot, "content"))
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.wantContent, string(content))
+
+			_, err = os.Stat(filepath.Join(workDir, snapshotsDir, "chroot"))
+			if !os.IsNotExist(err) {
+				t.Errorf("The snapshot was not removed: %v", err)
+			}
+
+			failedContent, err := os.ReadFile(filepath.Join(workDir, snapshotsDir, "chroot.failed", "content"))
+			asserter.AssertEqual(tc.wantFailed, err == nil)
+			if tc.wantFailed {
+				asserter.AssertEqual("after", string(failedContent))
+
+				// the failed state is run again on --resume
+				var resumedStateMachine testStateMachine
+				resumedStateMachine.commonFlags, resumedStateMachine.stateMachineFlags = helper.InitCommonOpts()
+				resumedStateMachine.stateMachineFlags.WorkDir = workDir
+				resumedStateMachine.stateMachineFlags.Resume = true
+				resumedStateMachine.states = append([]stateFunc{allTestStates[0], allTestStates[1]},
+					stateMachine.states...)
+				err = resumedStateMachine.readMetadata(metadataStateFile)
+				asserter.AssertErrNil(err, true)
+				asserter.AssertEqual(2, resumedStateMachine.StepsTaken)
+				// the changes made by the failed state are not saved
+				asserter.AssertEqual(([]string)(nil), resumedStateMachine.Packages)
+			}
+		})
+	}
+}
+
+// mockLookPath makes execLookPath find or not every executable
+func mockLookPath(found bool) func() {
+	execLookPath = func(file string) (string, error) {
+		if found {
+			return filepath.Join("/usr/bin", file), nil
+		}
+		return "", exec.ErrNotFound
+	}
+	return func() { execLookPath = exec.LookPath }
+}
+
+func TestStateMachine_takeSnapshot(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreExecLookPath := mockLookPath(false)
+	t.Cleanup(restoreExecLookPath)
+
+	workDir := t.TempDir()
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.stateMachineFlags.WorkDir = workDir
+
+	// snapshots are opt-in
+	s, err := stateMachine.takeSnapshot(installPackagesState.name)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual((*snapshot)(nil), s)
+
+	stateMachine.stateMachineFlags.Snapshot = true
+
+	// the chroot does not exist yet
+	s, err = stateMachine.takeSnapshot(installPackagesState.name)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual((*snapshot)(nil), s)
+
+	err = os.Mkdir(filepath.Join(workDir, "chroot"), 0755)
+	asserter.AssertErrNil(err, true)
+
+	// the state does not modify the chroot
+	s, err = stateMachine.takeSnapshot(generatePackageManifestState.name)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual((*snapshot)(nil), s)
+
+	s, err = stateMachine.takeSnapshot(installPackagesState.name)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(filepath.Join(workDir, snapshotsDir, "chroot"), s.path)
+	_, err = os.Stat(s.path)
+	asserter.AssertErrNil(err, true)
+
+	// btrfs subvolumes are snapshotted
+	restoreExecLookPath = mockLookPath(true)
+	t.Cleanup(restoreExecLookPath)
+	var gotCmds [][]string
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		gotCmds = append(gotCmds, append([]string{name}, args...))
+		return exec.Command("true")
+	}
+	t.Cleanup(func() { execCommand = exec.Command })
+	_, err = stateMachine.takeSnapshot(installPackagesState.name)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual([][]string{
+		{"btrfs", "subvolume", "show", filepath.Join(workDir, "chroot")},
+		{"btrfs", "subvolume", "snapshot", filepath.Join(workDir, "chroot"), filepath.Join(workDir, snapshotsDir, "chroot")},
+	}, gotCmds)
+
+	execCommand = func(string, ...string) *exec.Cmd { return exec.Command("false") }
+	_, err = stateMachine.takeSnapshot(installPackagesState.name)
+	asserter.AssertErrContains(err, "Error taking snapshot")
+	execCommand = exec.Command
+
+	osMkdirAll = mockMkdirAll
+	_, err = stateMachine.takeSnapshot(installPackagesState.name)
+	asserter.AssertErrContains(err, "Error creating snapshots directory")
+	osMkdirAll = os.MkdirAll
+
+	osRemoveAll = mockRemoveAll
+	_, err = stateMachine.takeSnapshot(installPackagesState.name)
+	asserter.AssertErrContains(err, "Error removing previous snapshot")
+	osRemoveAll = os.RemoveAll
+}
+
+func TestSnapshot_restore_fail(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	workDir := t.TempDir()
+	s := &snapshot{
+		dir:  filepath.Join(workDir, "chroot"),
+		path: filepath.Join(workDir, snapshotsDir, "chroot"),
+	}
+
+	osRemoveAll = mockRemoveAll
+	err := s.restore()
+	asserter.AssertErrContains(err, "Error removing previous failed tree")
+	err = s.discard()
+	asserter.AssertErrContains(err, "Error removing snapshot")
+	osRemoveAll = os.RemoveAll
+
+	err = s.restore()
+	asserter.AssertErrContains(err, "Error moving failed tree")
+
+	err = os.Mkdir(s.dir, 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.Mkdir(filepath.Dir(s.path), 0755)
+	asserter.AssertErrNil(err, true)
+	err = s.restore()
+	asserter.AssertErrContains(err, "Error restoring snapshot")
+}
+
+// TestStateMachine_restoreSnapshot_mounted ensures a snapshot is not restored
+// while something is mounted in the tree left by the failed state
+func TestStateMachine_restoreSnapshot_mounted(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	workDir := t.TempDir()
+	s := &snapshot{
+		dir:   filepath.Join(workDir, "chroot"),
+		path:  filepath.Join(workDir, snapshotsDir, "chroot"),
+		state: []byte("{}"),
+	}
+	err := os.MkdirAll(s.dir, 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.MkdirAll(s.path, 0755)
+	asserter.AssertErrNil(err, true)
+
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.stateMachineFlags.WorkDir = workDir
+
+	mockProcMounts(t, "proc "+filepath.Join(s.dir, "proc")+" proc rw 0 0\n")
+	err = stateMachine.restoreSnapshot(s, installPackagesState.name)
+	asserter.AssertErrContains(err, "is still mounted")
+	_, err = os.Stat(s.path)
+	asserter.AssertErrNil(err, true)
+
+	// a directory sharing the prefix of the tree is not in it
+	mockProcMounts(t, "proc "+s.dir+"-other/proc proc rw 0 0\n")
+	err = stateMachine.restoreSnapshot(s, installPackagesState.name)
+	asserter.AssertErrNil(err, true)
+	_, err = os.Stat(s.path + ".failed")
+	asserter.AssertErrNil(err, true)
+}
+
+func TestStateMachine_validateInput_snapshot(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.stateMachineFlags.Snapshot = true
+
+	err := stateMachine.validateInput()
+	asserter.AssertErrContains(err, "must specify workdir when using --snapshot flag")
+}
@@ -30,6 +30,7 @@ import (
 
 const (
 	metadataStateFile = "ubuntu-image.json"
+	checkpointsDir    = "checkpoints"
 )
 
 var gadgetYamlPathInTree = filepath.Join("meta", "gadget.yaml")
@@ -43,6 +44,7 @@ var helperCheckEmptyFields = helper.CheckEmptyFields
 var helperCheckTags = helper.CheckTags
 var helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
 var helperRestoreResolvConf = helper.RestoreResolvConf
+var helperRunScript = helper.RunScript
 var osReadDir = os.ReadDir
 var osReadFile = os.ReadFile
 var osWriteFile = os.WriteFile
@@ -57,7 +59,9 @@ var osRename = os.Rename
 var osCreate = os.Create
 var osTruncate = os.Truncate
 var osGetenv = os.Getenv
+var osEnviron = os.Environ
 var osSetenv = os.Setenv
+var osUserCacheDir = os.UserCacheDir
 var osutilCopyFile = osutil.CopyFile
 var osutilCopySpecialFile = osutil.CopySpecialFile
 var execCommand = exec.Command
@@ -69,6 +73,7 @@ var seedOpen = seed.Open
 var imagePrepare = image.Prepare
 var gojsonschemaValidate = gojsonschema.Validate
 var filepathRel = filepath.Rel
+var gitRemoteList = listGitRemote
 
 // SmInterface allows different image types to implement their own setup/run/teardown functions
 type SmInterface interface {
@@ -99,6 +104,7 @@ type StateMachine struct {
 	cleanWorkDir  bool          // whether or not to clean up the workDir
 	CurrentStep   string        // tracks the current progress of the state machine
 	StepsTaken    int           // counts the number of steps taken
+	stepNames     []string      // names of the steps taken
 	ConfDefPath   string        // directory holding the model assertion / image definition file
 	YamlFilePath  string        // the location for the gadget yaml file
 	IsSeeded      bool          // core 20 images are seeded
@@ -110,6 +116,12 @@ type StateMachine struct {
 
 	series string
 
+	// exclusive lock held on the workdir from Setup to Teardown
+	lock *workDirLock
+
+	// image definitions extended by the classic image definition
+	extendedImageDefs []string
+
 	// The flags that were passed in on the command line
 	commonFlags       *commands.CommonOpts
 	stateMachineFlags *commands.StateMachineOpts
@@ -135,6 +147,15 @@ type StateMachine struct {
 
 	Packages []string
 	Snaps    []string
+
+	// commit the gadget tree was built from, if cloned from git
+	GadgetCommit string
+
+	// SHA256 sums of the inputs of the build, checked on --resume
+	InputHashes map[string]string
+
+	// variables substituted in the image definition, with their values
+	Variables map[string]string
 }
 
 // SetCommonOpts stores the common options for all image types in the struct
@@ -269,6 +290,10 @@ func (stateMachine *StateMachine) postProcessGadgetYaml() error {
 	var farthestOffsetUnknown bool = false
 	lastVolumeName := ""
 
+	if err := stateMachine.reportLintFindings(lintGadgetInfo(stateMachine.GadgetInfo, stateMachine.YamlFilePath)); err != nil {
+		return err
+	}
+
 	for _, volumeName := range stateMachine.VolumeOrder {
 		lastVolumeName = volumeName
 		volume := stateMachine.GadgetInfo.Volumes[volumeName]
@@ -278,8 +303,6 @@ func (stateMachine *StateMachine) postProcessGadgetYaml() error {
 		}
 		for i := range volume.Structure {
 			structure := &volume.Structure[i]
-			stateMachine.warnUsageOfSystemLabel(volumeName, structure, i)
-
 			if helper.IsRootfsStructure(structure) {
 				rootfsSeen = true
 			}
@@ -314,14 +337,6 @@ func (stateMachine *StateMachine) postProcessGadgetYaml() error {
 	return nil
 }
 
-func (stateMachine *StateMachine) warnUsageOfSystemLabel(volumeName string, structure *gadget.VolumeStructure, structIndex int) {
-	if structure.Role == "" && structure.Label == gadget.SystemBoot && !stateMachine.commonFlags.Quiet {
-		fmt.Printf("WARNING: volumes:%s:structure:%d:filesystem_label "+
-			"used for defining partition roles; use role instead\n",
-			volumeName, structIndex)
-	}
-}
-
 // handleSystemSeed checks if the structure is a system-seed one and fixes the Label if needed
 func (stateMachine *StateMachine) handleSystemSeed(volume *gadget.Volume, structure *gadget.VolumeStructure, structIndex int) {
 	if !helper.IsSystemSeedStructure(structure) {
@@ -420,33 +435,57 @@ func (stateMachine *StateMachine) fixMissingSystemData(lastVolumeName string, fa
 
 // readMetadata reads info about a partial state machine encoded as JSON from disk
 func (stateMachine *StateMachine) readMetadata(metadataFile string) error {
-	if !stateMachine.stateMachineFlags.Resume {
+	if !stateMachine.stateMachineFlags.Resume && stateMachine.stateMachineFlags.From == "" {
 		return nil
 	}
 	// open the ubuntu-image.json file and load the state
-	var partialStateMachine = &StateMachine{}
 	jsonfilePath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, metadataFile)
 	jsonfile, err := os.ReadFile(jsonfilePath)
 	if err != nil {
 		return fmt.Errorf("error reading metadata file: %s", err.Error())
 	}
 
-	err = json.Unmarshal(jsonfile, partialStateMachine)
+	partialStateMachine, err := decodeMetadata(jsonfile, stateMachine.stateNames())
 	if err != nil {
-		return fmt.Errorf("failed to parse metadata file: %s", err.Error())
+		return fmt.Errorf("error loading the state saved in %s: %s", jsonfilePath, err.Error())
 	}
 
 	return stateMachine.loadState(partialStateMachine)
 }
 
-func (stateMachine *StateMachine) loadState(partialStateMachine *StateMachine) error {
+func (stateMachine *StateMachine) loadState(partialStateMachine *savedState) error {
 	stateMachine.StepsTaken = partialStateMachine.StepsTaken
 
 	if stateMachine.StepsTaken > len(stateMachine.states) {
 		return fmt.Errorf("invalid steps taken count (%d). The state machine only have %d steps", stateMachine.StepsTaken, len(stateMachine.states))
 	}
 
+	// the steps of the build change with the image definition and between
+	// versions of ubuntu-image
+	if err := stateMachine.checkStepNames(partialStateMachine.StepNames); err != nil {
+		return err
+	}
+
+	rewoundState, err := stateMachine.checkInputs(partialStateMachine.InputHashes)
+	if err != nil {
+		return err
+	}
+
+	if stateMachine.stateMachineFlags.From != "" {
+		rewoundState, err = stateMachine.rewindTo(stateMachine.stateMachineFlags.From)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the fields written by the steps rewound are reset to their value
+	// before the first of them
+	if rewoundState != nil {
+		partialStateMachine = rewoundState
+	}
+
 	// delete all of the stateFuncs that have already run
+	stateMachine.stepNames = stateMachine.stateNames()[:stateMachine.StepsTaken]
 	stateMachine.states = stateMachine.states[stateMachine.StepsTaken:]
 
 	stateMachine.CurrentStep = partialStateMachine.CurrentStep
@@ -472,6 +511,7 @@ func (stateMachine *StateMachine) loadState(partialStateMachine *StateMachine) e
 
 	stateMachine.Packages = partialStateMachine.Packages
 	stateMachine.Snaps = partialStateMachine.Snaps
+	stateMachine.GadgetCommit = partialStateMachine.GadgetCommit
 
 	if stateMachine.GadgetInfo != nil {
 		// Due to https://github.com/golang/go/issues/10415 we need to set back the volume
@@ -484,6 +524,125 @@ func (stateMachine *StateMachine) loadState(partialStateMachine *StateMachine) e
 	return nil
 }
 
+// stateNames returns the names of the states of the state machine
+func (stateMachine *StateMachine) stateNames() []string {
+	names := make([]string, 0, len(stateMachine.states))
+	for _, state := range stateMachine.states {
+		names = append(names, state.name)
+	}
+	return names
+}
+
+// checkStepNames checks that the steps taken by the previous run are the
+// first steps of this build
+func (stateMachine *StateMachine) checkStepNames(stepNames []string) error {
+	wantStepNames := stateMachine.stateNames()[:stateMachine.StepsTaken]
+	if strings.Join(stepNames, ",") == strings.Join(wantStepNames, ",") {
+		return nil
+	}
+	return fmt.Errorf("the steps taken by the previous run (%s) are not the first steps of this "+
+		"build (%s). The image definition or the version of ubuntu-image changed, start the build again",
+		strings.Join(stepNames, ", "), strings.Join(wantStepNames, ", "))
+}
+
+// stateOutputs are the paths in the workdir populated by the states. They
+// must still be there to run again the states coming after them, and are
+// removed to run again the states populating them.
+var stateOutputs = map[string][]string{
+	buildGadgetTreeState.name:               {filepath.Join("scratch", "gadget")},
+	prepareGadgetTreeState.name:             {"unpack"},
+	prepareImageState.name:                  {"unpack"},
+	createChrootState.name:                  {"chroot"},
+	extractRootfsTarState.name:              {"chroot"},
+	germinateState.name:                     {"germinate"},
+	populateClassicRootfsContentsState.name: {"root"},
+	populateBootfsContentsState.name:        {"volumes"},
+	buildInstallerLayersState.name:          {filepath.Join("installer", "layers")},
+	prepareInstallerMediaState.name:         {filepath.Join("installer", "media")},
+}
+
+// rewindTo rewinds the saved state to the given step so that it is run
+// again along with all the steps after it. It returns the state saved
+// before the step ran, or nil if the step was not taken yet.
+func (stateMachine *StateMachine) rewindTo(stepName string) (*savedState, error) {
+	stepIndex := -1
+	for i, state := range stateMachine.states {
+		if state.name == stepName {
+			stepIndex = i
+			break
+		}
+	}
+	if stepIndex == -1 {
+		return nil, fmt.Errorf("state %s is not a valid state name", stepName)
+	}
+	if stepIndex > stateMachine.StepsTaken {
+		return nil, fmt.Errorf("cannot run from step %s as the previous run stopped before it, "+
+			"at step %d", stepName, stateMachine.StepsTaken)
+	}
+
+	for _, state := range stateMachine.states[:stepIndex] {
+		for _, output := range stateOutputs[state.name] {
+			outputPath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, output)
+			entries, err := osReadDir(outputPath)
+			if err != nil || len(entries) == 0 {
+				return nil, fmt.Errorf("cannot run from step %s as %s, populated by step %s, "+
+					"is missing or empty", stepName, outputPath, state.name)
+			}
+		}
+	}
+
+	if stepIndex == stateMachine.StepsTaken {
+		return nil, nil
+	}
+
+	checkpoint, err := stateMachine.readCheckpoint(stepName)
+	if err != nil {
+		return nil, err
+	}
+
+	// the steps run again start from an empty output, as some of them
+	// fail when it already exists
+	if !stateMachine.commonFlags.DryRun {
+		for _, state := range stateMachine.states[stepIndex:stateMachine.StepsTaken] {
+			for _, output := range stateOutputs[state.name] {
+				outputPath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, output)
+				if err := osRemoveAll(outputPath); err != nil {
+					return nil, fmt.Errorf("Error removing %s, populated by step %s: %s",
+						outputPath, state.name, err.Error())
+				}
+			}
+		}
+	}
+
+	stateMachine.StepsTaken = stepIndex
+	return checkpoint, nil
+}
+
+// writeCheckpoint saves the state before the given step runs, to restore it
+// when the build is rewound to the step
+func (stateMachine *StateMachine) writeCheckpoint(stepName string) error {
+	err := osMkdir(filepath.Join(stateMachine.stateMachineFlags.WorkDir, checkpointsDir), 0755)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Error creating checkpoints directory: %s", err.Error())
+	}
+	return stateMachine.writeMetadata(filepath.Join(checkpointsDir, stepName+".json"))
+}
+
+// readCheckpoint reads the state saved before the given step ran
+func (stateMachine *StateMachine) readCheckpoint(stepName string) (*savedState, error) {
+	checkpointPath := filepath.Join(stateMachine.stateMachineFlags.WorkDir, checkpointsDir, stepName+".json")
+	content, err := os.ReadFile(checkpointPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot run from step %s as the state saved before it is missing "+
+			"(%s). Start the build again", stepName, err.Error())
+	}
+	checkpoint, err := decodeMetadata(content, stateMachine.stateNames())
+	if err != nil {
+		return nil, fmt.Errorf("error loading the state saved in %s: %s", checkpointPath, err.Error())
+	}
+	return checkpoint, nil
+}
+
 // rebuildYamlIndex reset the YamlIndex field in VolumeStructure
 // This field is not serialized (for a good reason) so it is lost when saving the metadata
 // We consider here the JSON serialization keeps the struct order and we can naively
@@ -536,7 +695,7 @@ func (stateMachine *StateMachine) writeMetadata(metadataFile string) error {
 	}
 	defer jsonfile.Close()
 
-	b, err := json.Marshal(stateMachine)
+	b, err := json.Marshal(stateMachine.savedState())
 	if err != nil {
 		return fmt.Errorf("failed to JSON encode metadata: %w", err)
 	}
@@ -604,24 +763,112 @@ func (stateMachine *StateMachine) determineOutputDirectory() error {
 }
 
 // Run iterates through the state functions, stopping when appropriate based on --until and --thru
-func (stateMachine *StateMachine) Run() error {
+func (stateMachine *StateMachine) Run() (err error) {
 	if stateMachine.commonFlags.DryRun {
 		return nil
 	}
+
+	// Teardown is not called when the build fails
+	defer func() {
+		if err == nil {
+			return
+		}
+		if _, isClean := stateMachine.parent.(*CleanStateMachine); isClean {
+			// a workdir not fully cleaned must be cleaned again before use
+			stateMachine.lock.keep()
+			stateMachine.lock = nil
+		} else if unlockErr := stateMachine.unlockWorkDir(); unlockErr != nil {
+			err = fmt.Errorf("%w\n%s", err, unlockErr.Error())
+		}
+	}()
+
+	// the list of steps is replaced by the json events written to stdout
+	jsonOnStdout := stateMachine.commonFlags.Progress == "json" && stateMachine.commonFlags.ProgressFile == ""
+	printProgress := !stateMachine.commonFlags.Quiet && !jsonOnStdout
+	var progress *progressReporter
+	if stateMachine.commonFlags.Progress == "json" {
+		var err error
+		progress, err = newProgressReporter(stateMachine.commonFlags.ProgressFile,
+			stateMachine.commonFlags.OutputDir)
+		if err != nil {
+			return err
+		}
+		defer progress.close()
+	}
+
+	// stop gracefully on SIGINT and SIGTERM, tearing down the current state
+	interrupt := newInterruptHandler()
+	defer interrupt.stop()
+
 	// iterate through the states
+	completed := true
 	for i := 0; i < len(stateMachine.states); i++ {
 		stateFunc := stateMachine.states[i]
+		if sig := interrupt.interrupted(); sig != nil {
+			err := stateMachine.saveInterrupted(sig, stateMachine.CurrentStep)
+			if cleanupErr := stateMachine.cleanup(); cleanupErr != nil {
+				return fmt.Errorf("error during cleanup: %s while cleaning after interruption: %w", cleanupErr.Error(), err)
+			}
+			return err
+		}
 		stateMachine.CurrentStep = stateFunc.name
 		if stateFunc.name == stateMachine.stateMachineFlags.Until {
+			completed = false
 			break
 		}
-		if !stateMachine.commonFlags.Quiet {
+		if printProgress {
 			fmt.Printf("[%d] %s\n", stateMachine.StepsTaken, stateFunc.name)
 		}
-		start := time.Now()
-		err := stateFunc.function(stateMachine)
-		if stateMachine.commonFlags.Debug {
-			fmt.Printf("duration: %v\n", time.Since(start))
+		var err error
+		if progress != nil {
+			err = progress.stateStarted(stateMachine.StepsTaken, stateFunc.name)
+		}
+		if err == nil && !stateMachine.cleanWorkDir {
+			err = stateMachine.writeCheckpoint(stateFunc.name)
+		}
+		var stateSnapshot *snapshot
+		if err == nil {
+			stateSnapshot, err = stateMachine.takeSnapshot(stateFunc.name)
+		}
+		if err == nil {
+			err = stateMachine.runHooks(preHook, stateFunc.name)
+		}
+		if err == nil {
+			start := time.Now()
+			err = stateFunc.function(stateMachine)
+			if stateMachine.commonFlags.Debug {
+				fmt.Printf("duration: %v\n", time.Since(start))
+			}
+		}
+		if err == nil {
+			err = stateMachine.runHooks(postHook, stateFunc.name)
+		}
+		if progress != nil {
+			progressErr := progress.stateFinished(stateMachine.StepsTaken, stateFunc.name, err)
+			if err == nil {
+				err = progressErr
+			}
+		}
+		restored := false
+		if stateSnapshot != nil {
+			if err != nil {
+				if restoreErr := stateMachine.restoreSnapshot(stateSnapshot, stateFunc.name); restoreErr != nil {
+					err = fmt.Errorf("%w\nError restoring snapshot: %s", err, restoreErr.Error())
+				} else {
+					restored = true
+				}
+			} else {
+				err = stateSnapshot.discard()
+			}
+		}
+		if sig := interrupt.interrupted(); sig != nil && err != nil {
+			// the state is run again on --resume
+			if restored {
+				// the state saved with the snapshot must not be overwritten
+				err = &InterruptedError{Signal: sig, Step: stateFunc.name, Resumable: true}
+			} else {
+				err = stateMachine.saveInterrupted(sig, stateFunc.name)
+			}
 		}
 		if err != nil {
 			// clean up work dir on error
@@ -632,11 +879,22 @@ func (stateMachine *StateMachine) Run() error {
 			return err
 		}
 		stateMachine.StepsTaken++
+		stateMachine.stepNames = append(stateMachine.stepNames, stateFunc.name)
 		if stateFunc.name == stateMachine.stateMachineFlags.Thru {
+			completed = i == len(stateMachine.states)-1
 			break
 		}
 	}
-	fmt.Println("Build successful")
+	// the artifacts are only reported once all of them are built
+	if completed {
+		err := stateMachine.writeBuildResult()
+		if err != nil {
+			return err
+		}
+	}
+	if !jsonOnStdout {
+		fmt.Println("Build successful")
+	}
 	return nil
 }
 
@@ -648,5 +906,8 @@ func (stateMachine *StateMachine) Teardown() error {
 	if stateMachine.cleanWorkDir {
 		return stateMachine.cleanup()
 	}
-	return stateMachine.writeMetadata(metadataStateFile)
+	if err := stateMachine.writeMetadata(metadataStateFile); err != nil {
+		return err
+	}
+	return stateMachine.unlockWorkDir()
 }
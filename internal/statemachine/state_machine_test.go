@@ -122,6 +122,9 @@ func mockOpenFile(string, int, os.FileMode) (*os.File, error) {
 func mockOpenFileAppend(name string, flag int, perm os.FileMode) (*os.File, error) {
 	return os.OpenFile(name, flag|os.O_APPEND, perm)
 }
+func mockRemove(string) error {
+	return fmt.Errorf("Test error")
+}
 func mockRemoveAll(string) error {
 	return fmt.Errorf("Test error")
 }
@@ -321,6 +324,158 @@ func TestUntilThru(t *testing.T) {
 	}
 }
 
+// TestFrom tests rewinding a previous run with --from
+func TestFrom(t *testing.T) {
+	testCases := []struct {
+		name           string
+		thru           string
+		from           string
+		outputs        []string
+		noCheckpoints  bool
+		wantStepsTaken int
+		wantRemoved    []string
+		expectedError  string
+	}{
+		{
+			name:           "rewind",
+			from:           populateBootfsContentsState.name,
+			outputs:        []string{"unpack", "root", "volumes"},
+			wantStepsTaken: 6,
+			wantRemoved:    []string{"volumes"},
+		},
+		{
+			name:           "rewind to the first step",
+			from:           prepareGadgetTreeState.name,
+			wantStepsTaken: 0,
+		},
+		{
+			name:           "rewind to the step after the last one taken",
+			thru:           calculateRootfsSizeState.name,
+			from:           populateBootfsContentsState.name,
+			outputs:        []string{"unpack", "root"},
+			wantStepsTaken: 6,
+		},
+		{
+			name:          "missing output",
+			from:          populateBootfsContentsState.name,
+			outputs:       []string{"unpack"},
+			expectedError: "populated by step populate_rootfs_contents, is missing or empty",
+		},
+		{
+			name:          "missing checkpoint",
+			from:          populateBootfsContentsState.name,
+			outputs:       []string{"unpack", "root"},
+			noCheckpoints: true,
+			expectedError: "the state saved before it is missing",
+		},
+		{
+			name:          "step not taken",
+			thru:          calculateRootfsSizeState.name,
+			from:          makeDiskState.name,
+			outputs:       []string{"unpack", "root"},
+			expectedError: "the previous run stopped before it",
+		},
+		{
+			name:          "invalid step",
+			from:          "fake step",
+			expectedError: "state fake step is not a valid state name",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			workDir := t.TempDir()
+
+			var partialStateMachine testStateMachine
+			partialStateMachine.commonFlags, partialStateMachine.stateMachineFlags = helper.InitCommonOpts()
+			partialStateMachine.commonFlags.Quiet = true
+			partialStateMachine.stateMachineFlags.WorkDir = workDir
+			partialStateMachine.stateMachineFlags.Thru = tc.thru
+			err := partialStateMachine.Setup()
+			asserter.AssertErrNil(err, true)
+			err = partialStateMachine.Run()
+			asserter.AssertErrNil(err, true)
+			// written by a step run again, so it must be reset
+			partialStateMachine.Packages = []string{"package"}
+			err = partialStateMachine.Teardown()
+			asserter.AssertErrNil(err, true)
+
+			if tc.noCheckpoints {
+				err = os.RemoveAll(filepath.Join(workDir, checkpointsDir))
+				asserter.AssertErrNil(err, true)
+			}
+			for _, output := range tc.outputs {
+				err = os.MkdirAll(filepath.Join(workDir, output), 0755)
+				asserter.AssertErrNil(err, true)
+				err = os.WriteFile(filepath.Join(workDir, output, "content"), []byte("content"), 0644)
+				asserter.AssertErrNil(err, true)
+			}
+
+			var fromStateMachine testStateMachine
+			fromStateMachine.commonFlags, fromStateMachine.stateMachineFlags = helper.InitCommonOpts()
+			fromStateMachine.stateMachineFlags.WorkDir = workDir
+			fromStateMachine.stateMachineFlags.From = tc.from
+			err = fromStateMachine.Setup()
+			if tc.expectedError != "" {
+				asserter.AssertErrContains(err, tc.expectedError)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.wantStepsTaken, fromStateMachine.StepsTaken)
+			asserter.AssertEqual(tc.from, fromStateMachine.states[0].name)
+			if tc.wantStepsTaken < len(allTestStates) && tc.thru == "" {
+				asserter.AssertEqual([]string(nil), fromStateMachine.Packages)
+			}
+			for _, output := range tc.wantRemoved {
+				_, err = os.Stat(filepath.Join(workDir, output))
+				if !os.IsNotExist(err) {
+					t.Errorf("%s was not removed when rewinding", output)
+				}
+			}
+		})
+	}
+}
+
+// TestFromWithoutWorkDir ensures --from cannot be used without a workdir
+func TestFromWithoutWorkDir(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.stateMachineFlags.From = makeDiskState.name
+
+	err := stateMachine.validateInput()
+	asserter.AssertErrContains(err, "must specify workdir when using --from flag")
+}
+
+// TestFromWithOtherFlags ensures --from cannot be used with --resume, --until or --thru
+func TestFromWithOtherFlags(t *testing.T) {
+	testCases := []struct {
+		name   string
+		resume bool
+		until  string
+		thru   string
+	}{
+		{name: "resume", resume: true},
+		{name: "until", until: makeDiskState.name},
+		{name: "thru", thru: makeDiskState.name},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+			stateMachine.stateMachineFlags.From = populateBootfsContentsState.name
+			stateMachine.stateMachineFlags.Resume = tc.resume
+			stateMachine.stateMachineFlags.Until = tc.until
+			stateMachine.stateMachineFlags.Thru = tc.thru
+
+			err := stateMachine.validateInput()
+			asserter.AssertErrContains(err, "cannot specify --from with --resume, --until or --thru")
+		})
+	}
+}
+
 // TestDebug ensures that the name of the states is printed when the --debug flag is used
 func TestDebug(t *testing.T) {
 	asserter := helper.Asserter{T: t}
@@ -1155,6 +1310,7 @@ func TestStateMachine_readMetadata(t *testing.T) {
 				},
 				CurrentStep:  "",
 				StepsTaken:   2,
+				stepNames:    []string{allTestStates[0].name, allTestStates[1].name},
 				YamlFilePath: "/tmp/ubuntu-image-2329554237/unpack/gadget/meta/gadget.yaml",
 				IsSeeded:     true,
 				SectorSize:   quantity.Size(512),
@@ -1200,11 +1356,12 @@ func TestStateMachine_readMetadata(t *testing.T) {
 						},
 					},
 				},
-				ImageSizes:  map[string]quantity.Size{"pc": 3155165184},
-				VolumeOrder: []string{"pc"},
-				VolumeNames: map[string]string{"pc": "pc.img"},
-				Packages:    []string{"nginx", "apache2"},
-				Snaps:       []string{"core", "lxd"},
+				ImageSizes:   map[string]quantity.Size{"pc": 3155165184},
+				VolumeOrder:  []string{"pc"},
+				VolumeNames:  map[string]string{"pc": "pc.img"},
+				Packages:     []string{"nginx", "apache2"},
+				Snaps:        []string{"core", "lxd"},
+				GadgetCommit: "0123456789abcdef0123456789abcdef01234567",
 				tempDirs: temporaryDirectories{
 					rootfs:  filepath.Join(testDataDir, "metadata", "root"),
 					unpack:  filepath.Join(testDataDir, "metadata", "unpack"),
@@ -1261,6 +1418,16 @@ func TestStateMachine_readMetadata(t *testing.T) {
 			shouldPass:       false,
 			expectedError:    "invalid steps taken count",
 		},
+		{
+			name: "state file saved by a newer version",
+			args: args{
+				metadataFile: "newer_version.json",
+				resume:       true,
+			},
+			wantStateMachine: nil,
+			shouldPass:       false,
+			expectedError:    "the state was saved by a newer version of ubuntu-image",
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -1300,6 +1467,7 @@ func TestStateMachine_writeMetadata(t *testing.T) {
 				},
 				CurrentStep:  "",
 				StepsTaken:   2,
+				stepNames:    []string{allTestStates[0].name, allTestStates[1].name},
 				YamlFilePath: "/tmp/ubuntu-image-2329554237/unpack/gadget/meta/gadget.yaml",
 				IsSeeded:     true,
 				SectorSize:   quantity.Size(512),
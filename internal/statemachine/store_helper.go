@@ -0,0 +1,214 @@
+package statemachine
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/snapasserts"
+	"github.com/snapcore/snapd/asserts/sysdb"
+	"github.com/snapcore/snapd/image"
+	"github.com/snapcore/snapd/snap"
+	"github.com/snapcore/snapd/store/tooling"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// canonicalStore is the store snaps are taken from by default
+const canonicalStore = "canonical"
+
+var toolingNewToolingStore = tooling.NewToolingStore
+
+var snapassertsFetchSnapAssertions = snapasserts.FetchSnapAssertions
+
+// snapStoreID returns the ID of the store of an extra snap, empty for the
+// default store
+func snapStoreID(extraSnap *imagedefinition.Snap) string {
+	if extraSnap.Store == canonicalStore {
+		return ""
+	}
+	return extraSnap.Store
+}
+
+// storeName returns the name of a store given its ID, empty for the default store
+func storeName(storeID string) string {
+	if storeID == "" {
+		return canonicalStore
+	}
+	return storeID
+}
+
+// setTemporaryEnv sets the given environment variables and returns a
+// function restoring their previous values
+func setTemporaryEnv(env map[string]string) (func() error, error) {
+	previous := make(map[string]*string)
+	restore := func() error {
+		for key, value := range previous {
+			var err error
+			if value == nil {
+				err = os.Unsetenv(key)
+			} else {
+				err = osSetenv(key, *value)
+			}
+			if err != nil {
+				return fmt.Errorf("Error restoring environment variable %s: %s", key, err.Error())
+			}
+		}
+		return nil
+	}
+
+	for key, value := range env {
+		if oldValue, found := os.LookupEnv(key); found {
+			previous[key] = &oldValue
+		} else {
+			previous[key] = nil
+		}
+		err := osSetenv(key, value)
+		if err != nil {
+			restoreErr := restore()
+			if restoreErr != nil {
+				return nil, fmt.Errorf("%s after previous error: %w", restoreErr.Error(), err)
+			}
+			return nil, fmt.Errorf("Error setting environment variable %s: %s", key, err.Error())
+		}
+	}
+	return restore, nil
+}
+
+// storeAuthEnv returns the environment variables making the tooling stores
+// read their credentials from authFile. If authFile is empty, the credentials
+// are read from the environment as they are.
+func storeAuthEnv(authFile string) map[string]string {
+	env := make(map[string]string)
+	if authFile != "" {
+		env["UBUNTU_STORE_AUTH_DATA_FILENAME"] = authFile
+		// UBUNTU_STORE_AUTH takes precedence over the file when not empty
+		env["UBUNTU_STORE_AUTH"] = ""
+	}
+	return env
+}
+
+// newToolingStore creates a client of the given store, configured as the
+// one image.Prepare creates from the model assertion. The tooling store is
+// configured through environment variables so they are only set while
+// creating it.
+func newToolingStore(storeID string, arch string, authFile string) (toolingStore *tooling.ToolingStore, err error) {
+	env := storeAuthEnv(authFile)
+	env["UBUNTU_STORE_ID"] = storeID
+	env["UBUNTU_STORE_ARCH"] = arch
+
+	restoreEnv, err := setTemporaryEnv(env)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		restoreErr := restoreEnv()
+		if restoreErr != nil {
+			if err != nil {
+				err = fmt.Errorf("%s after previous error: %w", restoreErr.Error(), err)
+			} else {
+				err = restoreErr
+			}
+		}
+	}()
+
+	return toolingNewToolingStore()
+}
+
+// modelStore returns the store of the model assertion, from which image.Prepare
+// seeds every snap. The default model assertion uses the "canonical" store.
+func modelStore(modelFile string) (string, error) {
+	if modelFile == "" {
+		return "", nil
+	}
+	rawAssert, err := osReadFile(modelFile)
+	if err != nil {
+		return "", fmt.Errorf("Error reading model assertion %s: %s", modelFile, err.Error())
+	}
+	model, err := decodeModel(modelFile, rawAssert)
+	if err != nil {
+		return "", fmt.Errorf("Error reading model assertion %s: %s", modelFile, err.Error())
+	}
+	return model.Store(), nil
+}
+
+// fetchSnapAssertions fetches the assertions of a snap downloaded from a
+// store, which also checks the snap file is the one published in this store
+func fetchSnapAssertions(toolingStore *tooling.ToolingStore, snapPath string, snapInfo *snap.Info) error {
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore: asserts.NewMemoryBackstore(),
+		Trusted:   sysdb.Trusted(),
+	})
+	if err != nil {
+		return err
+	}
+	digest, _, err := asserts.SnapFileSHA3_384(snapPath)
+	if err != nil {
+		return err
+	}
+	fetcher := toolingStore.AssertionFetcher(db, func(asserts.Assertion) error { return nil })
+	return snapassertsFetchSnapAssertions(fetcher, digest, snapInfo.Provenance())
+}
+
+// fetchStoreSnaps downloads the extra snaps coming from another store than the
+// one of the model assertion from their own store, along with their
+// assertions. image.Prepare only downloads snaps from the store of the model
+// assertion, so they are given to it as local snaps instead of their names. It
+// then seeds them with their assertions, found from the digest of the files.
+func fetchStoreSnaps(imageOpts *image.Options, imageDefinition *imagedefinition.ImageDefinition, modelStoreID string, arch string, storeAuth map[string]string, targetDir string) error {
+	if imageDefinition.Customization == nil {
+		return nil
+	}
+	toolingStores := make(map[string]*tooling.ToolingStore)
+	for _, extraSnap := range imageDefinition.Customization.ExtraSnaps {
+		storeID := snapStoreID(extraSnap)
+		if storeID == modelStoreID {
+			continue
+		}
+		toolingStore, found := toolingStores[storeID]
+		if !found {
+			var err error
+			toolingStore, err = newToolingStore(storeID, arch, storeAuth[storeName(storeID)])
+			if err != nil {
+				return fmt.Errorf("Error connecting to store \"%s\": %s", storeName(storeID), err.Error())
+			}
+			toolingStores[storeID] = toolingStore
+		}
+
+		err := osMkdirAll(targetDir, 0755)
+		if err != nil {
+			return fmt.Errorf("Error creating directory %s: %s", targetDir, err.Error())
+		}
+		downloadOpts := tooling.DownloadSnapOptions{TargetDir: targetDir}
+		if extraSnap.SnapRevision != 0 {
+			downloadOpts.Revision = snap.R(extraSnap.SnapRevision)
+		} else if channel, found := imageOpts.SnapChannels[extraSnap.SnapName]; found {
+			downloadOpts.Channel = channel
+		} else {
+			downloadOpts.Channel = imageOpts.Channel
+		}
+		downloadedSnap, err := toolingStore.DownloadSnap(extraSnap.SnapName, nil, downloadOpts)
+		if err != nil {
+			return fmt.Errorf("Error downloading snap %s from store \"%s\": %s",
+				extraSnap.SnapName, storeName(storeID), err.Error())
+		}
+		err = fetchSnapAssertions(toolingStore, downloadedSnap.Path, downloadedSnap.Info)
+		if err != nil {
+			return fmt.Errorf("Error fetching the assertions of snap %s from store \"%s\": %s",
+				extraSnap.SnapName, storeName(storeID), err.Error())
+		}
+
+		for i, seededSnap := range imageOpts.Snaps {
+			if seededSnap == extraSnap.SnapName {
+				imageOpts.Snaps[i] = downloadedSnap.Path
+			}
+		}
+		delete(imageOpts.SnapChannels, extraSnap.SnapName)
+		base := downloadedSnap.Info.Base
+		if base != "" && !helper.SliceHasElement(imageOpts.Snaps, base) {
+			imageOpts.Snaps = append(imageOpts.Snaps, base)
+		}
+	}
+	return nil
+}
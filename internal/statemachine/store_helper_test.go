@@ -0,0 +1,344 @@
+package statemachine
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/snapasserts"
+	"github.com/snapcore/snapd/image"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+// fakeStoreSnap is a snap served by the fake store
+type fakeStoreSnap struct {
+	store    string
+	name     string
+	revision int
+	base     string
+	content  []byte
+}
+
+// newFakeStore starts a minimal snap store serving the given snaps. Only the
+// snaps of the store given in the Snap-Device-Store header are visible. The
+// Authorization headers received are recorded in authorizations.
+func newFakeStore(t *testing.T, snaps []fakeStoreSnap, authorizations map[string]string) *httptest.Server {
+	t.Helper()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/download/") {
+			for _, s := range snaps {
+				if r.URL.Path == fmt.Sprintf("/download/%s_%d.snap", s.name, s.revision) {
+					w.Write(s.content) // nolint: errcheck
+					return
+				}
+			}
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Path != "/v2/snaps/refresh" {
+			http.NotFound(w, r)
+			return
+		}
+
+		storeID := r.Header.Get("Snap-Device-Store")
+		authorizations[storeID] = r.Header.Get("Authorization")
+
+		var request struct {
+			Actions []struct {
+				InstanceKey string `json:"instance-key"`
+				Name        string `json:"name"`
+				Revision    int    `json:"revision"`
+			} `json:"actions"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var results []map[string]interface{}
+		for _, action := range request.Actions {
+			result := map[string]interface{}{
+				"instance-key": action.InstanceKey,
+				"name":         action.Name,
+				"result":       "error",
+				"error":        map[string]string{"code": "name-not-found", "message": "not found"},
+			}
+			for _, s := range snaps {
+				if s.store != storeID || s.name != action.Name {
+					continue
+				}
+				if action.Revision != 0 && action.Revision != s.revision {
+					continue
+				}
+				// snapd registers the SHA3-384 implementation
+				hasher := crypto.SHA3_384.New()
+				hasher.Write(s.content) // nolint: errcheck
+				result = map[string]interface{}{
+					"instance-key": action.InstanceKey,
+					"name":         s.name,
+					"snap-id":      s.name + "-id",
+					"result":       "download",
+					"snap": map[string]interface{}{
+						"name":     s.name,
+						"snap-id":  s.name + "-id",
+						"revision": s.revision,
+						"version":  "1.0",
+						"type":     "app",
+						"base":     s.base,
+						"download": map[string]interface{}{
+							"url":      fmt.Sprintf("%s/download/%s_%d.snap", server.URL, s.name, s.revision),
+							"size":     len(s.content),
+							"sha3-384": fmt.Sprintf("%x", hasher.Sum(nil)),
+						},
+					},
+				}
+			}
+			results = append(results, result)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results}) // nolint: errcheck
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestEnsureSnapBasesInstalled(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	bearerAuth := func(token string) string {
+		return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(`{"t":"bearer","v":"%s"}`, token)))
+	}
+
+	authorizations := make(map[string]string)
+	server := newFakeStore(t, []fakeStoreSnap{
+		{store: "brand-store", name: "device-agent", revision: 7, base: "core22", content: []byte("device-agent")},
+		{store: "brand-store", name: "device-config", revision: 3, base: "device-base", content: []byte("device-config")},
+		{store: "brand-store", name: "device-base", revision: 1, content: []byte("device-base")},
+		{store: "", name: "device-agent", revision: 2, base: "core20", content: []byte("device-agent")},
+	}, authorizations)
+	t.Setenv("UBUNTU_STORE_URL", server.URL)
+	t.Setenv("UBUNTU_STORE_AUTH", bearerAuth("env-token"))
+
+	authFile := filepath.Join(t.TempDir(), "auth")
+	err := os.WriteFile(authFile, []byte(bearerAuth("file-token")), 0600)
+	asserter.AssertErrNil(err, true)
+
+	testCases := []struct {
+		name               string
+		storeID            string
+		authFile           string
+		snaps              []string
+		wantSnaps          []string
+		wantAuthorizations map[string]string
+		expectedError      string
+	}{
+		{
+			name:               "brand_store_with_auth_file",
+			storeID:            "brand-store",
+			authFile:           authFile,
+			snaps:              []string{"device-agent", "device-config", "device-base"},
+			wantSnaps:          []string{"device-agent", "device-config", "device-base", "core22"},
+			wantAuthorizations: map[string]string{"brand-store": "Bearer file-token"},
+		},
+		{
+			name:               "brand_store_with_auth_env",
+			storeID:            "brand-store",
+			snaps:              []string{"device-agent"},
+			wantSnaps:          []string{"device-agent", "core22"},
+			wantAuthorizations: map[string]string{"brand-store": "Bearer env-token"},
+		},
+		{
+			name:               "default_store",
+			snaps:              []string{"device-agent"},
+			wantSnaps:          []string{"device-agent", "core20"},
+			wantAuthorizations: map[string]string{"": "Bearer env-token"},
+		},
+		{
+			name:          "snap_not_in_store",
+			snaps:         []string{"device-config"},
+			expectedError: "Error getting info for snap device-config",
+		},
+		{
+			name:          "invalid_credentials",
+			storeID:       "brand-store",
+			authFile:      "/inexistent",
+			snaps:         []string{"device-agent"},
+			expectedError: "Error connecting to store \"brand-store\"",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			for storeID := range authorizations {
+				delete(authorizations, storeID)
+			}
+			imageOpts := &image.Options{
+				Snaps:        tc.snaps,
+				SnapChannels: map[string]string{},
+			}
+			err := ensureSnapBasesInstalled(imageOpts, tc.storeID, "amd64", tc.authFile)
+			if tc.expectedError != "" {
+				asserter.AssertErrContains(err, tc.expectedError)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.wantSnaps, imageOpts.Snaps)
+			asserter.AssertEqual(tc.wantAuthorizations, authorizations)
+
+			// the environment is restored once the store is created
+			asserter.AssertEqual(bearerAuth("env-token"), os.Getenv("UBUNTU_STORE_AUTH"))
+			if _, found := os.LookupEnv("UBUNTU_STORE_ID"); found {
+				t.Errorf("UBUNTU_STORE_ID should not be set anymore")
+			}
+		})
+	}
+}
+
+func TestFetchStoreSnaps(t *testing.T) {
+	bearerAuth := func(token string) string {
+		return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(`{"t":"bearer","v":"%s"}`, token)))
+	}
+
+	authorizations := make(map[string]string)
+	server := newFakeStore(t, []fakeStoreSnap{
+		{store: "brand-store", name: "device-agent", revision: 7, base: "core22", content: []byte("device-agent")},
+		{store: "", name: "lxd", revision: 2, content: []byte("lxd")},
+	}, authorizations)
+	t.Setenv("UBUNTU_STORE_URL", server.URL)
+	t.Setenv("UBUNTU_STORE_AUTH", bearerAuth("env-token"))
+
+	authFile := filepath.Join(t.TempDir(), "auth")
+	err := os.WriteFile(authFile, []byte(bearerAuth("file-token")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name               string
+		modelStoreID       string
+		storeAuth          map[string]string
+		extraSnaps         []*imagedefinition.Snap
+		assertionsErr      error
+		wantSnaps          []string
+		wantFetched        []string
+		wantAuthorizations map[string]string
+		expectedError      string
+	}{
+		{
+			name:         "brand_snap_with_default_model",
+			modelStoreID: "",
+			storeAuth:    map[string]string{"brand-store": authFile},
+			extraSnaps: []*imagedefinition.Snap{
+				{SnapName: "hello", Store: "canonical"},
+				{SnapName: "device-agent", Store: "brand-store", Channel: "edge"},
+			},
+			wantSnaps:          []string{"hello", "device-agent_7.snap", "core22"},
+			wantFetched:        []string{"device-agent"},
+			wantAuthorizations: map[string]string{"brand-store": "Bearer file-token"},
+		},
+		{
+			name:         "default_store_snap_with_brand_model",
+			modelStoreID: "brand-store",
+			storeAuth:    map[string]string{"canonical": authFile},
+			extraSnaps: []*imagedefinition.Snap{
+				{SnapName: "device-agent", Store: "brand-store"},
+				{SnapName: "lxd", Store: "canonical", SnapRevision: 2},
+			},
+			wantSnaps:          []string{"device-agent", "lxd_2.snap"},
+			wantFetched:        []string{"lxd"},
+			wantAuthorizations: map[string]string{"": "Bearer file-token"},
+		},
+		{
+			name:         "snap_not_in_store",
+			modelStoreID: "brand-store",
+			extraSnaps: []*imagedefinition.Snap{
+				{SnapName: "device-agent"},
+			},
+			expectedError: "Error downloading snap device-agent from store \"canonical\"",
+		},
+		{
+			name:          "snap_not_asserted",
+			extraSnaps:    []*imagedefinition.Snap{{SnapName: "device-agent", Store: "brand-store"}},
+			assertionsErr: fmt.Errorf("snap-revision not found"),
+			expectedError: "Error fetching the assertions of snap device-agent from store \"brand-store\": " +
+				"snap-revision not found",
+		},
+		{
+			name:          "invalid_credentials",
+			storeAuth:     map[string]string{"brand-store": "/inexistent"},
+			extraSnaps:    []*imagedefinition.Snap{{SnapName: "device-agent", Store: "brand-store"}},
+			expectedError: "Error connecting to store \"brand-store\"",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			for storeID := range authorizations {
+				delete(authorizations, storeID)
+			}
+			var fetched []string
+			snapassertsFetchSnapAssertions = func(f asserts.Fetcher, digest string, provenance string) error {
+				fetched = append(fetched, digest)
+				return tc.assertionsErr
+			}
+			t.Cleanup(func() { snapassertsFetchSnapAssertions = snapasserts.FetchSnapAssertions })
+
+			imageOpts := &image.Options{SnapChannels: map[string]string{}}
+			imageDef := &imagedefinition.ImageDefinition{
+				Customization: &imagedefinition.Customization{ExtraSnaps: tc.extraSnaps},
+			}
+			err := addExtraSnaps(imageOpts, imageDef)
+			asserter.AssertErrNil(err, true)
+			targetDir := filepath.Join(t.TempDir(), "snaps")
+			err = fetchStoreSnaps(imageOpts, imageDef, tc.modelStoreID, "amd64", tc.storeAuth, targetDir)
+			if tc.expectedError != "" {
+				asserter.AssertErrContains(err, tc.expectedError)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+
+			// the snaps downloaded are given as local snaps
+			var gotSnaps []string
+			for _, seededSnap := range imageOpts.Snaps {
+				gotSnaps = append(gotSnaps, strings.TrimPrefix(seededSnap, targetDir+"/"))
+			}
+			asserter.AssertEqual(tc.wantSnaps, gotSnaps)
+			for _, name := range tc.wantFetched {
+				if _, found := imageOpts.SnapChannels[name]; found {
+					t.Errorf("The channel of the local snap %s should not be set", name)
+				}
+			}
+			asserter.AssertEqual(len(tc.wantFetched), len(fetched))
+			asserter.AssertEqual(tc.wantAuthorizations, authorizations)
+		})
+	}
+}
+
+func TestModelStore(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+
+	storeID, err := modelStore("")
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("", storeID)
+
+	storeID, err = modelStore(filepath.Join("testdata", "modelAssertionClassic"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("", storeID)
+
+	_, err = modelStore("/inexistent")
+	asserter.AssertErrContains(err, "Error reading model assertion /inexistent")
+
+	_, err = modelStore(filepath.Join("testdata", "modelAssertionReserverdHeader"))
+	asserter.AssertErrContains(err, "reserved/unsupported header")
+}
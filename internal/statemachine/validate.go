@@ -0,0 +1,173 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/canonical/ubuntu-image/internal/commands"
+)
+
+// validationError is an error found in one of the validated files. Line and
+// Column are 0 when they are not known.
+type validationError struct {
+	File    string `json:"file"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e validationError) String() string {
+	return fmt.Sprintf("%s: %s", e.position(), e.Message)
+}
+
+// position returns the file, line and column of the error, as far as they are known
+func (e validationError) position() string {
+	if e.Line == 0 {
+		return e.File
+	}
+	if e.Column == 0 {
+		return fmt.Sprintf("%s:%d", e.File, e.Line)
+	}
+	return fmt.Sprintf("%s:%d:%d", e.File, e.Line, e.Column)
+}
+
+// validationReport is written to stdout with --format=json
+type validationReport struct {
+	Valid  bool              `json:"valid"`
+	Errors []validationError `json:"errors"`
+}
+
+// InvalidFilesError is returned when the validate command found errors. The
+// errors were already reported.
+type InvalidFilesError struct {
+	Count int
+}
+
+func (e *InvalidFilesError) Error() string {
+	switch e.Count {
+	case 0:
+		return "No errors found"
+	case 1:
+		return "1 error found"
+	default:
+		return fmt.Sprintf("%d errors found", e.Count)
+	}
+}
+
+// ValidateStateMachine embeds StateMachine and adds the command line flags specific to
+// validating image definitions, gadget.yaml files and model assertions
+type ValidateStateMachine struct {
+	StateMachine
+	Opts commands.ValidateOpts
+	Args commands.ValidateArgs
+
+	validationErrors []validationError
+}
+
+// Setup assigns variables and calls other functions that must be executed before Run()
+func (validateStateMachine *ValidateStateMachine) Setup() error {
+	// set the parent pointer of the embedded struct
+	validateStateMachine.parent = validateStateMachine
+
+	validateStateMachine.states = make([]stateFunc, 0)
+	if validateStateMachine.Args.ImageDefinition != "" {
+		validateStateMachine.states = append(validateStateMachine.states, validateImageDefinitionState)
+	}
+	if validateStateMachine.Opts.GadgetYaml != "" {
+		validateStateMachine.states = append(validateStateMachine.states, validateGadgetYamlState)
+	}
+	if validateStateMachine.Opts.ModelAssertion != "" {
+		validateStateMachine.states = append(validateStateMachine.states, validateModelAssertionState)
+	}
+
+	return validateStateMachine.validateValidateInput()
+}
+
+// validateValidateInput validates the command line options of the validate command
+func (validateStateMachine *ValidateStateMachine) validateValidateInput() error {
+	if len(validateStateMachine.states) == 0 {
+		return fmt.Errorf("must specify an image definition, a gadget.yaml with --gadget-yaml " +
+			"or a model assertion with --model-assertion")
+	}
+	if validateStateMachine.stateMachineFlags.Resume || validateStateMachine.stateMachineFlags.From != "" {
+		return fmt.Errorf("the validate command cannot be resumed")
+	}
+	return nil
+}
+
+// Run runs every validation, whether the previous ones found errors or not,
+// and reports the errors found, including the files that cannot be read.
+// Only the report is written to stdout.
+func (validateStateMachine *ValidateStateMachine) Run() error {
+	for _, state := range validateStateMachine.states {
+		if validateStateMachine.commonFlags.Debug {
+			fmt.Fprintf(os.Stderr, "[%s]\n", state.name)
+		}
+		if err := state.function(&validateStateMachine.StateMachine); err != nil {
+			return err
+		}
+	}
+
+	sort.SliceStable(validateStateMachine.validationErrors, func(i, j int) bool {
+		a, b := validateStateMachine.validationErrors[i], validateStateMachine.validationErrors[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+
+	if err := validateStateMachine.report(); err != nil {
+		return err
+	}
+	if len(validateStateMachine.validationErrors) > 0 {
+		return &InvalidFilesError{Count: len(validateStateMachine.validationErrors)}
+	}
+	return nil
+}
+
+// report prints the errors found in the format requested with --format
+func (validateStateMachine *ValidateStateMachine) report() error {
+	if validateStateMachine.Opts.Format == "json" {
+		report := validationReport{
+			Valid:  len(validateStateMachine.validationErrors) == 0,
+			Errors: validateStateMachine.validationErrors,
+		}
+		if report.Errors == nil {
+			report.Errors = []validationError{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			return fmt.Errorf("Error writing the validation report: %s", err.Error())
+		}
+		return nil
+	}
+
+	for _, validationErr := range validateStateMachine.validationErrors {
+		fmt.Println(validationErr.String())
+	}
+	if validateStateMachine.commonFlags.Quiet {
+		return nil
+	}
+	fmt.Println((&InvalidFilesError{Count: len(validateStateMachine.validationErrors)}).Error())
+	return nil
+}
+
+// addError records an error found in a validated file
+func (validateStateMachine *ValidateStateMachine) addError(position validationError, message string) {
+	position.Message = message
+	validateStateMachine.validationErrors = append(validateStateMachine.validationErrors, position)
+}
+
+// Placeholder method to satisfy the interface. This is not used when validating.
+func (validateStateMachine *ValidateStateMachine) SetSeries() error {
+	return nil
+}
+
+// Teardown has nothing to do since nothing is written when validating
+func (validateStateMachine *ValidateStateMachine) Teardown() error {
+	return nil
+}
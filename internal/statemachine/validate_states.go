@@ -0,0 +1,369 @@
+package statemachine
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/gadget"
+	"github.com/xeipuuv/gojsonschema"
+	yamlv3 "gopkg.in/yaml.v3"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+var validateImageDefinitionState = stateFunc{"validate_image_definition", (*StateMachine).validateImageDefinitionFile}
+
+// validateImageDefinitionFile reads the image definition as a build would and
+// records every error found in it
+func (stateMachine *StateMachine) validateImageDefinitionFile() error {
+	validateStateMachine := stateMachine.parent.(*ValidateStateMachine)
+	imageDefPath := validateStateMachine.Args.ImageDefinition
+
+	overrides, err := parseVariableOverrides(validateStateMachine.Opts.Variables)
+	if err != nil {
+		validateStateMachine.addError(validationError{File: imageDefPath}, err.Error())
+		return nil
+	}
+	imageDefinition, sources, err := readImageDefinition(imageDefPath, overrides)
+	if err != nil {
+		validateStateMachine.addImageDefinitionError(imageDefPath, err)
+		return nil
+	}
+
+	applyClassDefaults(imageDefinition)
+	if err := helperSetDefaults(imageDefinition); err != nil {
+		validateStateMachine.addError(validationError{File: imageDefPath}, err.Error())
+		return nil
+	}
+	result, err := checkImageDefinition(imageDefinition)
+	if err != nil {
+		validateStateMachine.addError(validationError{File: imageDefPath}, err.Error())
+		return nil
+	}
+
+	locator := newYAMLLocator(sources.files)
+	for _, resultErr := range result.Errors() {
+		location, message := resultErrorLocation(resultErr)
+		validateStateMachine.addError(locator.locate(location), message)
+	}
+	return nil
+}
+
+// addImageDefinitionError records an error preventing the image definition
+// from being read
+func (validateStateMachine *ValidateStateMachine) addImageDefinitionError(imageDefPath string, err error) {
+	var variableErr *unknownVariableError
+	var fileErr *imageDefinitionFileError
+	var mergeErr *mergeError
+	switch {
+	case errors.As(err, &variableErr):
+		// the variables are substituted once every file was read
+		_, files, treeErr := readImageDefinitionTree(imageDefPath, nil)
+		if treeErr != nil {
+			files = []string{imageDefPath}
+		}
+		validateStateMachine.addError(newYAMLLocator(files).locate(variableErr.location), variableErr.Error())
+	case errors.As(err, &mergeErr) && errors.As(err, &fileErr):
+		validateStateMachine.addError(newYAMLLocator([]string{fileErr.path}).locate(mergeErr.location), mergeErr.Error())
+	case errors.As(err, &fileErr):
+		validateStateMachine.addError(yamlErrorPosition(fileErr.path, fileErr.err), fileErr.err.Error())
+	default:
+		validateStateMachine.addError(validationError{File: imageDefPath}, err.Error())
+	}
+}
+
+// resultErrorLocation returns the location in the image definition of an error
+// found while validating it, and the message describing it
+func resultErrorLocation(resultErr gojsonschema.ResultError) ([]string, string) {
+	details := resultErr.Details()
+	// the custom errors give the location of the key they are about
+	if location, found := details[helper.ErrorLocationDetail]; found {
+		return splitLocation(location.(string)), resultErr.Description()
+	}
+
+	// the errors of the schema give the path of the JSON names of the fields
+	jsonPath := strings.Split(resultErr.Context().String(), ".")[1:]
+	if resultErr.Type() == "required" {
+		location := jsonToYAMLPath(append(jsonPath, fmt.Sprint(details["property"])))
+		message := fmt.Sprintf("key %s is required", location[len(location)-1])
+		if len(location) > 1 {
+			message = fmt.Sprintf("%s: %s", strings.Join(location[:len(location)-1], ":"), message)
+		}
+		return location, message
+	}
+	location := jsonToYAMLPath(jsonPath)
+	if len(location) == 0 {
+		return location, resultErr.Description()
+	}
+	// name the field by its keys in the YAML file
+	keys := strings.Join(location, ":")
+	if field := resultErr.Field(); strings.Contains(resultErr.Description(), field) {
+		return location, strings.Replace(resultErr.Description(), field, keys, 1)
+	}
+	return location, fmt.Sprintf("%s: %s", keys, resultErr.Description())
+}
+
+// splitLocation splits a location given as YAML keys separated by ":"
+func splitLocation(location string) []string {
+	if location == "" {
+		return nil
+	}
+	return strings.Split(location, ":")
+}
+
+// jsonToYAMLPath converts a path of JSON field names of the image definition
+// to the keys of the YAML file
+func jsonToYAMLPath(jsonPath []string) []string {
+	yamlPath := make([]string, 0, len(jsonPath))
+	fieldType := reflect.TypeOf(imagedefinition.ImageDefinition{})
+	for _, element := range jsonPath {
+		for fieldType != nil && fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType == nil {
+			yamlPath = append(yamlPath, element)
+			continue
+		}
+		switch fieldType.Kind() {
+		case reflect.Struct:
+			field, found := fieldByJSONName(fieldType, element)
+			if !found {
+				yamlPath = append(yamlPath, element)
+				fieldType = nil
+				continue
+			}
+			key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			yamlPath = append(yamlPath, key)
+			fieldType = field.Type
+		case reflect.Slice:
+			yamlPath = append(yamlPath, element)
+			fieldType = fieldType.Elem()
+		default:
+			yamlPath = append(yamlPath, element)
+			fieldType = nil
+		}
+	}
+	return yamlPath
+}
+
+// fieldByJSONName returns the field of a struct with the given JSON name
+func fieldByJSONName(structType reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		jsonName, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if jsonName == "" {
+			jsonName = field.Name
+		}
+		if jsonName == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// yamlLineRegex matches the line given in the errors of the YAML parsers
+var yamlLineRegex = regexp.MustCompile(`line (\d+)`)
+
+// yamlErrorPosition returns the position of a YAML parsing error
+func yamlErrorPosition(path string, err error) validationError {
+	position := validationError{File: path}
+	if match := yamlLineRegex.FindStringSubmatch(err.Error()); match != nil {
+		position.Line, _ = strconv.Atoi(match[1])
+	}
+	return position
+}
+
+// yamlLocator finds the position of the keys in the files an image definition
+// or a gadget.yaml is read from
+type yamlLocator struct {
+	files []string
+	roots []*yamlv3.Node // nil when the file cannot be parsed
+}
+
+// newYAMLLocator parses the files to locate keys in, the extended image
+// definitions first
+func newYAMLLocator(files []string) *yamlLocator {
+	locator := &yamlLocator{files: files, roots: make([]*yamlv3.Node, len(files))}
+	for i, file := range files {
+		content, err := osReadFile(file)
+		if err != nil {
+			continue
+		}
+		var document yamlv3.Node
+		if err := yamlv3.Unmarshal(content, &document); err != nil || len(document.Content) == 0 {
+			continue
+		}
+		locator.roots[i] = document.Content[0]
+	}
+	return locator
+}
+
+// locate returns the position of the key at location in the last file setting
+// it. When it is set in no file, as for missing keys, the position of its
+// deepest parent is returned instead.
+func (locator *yamlLocator) locate(location []string) validationError {
+	position := validationError{File: locator.files[len(locator.files)-1]}
+	foundDepth := -1
+	for i := len(locator.files) - 1; i >= 0; i-- {
+		if locator.roots[i] == nil {
+			continue
+		}
+		node, depth := findYAMLNode(locator.roots[i], location)
+		if depth > foundDepth {
+			foundDepth = depth
+			position = validationError{File: locator.files[i], Line: node.Line, Column: node.Column}
+		}
+	}
+	return position
+}
+
+// findYAMLNode returns the node of the key at location, or of its deepest
+// parent, and the number of elements of location found. Keys of mappings and
+// lists are returned rather than their value.
+func findYAMLNode(root *yamlv3.Node, location []string) (*yamlv3.Node, int) {
+	node, position := root, root
+	for depth, element := range location {
+		child, key := childYAMLNode(node, element)
+		if child == nil {
+			return position, depth
+		}
+		node, position = child, child
+		if key != nil && (child.Kind == yamlv3.MappingNode || child.Kind == yamlv3.SequenceNode) {
+			position = key
+		}
+	}
+	return position, len(location)
+}
+
+// childYAMLNode returns the child of a mapping or a list node, with its key
+// for mappings. Lists appended to extended image definitions are used for their
+// key without the "+" suffix.
+func childYAMLNode(node *yamlv3.Node, element string) (*yamlv3.Node, *yamlv3.Node) {
+	switch node.Kind {
+	case yamlv3.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			if key.Value == element || key.Value == element+appendSuffix {
+				return node.Content[i+1], key
+			}
+		}
+	case yamlv3.SequenceNode:
+		index, err := strconv.Atoi(element)
+		if err == nil && index >= 0 && index < len(node.Content) {
+			return node.Content[index], nil
+		}
+	}
+	return nil, nil
+}
+
+var validateGadgetYamlState = stateFunc{"validate_gadget_yaml", (*StateMachine).validateGadgetYaml}
+
+// validateGadgetYaml validates the gadget.yaml as snapd does when building an image
+func (stateMachine *StateMachine) validateGadgetYaml() error {
+	validateStateMachine := stateMachine.parent.(*ValidateStateMachine)
+	gadgetYamlPath := validateStateMachine.Opts.GadgetYaml
+
+	gadgetYamlBytes, err := osReadFile(gadgetYamlPath)
+	if err != nil {
+		validateStateMachine.addError(validationError{File: gadgetYamlPath},
+			fmt.Sprintf("Error reading gadget.yaml bytes: %s", err.Error()))
+		return nil
+	}
+
+	stateMachine.GadgetInfo, err = gadget.InfoFromGadgetYaml(gadgetYamlBytes, nil)
+	if err == nil {
+		err = gadget.Validate(stateMachine.GadgetInfo, nil, nil)
+	}
+	if err == nil {
+		err = stateMachine.validateVolumes()
+	}
+	if err != nil {
+		validateStateMachine.addError(gadgetErrorPosition(gadgetYamlPath, err), err.Error())
+	}
+	return nil
+}
+
+var (
+	gadgetVolumeRegex    = regexp.MustCompile(`invalid volume "([^"]+)"`)
+	gadgetStructureRegex = regexp.MustCompile(`invalid structure #(\d+)(?: \("([^"]+)"\))?`)
+)
+
+// gadgetErrorPosition returns the position of the volume or of the structure
+// named in an error of snapd
+func gadgetErrorPosition(gadgetYamlPath string, err error) validationError {
+	position := yamlErrorPosition(gadgetYamlPath, err)
+	volume := gadgetVolumeRegex.FindStringSubmatch(err.Error())
+	if position.Line != 0 || volume == nil {
+		return position
+	}
+
+	locator := newYAMLLocator([]string{gadgetYamlPath})
+	location := []string{"volumes", volume[1]}
+	if structure := gadgetStructureRegex.FindStringSubmatch(err.Error()); structure != nil {
+		index := structure[1]
+		// snapd sorts the structures by offset, find the named ones by name
+		if structure[2] != "" && locator.roots[0] != nil {
+			structures, depth := findYAMLNode(locator.roots[0], append(location, "structure"))
+			if depth == len(location)+1 {
+				for i, structureNode := range structures.Content {
+					if name, _ := childYAMLNode(structureNode, "name"); name != nil && name.Value == structure[2] {
+						index = strconv.Itoa(i)
+					}
+				}
+			}
+		}
+		location = append(location, "structure", index)
+	}
+	return locator.locate(location)
+}
+
+var validateModelAssertionState = stateFunc{"validate_model_assertion", (*StateMachine).validateModelAssertion}
+
+// validateModelAssertion decodes the model assertion as a snap build does
+func (stateMachine *StateMachine) validateModelAssertion() error {
+	validateStateMachine := stateMachine.parent.(*ValidateStateMachine)
+	modelAssertionPath := validateStateMachine.Opts.ModelAssertion
+
+	rawAssert, err := osReadFile(modelAssertionPath)
+	if err != nil {
+		validateStateMachine.addError(validationError{File: modelAssertionPath},
+			fmt.Sprintf("cannot read model assertion: %s", err))
+		return nil
+	}
+
+	if _, err := decodeModel(modelAssertionPath, rawAssert); err != nil {
+		validateStateMachine.addError(modelErrorPosition(modelAssertionPath, rawAssert, err), err.Error())
+	}
+	return nil
+}
+
+// modelHeaderRegex matches the header named in the errors of snapd
+var modelHeaderRegex = regexp.MustCompile(`"([^"]+)" header|header "([^"]+)"`)
+
+// modelErrorPosition returns the position of the header named in an error
+// decoding a model assertion
+func modelErrorPosition(modelAssertionPath string, rawAssert []byte, err error) validationError {
+	position := validationError{File: modelAssertionPath}
+	match := modelHeaderRegex.FindStringSubmatch(err.Error())
+	if match == nil {
+		return position
+	}
+	header := match[1] + match[2]
+	for i, line := range strings.Split(string(rawAssert), "\n") {
+		// the signature follows the first empty line
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, header+":") {
+			position.Line = i + 1
+			position.Column = 1
+			return position
+		}
+	}
+	return position
+}
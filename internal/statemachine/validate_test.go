@@ -0,0 +1,369 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/testhelper"
+)
+
+func TestValidateStateMachine_Setup(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ValidateStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+	err := stateMachine.Setup()
+	asserter.AssertErrContains(err, "must specify an image definition, a gadget.yaml with --gadget-yaml")
+
+	stateMachine.Args.ImageDefinition = "image-definition.yaml"
+	stateMachine.Opts.ModelAssertion = "model.assert"
+	err = stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(2, len(stateMachine.states))
+	asserter.AssertEqual(validateImageDefinitionState.name, stateMachine.states[0].name)
+	asserter.AssertEqual(validateModelAssertionState.name, stateMachine.states[1].name)
+
+	stateMachine.stateMachineFlags.Resume = true
+	err = stateMachine.Setup()
+	asserter.AssertErrContains(err, "the validate command cannot be resumed")
+}
+
+// writeValidatedFiles writes the files to validate in a temporary directory
+func writeValidatedFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	tmpDir := t.TempDir()
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write %s: %s", name, err.Error())
+		}
+	}
+	return tmpDir
+}
+
+const validImageDefinition = `name: ubuntu-server
+display-name: Ubuntu Server
+revision: 1
+architecture: amd64
+series: noble
+class: preinstalled
+kernel: linux-image-generic
+rootfs:
+  archive-tasks: [minimal]
+  sources-list-deb822: true
+`
+
+func TestStateMachine_validateImageDefinitionFile(t *testing.T) {
+	testCases := []struct {
+		name      string
+		files     map[string]string
+		variables []string
+		want      []validationError
+	}{
+		{
+			name:  "valid image definition",
+			files: map[string]string{"image.yaml": validImageDefinition},
+		},
+		{
+			name: "errors of the schema and of the custom rules",
+			files: map[string]string{"image.yaml": validImageDefinition + `gadget:
+  type: git
+customization:
+  extra-ppas:
+    - name: public/ppa
+    - name: private/ppa
+      auth: user:password
+  manual:
+    touch-file:
+      - path: relative/file
+`},
+			want: []validationError{
+				{File: "image.yaml", Line: 12, Column: 9, Message: "When key gadget:type is specified as git, a URL must be provided"},
+				{File: "image.yaml", Line: 16, Column: 7, Message: "Fingerprint is required for private PPAs"},
+				{File: "image.yaml", Line: 20, Column: 15, Message: "Key customization:manual:touch-file:path needs to be an absolute path (relative/file)"},
+			},
+		},
+		{
+			name: "invalid value",
+			files: map[string]string{"image.yaml": validImageDefinition + `customization:
+  pocket: bogus
+`},
+			want: []validationError{
+				{File: "image.yaml", Line: 12, Column: 11, Message: `customization:pocket must be one of the following: "release", "Release", "updates", "Updates", "security", "Security", "proposed", "Proposed"`},
+			},
+		},
+		{
+			name: "missing key located at its parent",
+			files: map[string]string{"image.yaml": validImageDefinition + `customization:
+  extra-packages:
+    - name: hello
+    - name: ""
+`},
+			want: []validationError{
+				{File: "image.yaml", Line: 14, Column: 7, Message: `Key "name" is required in struct "Package", but is not in the YAML file!`},
+			},
+		},
+		{
+			name: "error in an extended image definition",
+			files: map[string]string{
+				"base.yaml":  validImageDefinition + "gadget:\n  type: directory\n",
+				"image.yaml": "extends: base.yaml\nname: child\n",
+			},
+			want: []validationError{
+				{File: "base.yaml", Line: 12, Column: 9, Message: "When key gadget:type is specified as directory, a URL must be provided"},
+			},
+		},
+		{
+			name: "unknown variable",
+			files: map[string]string{
+				"image.yaml": "variables:\n  SERIES: noble\n" +
+					strings.Replace(validImageDefinition, "linux-image-generic", "linux-${FLAVOR}", 1),
+			},
+			variables: []string{"SERIES=jammy"},
+			want: []validationError{
+				{File: "image.yaml", Line: 9, Column: 9, Message: "unknown variable FLAVOR in kernel. Variables are defined in the variables section, with the UBUNTU_IMAGE_VAR_<NAME> environment variables or with --set <NAME>=<VALUE>"},
+			},
+		},
+		{
+			name:  "invalid yaml",
+			files: map[string]string{"image.yaml": "name: test\nrootfs: [\n"},
+			want: []validationError{
+				{File: "image.yaml", Line: 2, Message: "yaml: line 2: did not find expected node content"},
+			},
+		},
+		{
+			name: "invalid merge",
+			files: map[string]string{
+				"base.yaml":  validImageDefinition,
+				"image.yaml": "extends: base.yaml\nrootfs:\n  archive-tasks: [standard]\n  archive-tasks+: [server]\n",
+			},
+			want: []validationError{
+				{File: "image.yaml", Line: 3, Column: 3, Message: "rootfs: keys archive-tasks and archive-tasks+ cannot be used together"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			tmpDir := writeValidatedFiles(t, tc.files)
+
+			var stateMachine ValidateStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.Args.ImageDefinition = filepath.Join(tmpDir, "image.yaml")
+			stateMachine.Opts.Variables = tc.variables
+
+			err := stateMachine.validateImageDefinitionFile()
+			asserter.AssertErrNil(err, true)
+			for i := range tc.want {
+				tc.want[i].File = filepath.Join(tmpDir, tc.want[i].File)
+			}
+			asserter.AssertEqual(tc.want, stateMachine.validationErrors)
+		})
+	}
+}
+
+func TestStateMachine_validateGadgetYaml(t *testing.T) {
+	testCases := []struct {
+		name       string
+		gadgetYaml string
+		want       []validationError
+	}{
+		{
+			name:       "valid gadget.yaml",
+			gadgetYaml: "volumes:\n  pc:\n    bootloader: grub\n    structure:\n      - name: mbr\n        type: mbr\n        size: 440\n",
+		},
+		{
+			name:       "invalid structure",
+			gadgetYaml: "volumes:\n  pc:\n    bootloader: grub\n    structure:\n      - name: mbr\n        type: mbr\n        size: 440\n      - name: data\n        type: ZZ\n        size: 1M\n",
+			want: []validationError{
+				{Line: 8, Column: 9, Message: `invalid volume "pc": invalid structure #1 ("data"): invalid type "ZZ": invalid format`},
+			},
+		},
+		{
+			name:       "no volumes",
+			gadgetYaml: "volumes: {}\n",
+			want: []validationError{
+				{Message: "no volume in the gadget.yaml. Specify at least one volume."},
+			},
+		},
+		{
+			name:       "invalid yaml",
+			gadgetYaml: "volumes:\n  pc: [\n",
+			want: []validationError{
+				{Line: 2, Message: "cannot parse gadget metadata: yaml: line 2: did not find expected node content"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			tmpDir := writeValidatedFiles(t, map[string]string{"gadget.yaml": tc.gadgetYaml})
+
+			var stateMachine ValidateStateMachine
+			stateMachine.parent = &stateMachine
+			stateMachine.Opts.GadgetYaml = filepath.Join(tmpDir, "gadget.yaml")
+
+			err := stateMachine.validateGadgetYaml()
+			asserter.AssertErrNil(err, true)
+			for i := range tc.want {
+				tc.want[i].File = stateMachine.Opts.GadgetYaml
+			}
+			asserter.AssertEqual(tc.want, stateMachine.validationErrors)
+		})
+	}
+}
+
+func TestStateMachine_validateModelAssertion(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ValidateStateMachine
+	stateMachine.parent = &stateMachine
+
+	stateMachine.Opts.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+	err := stateMachine.validateModelAssertion()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(0, len(stateMachine.validationErrors))
+
+	stateMachine.Opts.ModelAssertion = filepath.Join("testdata", "modelAssertionReserverdHeader")
+	err = stateMachine.validateModelAssertion()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual([]validationError{{
+		File:    stateMachine.Opts.ModelAssertion,
+		Line:    5,
+		Column:  1,
+		Message: `model assertion cannot have reserved/unsupported header "core" set`,
+	}}, stateMachine.validationErrors)
+
+	stateMachine.validationErrors = nil
+	stateMachine.Opts.ModelAssertion = filepath.Join("testdata", "inexistent")
+	err = stateMachine.validateModelAssertion()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(1, len(stateMachine.validationErrors))
+	asserter.AssertEqual(stateMachine.Opts.ModelAssertion, stateMachine.validationErrors[0].File)
+	asserter.AssertEqual(true, strings.HasPrefix(stateMachine.validationErrors[0].Message, "cannot read model assertion"))
+}
+
+// TestValidateStateMachine_Run ensures every error is reported, in the format
+// requested
+func TestValidateStateMachine_Run(t *testing.T) {
+	testCases := []struct {
+		name   string
+		format string
+		want   string
+	}{
+		{
+			name:   "text",
+			format: "text",
+			want: `gadget.yaml: no volume in the gadget.yaml. Specify at least one volume.
+image.yaml:12:9: When key gadget:type is specified as git, a URL must be provided
+2 errors found
+`,
+		},
+		{
+			name:   "json",
+			format: "json",
+			want: `{"valid":false,"errors":[{"file":"gadget.yaml","message":"no volume in the gadget.yaml. Specify at least one volume."},` +
+				`{"file":"image.yaml","line":12,"column":9,"message":"When key gadget:type is specified as git, a URL must be provided"}]}
+`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			tmpDir := writeValidatedFiles(t, map[string]string{
+				"image.yaml":  validImageDefinition + "gadget:\n  type: git\n",
+				"gadget.yaml": "volumes: {}\n",
+			})
+			restoreCWD := testhelper.SaveCWD()
+			defer restoreCWD()
+			err := os.Chdir(tmpDir)
+			asserter.AssertErrNil(err, true)
+
+			var stateMachine ValidateStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.Args.ImageDefinition = "image.yaml"
+			stateMachine.Opts.GadgetYaml = "gadget.yaml"
+			stateMachine.Opts.Format = tc.format
+
+			err = stateMachine.Setup()
+			asserter.AssertErrNil(err, true)
+
+			stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.Run()
+			restoreStdout()
+			var invalidFilesErr *InvalidFilesError
+			if !errors.As(err, &invalidFilesErr) || invalidFilesErr.Count != 2 {
+				t.Errorf("Expected 2 errors to be found, got %v", err)
+			}
+			output, err := io.ReadAll(stdout)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.want, string(output))
+
+			err = stateMachine.Teardown()
+			asserter.AssertErrNil(err, true)
+		})
+	}
+}
+
+// TestValidateStateMachine_Run_failures ensures the files that cannot be read
+// and the invalid --set are reported in the JSON report, and that only the
+// report is written to stdout
+func TestValidateStateMachine_Run_failures(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	tmpDir := writeValidatedFiles(t, map[string]string{"image.yaml": validImageDefinition})
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+	err := os.Chdir(tmpDir)
+	asserter.AssertErrNil(err, true)
+
+	var stateMachine ValidateStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Debug = true
+	stateMachine.Args.ImageDefinition = "image.yaml"
+	stateMachine.Opts.GadgetYaml = "inexistent.yaml"
+	stateMachine.Opts.ModelAssertion = "inexistent.model"
+	stateMachine.Opts.Variables = []string{"SERIES"}
+	stateMachine.Opts.Format = "json"
+
+	err = stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.Run()
+	restoreStdout()
+	var invalidFilesErr *InvalidFilesError
+	if !errors.As(err, &invalidFilesErr) || invalidFilesErr.Count != 3 {
+		t.Errorf("Expected 3 errors to be found, got %v", err)
+	}
+	output, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+
+	var report validationReport
+	err = json.Unmarshal(output, &report)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(false, report.Valid)
+	var gotFiles []string
+	for _, validationErr := range report.Errors {
+		gotFiles = append(gotFiles, validationErr.File)
+	}
+	asserter.AssertEqual([]string{"image.yaml", "inexistent.model", "inexistent.yaml"}, gotFiles)
+	asserter.AssertEqual(`invalid variable "SERIES" given with --set, expected <name>=<value>`, report.Errors[0].Message)
+}
+
+func Test_jsonToYAMLPath(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	asserter.AssertEqual([]string{"rootfs", "seed", "urls", "0"},
+		jsonToYAMLPath([]string{"Rootfs", "Seed", "SeedURLs", "0"}))
+	asserter.AssertEqual([]string{"artifacts", "img", "1", "name"},
+		jsonToYAMLPath([]string{"Artifacts", "Img", "1", "ImgName"}))
+	asserter.AssertEqual([]string{"customization", "Unknown", "Field"},
+		jsonToYAMLPath([]string{"Customization", "Unknown", "Field"}))
+}
@@ -0,0 +1,180 @@
+package statemachine
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// variablesKey is the key of an image definition defining the variables
+// substituted in it
+const variablesKey = "variables"
+
+// variablesEnvPrefix is the prefix of the environment variables setting the
+// variables of image definitions
+const variablesEnvPrefix = "UBUNTU_IMAGE_VAR_"
+
+// redactedValue is recorded in the build metadata in place of the value of the
+// variables given with --redact-variable
+const redactedValue = "<redacted>"
+
+// variableRegex matches ${NAME}, and $${NAME} which is kept as ${NAME}
+var variableRegex = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// inlineContentKeys are the keys of image definitions holding the content of
+// files written as is in the image, in which variables are not substituted
+var inlineContentKeys = map[string]bool{
+	"customization:cloud-init:meta-data":      true,
+	"customization:cloud-init:user-data":      true,
+	"customization:cloud-init:network-config": true,
+}
+
+// parseVariableOverrides parses the variables given with --set
+func parseVariableOverrides(overrides []string) (map[string]string, error) {
+	variables := make(map[string]string)
+	for _, override := range overrides {
+		name, value, found := strings.Cut(override, "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid variable \"%s\" given with --set, expected <name>=<value>", override)
+		}
+		variables[name] = value
+	}
+	return variables, nil
+}
+
+// imageDefinitionVariables returns the variables of the image definition,
+// overridden by the environment and then by the values given with --set
+func imageDefinitionVariables(definition map[interface{}]interface{}, overrides map[string]string) (map[string]string, error) {
+	variables := make(map[string]string)
+	switch defined := definition[variablesKey].(type) {
+	case nil:
+	case map[interface{}]interface{}:
+		for name, value := range defined {
+			switch value.(type) {
+			case map[interface{}]interface{}, []interface{}, nil:
+				return nil, fmt.Errorf("the value of variable %v must be a string", name)
+			}
+			variables[fmt.Sprint(name)] = fmt.Sprint(value)
+		}
+	default:
+		return nil, fmt.Errorf("%s must be a mapping of names to values", variablesKey)
+	}
+
+	for _, env := range osEnviron() {
+		if !strings.HasPrefix(env, variablesEnvPrefix) {
+			continue
+		}
+		name, value, _ := strings.Cut(strings.TrimPrefix(env, variablesEnvPrefix), "=")
+		variables[name] = value
+	}
+
+	for name, value := range overrides {
+		variables[name] = value
+	}
+	return variables, nil
+}
+
+// unknownVariableError is returned when the image definition uses variables
+// that are not defined
+type unknownVariableError struct {
+	names    []string
+	keyPath  string
+	location []string
+}
+
+func (e *unknownVariableError) Error() string {
+	return fmt.Sprintf("unknown variable %s in %s. Variables are defined in the %s "+
+		"section, with the %s<NAME> environment variables or with --set <NAME>=<VALUE>",
+		strings.Join(e.names, ", "), e.keyPath, variablesKey, variablesEnvPrefix)
+}
+
+// expandVariables substitutes the variables in the strings of a decoded image
+// definition found at location. The variables substituted are added to used.
+func expandVariables(value interface{}, variables map[string]string, used map[string]string, keyPath string, location []string) (interface{}, error) {
+	switch typed := value.(type) {
+	case map[interface{}]interface{}:
+		expanded := make(map[interface{}]interface{}, len(typed))
+		for key, item := range typed {
+			itemPath := fmt.Sprint(key)
+			if keyPath != "" {
+				itemPath = keyPath + ":" + itemPath
+			}
+			if inlineContentKeys[itemPath] {
+				expanded[key] = item
+				continue
+			}
+			itemLocation := append(append([]string{}, location...), fmt.Sprint(key))
+			expandedItem, err := expandVariables(item, variables, used, itemPath, itemLocation)
+			if err != nil {
+				return nil, err
+			}
+			expanded[key] = expandedItem
+		}
+		return expanded, nil
+	case []interface{}:
+		expanded := make([]interface{}, len(typed))
+		for i, item := range typed {
+			itemLocation := append(append([]string{}, location...), strconv.Itoa(i))
+			expandedItem, err := expandVariables(item, variables, used, fmt.Sprintf("%s[%d]", keyPath, i), itemLocation)
+			if err != nil {
+				return nil, err
+			}
+			expanded[i] = expandedItem
+		}
+		return expanded, nil
+	case string:
+		var unknown []string
+		expanded := variableRegex.ReplaceAllStringFunc(typed, func(match string) string {
+			groups := variableRegex.FindStringSubmatch(match)
+			if groups[1] != "" {
+				return strings.TrimPrefix(match, "$")
+			}
+			variableValue, found := variables[groups[2]]
+			if !found {
+				unknown = append(unknown, groups[2])
+				return match
+			}
+			used[groups[2]] = variableValue
+			return variableValue
+		})
+		if len(unknown) > 0 {
+			return nil, &unknownVariableError{unknown, keyPath, location}
+		}
+		return expanded, nil
+	default:
+		return value, nil
+	}
+}
+
+// substituteVariables substitutes the variables in the image definition and
+// returns the ones used, with their values
+func substituteVariables(definition map[interface{}]interface{}, overrides map[string]string) (map[interface{}]interface{}, map[string]string, error) {
+	variables, err := imageDefinitionVariables(definition, overrides)
+	if err != nil {
+		return nil, nil, err
+	}
+	delete(definition, variablesKey)
+
+	used := make(map[string]string)
+	expanded, err := expandVariables(definition, variables, used, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return expanded.(map[interface{}]interface{}), used, nil
+}
+
+// redactVariables returns the variables with the value of the ones named in
+// redacted replaced, so secrets are not recorded in the build metadata
+func redactVariables(variables map[string]string, redacted []string) map[string]string {
+	recorded := make(map[string]string, len(variables))
+	for name, value := range variables {
+		if helper.SliceHasElement(redacted, name) {
+			value = redactedValue
+		}
+		recorded[name] = value
+	}
+	return recorded
+}
@@ -0,0 +1,168 @@
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+func Test_substituteVariables(t *testing.T) {
+	testCases := []struct {
+		name          string
+		definition    string
+		environ       []string
+		overrides     map[string]string
+		want          string
+		wantVariables map[string]string
+		expectedErr   string
+	}{
+		{
+			name:          "variables defined in the image definition",
+			definition:    "variables:\n  SERIES: noble\n  ARCH: arm64\n  UNUSED: x\nname: ${SERIES}-${ARCH}.img\n",
+			want:          "name: noble-arm64.img\n",
+			wantVariables: map[string]string{"ARCH": "arm64", "SERIES": "noble"},
+		},
+		{
+			name:          "variables overridden by the environment and --set",
+			definition:    "variables:\n  SERIES: noble\n  ARCH: arm64\nname: ${SERIES}-${ARCH}\n",
+			environ:       []string{"HOME=/root", "UBUNTU_IMAGE_VAR_SERIES=jammy", "UBUNTU_IMAGE_VAR_ARCH=armhf"},
+			overrides:     map[string]string{"ARCH": "amd64"},
+			want:          "name: jammy-amd64\n",
+			wantVariables: map[string]string{"ARCH": "amd64", "SERIES": "jammy"},
+		},
+		{
+			name:          "variables in lists and mappings",
+			definition:    "variables:\n  REVISION: 3\ncustomization:\n  extra-packages:\n    - name: hello-${REVISION}\n",
+			want:          "customization:\n  extra-packages:\n    - name: hello-3\n",
+			wantVariables: map[string]string{"REVISION": "3"},
+		},
+		{
+			name:          "escaped and shell variables",
+			definition:    "customization:\n  manual:\n    execute:\n      - path: echo $${HOME} $HOME ${1:-default} $$\n",
+			want:          "customization:\n  manual:\n    execute:\n      - path: echo ${HOME} $HOME ${1:-default} $$\n",
+			wantVariables: map[string]string{},
+		},
+		{
+			name:          "inline content not substituted",
+			definition:    "variables:\n  SERIES: noble\ncustomization:\n  cloud-init:\n    user-data: echo ${SERIES} $${HOME} ${HOME}\n    meta-data: ${ID}\n    network-config: ${IFACE}\n",
+			want:          "customization:\n  cloud-init:\n    user-data: echo ${SERIES} $${HOME} ${HOME}\n    meta-data: ${ID}\n    network-config: ${IFACE}\n",
+			wantVariables: map[string]string{},
+		},
+		{
+			name:        "unknown variable",
+			definition:  "artifacts:\n  img:\n    - name: ${SERIES}.img\n",
+			expectedErr: "unknown variable SERIES in artifacts:img[0]:name",
+		},
+		{
+			name:        "variables not a mapping",
+			definition:  "variables:\n  - SERIES\n",
+			expectedErr: "variables must be a mapping of names to values",
+		},
+		{
+			name:        "variable not a string",
+			definition:  "variables:\n  SERIES:\n    - noble\n",
+			expectedErr: "the value of variable SERIES must be a string",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			osEnviron = func() []string { return tc.environ }
+			t.Cleanup(func() { osEnviron = os.Environ })
+
+			definition := make(map[interface{}]interface{})
+			err := yaml.Unmarshal([]byte(tc.definition), &definition)
+			asserter.AssertErrNil(err, true)
+
+			got, gotVariables, err := substituteVariables(definition, tc.overrides)
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			want := make(map[interface{}]interface{})
+			err = yaml.Unmarshal([]byte(tc.want), &want)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(want, got)
+			asserter.AssertEqual(tc.wantVariables, gotVariables)
+		})
+	}
+}
+
+// Test_readImageDefinition_variables reads an image definition whose
+// variables are overridden with --set
+func Test_readImageDefinition_variables(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	imageDefPath := filepath.Join("testdata", "image_definitions", "test_variables.yaml")
+
+	imageDef, sources, err := readImageDefinition(imageDefPath, map[string]string{"ARCH": "riscv64"})
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("ubuntu-server-noble-riscv64", imageDef.ImageName)
+	asserter.AssertEqual("riscv64", imageDef.Architecture)
+	asserter.AssertEqual("noble", imageDef.Series)
+	asserter.AssertEqual(&[]imagedefinition.Img{{ImgName: "noble-riscv64.img"}}, imageDef.Artifacts.Img)
+	asserter.AssertEqual(map[string]string{"ARCH": "riscv64", "SERIES": "noble"}, sources.variables)
+}
+
+// TestClassicStateMachine_changedInputs_variables ensures a change of the
+// variables is detected on --resume
+func TestClassicStateMachine_changedInputs_variables(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions", "test_variables.yaml")
+
+	imageDef, _, err := readImageDefinition(stateMachine.Args.ImageDefinition, map[string]string{"ARCH": "arm64"})
+	asserter.AssertErrNil(err, true)
+	stateMachine.ImageDef = *imageDef
+	err = stateMachine.hashInputs()
+	asserter.AssertErrNil(err, true)
+	previousHashes := stateMachine.InputHashes
+
+	err = stateMachine.hashInputs()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(0, len(stateMachine.changedInputs(previousHashes)))
+
+	imageDef, _, err = readImageDefinition(stateMachine.Args.ImageDefinition, map[string]string{"ARCH": "riscv64"})
+	asserter.AssertErrNil(err, true)
+	stateMachine.ImageDef = *imageDef
+	err = stateMachine.hashInputs()
+	asserter.AssertErrNil(err, true)
+	var changedNames []string
+	for _, input := range stateMachine.changedInputs(previousHashes) {
+		changedNames = append(changedNames, input.name)
+	}
+	asserter.AssertEqual([]string{
+		"image definition key name",
+		"image definition key architecture",
+		"image definition key artifacts",
+	}, changedNames)
+}
+
+func Test_redactVariables(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	variables := map[string]string{"SERIES": "noble", "TOKEN": "secret"}
+	recorded := redactVariables(variables, []string{"TOKEN", "UNUSED"})
+	asserter.AssertEqual(map[string]string{"SERIES": "noble", "TOKEN": "<redacted>"}, recorded)
+	asserter.AssertEqual("secret", variables["TOKEN"])
+}
+
+func Test_parseVariableOverrides(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	variables, err := parseVariableOverrides([]string{"SERIES=noble", "EXTRA=a=b", "EMPTY="})
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(map[string]string{"SERIES": "noble", "EXTRA": "a=b", "EMPTY": ""}, variables)
+
+	_, err = parseVariableOverrides([]string{"SERIES"})
+	asserter.AssertErrContains(err, "invalid variable \"SERIES\" given with --set")
+
+	_, err = parseVariableOverrides([]string{"=noble"})
+	asserter.AssertErrContains(err, "expected <name>=<value>")
+}